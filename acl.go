@@ -0,0 +1,133 @@
+// acl.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// roleRank orders space roles; each role includes the ones below it.
+var roleRank = map[memory.SpaceRole]int{
+	memory.SpaceRoleReader: 1,
+	memory.SpaceRoleWriter: 2,
+	memory.SpaceRoleAdmin:  3,
+}
+
+// parseRole maps a role name to a SpaceRole and rejects anything else.
+func parseRole(s string) (memory.SpaceRole, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "admin":
+		return memory.SpaceRoleAdmin, nil
+	case "writer", "write":
+		return memory.SpaceRoleWriter, nil
+	case "reader", "read":
+		return memory.SpaceRoleReader, nil
+	}
+	return "", fmt.Errorf("unknown role %q (want reader, writer or admin)", s)
+}
+
+// ErrPermissionDenied is returned when a principal lacks the role an
+// operation needs. Tools return it as a structured error result.
+type ErrPermissionDenied struct {
+	Code      string           `json:"error"`
+	Space     string           `json:"space"`
+	Principal string           `json:"principal"`
+	Required  memory.SpaceRole `json:"required_role"`
+	Role      memory.SpaceRole `json:"role,omitempty"`
+	Reason    string           `json:"reason"`
+}
+
+func (e *ErrPermissionDenied) Error() string {
+	role := string(e.Role)
+	if role == "" {
+		role = "none"
+	}
+	return fmt.Sprintf("permission denied: principal %q needs role %s in space %q (has %s): %s",
+		e.Principal, e.Required, e.Space, role, e.Reason)
+}
+
+// requireAdmin checks that caller is one of the configured server admins,
+// who alone may use tools that read across sessions, spaces and groups.
+func (a *App) requireAdmin(caller string) error {
+	caller = strings.TrimSpace(caller)
+	if caller == "" || !slices.Contains(a.admins, caller) {
+		return fmt.Errorf("permission denied: %q is not a server admin (see the admins setting)", caller)
+	}
+	return nil
+}
+
+// requireRole checks that principal holds at least need in space, taking
+// roles inherited from parent spaces into account. A space that does not
+// exist yet may be created by an admin of its nearest existing ancestor,
+// or by anyone at the top of a new tree, provided they also administer
+// every existing descendant; the creator becomes its admin. Names of
+// registered sessions cannot be taken.
+// Expired spaces in their grace period only admit admins, who may renew
+// or delete them.
+func (a *App) requireRole(space, principal string, need memory.SpaceRole) error {
+	space, principal = strings.TrimSpace(space), strings.TrimSpace(principal)
+	denied := &ErrPermissionDenied{Code: "permission_denied", Space: space, Principal: principal, Required: need}
+	if principal == "" {
+		denied.Reason = "no principal given"
+		return denied
+	}
+	sp, ok := a.catalog.get(space)
+	if !ok {
+		if need != memory.SpaceRoleAdmin {
+			denied.Reason = "space does not exist"
+			return denied
+		}
+		// A space named after a session would claim its records.
+		if a.sessions.exists(space) {
+			denied.Reason = "name is taken by a session"
+			return denied
+		}
+		if parent, ok := a.catalog.nearestAncestor(space); ok {
+			if err := a.requireRole(parent, principal, memory.SpaceRoleAdmin); err != nil {
+				denied.Role = err.(*ErrPermissionDenied).Role
+				denied.Reason = fmt.Sprintf("creating a sub-space needs admin on %q", parent)
+				return denied
+			}
+		}
+		// The creator becomes admin of everything below the new space, so
+		// it must already administer every existing descendant.
+		for _, d := range a.catalog.descendants(space) {
+			if err := a.requireRole(d, principal, memory.SpaceRoleAdmin); err != nil {
+				denied.Reason = fmt.Sprintf("creating a parent space needs admin on %q", d)
+				return denied
+			}
+		}
+		return nil
+	}
+	denied.Role = a.resolveACL(a.catalog.effective(space))[principal]
+	switch {
+	case denied.Role == "":
+		denied.Reason = "principal has no role in the space"
+	case roleRank[denied.Role] < roleRank[need]:
+		denied.Reason = "role is too low"
+	case need != memory.SpaceRoleAdmin && !sp.ExpiresAt.IsZero() && time.Now().After(sp.ExpiresAt):
+		denied.Reason = "space has expired"
+	default:
+		return nil
+	}
+	return denied
+}
+
+// toolError turns err into an error result, with a structured payload for
+// permission errors.
+func toolError(err error) *mcp.CallToolResult {
+	var denied *ErrPermissionDenied
+	if errors.As(err, &denied) {
+		res := mcp.NewToolResultStructured(denied, denied.Error())
+		res.IsError = true
+		return res
+	}
+	return mcp.NewToolResultError(err.Error())
+}
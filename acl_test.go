@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+)
+
+func TestCreatingParentSpaceNeedsAdminOnDescendants(t *testing.T) {
+	app := newTestApp(t, nil)
+	app.upsertSpace("eng/payments", time.Hour, map[string]memory.SpaceRole{"alice": memory.SpaceRoleAdmin}, "", "")
+
+	if err := app.requireRole("eng", "mallory", memory.SpaceRoleAdmin); err == nil {
+		t.Fatal("mallory may create eng above alice's eng/payments")
+	}
+	if err := app.requireRole("eng", "alice", memory.SpaceRoleAdmin); err != nil {
+		t.Fatalf("alice may not create eng: %v", err)
+	}
+	if err := app.requireRole("ops", "mallory", memory.SpaceRoleAdmin); err != nil {
+		t.Fatalf("mallory may not create an unrelated space: %v", err)
+	}
+}
+
+func TestGroupEntriesStayOutOfRegistry(t *testing.T) {
+	app := newTestApp(t, nil)
+	if err := app.groups.create("devs", "dana"); err != nil {
+		t.Fatal(err)
+	}
+	app.upsertSpace("team", time.Hour, map[string]memory.SpaceRole{groupPrefix + "devs": memory.SpaceRoleReader}, "", "")
+	if err := app.grantSpace("team", groupPrefix+"devs", memory.SpaceRoleWriter, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	if app.spaces.CanRead("team", groupPrefix+"devs") {
+		t.Fatal("the raw group entry is in the registry ACL")
+	}
+	if !app.spaces.CanWrite("team", "dana") {
+		t.Fatal("group member dana cannot write to the space")
+	}
+}
+
+func TestGroupGrantsSurviveRestart(t *testing.T) {
+	app := newTestApp(t, nil)
+	if err := app.groups.create("devs", "dana"); err != nil {
+		t.Fatal(err)
+	}
+	app.groups.add("devs", "erin", false, time.Hour)
+	app.upsertSpace("team", time.Hour, map[string]memory.SpaceRole{groupPrefix + "devs": memory.SpaceRoleWriter}, "", "")
+
+	app = reopenTestApp(t, nil)
+	if exists, admin := app.groups.isAdmin("devs", "dana"); !exists || !admin {
+		t.Fatalf("group after restart: exists=%v, dana admin=%v", exists, admin)
+	}
+	for _, p := range []string{"dana", "erin"} {
+		if !app.spaces.CanWrite("team", p) {
+			t.Fatalf("group member %s lost write access on restart", p)
+		}
+	}
+	if app.groups.remove("devs", "erin"); len(reopenTestApp(t, nil).groups.members("devs")) != 1 {
+		t.Fatal("group removal was not saved")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// newTestApp returns an App with the default settings on the in-memory
+// store, the offline hash embedder and the stub LLM, keeping all state
+// under a temporary HOME. configure, if set, adjusts the settings first.
+func newTestApp(t *testing.T, configure func(*GeminiSettings)) *App {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	return reopenTestApp(t, configure)
+}
+
+// reopenTestApp builds another App on the state directory of the test's
+// last newTestApp, as a restarted server would. The in-memory store
+// starts out empty.
+func reopenTestApp(t *testing.T, configure func(*GeminiSettings)) *App {
+	t.Helper()
+	t.Setenv("LLM_PROVIDER", "stub")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	settings, err := loadGeminiSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.MemoryStore = "inmemory"
+	settings.EmbedProvider = "hash"
+	if configure != nil {
+		configure(settings)
+	}
+	app, err := newApp(ctx, settings, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// mustStore stores content in session through the engine and returns the
+// stored record.
+func mustStore(t *testing.T, app *App, session, content string, meta map[string]any) model.MemoryRecord {
+	t.Helper()
+	rec, err := app.engine.Store(context.Background(), session, content, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+// recordIDs returns the IDs of the records of session in the store.
+func recordIDs(t *testing.T, app *App, session string) map[int64]model.MemoryRecord {
+	t.Helper()
+	recs, err := app.sessionRecords(context.Background(), session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[int64]model.MemoryRecord, len(recs))
+	for _, rec := range recs {
+		out[rec.ID] = rec
+	}
+	return out
+}
+
+// callTool runs the tool name, as register adds it, on app with args.
+func callTool(t *testing.T, app *App, register func(*server.MCPServer, *App), name string, args map[string]any) *mcp.CallToolResult {
+	t.Helper()
+	s := server.NewMCPServer("test", "0")
+	register(s, app)
+	tool := s.GetTool(name)
+	if tool == nil {
+		t.Fatalf("no tool %q", name)
+	}
+	var req mcp.CallToolRequest
+	req.Params.Name = name
+	req.Params.Arguments = args
+	res, err := tool.Handler(context.WithValue(context.Background(), tenantAppKey{}, app), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
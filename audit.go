@@ -0,0 +1,320 @@
+// audit.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// auditedTools are the tools that change memories, spaces or shared views.
+var auditedTools = map[string]bool{
+	"store_long":            true,
+	"add_short":             true,
+	"flush":                 true,
+	"get_or_create_session": true,
+	"chain_prompt":          true,
+	"memory.reembed":        true,
+	"memory.reembed_cancel": true,
+	"memory.update":         true,
+	"memory.revert":         true,
+	"memory.link":           true,
+	"memory.unlink":         true,
+	"memory.extract":        true,
+	"spaces.upsert":         true,
+	"spaces.grant":          true,
+	"spaces.revoke":         true,
+	"spaces.delete":         true,
+	"shared.join":           true,
+	"shared.leave":          true,
+	"shared.add_short_to":   true,
+	"groups.create":         true,
+	"groups.add":            true,
+	"groups.remove":         true,
+	"initialize":            true,
+	"sessions.switch":       true,
+	"sessions.rename":       true,
+	"sessions.delete":       true,
+	"sessions.update":       true,
+	"sessions.archive":      true,
+	"sessions.purge":        true,
+	"sessions.fork":         true,
+	"sessions.merge":        true,
+	"sessions.snapshot":     true,
+	"sessions.restore":      true,
+}
+
+// AuditEntry is one line of the audit log. Arguments are recorded only as
+// a digest so the log never holds memory content.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Tool       string    `json:"tool"`
+	Principal  string    `json:"principal,omitempty"`
+	Session    string    `json:"session_id,omitempty"`
+	Space      string    `json:"space,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	ArgsDigest string    `json:"args_digest"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// auditLog appends entries to audit.jsonl and rotates it to
+// audit-<timestamp>.jsonl once it reaches maxBytes, keeping maxFiles
+// rotated files.
+type auditLog struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func newAuditLog(dir string, maxBytes int64, maxFiles int) (*auditLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit directory: %w", err)
+	}
+	l := &auditLog{dir: dir, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) current() string { return filepath.Join(l.dir, "audit.jsonl") }
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.current(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+func (l *auditLog) append(e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *auditLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+	rotated := filepath.Join(l.dir, "audit-"+time.Now().UTC().Format("20060102T150405.000000000Z")+".jsonl")
+	if err := os.Rename(l.current(), rotated); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	if old := l.rotated(); l.maxFiles > 0 && len(old) > l.maxFiles {
+		for _, path := range old[:len(old)-l.maxFiles] {
+			os.Remove(path)
+		}
+	}
+	return l.open()
+}
+
+// rotated lists rotated files, oldest first.
+func (l *auditLog) rotated() []string {
+	files, _ := filepath.Glob(filepath.Join(l.dir, "audit-*.jsonl"))
+	sort.Strings(files)
+	return files
+}
+
+// AuditFilter selects entries for audit.query; zero fields match all.
+type AuditFilter struct {
+	From      time.Time
+	To        time.Time
+	Principal string
+	Session   string
+	Tool      string
+	Limit     int
+}
+
+func (f AuditFilter) match(e AuditEntry) bool {
+	return (f.From.IsZero() || !e.Time.Before(f.From)) &&
+		(f.To.IsZero() || !e.Time.After(f.To)) &&
+		(f.Principal == "" || e.Principal == f.Principal || e.Target == f.Principal) &&
+		(f.Session == "" || e.Session == f.Session) &&
+		(f.Tool == "" || e.Tool == f.Tool)
+}
+
+// query scans every file and returns the newest Limit matches, newest
+// first.
+func (l *auditLog) query(f AuditFilter) ([]AuditEntry, error) {
+	l.mu.Lock()
+	files := append(l.rotated(), l.current())
+	l.mu.Unlock()
+
+	var out []AuditEntry
+	for _, path := range files {
+		if err := scanAuditFile(path, func(e AuditEntry) {
+			if f.match(e) {
+				out = append(out, e)
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[:f.Limit]
+	}
+	return out, nil
+}
+
+func scanAuditFile(path string, fn func(AuditEntry)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			fn(e)
+		}
+	}
+	return sc.Err()
+}
+
+// argsDigest hashes the call arguments; json.Marshal sorts map keys, so
+// equal arguments give equal digests.
+func argsDigest(args any) string {
+	b, _ := json.Marshal(args)
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// middleware records every audited tool call after it has run.
+func (l *auditLog) middleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		res, err := next(ctx, req)
+		if l == nil || !auditedTools[req.Params.Name] {
+			return res, err
+		}
+		e := AuditEntry{
+			Time:       time.Now().UTC(),
+			RequestID:  requestID(ctx),
+			Tool:       req.Params.Name,
+			Principal:  strings.TrimSpace(getStringParam(req, "principal")),
+			Session:    strings.TrimSpace(getStringParam(req, "session_id")),
+			Space:      strings.TrimSpace(getStringParam(req, "space")),
+			ArgsDigest: argsDigest(req.Params.Arguments),
+			Outcome:    "ok",
+		}
+		// spaces.* name the space "name" and sessions.* the session
+		// "session"; grant, revoke and groups.add/remove act on behalf of
+		// "caller" against "principal".
+		if e.Space == "" && strings.HasPrefix(e.Tool, "spaces.") {
+			e.Space = strings.TrimSpace(getStringParam(req, "name"))
+		}
+		if e.Session == "" && strings.HasPrefix(e.Tool, "sessions.") {
+			e.Session = strings.TrimSpace(getStringParam(req, "session"))
+		}
+		if caller := strings.TrimSpace(getStringParam(req, "caller")); caller != "" {
+			e.Principal, e.Target = caller, e.Principal
+		}
+		switch {
+		case err != nil:
+			e.Outcome, e.Error = "error", truncate(err.Error(), 200)
+		case res != nil && res.IsError:
+			e.Outcome, e.Error = "error", truncate(toolResultText(res), 200)
+		}
+		if aerr := l.append(e); aerr != nil {
+			logger(ctx).Error("audit write failed", "error", aerr)
+		}
+		return res, err
+	}
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return s
+}
+
+func registerAuditTools(s *server.MCPServer, app *App) {
+	queryTool := mcp.NewTool("audit.query",
+		mcp.WithDescription("Query the audit log of memory and ACL mutations, newest first"),
+		mcp.WithString("caller", mcp.Required(), mcp.Description("Must be a server admin")),
+		mcp.WithString("from", mcp.Description("RFC 3339 start time (inclusive)")),
+		mcp.WithString("to", mcp.Description("RFC 3339 end time (inclusive)")),
+		mcp.WithString("principal", mcp.Description("Only calls by or targeting this principal")),
+		mcp.WithString("session_id"),
+		mcp.WithString("tool"),
+		mcp.WithNumber("limit", mcp.Description("Maximum entries (default 100)")),
+	)
+	s.AddTool(queryTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		if app.audit == nil {
+			return mcp.NewToolResultError("audit log is disabled"), nil
+		}
+		if err := app.requireAdmin(getStringParam(req, "caller")); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		f := AuditFilter{
+			Principal: strings.TrimSpace(getStringParam(req, "principal")),
+			Session:   strings.TrimSpace(getStringParam(req, "session_id")),
+			Tool:      strings.TrimSpace(getStringParam(req, "tool")),
+			Limit:     int(getNumberParam(req, "limit")),
+		}
+		if f.Limit <= 0 {
+			f.Limit = 100
+		}
+		for key, dst := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+			if v := getStringParam(req, key); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					return mcp.NewToolResultError(fmt.Sprintf("invalid %s (want RFC 3339): %v", key, err)), nil
+				}
+				*dst = t
+			}
+		}
+		entries, err := app.audit.query(f)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("audit query failed: %v", err)), nil
+		}
+		if entries == nil {
+			entries = []AuditEntry{}
+		}
+		return mcp.NewToolResultJSON(entries)
+	})
+}
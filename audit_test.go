@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func TestAuditLogRotatesAndKeepsMaxFiles(t *testing.T) {
+	dir := t.TempDir()
+	l, err := newAuditLog(dir, 400, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 20 {
+		e := AuditEntry{Time: base.Add(time.Duration(i) * time.Second), Tool: "store_long", Session: fmt.Sprint("s", i), ArgsDigest: argsDigest(i), Outcome: "ok"}
+		if err := l.append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := len(l.rotated()); got != 2 {
+		t.Fatalf("rotated files = %d, want 2", got)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 400 {
+		t.Fatalf("current file is %d bytes, over the 400 byte limit", fi.Size())
+	}
+
+	entries, err := l.query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || len(entries) >= 20 {
+		t.Fatalf("query returned %d entries; want the ones left after pruning", len(entries))
+	}
+	if entries[0].Session != "s19" {
+		t.Fatalf("newest entry = %+v, want s19", entries[0])
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Time.After(entries[i-1].Time) {
+			t.Fatal("entries are not newest first")
+		}
+	}
+	// Pruning drops the oldest files, so what is left is a contiguous tail.
+	if want := fmt.Sprint("s", 20-len(entries)); entries[len(entries)-1].Session != want {
+		t.Fatalf("oldest kept entry = %s, want %s", entries[len(entries)-1].Session, want)
+	}
+}
+
+func TestAuditQueryFilters(t *testing.T) {
+	l, err := newAuditLog(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, e := range []AuditEntry{
+		{Time: base, Tool: "store_long", Principal: "alice", Session: "s1"},
+		{Time: base.Add(time.Hour), Tool: "spaces.grant", Principal: "alice", Target: "bob", Space: "team"},
+		{Time: base.Add(2 * time.Hour), Tool: "store_long", Principal: "bob", Session: "s2"},
+		{Time: base.Add(3 * time.Hour), Tool: "flush", Principal: "carol", Session: "s1"},
+	} {
+		if err := l.append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		f    AuditFilter
+		want []string
+	}{
+		{"all", AuditFilter{}, []string{"flush", "store_long", "spaces.grant", "store_long"}},
+		{"from", AuditFilter{From: base.Add(time.Hour)}, []string{"flush", "store_long", "spaces.grant"}},
+		{"to", AuditFilter{To: base.Add(time.Hour)}, []string{"spaces.grant", "store_long"}},
+		{"window", AuditFilter{From: base.Add(time.Hour), To: base.Add(2 * time.Hour)}, []string{"store_long", "spaces.grant"}},
+		{"principal or target", AuditFilter{Principal: "bob"}, []string{"store_long", "spaces.grant"}},
+		{"session", AuditFilter{Session: "s1"}, []string{"flush", "store_long"}},
+		{"tool", AuditFilter{Tool: "store_long", Principal: "alice"}, []string{"store_long"}},
+		{"limit", AuditFilter{Limit: 1}, []string{"flush"}},
+	} {
+		entries, err := l.query(tc.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Tool)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Fatalf("%s: tools = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAuditMiddlewareRecordsOutcomeWithoutContent(t *testing.T) {
+	l, err := newAuditLog(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := l.middleware(func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if req.Params.Name == "spaces.grant" {
+			return mcp.NewToolResultError("caller is not an admin"), nil
+		}
+		return mcp.NewToolResultText("ok"), nil
+	})
+	call := func(name string, args map[string]any) {
+		var req mcp.CallToolRequest
+		req.Params.Name = name
+		req.Params.Arguments = args
+		if _, err := handler(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call("store_long", map[string]any{"session_id": "s1", "principal": "alice", "content": "the vault code is 1234"})
+	call("retrieve_context", map[string]any{"session_id": "s1", "query": "vault"})
+	call("spaces.grant", map[string]any{"name": "team", "caller": "mallory", "principal": "bob", "role": "admin"})
+
+	entries, err := l.query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("entries = %+v, want store_long and spaces.grant only", entries)
+	}
+	grant, store := entries[0], entries[1]
+	if store.Tool != "store_long" || store.Principal != "alice" || store.Session != "s1" || store.Outcome != "ok" {
+		t.Fatalf("store_long entry = %+v", store)
+	}
+	if grant.Principal != "mallory" || grant.Target != "bob" || grant.Space != "team" ||
+		grant.Outcome != "error" || grant.Error != "caller is not an admin" {
+		t.Fatalf("spaces.grant entry = %+v", grant)
+	}
+	raw, _ := json.Marshal(entries)
+	if strings.Contains(string(raw), "vault") {
+		t.Fatal("audit entry holds argument content")
+	}
+}
+
+func TestAuditQueryToolNeedsAdmin(t *testing.T) {
+	app := newTestApp(t, func(s *GeminiSettings) { s.Admins = []string{"root"} })
+	if err := app.audit.append(AuditEntry{Time: time.Now().UTC(), Tool: "flush", Principal: "alice", Outcome: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	if res := callTool(t, app, registerAuditTools, "audit.query", map[string]any{"caller": "alice"}); !res.IsError {
+		t.Fatal("a non-admin queried the audit log")
+	}
+	if res := callTool(t, app, registerAuditTools, "audit.query", map[string]any{"caller": "root", "from": "yesterday"}); !res.IsError {
+		t.Fatal("an invalid from time was accepted")
+	}
+	res := callTool(t, app, registerAuditTools, "audit.query", map[string]any{"caller": "root", "principal": "alice"})
+	if res.IsError {
+		t.Fatal(res.Content[0].(mcp.TextContent).Text)
+	}
+	var entries []AuditEntry
+	if err := json.Unmarshal([]byte(res.Content[0].(mcp.TextContent).Text), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Tool != "flush" {
+		t.Fatalf("entries = %+v", entries)
+	}
+}
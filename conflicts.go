@@ -0,0 +1,318 @@
+// conflicts.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+)
+
+// ConflictOptions configures the check store_long runs against similar
+// records of the session before writing.
+type ConflictOptions struct {
+	Enabled   bool
+	Threshold float64 // minimum similarity of a record to compare with
+	Action    string  // conflictFlag or conflictSupersede
+	LLMJudge  bool
+}
+
+// Conflict actions.
+const (
+	conflictFlag      = "flag"
+	conflictSupersede = "supersede"
+)
+
+func validConflictAction(action string) bool {
+	return action == conflictFlag || action == conflictSupersede
+}
+
+// Relations of a new write to an existing record.
+const (
+	relDuplicate     = "duplicate"
+	relRefinement    = "refinement"
+	relContradiction = "contradiction"
+	relUnrelated     = "unrelated"
+)
+
+const (
+	defaultConflictThreshold = 0.7
+	conflictCandidates       = 10
+)
+
+// WriteConflict is an existing record a write duplicates, refines or
+// contradicts, and what the write did about it.
+type WriteConflict struct {
+	Record     int64   `json:"record_id"`
+	Content    string  `json:"content"`
+	Similarity float64 `json:"similarity"`
+	Relation   string  `json:"relation"`
+	Reason     string  `json:"reason,omitempty"`
+	Judge      string  `json:"judge"`
+	Action     string  `json:"action"` // skipped, superseded or flagged
+}
+
+// CheckedWrite is the store_long payload: the record plus the conflicts
+// found when the check ran.
+type CheckedWrite struct {
+	model.MemoryRecord
+	Conflicts []WriteConflict `json:"conflicts,omitempty"`
+}
+
+var negations = map[string]bool{
+	"not": true, "no": true, "never": true, "cannot": true, "without": true, "avoid": true, "stop": true,
+	"don't": true, "dont": true, "doesn't": true, "doesnt": true, "didn't": true, "didnt": true,
+	"isn't": true, "isnt": true, "aren't": true, "arent": true, "wasn't": true, "wasnt": true,
+	"won't": true, "wont": true, "can't": true, "cant": true, "shouldn't": true, "shouldnt": true,
+	"mustn't": true, "mustnt": true,
+}
+
+// conflictTokens splits s into lowercase words, keeping apostrophes so
+// "don't" stays one negation.
+func conflictTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(strings.ReplaceAll(s, "’", "'")), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+}
+
+// classifyConflict is the heuristic judge. Only equal content (ignoring
+// case and whitespace) is a duplicate: "pool size is 5" and "pool size is
+// 6" embed almost alike, so similarity cannot tell. A difference in
+// negation is a contradiction; a write that keeps every word
+// of the old record and adds some is a refinement; a write that swaps one
+// or two words of an otherwise equal statement (a value, a name) is a
+// contradiction. Anything else is unrelated.
+func classifyConflict(old, content string) (string, string) {
+	if normalizeContent(old) == normalizeContent(content) {
+		return relDuplicate, "same content"
+	}
+	oldWords, newWords := map[string]bool{}, map[string]bool{}
+	oldNeg, newNeg := false, false
+	for _, w := range conflictTokens(old) {
+		if negations[w] {
+			oldNeg = true
+			continue
+		}
+		oldWords[w] = true
+	}
+	for _, w := range conflictTokens(content) {
+		if negations[w] {
+			newNeg = true
+			continue
+		}
+		newWords[w] = true
+	}
+	if oldNeg != newNeg {
+		return relContradiction, "one statement is negated"
+	}
+	var removed, added []string
+	for w := range oldWords {
+		if !newWords[w] {
+			removed = append(removed, w)
+		}
+	}
+	for w := range newWords {
+		if !oldWords[w] {
+			added = append(added, w)
+		}
+	}
+	shared := len(oldWords) - len(removed)
+	switch {
+	case len(removed) == 0 && len(added) > 0:
+		return relRefinement, "adds detail to the existing record"
+	case len(removed) > 0 && len(removed) <= 2 && len(added) > 0 && len(added) <= 2 && shared >= 2:
+		sort.Strings(removed)
+		sort.Strings(added)
+		return relContradiction, fmt.Sprintf("%s replaced by %s", strings.Join(removed, " "), strings.Join(added, " "))
+	}
+	return relUnrelated, ""
+}
+
+const judgePrompt = `Compare a new memory with an existing one.
+Reply with JSON only: {"relation":"duplicate|refinement|contradiction|unrelated","reason":"..."}
+duplicate: both say the same thing. refinement: the new one adds detail without
+changing the old one. contradiction: both cannot be true at once, or the new one
+changes a decision or value. unrelated: none of these.
+
+Existing: %s
+New: %s
+`
+
+// judgeConflict asks the model for the relation of content to old.
+func (a *App) judgeConflict(ctx context.Context, old, content string) (string, string, error) {
+	out, err := a.llm.Generate(ctx, fmt.Sprintf(judgePrompt, old, content))
+	if err != nil {
+		return "", "", err
+	}
+	reply := fmt.Sprint(out)
+	start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return "", "", fmt.Errorf("judge reply holds no JSON object")
+	}
+	var v struct {
+		Relation string `json:"relation"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &v); err != nil {
+		return "", "", fmt.Errorf("bad judge reply: %w", err)
+	}
+	switch rel := strings.ToLower(strings.TrimSpace(v.Relation)); rel {
+	case relDuplicate, relRefinement, relContradiction, relUnrelated:
+		return rel, strings.TrimSpace(v.Reason), nil
+	default:
+		return "", "", fmt.Errorf("judge returned unknown relation %q", v.Relation)
+	}
+}
+
+// findConflicts compares content with the session's records at least
+// opts.Threshold similar to it. Superseded versions and extracted facts
+// are not compared. The search oversamples past other sessions' records,
+// which would otherwise fill the candidates.
+func (a *App) findConflicts(ctx context.Context, session, content string, emb []float32, opts ConflictOptions) ([]WriteConflict, error) {
+	cands, err := searchKeeping(ctx, a.bank.Store, emb, conflictCandidates, func(rec model.MemoryRecord) bool {
+		return rec.SessionID == session && !isExtracted(model.DecodeMetadata(rec.Metadata))
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []WriteConflict
+	for _, rec := range cands {
+		recEmb, err := a.recordEmbedding(ctx, rec)
+		if err != nil {
+			return nil, err
+		}
+		sim := model.CosineSimilarity(emb, recEmb)
+		if sim < opts.Threshold {
+			continue
+		}
+		c := WriteConflict{Record: rec.ID, Content: rec.Content, Similarity: sim, Judge: "heuristic"}
+		c.Relation, c.Reason = classifyConflict(rec.Content, content)
+		// Equal content needs no judge; the engine would dedup it too.
+		if opts.LLMJudge && c.Relation != relDuplicate {
+			if rel, reason, err := a.judgeConflict(ctx, rec.Content, content); err != nil {
+				logger(ctx).Warn("conflict judge failed; using heuristic", "record_id", rec.ID, "error", err)
+			} else {
+				c.Relation, c.Reason, c.Judge = rel, reason, "llm"
+			}
+		}
+		if c.Relation != relUnrelated {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Similarity > out[j].Similarity })
+	return out, nil
+}
+
+// storeChecked is store_long with the conflict check. A duplicate of an
+// existing record is not stored again and that record is returned. With
+// the supersede action the new content becomes the next version of the
+// most similar refined record (see memory.history), which hides it from
+// search. Contradictions are never superseded, as the heuristic cannot
+// tell a changed value from a different subject ("use Postgres for
+// billing" / "use Postgres for search"). Every other refined or
+// contradicted record is flagged: its ID goes in the new record's
+// conflicts_with metadata and the new record is linked to it as refines
+// or contradicts. The caller has already run checkWrite for the write.
+func (a *App) storeChecked(ctx context.Context, session, content string, meta map[string]any, opts ConflictOptions) (CheckedWrite, error) {
+	emb, err := a.embed(ctx, content)
+	if err != nil {
+		return CheckedWrite{}, err
+	}
+	conflicts, err := a.findConflicts(ctx, session, content, emb, opts)
+	if err != nil {
+		return CheckedWrite{}, err
+	}
+	out := CheckedWrite{Conflicts: conflicts}
+	for _, c := range conflicts {
+		if c.Relation == relDuplicate {
+			c.Action = "skipped"
+			out.Conflicts = []WriteConflict{c}
+			found, err := a.findRecords(ctx, c.Record)
+			if err != nil {
+				return out, err
+			}
+			out.MemoryRecord = found[c.Record]
+			return out, nil
+		}
+	}
+	if len(conflicts) == 0 {
+		out.MemoryRecord, err = a.engine.Store(ctx, session, content, meta)
+		return out, err
+	}
+
+	superseded := -1
+	if opts.Action == conflictSupersede {
+		for i, c := range out.Conflicts {
+			if c.Relation == relRefinement {
+				superseded = i
+				out.Conflicts[i].Action = "superseded"
+				break
+			}
+		}
+	}
+	var flagged []int64
+	for i := range out.Conflicts {
+		if i != superseded {
+			out.Conflicts[i].Action = "flagged"
+			flagged = append(flagged, out.Conflicts[i].Record)
+		}
+	}
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	if len(flagged) > 0 {
+		meta["conflicts_with"] = flagged
+	}
+	editor, _ := meta["principal"].(string)
+	if superseded >= 0 {
+		out.MemoryRecord, err = a.storeVersion(ctx, out.Conflicts[superseded].Record, content, meta, editor, 0, nil)
+	} else {
+		out.MemoryRecord, err = a.storeFlagged(ctx, session, content, meta, emb)
+	}
+	if err != nil {
+		return out, err
+	}
+	for _, c := range out.Conflicts {
+		if c.Action != "flagged" {
+			continue
+		}
+		typ := "contradicts"
+		if c.Relation == relRefinement {
+			typ = "refines"
+		}
+		if _, err := a.links.Add(ctx, MemoryLink{From: out.ID, To: c.Record, Type: typ, Principal: editor, CreatedAt: out.CreatedAt}); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// storeFlagged stores content without the engine's near-duplicate check,
+// which could otherwise return the record it contradicts, and returns the
+// stored record.
+func (a *App) storeFlagged(ctx context.Context, session, content string, meta map[string]any, emb []float32) (model.MemoryRecord, error) {
+	if err := a.bank.Store.StoreMemory(ctx, session, content, meta, emb); err != nil {
+		return model.MemoryRecord{}, err
+	}
+	hits, err := searchKeeping(ctx, a.bank.Store, emb, conflictCandidates, func(rec model.MemoryRecord) bool {
+		return rec.SessionID == session && rec.Content == content
+	})
+	if err != nil {
+		return model.MemoryRecord{}, err
+	}
+	// IDs are not ordered on every backend; the newest copy is ours.
+	var stored model.MemoryRecord
+	for _, rec := range hits {
+		if stored.ID == 0 || rec.CreatedAt.After(stored.CreatedAt) {
+			stored = rec
+		}
+	}
+	if stored.ID == 0 {
+		return model.MemoryRecord{}, fmt.Errorf("stored record could not be found")
+	}
+	return stored, nil
+}
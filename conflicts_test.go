@@ -0,0 +1,126 @@
+// conflicts_test.go
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSupersedeOnlyReplacesRefinements(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+	opts := ConflictOptions{Enabled: true, Threshold: 0.3, Action: conflictSupersede}
+	old := mustStore(t, app, "s1", "use Postgres for billing", nil)
+
+	out, err := app.storeChecked(ctx, "s1", "use Postgres for search", map[string]any{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Conflicts) != 1 || out.Conflicts[0].Relation != relContradiction || out.Conflicts[0].Action != "flagged" {
+		t.Fatalf("conflicts = %+v, want one flagged contradiction", out.Conflicts)
+	}
+	if app.versions.superseded(old.ID) {
+		t.Fatal("a contradiction superseded the existing record")
+	}
+
+	out, err = app.storeChecked(ctx, "s1", "use Postgres 16 for billing", map[string]any{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, c := range out.Conflicts {
+		if c.Record == old.ID {
+			actions = append(actions, c.Relation+" "+c.Action)
+		}
+	}
+	if len(actions) != 1 || actions[0] != "refinement superseded" {
+		t.Fatalf("conflicts with the old record = %v, want it superseded as a refinement", actions)
+	}
+	if !app.versions.superseded(old.ID) {
+		t.Fatal("the refined record is still current")
+	}
+}
+
+func TestSupersedeChargesOneWrite(t *testing.T) {
+	app := newTestApp(t, func(s *GeminiSettings) {
+		s.Quotas.Session = QuotaLimits{WritesPerMin: 2}
+	})
+	ctx := context.Background()
+	mustStore(t, app, "s1", "the deploy runs on fridays", nil)
+	content := "the deploy runs on fridays at noon"
+	// store_long's handler admits the write before storeChecked runs.
+	if _, err := app.quotas.checkWrite("s1", map[string]any{}, len(content)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := app.storeChecked(ctx, "s1", content, map[string]any{}, ConflictOptions{Enabled: true, Threshold: 0.3, Action: conflictSupersede})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Conflicts) != 1 || out.Conflicts[0].Action != "superseded" {
+		t.Fatalf("conflicts = %+v, want the old record superseded", out.Conflicts)
+	}
+	if _, err := app.quotas.checkWrite("s1", map[string]any{}, 1); err != nil {
+		t.Fatalf("second write = %v, want it admitted", err)
+	}
+}
+
+func TestFindConflictsLooksPastOtherSessions(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+	content := "the billing service uses Postgres 16"
+	emb, err := app.embed(ctx, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*conflictCandidates; i++ {
+		if err := app.bank.Store.StoreMemory(ctx, "s2", content, map[string]any{}, emb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	own := mustStore(t, app, "s1", "the billing service uses Postgres", nil)
+	found, err := app.findConflicts(ctx, "s1", content, emb, ConflictOptions{Threshold: 0.3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Record != own.ID {
+		t.Fatalf("conflicts = %+v, want only record %d of s1", found, own.ID)
+	}
+}
+
+func TestConflictActionCheckedAtStartup(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("CONFLICT_ACTION", "")
+	settings, err := loadGeminiSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.MemoryStore = "inmemory"
+	settings.EmbedProvider = "hash"
+	settings.ConflictAction = "replace"
+	if _, err := newApp(context.Background(), settings, "", nil); err == nil {
+		t.Fatal("newApp accepted conflict_action replace")
+	}
+}
+
+func TestNearIdenticalValuesAreNotDuplicates(t *testing.T) {
+	if rel, _ := classifyConflict("The pool size is 5", "the pool size is  5"); rel != relDuplicate {
+		t.Fatalf("equal content = %s, want duplicate", rel)
+	}
+	if rel, _ := classifyConflict("the pool size is 5", "the pool size is 6"); rel != relContradiction {
+		t.Fatalf("changed value = %s, want contradiction", rel)
+	}
+
+	app := newTestApp(t, nil)
+	old := mustStore(t, app, "s1", "the connection pool size is 5", nil)
+	out, err := app.storeChecked(context.Background(), "s1", "the connection pool size is 6", map[string]any{},
+		ConflictOptions{Enabled: true, Threshold: 0.3, Action: conflictFlag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Conflicts) != 1 || out.Conflicts[0].Relation != relContradiction {
+		t.Fatalf("conflicts = %+v, want one contradiction", out.Conflicts)
+	}
+	if out.ID == old.ID {
+		t.Fatal("the new value was dropped as a duplicate of the old one")
+	}
+}
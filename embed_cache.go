@@ -0,0 +1,541 @@
+// embed_cache.go
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// embedCacheKey is the content address of a cached vector:
+// sha256([tenant \x00] provider \x00 model \x00 normalized text). The
+// default tenant has no prefix.
+type embedCacheKey [sha256.Size]byte
+
+func newEmbedCacheKey(tenant, provider, model, text string) embedCacheKey {
+	h := sha256.New()
+	if tenant != "" {
+		h.Write([]byte(tenant))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(provider))
+	h.Write([]byte{0})
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write([]byte(normalizeEmbedText(text)))
+	var k embedCacheKey
+	copy(k[:], h.Sum(nil))
+	return k
+}
+
+// normalizeEmbedText trims the text and collapses whitespace runs so that
+// formatting-only differences share a cache entry.
+func normalizeEmbedText(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// EmbedCacheStats is reported under engine.metrics.
+type EmbedCacheStats struct {
+	Entries    int    `json:"entries"`
+	Capacity   int    `json:"capacity"`
+	Hits       int64  `json:"hits"`
+	DiskHits   int64  `json:"disk_hits"`
+	Misses     int64  `json:"misses"`
+	Evictions  int64  `json:"evictions"`
+	DiskWrites int64  `json:"disk_writes"`
+	DiskErrors int64  `json:"disk_errors"`
+	DiskPath   string `json:"disk_path,omitempty"`
+	// DiskEntries and DiskEvictions describe the disk tier, which holds
+	// up to its own limit and drops least recently used vectors beyond it.
+	DiskEntries   int   `json:"disk_entries,omitempty"`
+	DiskEvictions int64 `json:"disk_evictions,omitempty"`
+}
+
+type embedCacheEntry struct {
+	key embedCacheKey
+	vec []float32
+}
+
+// embedCache is an LRU of embedding vectors with an optional bounded
+// on-disk tier that survives restarts.
+type embedCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[embedCacheKey]*list.Element
+	disk     *diskEmbedCache
+
+	hits       atomic.Int64
+	diskHits   atomic.Int64
+	misses     atomic.Int64
+	evictions  atomic.Int64
+	diskWrites atomic.Int64
+	diskErrors atomic.Int64
+}
+
+// newEmbedCache builds a cache holding up to capacity vectors in memory.
+// diskPath enables the persistent tier, holding up to diskEntries vectors,
+// when non-empty.
+func newEmbedCache(capacity int, diskPath string, diskEntries int) (*embedCache, error) {
+	c := &embedCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[embedCacheKey]*list.Element),
+	}
+	if diskPath != "" {
+		d, err := openDiskEmbedCache(diskPath, diskEntries)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = d
+	}
+	return c, nil
+}
+
+// Get returns a copy of the cached vector for key.
+func (c *embedCache) Get(key embedCacheKey) ([]float32, bool) {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		vec := el.Value.(*embedCacheEntry).vec
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return append([]float32(nil), vec...), true
+	}
+	c.mu.Unlock()
+
+	if c.disk != nil {
+		vec, err := c.disk.Get(key)
+		if err != nil {
+			c.diskErrors.Add(1)
+			slog.Warn("embed cache disk read failed", "error", err)
+		} else if vec != nil {
+			c.diskHits.Add(1)
+			c.putMemory(key, vec)
+			return append([]float32(nil), vec...), true
+		}
+	}
+	c.misses.Add(1)
+	return nil, false
+}
+
+// Put stores vec under key in memory and, when enabled, on disk.
+func (c *embedCache) Put(key embedCacheKey, vec []float32) {
+	if len(vec) == 0 {
+		return
+	}
+	vec = append([]float32(nil), vec...)
+	c.putMemory(key, vec)
+	if c.disk != nil {
+		written, err := c.disk.Put(key, vec)
+		if err != nil {
+			c.diskErrors.Add(1)
+			slog.Warn("embed cache disk write failed", "error", err)
+		} else if written {
+			c.diskWrites.Add(1)
+		}
+	}
+}
+
+func (c *embedCache) putMemory(key embedCacheKey, vec []float32) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*embedCacheEntry).vec = vec
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&embedCacheEntry{key: key, vec: vec})
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*embedCacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+// Stats returns the current counters.
+func (c *embedCache) Stats() EmbedCacheStats {
+	if c == nil {
+		return EmbedCacheStats{}
+	}
+	c.mu.Lock()
+	entries := c.ll.Len()
+	c.mu.Unlock()
+	st := EmbedCacheStats{
+		Entries:    entries,
+		Capacity:   c.capacity,
+		Hits:       c.hits.Load(),
+		DiskHits:   c.diskHits.Load(),
+		Misses:     c.misses.Load(),
+		Evictions:  c.evictions.Load(),
+		DiskWrites: c.diskWrites.Load(),
+		DiskErrors: c.diskErrors.Load(),
+	}
+	if c.disk != nil {
+		st.DiskPath = c.disk.path
+		st.DiskEntries, st.DiskEvictions = c.disk.stats()
+	}
+	return st
+}
+
+// diskEmbedCache is a file of fixed-header records:
+//
+//	[32-byte key][uint32 dim][dim x float32], little endian.
+//
+// New vectors are appended. The index of key -> offset is rebuilt on open,
+// and a torn trailing record from a crash is truncated away. Once the file
+// holds more than maxEntries vectors it is rewritten with the most recently
+// used three quarters of them, so it never grows without bound.
+//
+// Every server process on the machine shares the file, so each access
+// holds an flock on path+".lock" and first catches up with what other
+// processes did: records they appended are indexed, and a file they
+// compacted is reopened. read still checks the stored key, so a stale
+// offset is a miss, never another text's vector.
+type diskEmbedCache struct {
+	mu         sync.Mutex
+	path       string
+	f          *os.File
+	index      map[embedCacheKey]*diskEmbedSlot
+	size       int64
+	maxEntries int
+	clock      uint64
+	evictions  int64
+}
+
+type diskEmbedSlot struct {
+	off  int64
+	used uint64 // clock value of the last Get or Put
+}
+
+const (
+	diskEmbedHeader = sha256.Size + 4
+	// maxDiskEmbedDim bounds the dimension read from a record header, so
+	// a corrupt header cannot make read allocate gigabytes.
+	maxDiskEmbedDim = 1 << 16
+	// defaultDiskEmbedEntries bounds the disk tier when no limit is set;
+	// at 768 dimensions that is about 300 MB.
+	defaultDiskEmbedEntries = 100000
+)
+
+func openDiskEmbedCache(path string, maxEntries int) (*diskEmbedCache, error) {
+	if maxEntries <= 0 {
+		maxEntries = defaultDiskEmbedEntries
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create embed cache directory: %w", err)
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	d := &diskEmbedCache{path: path, maxEntries: maxEntries}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	if len(d.index) > d.maxEntries {
+		if err := d.compact(); err != nil {
+			d.f.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// open (re)opens the file and rebuilds the index from scratch; the file
+// lock must be held.
+func (d *diskEmbedCache) open() error {
+	f, err := os.OpenFile(d.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open embed cache: %w", err)
+	}
+	if d.f != nil {
+		d.f.Close()
+	}
+	d.f, d.index, d.size = f, make(map[embedCacheKey]*diskEmbedSlot), 0
+	if err := d.load(0); err != nil {
+		d.f.Close()
+		return err
+	}
+	return nil
+}
+
+// load indexes the records from off to the end of the file. Records later
+// in the file count as more recently used. A torn or corrupt tail is
+// truncated away; the file lock must be held.
+func (d *diskEmbedCache) load(off int64) error {
+	if _, err := d.f.Seek(off, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read embed cache: %w", err)
+	}
+	r := bufio.NewReader(d.f)
+	var hdr [diskEmbedHeader]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return fmt.Errorf("failed to read embed cache: %w", err)
+		}
+		dim := int64(binary.LittleEndian.Uint32(hdr[sha256.Size:]))
+		if dim > maxDiskEmbedDim {
+			break
+		}
+		if _, err := r.Discard(int(dim * 4)); err != nil {
+			break
+		}
+		var key embedCacheKey
+		copy(key[:], hdr[:sha256.Size])
+		d.clock++
+		d.index[key] = &diskEmbedSlot{off: off, used: d.clock}
+		off += diskEmbedHeader + dim*4
+	}
+	if err := d.f.Truncate(off); err != nil {
+		return fmt.Errorf("failed to truncate embed cache: %w", err)
+	}
+	d.size = off
+	return nil
+}
+
+// sync catches up with other processes sharing the file; d.mu and the
+// file lock must be held.
+func (d *diskEmbedCache) sync() error {
+	onDisk, err := os.Stat(d.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	open, err := d.f.Stat()
+	if err != nil {
+		return err
+	}
+	switch {
+	case onDisk == nil || !os.SameFile(onDisk, open) || onDisk.Size() < d.size:
+		// Compacted, removed or truncated by another process.
+		return d.open()
+	case onDisk.Size() > d.size:
+		return d.load(d.size)
+	}
+	return nil
+}
+
+// locked runs fn with d.mu and the file lock held, after sync.
+func (d *diskEmbedCache) locked(fn func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	unlock, err := lockFile(d.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := d.sync(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// Get returns nil, nil when the key is not on disk.
+func (d *diskEmbedCache) Get(key embedCacheKey) ([]float32, error) {
+	var vec []float32
+	err := d.locked(func() error {
+		slot, ok := d.index[key]
+		if !ok {
+			return nil
+		}
+		var err error
+		if vec, err = d.read(key, slot.off); err != nil {
+			return err
+		}
+		if vec == nil {
+			delete(d.index, key)
+			return nil
+		}
+		d.clock++
+		slot.used = d.clock
+		return nil
+	})
+	return vec, err
+}
+
+// read decodes the record for key at off. It returns nil, nil when the
+// record there is not key's, or its header is out of bounds; d.mu must be
+// held.
+func (d *diskEmbedCache) read(key embedCacheKey, off int64) ([]float32, error) {
+	var hdr [diskEmbedHeader]byte
+	if _, err := d.f.ReadAt(hdr[:], off); err != nil {
+		return nil, err
+	}
+	if embedCacheKey(hdr[:sha256.Size]) != key {
+		return nil, nil
+	}
+	dim := int64(binary.LittleEndian.Uint32(hdr[sha256.Size:]))
+	if dim > maxDiskEmbedDim || off+diskEmbedHeader+dim*4 > d.size {
+		return nil, nil
+	}
+	buf := make([]byte, dim*4)
+	if _, err := d.f.ReadAt(buf, off+diskEmbedHeader); err != nil {
+		return nil, err
+	}
+	vec := make([]float32, dim)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[i*4:]))
+	}
+	return vec, nil
+}
+
+func encodeDiskEmbed(key embedCacheKey, vec []float32) []byte {
+	buf := make([]byte, diskEmbedHeader+len(vec)*4)
+	copy(buf, key[:])
+	binary.LittleEndian.PutUint32(buf[sha256.Size:], uint32(len(vec)))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(buf[diskEmbedHeader+i*4:], math.Float32bits(v))
+	}
+	return buf
+}
+
+// Put appends vec unless key is already present, compacting the file when
+// it goes over the limit.
+func (d *diskEmbedCache) Put(key embedCacheKey, vec []float32) (bool, error) {
+	written := false
+	err := d.locked(func() error {
+		d.clock++
+		if slot, ok := d.index[key]; ok {
+			slot.used = d.clock
+			return nil
+		}
+		buf := encodeDiskEmbed(key, vec)
+		if _, err := d.f.WriteAt(buf, d.size); err != nil {
+			return err
+		}
+		written = true
+		d.index[key] = &diskEmbedSlot{off: d.size, used: d.clock}
+		d.size += int64(len(buf))
+		if len(d.index) > d.maxEntries {
+			if err := d.compact(); err != nil {
+				return fmt.Errorf("failed to compact embed cache: %w", err)
+			}
+		}
+		return nil
+	})
+	return written, err
+}
+
+// compact rewrites the file with the most recently used three quarters of
+// maxEntries, oldest first, and swaps it in; the file lock and d.mu must
+// be held (or d not yet shared).
+func (d *diskEmbedCache) compact() error {
+	type entry struct {
+		key  embedCacheKey
+		slot *diskEmbedSlot
+	}
+	entries := make([]entry, 0, len(d.index))
+	for k, slot := range d.index {
+		entries = append(entries, entry{k, slot})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].slot.used < entries[j].slot.used })
+	keep := d.maxEntries * 3 / 4
+	if keep < 1 {
+		keep = 1
+	}
+	if drop := len(entries) - keep; drop > 0 {
+		entries = entries[drop:]
+		d.evictions += int64(drop)
+	}
+
+	tmp := d.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	index := make(map[embedCacheKey]*diskEmbedSlot, len(entries))
+	w := bufio.NewWriter(out)
+	var off int64
+	for _, e := range entries {
+		vec, err := d.read(e.key, e.slot.off)
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+		if vec == nil {
+			continue
+		}
+		buf := encodeDiskEmbed(e.key, vec)
+		if _, err := w.Write(buf); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+		index[e.key] = &diskEmbedSlot{off: off, used: e.slot.used}
+		off += int64(len(buf))
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, d.path); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	d.f.Close()
+	d.f, d.index, d.size = out, index, off
+	return nil
+}
+
+func (d *diskEmbedCache) stats() (int, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.index), d.evictions
+}
+
+// cachedEmbedder serves repeated texts from an embedCache instead of
+// calling the provider again. Tenants share the cache but key their
+// entries apart, so one tenant never gets a hit on another's text.
+type cachedEmbedder struct {
+	base     memory.Embedder
+	cache    *embedCache
+	tenant   string
+	provider string
+	model    string
+}
+
+func newCachedEmbedder(base memory.Embedder, cache *embedCache, tenant, provider, model string) *cachedEmbedder {
+	return &cachedEmbedder{base: base, cache: cache, tenant: tenant, provider: provider, model: model}
+}
+
+func (c *cachedEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	key := newEmbedCacheKey(c.tenant, c.provider, c.model, text)
+	if vec, ok := c.cache.Get(key); ok {
+		trace.SpanFromContext(ctx).SetAttributes(attrCacheHit.Bool(true))
+		return vec, nil
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attrCacheHit.Bool(false))
+	vec, err := c.base.Embed(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.Put(key, vec)
+	return vec, nil
+}
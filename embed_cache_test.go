@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskEmbedCacheCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "embed_cache.bin")
+	c, err := newEmbedCache(0, path, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]embedCacheKey, 20)
+	for i := range keys {
+		keys[i] = newEmbedCacheKey("", "hash", "m", string(rune('a'+i)))
+		c.Put(keys[i], []float32{float32(i), 1})
+		// Keep the first key in use so it survives compaction.
+		if _, ok := c.Get(keys[0]); !ok {
+			t.Fatalf("key 0 evicted after %d puts", i+1)
+		}
+	}
+	st := c.Stats()
+	if st.DiskEntries > 8 || st.DiskEvictions == 0 {
+		t.Fatalf("disk tier not bounded: %+v", st)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(st.DiskEntries) * (diskEmbedHeader + 8); info.Size() != want {
+		t.Fatalf("file is %d bytes, want %d", info.Size(), want)
+	}
+
+	// Reopening with a lower limit compacts on load and keeps the newest.
+	c.disk.f.Close()
+	c, err = newEmbedCache(0, path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Stats(); st.DiskEntries != 3 {
+		t.Fatalf("reopened with %d entries, want 3", st.DiskEntries)
+	}
+	vec, ok := c.Get(keys[19])
+	if !ok || vec[0] != 19 {
+		t.Fatalf("newest vector lost: %v %v", vec, ok)
+	}
+}
+
+func TestDiskEmbedCacheSharedBetweenProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "embed_cache.bin")
+	a, err := openDiskEmbedCache(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := openDiskEmbedCache(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]embedCacheKey, 6)
+	for i := range keys {
+		keys[i] = newEmbedCacheKey("", "hash", "m", string(rune('a'+i)))
+	}
+	// Both append; neither overwrites the other's record.
+	if _, err := a.Put(keys[0], []float32{0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Put(keys[1], []float32{1}); err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range []*diskEmbedCache{a, b} {
+		for k := 0; k < 2; k++ {
+			if vec, err := d.Get(keys[k]); err != nil || len(vec) != 1 || vec[0] != float32(k) {
+				t.Fatalf("process %d read key %d as %v, %v", i, k, vec, err)
+			}
+		}
+	}
+
+	// b compacts the file; a reopens it instead of reading stale offsets.
+	for i := 2; i < len(keys); i++ {
+		if _, err := b.Put(keys[i], []float32{float32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range keys {
+		vec, err := a.Get(keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vec != nil && vec[0] != float32(i) {
+			t.Fatalf("key %d read as %v", i, vec)
+		}
+	}
+	if vec, _ := a.Get(keys[5]); vec == nil {
+		t.Fatal("newest vector written by the other process not found")
+	}
+}
+
+func TestDiskEmbedCacheChecksRecordKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "embed_cache.bin")
+	d, err := openDiskEmbedCache(path, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := newEmbedCacheKey("", "hash", "m", "one")
+	two := newEmbedCacheKey("", "hash", "m", "two")
+	if _, err := d.Put(one, []float32{1}); err != nil {
+		t.Fatal(err)
+	}
+	// A stale index entry pointing at another key's record is a miss.
+	d.index[two] = &diskEmbedSlot{off: 0}
+	if vec, err := d.Get(two); err != nil || vec != nil {
+		t.Fatalf("stale slot read as %v, %v", vec, err)
+	}
+
+	// A corrupt dimension ends the file on load instead of allocating.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := encodeDiskEmbed(two, []float32{2})
+	bad[sha256.Size] = 0xff
+	bad[sha256.Size+3] = 0xff
+	f.Write(bad)
+	f.Close()
+	d, err = openDiskEmbedCache(path, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vec, err := d.Get(one); err != nil || len(vec) != 1 {
+		t.Fatalf("good record read as %v, %v", vec, err)
+	}
+	if _, ok := d.index[two]; ok {
+		t.Fatal("corrupt record was indexed")
+	}
+	if info, _ := os.Stat(path); info.Size() != diskEmbedHeader+4 {
+		t.Fatalf("file is %d bytes, want the corrupt tail truncated", info.Size())
+	}
+}
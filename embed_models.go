@@ -0,0 +1,570 @@
+// embed_models.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Metadata keys recording which embedder produced a stored vector.
+const (
+	metaEmbedProvider = "embed_provider"
+	metaEmbedModel    = "embed_model"
+	metaEmbedDim      = "embed_dim"
+)
+
+// EmbedModelStats is reported under engine.metrics.
+type EmbedModelStats struct {
+	Provider            string `json:"provider"`
+	Model               string `json:"model"`
+	Dim                 int64  `json:"dim"`
+	IncompatibleSkipped int64  `json:"incompatible_skipped"`
+}
+
+// modelTagStore tags every write with the active embedder's provider,
+// model and dimension, and drops search hits produced by a different
+// embedder so vectors from incompatible spaces are never compared.
+//
+// VectorStore cannot rewrite metadata, so a record re-embedded in place
+// keeps its old tags in the store; its new tags are kept in
+// embed_tags.json in the state directory and applied to every record the
+// store returns.
+type modelTagStore struct {
+	memory.VectorStore
+	provider string
+	model    string
+
+	dim     atomic.Int64
+	skipped atomic.Int64
+
+	tagsMu    sync.Mutex
+	tagsPath  string
+	tags      map[int64]embedTag
+	tagsDirty bool // tags changed since the last save
+}
+
+// embedTag is the embedder of a record re-embedded in place.
+type embedTag struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Dim      int    `json:"dim"`
+}
+
+func newModelTagStore(vs memory.VectorStore, provider, model, stateDir string) (*modelTagStore, error) {
+	s := &modelTagStore{
+		VectorStore: vs,
+		provider:    provider,
+		model:       model,
+		tagsPath:    filepath.Join(stateDir, "embed_tags.json"),
+		tags:        make(map[int64]embedTag),
+	}
+	data, err := os.ReadFile(s.tagsPath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedding tags: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.tags); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", s.tagsPath, err)
+	}
+	return s, nil
+}
+
+// saveTags writes the tag overlay; s.tagsMu must be held.
+func (s *modelTagStore) saveTags() error {
+	data, err := json.Marshal(s.tags)
+	if err != nil {
+		return err
+	}
+	tmp := s.tagsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write embedding tags: %w", err)
+	}
+	if err := os.Rename(tmp, s.tagsPath); err != nil {
+		return err
+	}
+	s.tagsDirty = false
+	return nil
+}
+
+// flushTags saves the tag overlay if retag or pruneTags changed it.
+func (s *modelTagStore) flushTags() error {
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+	if !s.tagsDirty {
+		return nil
+	}
+	return s.saveTags()
+}
+
+// retag replaces the vector of record id, keeping its ID, and records the
+// active embedder as the one that produced it. The tag is saved by the
+// next flushTags, so a job writes embed_tags.json once per batch.
+func (s *modelTagStore) retag(ctx context.Context, id int64, embedding []float32) error {
+	if err := s.VectorStore.UpdateEmbedding(ctx, id, embedding, time.Now().UTC()); err != nil {
+		return err
+	}
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+	s.tags[id] = embedTag{Provider: s.provider, Model: s.model, Dim: len(embedding)}
+	s.tagsDirty = true
+	s.dim.Store(int64(len(embedding)))
+	return nil
+}
+
+// pruneTags drops the tags of records not in exists, e.g. ones deleted
+// below this store by a sweep.
+func (s *modelTagStore) pruneTags(exists map[int64]bool) {
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+	for id := range s.tags {
+		if !exists[id] {
+			delete(s.tags, id)
+			s.tagsDirty = true
+		}
+	}
+}
+
+// applyTags rewrites the tags of records re-embedded in place.
+func (s *modelTagStore) applyTags(recs []model.MemoryRecord) {
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+	if len(s.tags) == 0 {
+		return
+	}
+	for i := range recs {
+		if tag, ok := s.tags[recs[i].ID]; ok {
+			recs[i].Metadata = retaggedMetadata(recs[i].Metadata, tag)
+		}
+	}
+}
+
+func retaggedMetadata(raw string, tag embedTag) string {
+	meta := model.DecodeMetadata(raw)
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	meta[metaEmbedProvider] = tag.Provider
+	meta[metaEmbedModel] = tag.Model
+	meta[metaEmbedDim] = tag.Dim
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return raw
+	}
+	return string(data)
+}
+
+func (s *modelTagStore) Iterate(ctx context.Context, fn func(model.MemoryRecord) bool) error {
+	return s.VectorStore.Iterate(ctx, func(rec model.MemoryRecord) bool {
+		one := []model.MemoryRecord{rec}
+		s.applyTags(one)
+		return fn(one[0])
+	})
+}
+
+func (s *modelTagStore) DeleteMemory(ctx context.Context, ids []int64) error {
+	if err := s.VectorStore.DeleteMemory(ctx, ids); err != nil {
+		return err
+	}
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+	dropped := false
+	for _, id := range ids {
+		if _, ok := s.tags[id]; ok {
+			delete(s.tags, id)
+			dropped = true
+		}
+	}
+	if !dropped {
+		return nil
+	}
+	return s.saveTags()
+}
+
+func (s *modelTagStore) StoreMemory(ctx context.Context, sessionID, content string, metadata map[string]any, embedding []float32) error {
+	if metadata == nil {
+		metadata = map[string]any{}
+	}
+	// Engine.Store and SessionMemory.Embed fall back to DummyEmbedding when
+	// the provider fails; record that honestly instead of claiming the model.
+	provider, model := s.provider, s.model
+	if provider != "dummy" && isDummyEmbedding(content, embedding) {
+		provider, model = "dummy", ""
+	}
+	metadata[metaEmbedProvider] = provider
+	metadata[metaEmbedModel] = model
+	metadata[metaEmbedDim] = len(embedding)
+	if provider == s.provider && len(embedding) > 0 {
+		s.dim.Store(int64(len(embedding)))
+	}
+	return s.VectorStore.StoreMemory(ctx, sessionID, content, metadata, embedding)
+}
+
+func (s *modelTagStore) SearchMemory(ctx context.Context, queryEmbedding []float32, limit int) ([]model.MemoryRecord, error) {
+	recs, err := s.VectorStore.SearchMemory(ctx, queryEmbedding, limit)
+	if err != nil {
+		return nil, err
+	}
+	s.applyTags(recs)
+	out := s.filterCompatible(recs, len(queryEmbedding))
+	if len(out) < len(recs) && len(recs) >= limit {
+		// Some hits were discarded; oversample once to refill the page.
+		more, err := s.VectorStore.SearchMemory(ctx, queryEmbedding, limit*4)
+		if err != nil {
+			return nil, err
+		}
+		s.applyTags(more)
+		out = s.filterCompatible(more, len(queryEmbedding))
+	}
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *modelTagStore) filterCompatible(recs []model.MemoryRecord, queryDim int) []model.MemoryRecord {
+	out := recs[:0:0]
+	for _, rec := range recs {
+		if !s.compatible(rec, queryDim) {
+			s.skipped.Add(1)
+			continue
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// compatible reports whether rec was embedded by the active embedder.
+// Untagged records written before tagging existed are accepted when their
+// dimension matches the query.
+func (s *modelTagStore) compatible(rec model.MemoryRecord, queryDim int) bool {
+	if len(rec.Embedding) > 0 && queryDim > 0 && len(rec.Embedding) != queryDim {
+		return false
+	}
+	meta := model.DecodeMetadata(rec.Metadata)
+	provider, tagged := meta[metaEmbedProvider].(string)
+	if !tagged {
+		return true
+	}
+	m, _ := meta[metaEmbedModel].(string)
+	return provider == s.provider && m == s.model
+}
+
+func (s *modelTagStore) Stats() EmbedModelStats {
+	return EmbedModelStats{
+		Provider:            s.provider,
+		Model:               s.model,
+		Dim:                 s.dim.Load(),
+		IncompatibleSkipped: s.skipped.Load(),
+	}
+}
+
+func isDummyEmbedding(content string, embedding []float32) bool {
+	dummy := memory.DummyEmbedding(content)
+	if len(dummy) != len(embedding) {
+		return false
+	}
+	for i := range dummy {
+		if dummy[i] != embedding[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ReembedJob tracks a background migration of stored vectors to the active
+// embedder.
+type ReembedJob struct {
+	ID         string    `json:"id"`
+	Scope      string    `json:"scope"`
+	Provider   string    `json:"provider"`
+	Model      string    `json:"model"`
+	State      string    `json:"state"`
+	Total      int       `json:"total"`
+	Done       int       `json:"done"`
+	Skipped    int       `json:"skipped"`
+	Failed     int       `json:"failed"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// reembedJobs runs jobs under ctx, the server's lifetime, so they stop on
+// shutdown; each job can also be canceled on its own.
+type reembedJobs struct {
+	ctx  context.Context
+	mu   sync.Mutex
+	jobs map[string]*ReembedJob
+}
+
+// Finished jobs are reported for reembedJobRetention, and at most
+// maxFinishedReembedJobs of them are kept. A running job saves the tags
+// of the records it re-embedded every reembedTagBatch records.
+const (
+	reembedJobRetention    = 24 * time.Hour
+	maxFinishedReembedJobs = 50
+	reembedTagBatch        = 100
+)
+
+func newReembedJobs(ctx context.Context) *reembedJobs {
+	return &reembedJobs{ctx: ctx, jobs: make(map[string]*ReembedJob)}
+}
+
+// cancel stops a running job; it reports false if id is not running.
+func (j *reembedJobs) cancel(id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job := j.jobs[id]
+	if job == nil || !job.FinishedAt.IsZero() || job.cancel == nil {
+		return false
+	}
+	job.cancel()
+	return true
+}
+
+func (j *reembedJobs) update(id string, fn func(*ReembedJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if job := j.jobs[id]; job != nil {
+		fn(job)
+	}
+}
+
+// add registers job after dropping finished jobs past retention.
+func (j *reembedJobs) add(job *ReembedJob) ReembedJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var finished []*ReembedJob
+	for id, old := range j.jobs {
+		switch {
+		case old.FinishedAt.IsZero():
+		case time.Since(old.FinishedAt) > reembedJobRetention:
+			delete(j.jobs, id)
+		default:
+			finished = append(finished, old)
+		}
+	}
+	if extra := len(finished) - maxFinishedReembedJobs + 1; extra > 0 {
+		sort.Slice(finished, func(a, b int) bool { return finished[a].FinishedAt.Before(finished[b].FinishedAt) })
+		for _, old := range finished[:extra] {
+			delete(j.jobs, old.ID)
+		}
+	}
+	j.jobs[job.ID] = job
+	return *job
+}
+
+func (j *reembedJobs) get(id string) (ReembedJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job := j.jobs[id]
+	if job == nil {
+		return ReembedJob{}, false
+	}
+	return *job, true
+}
+
+func (j *reembedJobs) list() []ReembedJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	out := make([]ReembedJob, 0, len(j.jobs))
+	for _, job := range j.jobs {
+		out = append(out, *job)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].StartedAt.After(out[b].StartedAt) })
+	return out
+}
+
+// startReembed launches a job that re-embeds every record matching
+// sessionID / space (both empty means the whole store) with the active
+// embedder. Records already tagged with the active model are skipped
+// unless force is set.
+func (a *App) startReembed(sessionID, space string, force bool) ReembedJob {
+	scope := "all"
+	switch {
+	case sessionID != "":
+		scope = "session:" + sessionID
+	case space != "":
+		scope = "space:" + space
+	}
+	job := &ReembedJob{
+		ID:        fmt.Sprintf("reembed-%d", time.Now().UnixNano()),
+		Scope:     scope,
+		Provider:  a.modelStore.provider,
+		Model:     a.modelStore.model,
+		State:     "running",
+		StartedAt: time.Now().UTC(),
+	}
+	ctx, cancel := context.WithCancel(a.reembed.ctx)
+	job.cancel = cancel
+	snapshot := a.reembed.add(job)
+
+	go func() {
+		defer cancel()
+		a.runReembed(ctx, job.ID, sessionID, space, force)
+	}()
+	return snapshot
+}
+
+func (a *App) runReembed(ctx context.Context, id, sessionID, space string, force bool) {
+	var targets []model.MemoryRecord
+	err := a.modelStore.Iterate(ctx, func(rec model.MemoryRecord) bool {
+		if sessionID != "" && rec.SessionID != sessionID {
+			return true
+		}
+		if space != "" && recordSpace(rec) != space {
+			return true
+		}
+		targets = append(targets, rec)
+		return true
+	})
+	if err != nil {
+		a.reembed.update(id, func(j *ReembedJob) {
+			j.State, j.Error, j.FinishedAt = "failed", err.Error(), time.Now().UTC()
+		})
+		return
+	}
+	a.reembed.update(id, func(j *ReembedJob) { j.Total = len(targets) })
+	if sessionID == "" && space == "" {
+		// targets is the whole store, so tags of any other ID are stale.
+		exists := make(map[int64]bool, len(targets))
+		for _, rec := range targets {
+			exists[rec.ID] = true
+		}
+		a.modelStore.pruneTags(exists)
+	}
+
+	state := "completed"
+	for i, rec := range targets {
+		if ctx.Err() != nil {
+			state = "canceled"
+			break
+		}
+		if i > 0 && i%reembedTagBatch == 0 {
+			if err := a.modelStore.flushTags(); err != nil {
+				slog.Error("failed to save embedding tags", "job_id", id, "error", err)
+			}
+		}
+		meta := model.DecodeMetadata(rec.Metadata)
+		if !force && meta[metaEmbedProvider] == a.modelStore.provider && meta[metaEmbedModel] == a.modelStore.model {
+			a.reembed.update(id, func(j *ReembedJob) { j.Skipped++ })
+			continue
+		}
+		if err := a.reembedRecord(ctx, rec); err != nil {
+			slog.Warn("reembed record failed", "job_id", id, "record_id", rec.ID, "error", err)
+			a.reembed.update(id, func(j *ReembedJob) { j.Failed++ })
+			continue
+		}
+		a.reembed.update(id, func(j *ReembedJob) { j.Done++ })
+	}
+	if err := a.modelStore.flushTags(); err != nil {
+		a.reembed.update(id, func(j *ReembedJob) {
+			j.State, j.Error, j.FinishedAt = "failed", err.Error(), time.Now().UTC()
+		})
+		return
+	}
+	a.reembed.update(id, func(j *ReembedJob) {
+		j.State, j.FinishedAt = state, time.Now().UTC()
+	})
+}
+
+// reembedRecord replaces rec's vector in place, so versions, links and
+// extracted facts that refer to its ID stay valid.
+func (a *App) reembedRecord(ctx context.Context, rec model.MemoryRecord) error {
+	vec, err := a.embedder.Embed(ctx, rec.Content)
+	if err != nil {
+		return err
+	}
+	if len(vec) == 0 {
+		return fmt.Errorf("empty embedding")
+	}
+	return a.modelStore.retag(ctx, rec.ID, vec)
+}
+
+// recordSpace returns the space a long-term record was written to.
+func recordSpace(rec model.MemoryRecord) string {
+	if rec.Space != "" {
+		return rec.Space
+	}
+	if space, _ := model.DecodeMetadata(rec.Metadata)["space"].(string); space != "" {
+		return space
+	}
+	return rec.SessionID
+}
+
+func registerReembedTools(s *server.MCPServer, app *App) {
+	reembedTool := mcp.NewTool("memory.reembed",
+		mcp.WithDescription("Start a background job re-embedding stored memories with the active embedding model"),
+		mcp.WithString("session_id", mcp.Description("Only re-embed records of this session")),
+		mcp.WithString("space", mcp.Description("Only re-embed records of this space")),
+		mcp.WithBoolean("all", mcp.Description("Re-embed the whole store (required when no session_id/space is given)")),
+		mcp.WithBoolean("force", mcp.Description("Also re-embed records already tagged with the active model")),
+	)
+	s.AddTool(reembedTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		sid := strings.TrimSpace(getStringParam(req, "session_id"))
+		space := strings.TrimSpace(getStringParam(req, "space"))
+		if sid != "" && space != "" {
+			return mcp.NewToolResultError("pass either session_id or space, not both"), nil
+		}
+		if sid == "" && space == "" && !req.GetBool("all", false) {
+			return mcp.NewToolResultError("no scope given: pass session_id, space, or all=true"), nil
+		}
+		job := app.startReembed(sid, space, req.GetBool("force", false))
+		res, _ := mcp.NewToolResultJSON(job)
+		return res, nil
+	})
+
+	reembedStatus := mcp.NewTool("memory.reembed_status",
+		mcp.WithDescription("Report progress of re-embedding jobs (all jobs if job_id is omitted)"),
+		mcp.WithString("job_id"),
+	)
+	s.AddTool(reembedStatus, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		id := getStringParam(req, "job_id")
+		if id == "" {
+			res, _ := mcp.NewToolResultJSON(app.reembed.list())
+			return res, nil
+		}
+		job, ok := app.reembed.get(id)
+		if !ok {
+			return mcp.NewToolResultError(fmt.Sprintf("unknown job_id %q", id)), nil
+		}
+		res, _ := mcp.NewToolResultJSON(job)
+		return res, nil
+	})
+
+	reembedCancel := mcp.NewTool("memory.reembed_cancel",
+		mcp.WithDescription("Stop a running re-embedding job; records already re-embedded keep their new vectors"),
+		mcp.WithString("job_id", mcp.Required()),
+	)
+	s.AddTool(reembedCancel, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		id, err := req.RequireString("job_id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing job_id: %v", err)), nil
+		}
+		if !app.reembed.cancel(id) {
+			return mcp.NewToolResultError(fmt.Sprintf("job %q is not running", id)), nil
+		}
+		return mcp.NewToolResultJSON(map[string]any{"job_id": id, "canceled": true})
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+)
+
+func TestReembedKeepsRecordIDs(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+	rec := mustStore(t, app, "s", "The billing service runs on Kubernetes", nil)
+	other := mustStore(t, app, "s", "Deploys happen on Tuesdays", nil)
+	if _, _, err := app.linkRecords(ctx, rec.ID, other.ID, "related", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	job := app.startReembed("s", "", true)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j, _ := app.reembed.get(job.ID)
+		if j.State == "completed" {
+			if j.Done != 2 || j.Failed != 0 {
+				t.Fatalf("job = %+v", j)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish: %+v", j)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	recs := recordIDs(t, app, "s")
+	if len(recs) != 2 {
+		t.Fatalf("session has %d records, want 2", len(recs))
+	}
+	got, ok := recs[rec.ID]
+	if !ok {
+		t.Fatalf("record %d was given a new ID", rec.ID)
+	}
+	meta := model.DecodeMetadata(got.Metadata)
+	if meta[metaEmbedProvider] != app.modelStore.provider || meta[metaEmbedModel] != app.modelStore.model {
+		t.Fatalf("tags not applied: %v", meta)
+	}
+	ns, err := app.neighbors(ctx, []int64{rec.ID}, 1, nil, linkBoth, func(model.MemoryRecord) bool { return true })
+	if err != nil || len(ns) != 1 || ns[0].ID != other.ID {
+		t.Fatalf("link lost after reembed: %+v %v", ns, err)
+	}
+
+	// Tags survive a restart.
+	again, err := newModelTagStore(app.modelStore.VectorStore, "hash", "m", app.stateDir)
+	if err != nil || len(again.tags) != 2 {
+		t.Fatalf("reloaded %d tags, err %v", len(again.tags), err)
+	}
+}
+
+func TestReembedSavesTagsPerBatchAndPrunes(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+	rec := mustStore(t, app, "s", "The billing service runs on Kubernetes", nil)
+	// A tag left behind by a record deleted below the tag store.
+	app.modelStore.tags[999999] = embedTag{Provider: "old", Model: "m", Dim: 3}
+
+	vec, err := app.embed(ctx, rec.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.modelStore.retag(ctx, rec.ID, vec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(app.stateDir, "embed_tags.json")); !os.IsNotExist(err) {
+		t.Fatalf("retag saved the tags itself: %v", err)
+	}
+
+	id := app.reembed.add(&ReembedJob{ID: "job", State: "running"}).ID
+	app.runReembed(ctx, id, "", "", true)
+	if j, _ := app.reembed.get(id); j.State != "completed" || j.Done != 1 {
+		t.Fatalf("job = %+v", j)
+	}
+	again, err := newModelTagStore(app.modelStore.VectorStore, "hash", "m", app.stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := again.tags[rec.ID]; !ok || len(again.tags) != 1 {
+		t.Fatalf("saved tags = %v, want only record %d", again.tags, rec.ID)
+	}
+}
+
+func TestReembedStopsWhenCanceled(t *testing.T) {
+	app := newTestApp(t, nil)
+	mustStore(t, app, "s", "The billing service runs on Kubernetes", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	id := app.reembed.add(&ReembedJob{ID: "job", State: "running"}).ID
+	app.runReembed(ctx, id, "s", "", true)
+	if j, _ := app.reembed.get(id); j.State != "canceled" || j.Done != 0 || j.FinishedAt.IsZero() {
+		t.Fatalf("job = %+v, want it canceled before any record", j)
+	}
+	if app.reembed.cancel(id) {
+		t.Fatal("canceled a finished job")
+	}
+}
@@ -0,0 +1,190 @@
+// embedders.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/embed"
+)
+
+const (
+	defaultHashEmbedDim   = 384
+	defaultFastEmbedModel = "fast-bge-small-en-v1.5"
+)
+
+// newEmbedder builds the embedder selected by the embed_provider setting
+// and returns the canonical provider/model names used for cache keys and
+// record tags. "auto" (the default) defers to AutoEmbedder and ADK_EMBED_*.
+func newEmbedder(ctx context.Context, provider, model string, dim int, offline bool) (memory.Embedder, string, string, error) {
+	provider = canonicalEmbedProvider(provider)
+	if offline && provider != "hash" && provider != "fastembed" {
+		slog.Info("offline mode: using hash embedder", "requested_provider", provider)
+		provider, model = "hash", ""
+	}
+
+	switch provider {
+	case "", "auto":
+		e := memory.AutoEmbedder()
+		p, m := embedderIdentity(e)
+		return e, p, m, nil
+
+	case "hash":
+		if dim <= 0 {
+			dim = defaultHashEmbedDim
+		}
+		e := newHashEmbedder(dim)
+		return e, "hash", e.Model(), nil
+
+	case "fastembed":
+		if model == "" {
+			model = defaultFastEmbedModel
+		}
+		dir, err := ensureSessionDir()
+		if err != nil {
+			return nil, "", "", err
+		}
+		cacheDir := filepath.Join(dir, "fastembed")
+		// fastembed downloads a missing model into cacheDir/<model>, so
+		// offline it may only load one that is already there.
+		if offline {
+			if _, err := os.Stat(filepath.Join(cacheDir, model)); err != nil {
+				return nil, "", "", fmt.Errorf("offline mode: fastembed model %q is not cached in %s", model, cacheDir)
+			}
+		}
+		e, err := memory.NewFastEmbeed(ctx, &embed.Options{
+			Model:    model,
+			CacheDir: cacheDir,
+		})
+		if err != nil {
+			return nil, "", "", fmt.Errorf("failed to create fastembed embedder: %w", err)
+		}
+		return e, "fastembed", model, nil
+
+	case "openai":
+		e, err := memory.NewOpenAIEmbedder(model)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("failed to create openai embedder: %w", err)
+		}
+		return e, provider, model, nil
+
+	case "gemini":
+		e, err := memory.NewVertexAIEmbedder(model)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("failed to create gemini embedder: %w", err)
+		}
+		return e, provider, model, nil
+
+	case "ollama":
+		e, err := memory.NewOllamaEmbedder(model)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("failed to create ollama embedder: %w", err)
+		}
+		return e, provider, model, nil
+
+	case "claude":
+		e, err := memory.NewClaudeEmbedder(model)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("failed to create claude embedder: %w", err)
+		}
+		return e, provider, model, nil
+
+	case "dummy":
+		return memory.DummyEmbedder{}, "dummy", "", nil
+
+	default:
+		return nil, "", "", fmt.Errorf("unknown embed_provider %q", provider)
+	}
+}
+
+// canonicalEmbedProvider folds provider aliases so records tagged under
+// "google" and "gemini" are treated as the same embedder.
+func canonicalEmbedProvider(p string) string {
+	switch p = strings.ToLower(strings.TrimSpace(p)); p {
+	case "google", "vertex", "vertexai":
+		return "gemini"
+	case "anthropic":
+		return "claude"
+	case "local", "offline":
+		return "hash"
+	}
+	return p
+}
+
+// embedderIdentity names the provider and model AutoEmbedder picked.
+func embedderIdentity(e memory.Embedder) (provider, model string) {
+	if _, ok := e.(memory.DummyEmbedder); ok {
+		return "dummy", ""
+	}
+	provider = canonicalEmbedProvider(os.Getenv("ADK_EMBED_PROVIDER"))
+	model = strings.TrimSpace(os.Getenv("ADK_EMBED_MODEL"))
+	return provider, model
+}
+
+// hashEmbedder is a deterministic, dependency-free embedder based on
+// feature hashing of word unigrams, word bigrams and character trigrams.
+// It needs no network or model files, so the server works fully offline;
+// similarity is lexical rather than semantic.
+type hashEmbedder struct {
+	dim int
+}
+
+func newHashEmbedder(dim int) *hashEmbedder {
+	return &hashEmbedder{dim: dim}
+}
+
+// Model encodes the feature set version and dimension so vectors from a
+// different configuration are never mixed.
+func (h *hashEmbedder) Model() string {
+	return fmt.Sprintf("ngram-v1-%d", h.dim)
+}
+
+func (h *hashEmbedder) Embed(_ context.Context, text string) ([]float32, error) {
+	vec := make([]float32, h.dim)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for i, w := range words {
+		h.add(vec, "w:"+w, 1)
+		if i > 0 {
+			h.add(vec, "b:"+words[i-1]+" "+w, 0.5)
+		}
+		runes := []rune("^" + w + "$")
+		for j := 0; j+3 <= len(runes); j++ {
+			h.add(vec, "c:"+string(runes[j:j+3]), 0.25)
+		}
+	}
+
+	var norm float64
+	for _, v := range vec {
+		norm += float64(v) * float64(v)
+	}
+	if norm > 0 {
+		inv := float32(1 / math.Sqrt(norm))
+		for i := range vec {
+			vec[i] *= inv
+		}
+	}
+	return vec, nil
+}
+
+// add hashes feature into a bucket; a second hash bit picks the sign so
+// collisions cancel out on average.
+func (h *hashEmbedder) add(vec []float32, feature string, weight float32) {
+	f := fnv.New64a()
+	f.Write([]byte(feature))
+	sum := f.Sum64()
+	idx := int(sum % uint64(h.dim))
+	if sum>>63 == 1 {
+		weight = -weight
+	}
+	vec[idx] += weight
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashEmbedderIsDeterministic(t *testing.T) {
+	ctx := context.Background()
+	a, err := newHashEmbedder(64).Embed(ctx, "Payments service depends on Postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newHashEmbedder(64).Embed(ctx, "Payments service depends on Postgres")
+	if len(a) != 64 {
+		t.Fatalf("dimension = %d, want 64", len(a))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("vectors differ at %d: %v != %v", i, a[i], b[i])
+		}
+	}
+	other, _ := newHashEmbedder(64).Embed(ctx, "the release is on friday")
+	var same, diff float32
+	for i := range a {
+		same += a[i] * b[i]
+		diff += a[i] * other[i]
+	}
+	if diff >= same {
+		t.Fatalf("unrelated text scores %v, the same text %v", diff, same)
+	}
+}
+
+func TestNewEmbedderHashDimension(t *testing.T) {
+	for _, tc := range []struct {
+		dim, want int
+	}{{0, defaultHashEmbedDim}, {128, 128}} {
+		e, provider, model, err := newEmbedder(context.Background(), "hash", "", tc.dim, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vec, _ := e.Embed(context.Background(), "hello world")
+		if provider != "hash" || len(vec) != tc.want || model != fmt.Sprintf("ngram-v1-%d", tc.want) {
+			t.Fatalf("dim %d: provider=%q model=%q len=%d", tc.dim, provider, model, len(vec))
+		}
+	}
+}
+
+func TestOfflineModeForcesHashEmbedder(t *testing.T) {
+	for _, p := range []string{"openai", "gemini", "ollama", "auto"} {
+		_, provider, _, err := newEmbedder(context.Background(), p, "some-model", 0, true)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if provider != "hash" {
+			t.Fatalf("offline %s: provider = %q, want hash", p, provider)
+		}
+	}
+}
+
+func TestOfflineFastEmbedNeedsCachedModel(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	_, _, _, err := newEmbedder(context.Background(), "fastembed", "", 0, true)
+	if err == nil || !strings.Contains(err.Error(), "not cached") {
+		t.Fatalf("offline fastembed without a cached model: err = %v", err)
+	}
+
+	dir, err := ensureSessionDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "fastembed", defaultFastEmbedModel), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = newEmbedder(context.Background(), "fastembed", "", 0, true)
+	if err != nil && strings.Contains(err.Error(), "not cached") {
+		t.Fatalf("cached model was rejected: %v", err)
+	}
+}
@@ -0,0 +1,588 @@
+// facts.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Kinds of extracted records, stored under metaKind.
+const (
+	metaKind   = "extracted"
+	kindFact   = "fact"
+	kindEntity = "entity"
+)
+
+// Link types between extracted records and their source.
+const (
+	linkDerivedFrom = "derived_from"
+	linkAbout       = "about"
+	linkMentionedIn = "mentioned_in"
+)
+
+// maxExtracted caps the entities and the facts kept from one record.
+const maxExtracted = 32
+
+// ExtractedEntity is a named thing the content mentions.
+type ExtractedEntity struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// ExtractedFact is a subject-predicate-object statement.
+type ExtractedFact struct {
+	Subject   string `json:"subject"`
+	Predicate string `json:"predicate"`
+	Object    string `json:"object"`
+}
+
+// Extraction is what the model returns for one piece of content.
+type Extraction struct {
+	Entities []ExtractedEntity `json:"entities"`
+	Facts    []ExtractedFact   `json:"facts"`
+}
+
+// ExtractionResult reports the records an extraction stored.
+type ExtractionResult struct {
+	Source   int64      `json:"source_record"`
+	Entities []int64    `json:"entity_records"`
+	Facts    []int64    `json:"fact_records"`
+	Extract  Extraction `json:"extraction"`
+}
+
+const factPrompt = `Extract the named entities and the facts stated in the text below.
+Reply with JSON only, in this form:
+{"entities":[{"name":"...","type":"service|person|team|config|bug|decision|other"}],
+ "facts":[{"subject":"...","predicate":"...","object":"..."}]}
+Use short predicates in snake_case (e.g. uses, depends_on, owned_by, caused_by).
+Only include facts the text states. Reply {"entities":[],"facts":[]} if there are none.
+
+Text:
+`
+
+// extract asks the model for the entities and facts in content.
+func (a *App) extract(ctx context.Context, content string) (Extraction, error) {
+	out, err := a.llm.Generate(ctx, factPrompt+content)
+	if err != nil {
+		return Extraction{}, fmt.Errorf("fact extraction: %w", err)
+	}
+	return parseExtraction(fmt.Sprint(out))
+}
+
+// parseExtraction reads the JSON object in a model reply, ignoring any
+// prose or code fences around it, and drops incomplete entries.
+func parseExtraction(reply string) (Extraction, error) {
+	start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return Extraction{}, errors.New("fact extraction: reply holds no JSON object")
+	}
+	var raw Extraction
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &raw); err != nil {
+		return Extraction{}, fmt.Errorf("fact extraction: bad reply: %w", err)
+	}
+	var ex Extraction
+	seen := map[string]bool{}
+	for _, e := range raw.Entities {
+		e.Name = strings.TrimSpace(e.Name)
+		e.Type = strings.ToLower(strings.TrimSpace(e.Type))
+		if key := entityKey(e.Name); key != "" && !seen[key] && len(ex.Entities) < maxExtracted {
+			seen[key] = true
+			ex.Entities = append(ex.Entities, e)
+		}
+	}
+	for _, f := range raw.Facts {
+		f.Subject = strings.TrimSpace(f.Subject)
+		f.Object = strings.TrimSpace(f.Object)
+		f.Predicate = strings.Join(strings.Fields(strings.ToLower(f.Predicate)), "_")
+		if f.Subject != "" && f.Predicate != "" && f.Object != "" && len(ex.Facts) < maxExtracted {
+			ex.Facts = append(ex.Facts, f)
+		}
+	}
+	return ex, nil
+}
+
+// entityKey folds case and whitespace so "Service X" and "service  x"
+// are the same entity.
+func entityKey(name string) string {
+	return normalizeContent(name)
+}
+
+// factKey identifies a fact for de-duplication within a session.
+func factKey(subject, predicate, object string) string {
+	return entityKey(subject) + "\x00" + predicate + "\x00" + entityKey(object)
+}
+
+// stubLLM is the "stub" llm_provider: it answers the extraction prompt
+// with simple "<subject> <verb> <object>" sentence rules and the conflict
+// judge prompt with classifyConflict instead of a model, for tests and
+// offline use.
+type stubLLM struct{}
+
+var stubSentenceRe = regexp.MustCompile(`[.!?;\n]+`)
+
+var stubFactRe = regexp.MustCompile(`(?i)^(.+?)\s+(is caused by|is owned by|depends on|runs on|belongs to|is part of|uses|owns|calls|stores|replaces|causes|is|are)\s+(.+)$`)
+
+func (stubLLM) Generate(_ context.Context, prompt string) (any, error) {
+	if i := strings.LastIndex(prompt, "\nExisting: "); i >= 0 && strings.HasPrefix(prompt, "Compare a new memory") {
+		old, content, _ := strings.Cut(prompt[i+len("\nExisting: "):], "\nNew: ")
+		rel, reason := classifyConflict(old, strings.TrimSpace(content))
+		out, err := json.Marshal(map[string]string{"relation": rel, "reason": reason})
+		return string(out), err
+	}
+	text := prompt
+	if i := strings.LastIndex(prompt, "\nText:\n"); i >= 0 {
+		text = prompt[i+len("\nText:\n"):]
+	}
+	var ex Extraction
+	for _, sentence := range stubSentenceRe.Split(text, -1) {
+		m := stubFactRe.FindStringSubmatch(strings.TrimSpace(sentence))
+		if m == nil {
+			continue
+		}
+		f := ExtractedFact{Subject: m[1], Predicate: m[2], Object: m[3]}
+		ex.Facts = append(ex.Facts, f)
+		ex.Entities = append(ex.Entities, ExtractedEntity{Name: f.Subject})
+		if f.Predicate != "is" && f.Predicate != "are" {
+			ex.Entities = append(ex.Entities, ExtractedEntity{Name: f.Object})
+		}
+	}
+	out, err := json.Marshal(ex)
+	return string(out), err
+}
+
+// isExtracted reports whether meta belongs to an extracted fact or entity.
+func isExtracted(meta map[string]any) bool {
+	kind, _ := meta[metaKind].(string)
+	return kind == kindFact || kind == kindEntity
+}
+
+// extractFacts runs the extractor on rec and stores each new entity and
+// each fact as a record of rec's session. Facts link derived_from rec and
+// about their entities; entities link mentioned_in rec. An entity the
+// session already has a record for is reused. Existing entities and facts
+// are found by searching near each one's vector rather than by scanning
+// the store.
+func (a *App) extractFacts(ctx context.Context, rec model.MemoryRecord) (ExtractionResult, error) {
+	res := ExtractionResult{Source: rec.ID, Entities: []int64{}, Facts: []int64{}}
+	srcMeta := model.DecodeMetadata(rec.Metadata)
+	if isExtracted(srcMeta) {
+		return res, fmt.Errorf("record %d is itself an extracted %v", rec.ID, srcMeta[metaKind])
+	}
+	ex, err := a.extract(ctx, rec.Content)
+	if err != nil {
+		return res, err
+	}
+	res.Extract = ex
+	// Facts name entities the model may not have listed separately.
+	listed := map[string]bool{}
+	for _, e := range ex.Entities {
+		listed[entityKey(e.Name)] = true
+	}
+	for _, f := range ex.Facts {
+		if key := entityKey(f.Subject); !listed[key] {
+			listed[key] = true
+			ex.Entities = append(ex.Entities, ExtractedEntity{Name: f.Subject})
+		}
+	}
+
+	batch := fmt.Sprintf("%d-%d", rec.ID, time.Now().UnixNano())
+	base := func(kind string) map[string]any {
+		meta := map[string]any{metaKind: kind, "source_record": rec.ID, "extraction": batch}
+		for _, k := range []string{"space", "principal"} {
+			if v, ok := srcMeta[k]; ok {
+				meta[k] = v
+			}
+		}
+		return meta
+	}
+	link := func(from, to int64, typ string) error {
+		if from == 0 || to == 0 {
+			return nil
+		}
+		_, err := a.links.Add(ctx, MemoryLink{From: from, To: to, Type: typ, CreatedAt: time.Now().UTC()})
+		return err
+	}
+
+	entities := map[string]int64{} // entity key -> record
+	for _, e := range ex.Entities {
+		key := entityKey(e.Name)
+		meta := base(kindEntity)
+		meta["entity"] = e.Name
+		if e.Type != "" {
+			meta["entity_type"] = e.Type
+		}
+		id, created, err := a.storeExtracted(ctx, rec.SessionID, e.Name, meta, entityMatch(key))
+		if err != nil {
+			return res, err
+		}
+		entities[key] = id
+		if created {
+			res.Entities = append(res.Entities, id)
+			if err := link(id, rec.ID, linkMentionedIn); err != nil {
+				return res, err
+			}
+		}
+	}
+	// entity resolves a fact's object, which may name an entity the
+	// session has but this extraction did not list.
+	entity := func(name string) (int64, error) {
+		key := entityKey(name)
+		if id, ok := entities[key]; ok {
+			return id, nil
+		}
+		emb, err := a.embed(ctx, name)
+		if err != nil {
+			return 0, err
+		}
+		found, err := a.findExtracted(ctx, rec.SessionID, emb, entityMatch(key))
+		if err != nil {
+			return 0, err
+		}
+		entities[key] = found.ID
+		return found.ID, nil
+	}
+
+	known := map[string]bool{}
+	for _, f := range ex.Facts {
+		key := factKey(f.Subject, f.Predicate, f.Object)
+		if known[key] {
+			continue
+		}
+		known[key] = true
+		meta := base(kindFact)
+		meta["subject"], meta["predicate"], meta["object"] = f.Subject, f.Predicate, f.Object
+		content := f.Subject + " " + strings.ReplaceAll(f.Predicate, "_", " ") + " " + f.Object
+		id, created, err := a.storeExtracted(ctx, rec.SessionID, content, meta, func(m map[string]any) bool {
+			return m[metaKind] == kindFact && factKey(fmt.Sprint(m["subject"]), fmt.Sprint(m["predicate"]), fmt.Sprint(m["object"])) == key
+		})
+		if err != nil {
+			return res, err
+		}
+		if !created {
+			continue
+		}
+		res.Facts = append(res.Facts, id)
+		if err := link(id, rec.ID, linkDerivedFrom); err != nil {
+			return res, err
+		}
+		for _, name := range []string{f.Subject, f.Object} {
+			to, err := entity(name)
+			if err != nil {
+				return res, err
+			}
+			if err := link(id, to, linkAbout); err != nil {
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// extractLookupLimit is how many nearest records extraction searches for
+// an entity or fact the session already has; other sessions' records of
+// the same name share its vector, so searchKeeping oversamples past them.
+const extractLookupLimit = 16
+
+// entityMatch matches the entity record for key.
+func entityMatch(key string) func(map[string]any) bool {
+	return func(meta map[string]any) bool {
+		return meta[metaKind] == kindEntity && entityKey(fmt.Sprint(meta["entity"])) == key
+	}
+}
+
+// findExtracted searches near emb for the session's current record whose
+// metadata matches; the ID is zero when there is none.
+func (a *App) findExtracted(ctx context.Context, session string, emb []float32, match func(map[string]any) bool) (model.MemoryRecord, error) {
+	hits, err := searchKeeping(ctx, a.bank.Store, emb, extractLookupLimit, func(r model.MemoryRecord) bool {
+		return r.SessionID == session && match(model.DecodeMetadata(r.Metadata))
+	})
+	if err != nil || len(hits) == 0 {
+		return model.MemoryRecord{}, err
+	}
+	return hits[0], nil
+}
+
+// storeExtracted returns the session's record matching match, or embeds
+// and stores content with meta when there is none, reporting whether it
+// did. It bypasses the engine's near-duplicate check so each fact gets a
+// record of its own.
+func (a *App) storeExtracted(ctx context.Context, session, content string, meta map[string]any, match func(map[string]any) bool) (int64, bool, error) {
+	emb, err := a.embed(ctx, content)
+	if err != nil {
+		return 0, false, err
+	}
+	found, err := a.findExtracted(ctx, session, emb, match)
+	if err != nil || found.ID != 0 {
+		return found.ID, false, err
+	}
+	if err := a.quotas.checkCapacity(ownerOf(session, meta), 1, len(content)); err != nil {
+		return 0, false, err
+	}
+	if err := a.bank.Store.StoreMemory(ctx, session, content, meta, emb); err != nil {
+		return 0, false, err
+	}
+	// StoreMemory does not return the ID; search for the record just
+	// written by its vector and extraction batch.
+	batch := meta["extraction"]
+	found, err = a.findExtracted(ctx, session, emb, func(m map[string]any) bool {
+		return m["extraction"] == batch && match(m)
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if found.ID == 0 {
+		return 0, false, fmt.Errorf("stored %s %q could not be found", meta[metaKind], content)
+	}
+	return found.ID, true, nil
+}
+
+// factQueueSize bounds the background extractions waiting for the fact
+// worker; store_long and flush skip extraction, with a warning, when it
+// is full.
+const factQueueSize = 256
+
+// factJob is one background extraction: rec, or the session's records
+// created at or after since.
+type factJob struct {
+	ctx     context.Context
+	session string
+	since   time.Time
+	rec     *model.MemoryRecord
+}
+
+// FactQueueStats is reported under engine.metrics.
+type FactQueueStats struct {
+	Pending   int   `json:"pending"`
+	Capacity  int   `json:"capacity"`
+	Queued    int64 `json:"queued"`
+	Completed int64 `json:"completed"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`
+}
+
+// factQueue feeds background extractions to a single worker, so a burst
+// of writes waits for the model instead of calling it all at once.
+type factQueue struct {
+	jobs chan factJob
+
+	queued    atomic.Int64
+	completed atomic.Int64
+	failed    atomic.Int64
+	dropped   atomic.Int64
+}
+
+func newFactQueue(capacity int) *factQueue {
+	return &factQueue{jobs: make(chan factJob, capacity)}
+}
+
+// push queues job, reporting false when the queue is full.
+func (q *factQueue) push(job factJob) bool {
+	select {
+	case q.jobs <- job:
+		q.queued.Add(1)
+		return true
+	default:
+		q.dropped.Add(1)
+		return false
+	}
+}
+
+func (q *factQueue) Stats() FactQueueStats {
+	if q == nil {
+		return FactQueueStats{}
+	}
+	return FactQueueStats{
+		Pending:   len(q.jobs),
+		Capacity:  cap(q.jobs),
+		Queued:    q.queued.Load(),
+		Completed: q.completed.Load(),
+		Failed:    q.failed.Load(),
+		Dropped:   q.dropped.Load(),
+	}
+}
+
+// extractInBackground queues extractFacts on the session's records
+// created at or after since (all of rec if given); the fact worker logs
+// the outcome. It is how store_long and flush extract without waiting on
+// the model.
+func (a *App) extractInBackground(ctx context.Context, session string, since time.Time, rec *model.MemoryRecord) {
+	job := factJob{ctx: context.WithoutCancel(ctx), session: session, since: since, rec: rec}
+	if !a.factQueue.push(job) {
+		logger(ctx).Warn("fact extraction skipped, queue is full", "session_id", session)
+	}
+}
+
+// runFactWorker serves the fact queue until ctx is done.
+func (a *App) runFactWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-a.factQueue.jobs:
+			a.runFactJob(job)
+		}
+	}
+}
+
+func (a *App) runFactJob(job factJob) {
+	ctx, session := job.ctx, job.session
+	var recs []model.MemoryRecord
+	if job.rec != nil {
+		recs = []model.MemoryRecord{*job.rec}
+	} else {
+		all, err := a.sessionRecords(ctx, session)
+		if err != nil {
+			a.factQueue.failed.Add(1)
+			logger(ctx).Warn("fact extraction failed", "session_id", session, "error", err)
+			return
+		}
+		for _, r := range all {
+			if !r.CreatedAt.Before(job.since) && !isExtracted(model.DecodeMetadata(r.Metadata)) {
+				recs = append(recs, r)
+			}
+		}
+	}
+	failed := false
+	for _, r := range recs {
+		res, err := a.extractFacts(ctx, r)
+		if err != nil {
+			failed = true
+			logger(ctx).Warn("fact extraction failed", "session_id", session, "record_id", r.ID, "error", err)
+			continue
+		}
+		logger(ctx).Info("facts extracted", "session_id", session, "record_id", r.ID,
+			"entities", len(res.Entities), "facts", len(res.Facts))
+	}
+	if failed {
+		a.factQueue.failed.Add(1)
+	} else {
+		a.factQueue.completed.Add(1)
+	}
+}
+
+// StoredFact is one memory.facts result.
+type StoredFact struct {
+	ID        int64     `json:"id"`
+	SessionID string    `json:"session_id"`
+	Subject   string    `json:"subject"`
+	Predicate string    `json:"predicate"`
+	Object    string    `json:"object"`
+	Source    int64     `json:"source_record,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// queryFacts returns the current facts whose subject or object is entity,
+// optionally only with predicate, newest first. Only the fact records
+// visible keeps are returned.
+func (a *App) queryFacts(ctx context.Context, entity, predicate string, visible func(model.MemoryRecord) bool, limit int) ([]StoredFact, error) {
+	key := entityKey(entity)
+	predicate = strings.Join(strings.Fields(strings.ToLower(predicate)), "_")
+	out := []StoredFact{}
+	err := a.bank.Store.Iterate(ctx, func(r model.MemoryRecord) bool {
+		meta := model.DecodeMetadata(r.Metadata)
+		if meta[metaKind] != kindFact || a.versions.superseded(r.ID) {
+			return true
+		}
+		f := StoredFact{
+			ID:        r.ID,
+			SessionID: r.SessionID,
+			Subject:   fmt.Sprint(meta["subject"]),
+			Predicate: fmt.Sprint(meta["predicate"]),
+			Object:    fmt.Sprint(meta["object"]),
+			CreatedAt: r.CreatedAt,
+		}
+		if entityKey(f.Subject) != key && entityKey(f.Object) != key {
+			return true
+		}
+		if predicate != "" && f.Predicate != predicate {
+			return true
+		}
+		if !visible(r) {
+			return true
+		}
+		if id, ok := meta["source_record"].(float64); ok {
+			f.Source = int64(id)
+		}
+		out = append(out, f)
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, err
+}
+
+func registerFactTools(s *server.MCPServer, app *App) {
+	extractTool := mcp.NewTool("memory.extract",
+		mcp.WithDescription("Extract entities and subject-predicate-object facts from a stored record and store them as linked records"),
+		mcp.WithNumber("id", mcp.Required(), mcp.Description("Source record ID")),
+		mcp.WithString("session_id", mcp.Required(), mcp.Description("Session the caller works in; the record must belong to it or to a space the principal can read")),
+		mcp.WithString("principal", mcp.Description("Must be a writer of the record's space or the owner of its session")),
+	)
+	s.AddTool(extractTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		id, err := req.RequireFloat("id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing id: %v", err)), nil
+		}
+		session, err := req.RequireString("session_id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session_id: %v", err)), nil
+		}
+		principal := strings.TrimSpace(getStringParam(req, "principal"))
+		found, err := app.visibleRecords(ctx, session, principal, int64(id))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		rec := found[app.currentID(int64(id))]
+		if err := app.checkRecordEditor(rec, principal); err != nil {
+			return toolError(err), nil
+		}
+		res, err := app.extractFacts(ctx, rec)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(res)
+	})
+
+	factsTool := mcp.NewTool("memory.facts",
+		mcp.WithDescription("List the extracted facts about an entity, newest first"),
+		mcp.WithString("entity", mcp.Required(), mcp.Description("Entity name, matched ignoring case and spacing")),
+		mcp.WithString("session_id", mcp.Required(), mcp.Description("Session the caller reads from; only its facts and those of spaces the principal can read are returned")),
+		mcp.WithString("principal", mcp.Description("Caller, for facts of shared spaces")),
+		mcp.WithString("predicate", mcp.Description("Only facts with this predicate, e.g. depends_on")),
+		mcp.WithNumber("limit", mcp.Description("Maximum facts to return (default 50)")),
+	)
+	s.AddTool(factsTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		entity, err := req.RequireString("entity")
+		if err != nil || strings.TrimSpace(entity) == "" {
+			return mcp.NewToolResultError("missing entity"), nil
+		}
+		session, err := req.RequireString("session_id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session_id: %v", err)), nil
+		}
+		principal := strings.TrimSpace(getStringParam(req, "principal"))
+		visible := func(rec model.MemoryRecord) bool { return app.linkVisible(rec, session, principal) }
+		limit := int(req.GetInt("limit", 50))
+		facts, err := app.queryFacts(ctx, entity, getStringParam(req, "predicate"), visible, limit)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(map[string]any{"entity": strings.TrimSpace(entity), "facts": facts})
+	})
+}
@@ -0,0 +1,160 @@
+// facts_test.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func TestExtractFactsReusesSessionEntities(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+
+	src := mustStore(t, app, "s1", "billing uses Postgres", nil)
+	res, err := app.extractFacts(ctx, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Facts) != 1 || len(res.Entities) != 2 {
+		t.Fatalf("first extraction stored %d facts and %d entities, want 1 and 2", len(res.Facts), len(res.Entities))
+	}
+	postgres := idOf(t, app, "s1", "Postgres")
+	links, err := app.links.Links(ctx, res.Facts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]int{}
+	for _, l := range links {
+		types[l.Type]++
+		if l.Type == linkAbout && l.To != postgres && l.To != idOf(t, app, "s1", "billing") {
+			t.Errorf("fact is about %d, not an entity of the session", l.To)
+		}
+	}
+	if types[linkDerivedFrom] != 1 || types[linkAbout] != 2 {
+		t.Errorf("fact links = %v, want one derived_from and two about", types)
+	}
+
+	// Postgres is reused; the same fact is not stored twice.
+	other := mustStore(t, app, "s1", "search uses Postgres. billing uses Postgres", nil)
+	res, err = app.extractFacts(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Facts) != 1 || len(res.Entities) != 1 {
+		t.Fatalf("second extraction stored %d facts and %d entities, want 1 and 1", len(res.Facts), len(res.Entities))
+	}
+	links, err = app.links.Links(ctx, res.Facts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, l := range links {
+		found = found || (l.Type == linkAbout && l.To == postgres)
+	}
+	if !found {
+		t.Error("new fact is not linked about the existing Postgres entity")
+	}
+
+	// Another session gets entities of its own.
+	res, err = app.extractFacts(ctx, mustStore(t, app, "s2", "ledger runs on Postgres", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Facts) != 1 || len(res.Entities) != 2 {
+		t.Fatalf("other session stored %d facts and %d entities, want 1 and 2", len(res.Facts), len(res.Entities))
+	}
+}
+
+func TestFactQueueIsBounded(t *testing.T) {
+	q := newFactQueue(2)
+	for i := 0; i < 3; i++ {
+		if ok := q.push(factJob{session: "s1"}); ok != (i < 2) {
+			t.Fatalf("push %d = %v", i, ok)
+		}
+	}
+	if st := q.Stats(); st.Pending != 2 || st.Queued != 2 || st.Dropped != 1 {
+		t.Fatalf("stats = %+v, want 2 pending, 2 queued and 1 dropped", st)
+	}
+}
+
+func TestExtractInBackgroundRunsOnWorker(t *testing.T) {
+	app := newTestApp(t, nil)
+	rec := mustStore(t, app, "s1", "billing depends on ledger", nil)
+	app.extractInBackground(context.Background(), "s1", time.Time{}, &rec)
+	deadline := time.Now().Add(5 * time.Second)
+	for app.factQueue.Stats().Completed == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("extraction did not complete: %+v", app.factQueue.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	idOf(t, app, "s1", "billing depends on ledger")
+	idOf(t, app, "s1", "ledger")
+}
+
+func TestLLMModelDefaultsPerProvider(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("LLM_MODEL", "")
+	settings, err := loadGeminiSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for provider, want := range map[string]string{"gemini": "gemini-2.5-flash", "openai": "gpt-4o-mini", "ollama": "llama3.1"} {
+		settings.LLMProvider = provider
+		t.Setenv("LLM_PROVIDER", provider)
+		if got := llmSettingsFrom(settings).model(); got != want {
+			t.Errorf("%s model = %q, want %q", provider, got, want)
+		}
+	}
+	if got := (LLMSettings{Provider: "openai", Model: "gpt-4.1"}).model(); got != "gpt-4.1" {
+		t.Errorf("configured model = %q, want gpt-4.1", got)
+	}
+}
+
+func TestFactToolsCheckAccess(t *testing.T) {
+	app := newTestApp(t, nil)
+	owned, err := app.sessions.create("proj", SessionInfo{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := mustStore(t, app, owned.ID, "billing uses Postgres", nil)
+
+	extract := func(session, principal string) *mcp.CallToolResult {
+		return callTool(t, app, registerFactTools, "memory.extract", map[string]any{
+			"id": float64(src.ID), "session_id": session, "principal": principal,
+		})
+	}
+	if res := extract("s2", "mallory"); !res.IsError {
+		t.Fatal("extracted from a record of another session")
+	}
+	if res := extract(owned.ID, "mallory"); !res.IsError {
+		t.Fatal("mallory extracted from alice's record")
+	}
+	if res := extract(owned.ID, "alice"); res.IsError {
+		t.Fatalf("the owner alice could not extract: %v", res.Content)
+	}
+
+	facts := func(session string) []StoredFact {
+		res := callTool(t, app, registerFactTools, "memory.facts", map[string]any{"entity": "Postgres", "session_id": session})
+		if res.IsError {
+			t.Fatalf("memory.facts failed: %v", res.Content)
+		}
+		var out struct {
+			Facts []StoredFact `json:"facts"`
+		}
+		if err := json.Unmarshal([]byte(res.Content[0].(mcp.TextContent).Text), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Facts
+	}
+	if got := facts(owned.ID); len(got) != 1 {
+		t.Fatalf("facts of the session = %+v, want 1", got)
+	}
+	if got := facts("s2"); len(got) != 0 {
+		t.Fatalf("another session read facts %+v", got)
+	}
+}
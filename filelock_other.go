@@ -0,0 +1,10 @@
+//go:build !unix
+
+// filelock_other.go
+package main
+
+// lockFile is a no-op where flock is not available; server processes
+// sharing a state directory are then not kept apart.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,350 @@
+// groups.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// groupPrefix marks a group in a space ACL: granting "group:eng" a role
+// gives it to every current member of eng.
+const groupPrefix = "group:"
+
+// groupMember is one membership; a zero ExpiresAt never expires.
+type groupMember struct {
+	Admin     bool      `json:"admin,omitempty"`
+	AddedAt   time.Time `json:"added_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// Group is the groups.list payload entry.
+type Group struct {
+	Name      string                 `json:"name"`
+	CreatedAt time.Time              `json:"created_at"`
+	Members   map[string]groupMember `json:"members"`
+}
+
+// groupDirectory holds named groups of principals. Group admins manage
+// membership; the creator is the first admin. Groups are kept in
+// groups.json so "group:" grants in the space catalog keep resolving
+// after a restart.
+type groupDirectory struct {
+	mu     sync.Mutex
+	path   string
+	groups map[string]*Group
+}
+
+// newGroupDirectory loads dir/groups.json, if there is one.
+func newGroupDirectory(dir string) (*groupDirectory, error) {
+	d := &groupDirectory{path: filepath.Join(dir, "groups.json"), groups: make(map[string]*Group)}
+	data, err := os.ReadFile(d.path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read groups: %w", err)
+	}
+	if err := json.Unmarshal(data, &d.groups); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", d.path, err)
+	}
+	for name, g := range d.groups {
+		g.Name = name
+		if g.Members == nil {
+			g.Members = map[string]groupMember{}
+		}
+	}
+	return d, nil
+}
+
+// saveLocked writes the directory; d.mu must be held. Like the space
+// catalog, a failed write is logged rather than undone.
+func (d *groupDirectory) saveLocked() {
+	if d.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(d.groups, "", "  ")
+	if err == nil {
+		tmp := d.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, d.path)
+		}
+	}
+	if err != nil {
+		slog.Error("failed to write groups", "path", d.path, "error", err)
+	}
+}
+
+func validGroupName(name string) error {
+	if name == "" || name != strings.TrimSpace(name) || strings.ContainsAny(name, ":/") {
+		return fmt.Errorf("invalid group name %q: must be non-empty without ':' or '/'", name)
+	}
+	return nil
+}
+
+func (d *groupDirectory) create(name, creator string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.groups[name] != nil {
+		return fmt.Errorf("group %q already exists", name)
+	}
+	now := time.Now().UTC()
+	d.groups[name] = &Group{Name: name, CreatedAt: now, Members: map[string]groupMember{
+		creator: {Admin: true, AddedAt: now},
+	}}
+	d.saveLocked()
+	return nil
+}
+
+// isAdmin reports whether principal is a current admin of name.
+func (d *groupDirectory) isAdmin(name, principal string) (exists, admin bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	g := d.groups[name]
+	if g == nil {
+		return false, false
+	}
+	m, ok := g.Members[principal]
+	return true, ok && m.Admin && !membershipExpired(m, time.Now())
+}
+
+func (d *groupDirectory) add(name, principal string, admin bool, ttl time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := groupMember{Admin: admin, AddedAt: time.Now().UTC()}
+	if ttl > 0 {
+		m.ExpiresAt = m.AddedAt.Add(ttl)
+	}
+	d.groups[name].Members[principal] = m
+	d.saveLocked()
+}
+
+func (d *groupDirectory) remove(name, principal string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	g := d.groups[name]
+	if g == nil {
+		return false
+	}
+	if _, ok := g.Members[principal]; !ok {
+		return false
+	}
+	delete(g.Members, principal)
+	d.saveLocked()
+	return true
+}
+
+func membershipExpired(m groupMember, now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
+
+// members returns the current members of name.
+func (d *groupDirectory) members(name string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	g := d.groups[name]
+	if g == nil {
+		return nil
+	}
+	now := time.Now()
+	out := make([]string, 0, len(g.Members))
+	for p, m := range g.Members {
+		if !membershipExpired(m, now) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// list returns every group, or only those principal belongs to.
+func (d *groupDirectory) list(principal string) []Group {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := []Group{}
+	for _, g := range d.groups {
+		if _, ok := g.Members[principal]; principal != "" && !ok {
+			continue
+		}
+		cp := *g
+		cp.Members = make(map[string]groupMember, len(g.Members))
+		for p, m := range g.Members {
+			cp.Members[p] = m
+		}
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// pruneExpired drops lapsed memberships and reports whether any changed.
+func (d *groupDirectory) pruneExpired(now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := false
+	for _, g := range d.groups {
+		for p, m := range g.Members {
+			if membershipExpired(m, now) {
+				delete(g.Members, p)
+				slog.Info("group membership expired", "group", g.Name, "principal", p)
+				changed = true
+			}
+		}
+	}
+	if changed {
+		d.saveLocked()
+	}
+	return changed
+}
+
+// checkACLPrincipal rejects grants to groups that do not exist.
+func (a *App) checkACLPrincipal(p string) error {
+	name, ok := strings.CutPrefix(p, groupPrefix)
+	if !ok {
+		return nil
+	}
+	if exists, _ := a.groups.isAdmin(name, ""); !exists {
+		return fmt.Errorf("unknown group %q", name)
+	}
+	return nil
+}
+
+// resolveACL expands group entries of an effective ACL into their members.
+// Roles from a principal's own entry and its groups add up: the highest
+// one wins.
+func (a *App) resolveACL(eff map[string]effectiveGrant) map[string]memory.SpaceRole {
+	acl := make(map[string]memory.SpaceRole, len(eff))
+	raise := func(p string, role memory.SpaceRole) {
+		if roleRank[role] > roleRank[acl[p]] {
+			acl[p] = role
+		}
+	}
+	for key, g := range eff {
+		if name, ok := strings.CutPrefix(key, groupPrefix); ok {
+			for _, m := range a.groups.members(name) {
+				raise(m, g.Role)
+			}
+			continue
+		}
+		raise(key, g.Role)
+	}
+	return acl
+}
+
+func registerGroupTools(s *server.MCPServer, app *App) {
+	createTool := mcp.NewTool("groups.create",
+		mcp.WithDescription("Create a group of principals; the creator becomes its admin"),
+		mcp.WithString("name", mcp.Required()),
+		mcp.WithString("principal", mcp.Required(), mcp.Description("Creator")),
+	)
+	s.AddTool(createTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		name, err := req.RequireString("name")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing name: %v", err)), nil
+		}
+		principal, err := req.RequireString("principal")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err)), nil
+		}
+		if err := validGroupName(name); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if err := app.groups.create(name, strings.TrimSpace(principal)); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultText("ok"), nil
+	})
+
+	addTool := mcp.NewTool("groups.add",
+		mcp.WithDescription("Add a principal to a group, optionally for a limited time"),
+		mcp.WithString("name", mcp.Required()),
+		mcp.WithString("caller", mcp.Required(), mcp.Description("Must be an admin of the group")),
+		mcp.WithString("principal", mcp.Required()),
+		mcp.WithBoolean("admin", mcp.Description("Let the member manage the group")),
+		mcp.WithNumber("ttl_seconds", mcp.Description("Membership expires after this many seconds")),
+	)
+	s.AddTool(addTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		name, principal, res := groupMemberArgs(req, app)
+		if res != nil {
+			return res, nil
+		}
+		if strings.HasPrefix(principal, groupPrefix) {
+			return mcp.NewToolResultError("groups cannot contain groups"), nil
+		}
+		ttl := time.Duration(getNumberParam(req, "ttl_seconds") * float64(time.Second))
+		app.groups.add(name, principal, req.GetBool("admin", false), ttl)
+		app.syncAllSpaceACLs()
+		return mcp.NewToolResultText("ok"), nil
+	})
+
+	removeTool := mcp.NewTool("groups.remove",
+		mcp.WithDescription("Remove a principal from a group"),
+		mcp.WithString("name", mcp.Required()),
+		mcp.WithString("caller", mcp.Required(), mcp.Description("Must be an admin of the group")),
+		mcp.WithString("principal", mcp.Required()),
+	)
+	s.AddTool(removeTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		name, principal, res := groupMemberArgs(req, app)
+		if res != nil {
+			return res, nil
+		}
+		if !app.groups.remove(name, principal) {
+			return mcp.NewToolResultError(fmt.Sprintf("%q is not a member of group %q", principal, name)), nil
+		}
+		app.syncAllSpaceACLs()
+		return mcp.NewToolResultText("ok"), nil
+	})
+
+	listTool := mcp.NewTool("groups.list",
+		mcp.WithDescription("List groups with their members, or only the groups a principal belongs to"),
+		mcp.WithString("caller", mcp.Required(), mcp.Description("Must be a server admin")),
+		mcp.WithString("principal"),
+	)
+	s.AddTool(listTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		if err := app.requireAdmin(getStringParam(req, "caller")); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(app.groups.list(strings.TrimSpace(getStringParam(req, "principal"))))
+	})
+}
+
+// groupMemberArgs reads name/caller/principal and checks that caller
+// administers the group.
+func groupMemberArgs(req mcp.CallToolRequest, app *App) (name, principal string, res *mcp.CallToolResult) {
+	name, err := req.RequireString("name")
+	if err != nil {
+		return "", "", mcp.NewToolResultError(fmt.Sprintf("missing name: %v", err))
+	}
+	caller, err := req.RequireString("caller")
+	if err != nil {
+		return "", "", mcp.NewToolResultError(fmt.Sprintf("missing caller: %v", err))
+	}
+	principal, err = req.RequireString("principal")
+	if err != nil {
+		return "", "", mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err))
+	}
+	caller, principal = strings.TrimSpace(caller), strings.TrimSpace(principal)
+	exists, admin := app.groups.isAdmin(name, caller)
+	if !exists {
+		return "", "", mcp.NewToolResultError(fmt.Sprintf("unknown group %q", name))
+	}
+	if !admin {
+		return "", "", mcp.NewToolResultError(fmt.Sprintf("permission denied: %q is not an admin of group %q", caller, name))
+	}
+	return name, principal, nil
+}
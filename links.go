@@ -0,0 +1,882 @@
+// links.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// maxLinkHops bounds neighbor walks and retrieval expansion.
+const maxLinkHops = 3
+
+var linkTypeRe = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,63}$`)
+
+// MemoryLink is a typed, directed edge between two records, e.g.
+// 12 -supersedes-> 7 or 31 -caused_by-> 4.
+type MemoryLink struct {
+	From      int64     `json:"from" bson:"from"`
+	To        int64     `json:"to" bson:"to"`
+	Type      string    `json:"type" bson:"type"`
+	Principal string    `json:"principal,omitempty" bson:"principal,omitempty"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// linkStore persists links next to the records: a table for Postgres, a
+// collection for Mongo, the point payload for Qdrant and links.json in the
+// state directory for the in-memory store.
+type linkStore interface {
+	// Add stores l and reports false if an identical link exists.
+	Add(ctx context.Context, l MemoryLink) (bool, error)
+	// Remove deletes the links from -> to of type typ, or of any type if
+	// typ is empty, and returns how many it deleted.
+	Remove(ctx context.Context, from, to int64, typ string) (int, error)
+	// Links returns every link that starts or ends at one of ids.
+	Links(ctx context.Context, ids []int64) ([]MemoryLink, error)
+}
+
+// fileLinks keeps links in links.json for stores without a place for
+// them.
+type fileLinks struct {
+	mu    sync.Mutex
+	path  string
+	links []MemoryLink
+}
+
+func newFileLinks(dir string) (*fileLinks, error) {
+	fl := &fileLinks{path: filepath.Join(dir, "links.json")}
+	data, err := os.ReadFile(fl.path)
+	if os.IsNotExist(err) {
+		return fl, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read links: %w", err)
+	}
+	if err := json.Unmarshal(data, &fl.links); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", fl.path, err)
+	}
+	return fl, nil
+}
+
+// save writes the links; fl.mu must be held.
+func (fl *fileLinks) save() error {
+	data, err := json.MarshalIndent(fl.links, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fl.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write links: %w", err)
+	}
+	return os.Rename(tmp, fl.path)
+}
+
+func (fl *fileLinks) Add(_ context.Context, l MemoryLink) (bool, error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	for _, x := range fl.links {
+		if x.From == l.From && x.To == l.To && x.Type == l.Type {
+			return false, nil
+		}
+	}
+	fl.links = append(fl.links, l)
+	return true, fl.save()
+}
+
+func (fl *fileLinks) Remove(_ context.Context, from, to int64, typ string) (int, error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	kept := fl.links[:0]
+	for _, x := range fl.links {
+		if x.From != from || x.To != to || (typ != "" && x.Type != typ) {
+			kept = append(kept, x)
+		}
+	}
+	n := len(fl.links) - len(kept)
+	fl.links = kept
+	if n == 0 {
+		return 0, nil
+	}
+	return n, fl.save()
+}
+
+func (fl *fileLinks) Links(_ context.Context, ids []int64) ([]MemoryLink, error) {
+	want := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	var out []MemoryLink
+	for _, x := range fl.links {
+		if want[x.From] || want[x.To] {
+			out = append(out, x)
+		}
+	}
+	return out, nil
+}
+
+// pgLinks keeps links in the memory_links table, in the tenant's schema
+// when the store has one.
+type pgLinks struct {
+	db *pgxpool.Pool
+}
+
+func newPGLinks(ctx context.Context, db *pgxpool.Pool) (*pgLinks, error) {
+	_, err := db.Exec(ctx, `
+CREATE TABLE IF NOT EXISTS memory_links (
+	from_id    BIGINT NOT NULL,
+	to_id      BIGINT NOT NULL,
+	link_type  TEXT NOT NULL,
+	principal  TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (from_id, to_id, link_type)
+);
+CREATE INDEX IF NOT EXISTS memory_links_to_idx ON memory_links (to_id);`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create memory_links: %w", err)
+	}
+	return &pgLinks{db: db}, nil
+}
+
+func (pl *pgLinks) Add(ctx context.Context, l MemoryLink) (bool, error) {
+	tag, err := pl.db.Exec(ctx,
+		`INSERT INTO memory_links (from_id, to_id, link_type, principal, created_at)
+		 VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`,
+		l.From, l.To, l.Type, l.Principal, l.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (pl *pgLinks) Remove(ctx context.Context, from, to int64, typ string) (int, error) {
+	tag, err := pl.db.Exec(ctx,
+		`DELETE FROM memory_links WHERE from_id = $1 AND to_id = $2 AND ($3 = '' OR link_type = $3)`,
+		from, to, typ)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (pl *pgLinks) Links(ctx context.Context, ids []int64) ([]MemoryLink, error) {
+	rows, err := pl.db.Query(ctx,
+		`SELECT from_id, to_id, link_type, principal, created_at FROM memory_links
+		 WHERE from_id = ANY($1) OR to_id = ANY($1) ORDER BY created_at`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []MemoryLink
+	for rows.Next() {
+		var l MemoryLink
+		if err := rows.Scan(&l.From, &l.To, &l.Type, &l.Principal, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+// mongoLinks keeps links in a <collection>_links collection next to the
+// records.
+type mongoLinks struct {
+	col *mongo.Collection
+}
+
+func newMongoLinks(ctx context.Context, uri, database, collection string) (*mongoLinks, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+	col := client.Database(database).Collection(collection + "_links")
+	_, err = col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "from", Value: 1}, {Key: "to", Value: 1}, {Key: "type", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "to", Value: 1}}},
+	})
+	if err != nil {
+		_ = client.Disconnect(ctx)
+		return nil, fmt.Errorf("failed to index %s_links: %w", collection, err)
+	}
+	// The store keeps its own client private, so this one is closed with
+	// the tenant.
+	context.AfterFunc(ctx, func() {
+		dctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = client.Disconnect(dctx)
+	})
+	return &mongoLinks{col: col}, nil
+}
+
+func (ml *mongoLinks) Add(ctx context.Context, l MemoryLink) (bool, error) {
+	res, err := ml.col.UpdateOne(ctx,
+		bson.M{"from": l.From, "to": l.To, "type": l.Type},
+		bson.M{"$setOnInsert": l},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount > 0, nil
+}
+
+func (ml *mongoLinks) Remove(ctx context.Context, from, to int64, typ string) (int, error) {
+	filter := bson.M{"from": from, "to": to}
+	if typ != "" {
+		filter["type"] = typ
+	}
+	res, err := ml.col.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+func (ml *mongoLinks) Links(ctx context.Context, ids []int64) ([]MemoryLink, error) {
+	cur, err := ml.col.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"from": bson.M{"$in": ids}},
+		bson.M{"to": bson.M{"$in": ids}},
+	}}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var out []MemoryLink
+	if err := cur.All(ctx, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// qdrantLinks keeps each record's outgoing links in its point's payload,
+// so they live and die with the point. The IDs they point to are also
+// kept in memory_link_targets, which incoming links are filtered on.
+type qdrantLinks struct {
+	mu         sync.Mutex // serialises read-modify-write of a point's links
+	baseURL    string
+	collection string
+	apiKey     string
+	http       *http.Client
+}
+
+const (
+	qdrantLinksKey   = "memory_links"
+	qdrantTargetsKey = "memory_link_targets"
+)
+
+type qdrantLinkPoint struct {
+	ID      int64 `json:"id"`
+	Payload struct {
+		Links []MemoryLink `json:"memory_links"`
+	} `json:"payload"`
+}
+
+func newQdrantLinks(baseURL, collection, apiKey string) *qdrantLinks {
+	return &qdrantLinks{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		collection: collection,
+		apiKey:     apiKey,
+		http:       &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// call posts body to the collection's path and decodes the result field
+// of the response into out.
+func (ql *qdrantLinks) call(ctx context.Context, path string, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := ql.baseURL + "/collections/" + url.PathEscape(ql.collection) + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ql.apiKey != "" {
+		req.Header.Set("api-key", ql.apiKey)
+	}
+	resp, err := ql.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err = io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("qdrant %s: %s: %s", path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	var env struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return fmt.Errorf("qdrant %s: bad response: %w", path, err)
+	}
+	return json.Unmarshal(env.Result, out)
+}
+
+// outgoing returns the links stored on the points ids.
+func (ql *qdrantLinks) outgoing(ctx context.Context, ids []int64) ([]qdrantLinkPoint, error) {
+	var points []qdrantLinkPoint
+	err := ql.call(ctx, "/points", map[string]any{"ids": ids, "with_payload": []string{qdrantLinksKey}, "with_vector": false}, &points)
+	return points, err
+}
+
+// setLinks replaces the links stored on point id; ql.mu must be held.
+func (ql *qdrantLinks) setLinks(ctx context.Context, id int64, links []MemoryLink) error {
+	targets := make([]int64, 0, len(links))
+	for _, l := range links {
+		if !slices.Contains(targets, l.To) {
+			targets = append(targets, l.To)
+		}
+	}
+	return ql.call(ctx, "/points/payload?wait=true", map[string]any{
+		"points":  []int64{id},
+		"payload": map[string]any{qdrantLinksKey: links, qdrantTargetsKey: targets},
+	}, nil)
+}
+
+func (ql *qdrantLinks) Add(ctx context.Context, l MemoryLink) (bool, error) {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	points, err := ql.outgoing(ctx, []int64{l.From})
+	if err != nil {
+		return false, err
+	}
+	if len(points) == 0 {
+		return false, fmt.Errorf("record %d not found", l.From)
+	}
+	links := points[0].Payload.Links
+	for _, x := range links {
+		if x.To == l.To && x.Type == l.Type {
+			return false, nil
+		}
+	}
+	return true, ql.setLinks(ctx, l.From, append(links, l))
+}
+
+func (ql *qdrantLinks) Remove(ctx context.Context, from, to int64, typ string) (int, error) {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	points, err := ql.outgoing(ctx, []int64{from})
+	if err != nil || len(points) == 0 {
+		return 0, err
+	}
+	links := points[0].Payload.Links
+	kept := links[:0:0]
+	for _, x := range links {
+		if x.To != to || (typ != "" && x.Type != typ) {
+			kept = append(kept, x)
+		}
+	}
+	n := len(links) - len(kept)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, ql.setLinks(ctx, from, kept)
+}
+
+func (ql *qdrantLinks) Links(ctx context.Context, ids []int64) ([]MemoryLink, error) {
+	want := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	type key struct {
+		from, to int64
+		typ      string
+	}
+	seen := map[key]bool{}
+	var out []MemoryLink
+	collect := func(points []qdrantLinkPoint) {
+		for _, p := range points {
+			for _, l := range p.Payload.Links {
+				k := key{l.From, l.To, l.Type}
+				if (want[l.From] || want[l.To]) && !seen[k] {
+					seen[k] = true
+					out = append(out, l)
+				}
+			}
+		}
+	}
+	points, err := ql.outgoing(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	collect(points)
+	// Incoming links are on other points; find them by target.
+	var offset any
+	for {
+		body := map[string]any{
+			"filter":       map[string]any{"must": []any{map[string]any{"key": qdrantTargetsKey, "match": map[string]any{"any": ids}}}},
+			"limit":        256,
+			"with_payload": []string{qdrantLinksKey},
+			"with_vector":  false,
+		}
+		if offset != nil {
+			body["offset"] = offset
+		}
+		var page struct {
+			Points []qdrantLinkPoint `json:"points"`
+			Next   any               `json:"next_page_offset"`
+		}
+		if err := ql.call(ctx, "/points/scroll", body, &page); err != nil {
+			return nil, err
+		}
+		collect(page.Points)
+		if page.Next == nil || len(page.Points) == 0 {
+			break
+		}
+		offset = page.Next
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+// Link directions for memory.neighbors and retrieval expansion.
+const (
+	linkOut  = "out"
+	linkIn   = "in"
+	linkBoth = "both"
+)
+
+// Neighbor is a record reached by following links. Direction is "out"
+// when Via links to it and "in" when it links to Via.
+type Neighbor struct {
+	ID        int64          `json:"id"`
+	SessionID string         `json:"session_id,omitempty"`
+	Content   string         `json:"content,omitempty"`
+	Metadata  map[string]any `json:"metadata,omitempty"`
+	Type      string         `json:"type"`
+	Direction string         `json:"direction"`
+	Via       int64          `json:"via"`
+	Hops      int            `json:"hops"`
+	Missing   bool           `json:"missing,omitempty"`
+
+	record model.MemoryRecord
+}
+
+// lineageIDs returns the IDs of every version of id's record; links made
+// to any version belong to the record.
+func (a *App) lineageIDs(id int64) []int64 {
+	_, refs := a.versions.lineage(id)
+	if len(refs) == 0 {
+		return []int64{id}
+	}
+	ids := make([]int64, len(refs))
+	for i, r := range refs {
+		ids[i] = r.ID
+	}
+	return ids
+}
+
+// currentID maps any version of a record to its latest version.
+func (a *App) currentID(id int64) int64 {
+	_, refs := a.versions.lineage(id)
+	if len(refs) == 0 {
+		return id
+	}
+	return refs[len(refs)-1].ID
+}
+
+// linkRecords links from to to, both mapped to their latest versions.
+func (a *App) linkRecords(ctx context.Context, from, to int64, typ, principal string) (MemoryLink, bool, error) {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	if !linkTypeRe.MatchString(typ) {
+		return MemoryLink{}, false, fmt.Errorf("invalid link type %q (want lowercase letters, digits, _ or -)", typ)
+	}
+	from, to = a.currentID(from), a.currentID(to)
+	if from == to {
+		return MemoryLink{}, false, errors.New("cannot link a record to itself")
+	}
+	found, err := a.findRecords(ctx, from, to)
+	if err != nil {
+		return MemoryLink{}, false, err
+	}
+	for _, id := range []int64{from, to} {
+		if _, ok := found[id]; !ok {
+			return MemoryLink{}, false, fmt.Errorf("record %d not found", id)
+		}
+	}
+	l := MemoryLink{From: from, To: to, Type: typ, Principal: principal, CreatedAt: time.Now().UTC()}
+	created, err := a.links.Add(ctx, l)
+	return l, created, err
+}
+
+// unlinkRecords removes the links from -> to of type typ (any type if
+// empty), whichever versions of the two records they were made on.
+func (a *App) unlinkRecords(ctx context.Context, from, to int64, typ string) (int, error) {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	removed := 0
+	for _, f := range a.lineageIDs(from) {
+		for _, t := range a.lineageIDs(to) {
+			n, err := a.links.Remove(ctx, f, t, typ)
+			if err != nil {
+				return removed, err
+			}
+			removed += n
+		}
+	}
+	return removed, nil
+}
+
+// visibleRecords returns the latest versions of ids, failing with "not
+// found" for any the caller reading session as principal cannot reach, so
+// the tools do not reveal records of other sessions.
+func (a *App) visibleRecords(ctx context.Context, session, principal string, ids ...int64) (map[int64]model.MemoryRecord, error) {
+	cur := make([]int64, len(ids))
+	for i, id := range ids {
+		cur[i] = a.currentID(id)
+	}
+	found, err := a.findRecords(ctx, cur...)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range cur {
+		if rec, ok := found[id]; !ok || !a.linkVisible(rec, session, principal) {
+			return nil, fmt.Errorf("record %d not found", ids[i])
+		}
+	}
+	return found, nil
+}
+
+// linkVisible reports whether a caller reading session as principal may
+// reach rec through a link: rec must not have expired and must belong to
+// session or to a space principal can read.
+func (a *App) linkVisible(rec model.MemoryRecord, session, principal string) bool {
+	if recordExpired(rec, time.Now()) {
+		return false
+	}
+	if rec.SessionID == session {
+		return true
+	}
+	space := recordSpace(rec)
+	if _, ok := a.catalog.get(space); !ok || principal == "" {
+		return false
+	}
+	return a.requireRole(space, principal, memory.SpaceRoleReader) == nil
+}
+
+// recordIDsOf returns the IDs of recs.
+func recordIDsOf(recs []model.MemoryRecord) []int64 {
+	ids := make([]int64, len(recs))
+	for i, rec := range recs {
+		ids[i] = rec.ID
+	}
+	return ids
+}
+
+// copiesOf maps the source_record of each record of session whose
+// metadata key is value to the record's ID, the newest copy winning.
+func (a *App) copiesOf(ctx context.Context, session, key, value string) (map[int64]int64, error) {
+	recs, err := a.sessionRecords(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].CreatedAt.Before(recs[j].CreatedAt) })
+	out := map[int64]int64{}
+	for _, rec := range recs {
+		meta := model.DecodeMetadata(rec.Metadata)
+		if v, _ := meta[key].(string); v == value {
+			if src := metaInt(meta["source_record"]); src != 0 {
+				out[src] = rec.ID
+			}
+		}
+	}
+	return out, nil
+}
+
+// remapLinks carries the links ls over to copied records: each link with
+// an end in moved is made again with that end replaced by the copy's ID.
+// Links with an end in gone, records that were deleted, are removed and
+// not made again unless that end has a copy.
+func (a *App) remapLinks(ctx context.Context, ls []MemoryLink, moved map[int64]int64, gone map[int64]bool) error {
+	for _, l := range ls {
+		nl := l
+		from, fromMoved := moved[l.From]
+		to, toMoved := moved[l.To]
+		if fromMoved {
+			nl.From = from
+		}
+		if toMoved {
+			nl.To = to
+		}
+		dangling := (gone[l.From] && !fromMoved) || (gone[l.To] && !toMoved)
+		if (fromMoved || toMoved) && !dangling && nl.From != nl.To {
+			if _, err := a.links.Add(ctx, nl); err != nil {
+				return fmt.Errorf("link %d -%s-> %d: %w", nl.From, nl.Type, nl.To, err)
+			}
+		}
+		if gone[l.From] || gone[l.To] {
+			if _, err := a.links.Remove(ctx, l.From, l.To, l.Type); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// neighbors walks up to hops links out from seeds, breadth first, and
+// returns each record it reaches once, at its shortest distance. An empty
+// types follows every link type. Records that were deleted are reported
+// as missing and not walked further; records visible rejects are left
+// out and not walked through.
+func (a *App) neighbors(ctx context.Context, seeds []int64, hops int, types []string, direction string, visible func(model.MemoryRecord) bool) ([]Neighbor, error) {
+	hops = min(max(hops, 1), maxLinkHops)
+	visited := map[int64]bool{}
+	frontier := make([]int64, 0, len(seeds))
+	for _, id := range seeds {
+		if id = a.currentID(id); !visited[id] {
+			visited[id] = true
+			frontier = append(frontier, id)
+		}
+	}
+	var out []Neighbor
+	for h := 1; h <= hops && len(frontier) > 0; h++ {
+		owner := map[int64]int64{} // version ID -> frontier record
+		var ids []int64
+		for _, id := range frontier {
+			for _, v := range a.lineageIDs(id) {
+				owner[v] = id
+				ids = append(ids, v)
+			}
+		}
+		links, err := a.links.Links(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		var reached []Neighbor
+		for _, l := range links {
+			if len(types) > 0 && !slices.Contains(types, l.Type) {
+				continue
+			}
+			if via, ok := owner[l.From]; ok && direction != linkIn {
+				reached = append(reached, Neighbor{ID: a.currentID(l.To), Type: l.Type, Direction: linkOut, Via: via, Hops: h})
+			}
+			if via, ok := owner[l.To]; ok && direction != linkOut {
+				reached = append(reached, Neighbor{ID: a.currentID(l.From), Type: l.Type, Direction: linkIn, Via: via, Hops: h})
+			}
+		}
+		var next []Neighbor
+		var nextIDs []int64
+		for _, n := range reached {
+			if visited[n.ID] {
+				continue
+			}
+			visited[n.ID] = true
+			next = append(next, n)
+			nextIDs = append(nextIDs, n.ID)
+		}
+		found, err := a.findRecords(ctx, nextIDs...)
+		if err != nil {
+			return nil, err
+		}
+		frontier = frontier[:0]
+		for _, n := range next {
+			rec, ok := found[n.ID]
+			switch {
+			case !ok:
+				n.Missing = true
+			case !visible(rec):
+				continue
+			default:
+				n.SessionID = rec.SessionID
+				n.Content = rec.Content
+				n.Metadata = model.DecodeMetadata(rec.Metadata)
+				n.record = rec
+				frontier = append(frontier, rec.ID)
+			}
+			out = append(out, n)
+		}
+	}
+	return out, nil
+}
+
+// expandLinks appends the records linked to recs, up to hops away, after
+// them, keeping to those a caller reading session as principal may see.
+// Each added record carries linked_from, link_type, link_direction and
+// hops in its metadata.
+func (a *App) expandLinks(ctx context.Context, recs []model.MemoryRecord, hops int, types []string, session, principal string) ([]model.MemoryRecord, error) {
+	if hops <= 0 || len(recs) == 0 {
+		return recs, nil
+	}
+	seeds := make([]int64, 0, len(recs))
+	for _, rec := range recs {
+		if rec.ID != 0 {
+			seeds = append(seeds, rec.ID)
+		}
+	}
+	ns, err := a.neighbors(ctx, seeds, hops, types, linkBoth, func(rec model.MemoryRecord) bool {
+		return a.linkVisible(rec, session, principal)
+	})
+	if err != nil {
+		return recs, err
+	}
+	for _, n := range ns {
+		if n.Missing {
+			continue
+		}
+		meta := n.Metadata
+		if meta == nil {
+			meta = map[string]any{}
+		}
+		meta["linked_from"] = n.Via
+		meta["link_type"] = n.Type
+		meta["link_direction"] = n.Direction
+		meta["hops"] = n.Hops
+		enc, _ := json.Marshal(meta)
+		rec := n.record
+		rec.Metadata = string(enc)
+		rec.Embedding = nil
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func registerLinkTools(s *server.MCPServer, app *App) {
+	linkTool := mcp.NewTool("memory.link",
+		mcp.WithDescription("Add a typed, directed link between two records, e.g. a decision that supersedes another or a bug caused by a config"),
+		mcp.WithNumber("from", mcp.Required(), mcp.Description("Source record ID")),
+		mcp.WithNumber("to", mcp.Required(), mcp.Description("Target record ID")),
+		mcp.WithString("type", mcp.Required(), mcp.Description("Link type, e.g. supersedes, caused_by, relates_to")),
+		mcp.WithString("session_id", mcp.Required(), mcp.Description("Session the caller works in; both records must belong to it or to spaces the principal can read")),
+		mcp.WithString("principal", mcp.Description("Who made the link")),
+	)
+	s.AddTool(linkTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		from, err := req.RequireFloat("from")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing from: %v", err)), nil
+		}
+		to, err := req.RequireFloat("to")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing to: %v", err)), nil
+		}
+		typ, err := req.RequireString("type")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing type: %v", err)), nil
+		}
+		session, err := req.RequireString("session_id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session_id: %v", err)), nil
+		}
+		principal := strings.TrimSpace(getStringParam(req, "principal"))
+		if _, err := app.visibleRecords(ctx, session, principal, int64(from), int64(to)); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("link failed: %v", err)), nil
+		}
+		l, created, err := app.linkRecords(ctx, int64(from), int64(to), typ, principal)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("link failed: %v", err)), nil
+		}
+		return mcp.NewToolResultJSON(map[string]any{"link": l, "created": created})
+	})
+
+	unlinkTool := mcp.NewTool("memory.unlink",
+		mcp.WithDescription("Remove the links from one record to another"),
+		mcp.WithNumber("from", mcp.Required(), mcp.Description("Source record ID")),
+		mcp.WithNumber("to", mcp.Required(), mcp.Description("Target record ID")),
+		mcp.WithString("type", mcp.Description("Only remove links of this type (default: all)")),
+		mcp.WithString("session_id", mcp.Required(), mcp.Description("Session the caller works in; the source record must belong to it or to a space the principal can read")),
+		mcp.WithString("principal", mcp.Description("Must be a writer of the source record's space or the owner of its session")),
+	)
+	s.AddTool(unlinkTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		from, err := req.RequireFloat("from")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing from: %v", err)), nil
+		}
+		to, err := req.RequireFloat("to")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing to: %v", err)), nil
+		}
+		session, err := req.RequireString("session_id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session_id: %v", err)), nil
+		}
+		principal := strings.TrimSpace(getStringParam(req, "principal"))
+		found, err := app.visibleRecords(ctx, session, principal, int64(from))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("unlink failed: %v", err)), nil
+		}
+		if err := app.checkRecordEditor(found[app.currentID(int64(from))], principal); err != nil {
+			return toolError(err), nil
+		}
+		n, err := app.unlinkRecords(ctx, int64(from), int64(to), getStringParam(req, "type"))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("unlink failed: %v", err)), nil
+		}
+		return mcp.NewToolResultJSON(map[string]any{"removed": n})
+	})
+
+	neighborsTool := mcp.NewTool("memory.neighbors",
+		mcp.WithDescription("List the records linked to a record, following links up to a number of hops"),
+		mcp.WithNumber("id", mcp.Required(), mcp.Description("Record ID")),
+		mcp.WithNumber("hops", mcp.Description("How many links to follow (default 1, max 3)")),
+		mcp.WithString("types", mcp.Description("Comma-separated link types to follow (default: all)")),
+		mcp.WithString("direction", mcp.Description("out, in or both (default both)")),
+		mcp.WithString("session_id", mcp.Required(), mcp.Description("Session the caller reads from; only its records and those of spaces the principal can read are returned")),
+		mcp.WithString("principal", mcp.Description("Caller, for records of shared spaces")),
+	)
+	s.AddTool(neighborsTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		id, err := req.RequireFloat("id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing id: %v", err)), nil
+		}
+		session, err := req.RequireString("session_id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session_id: %v", err)), nil
+		}
+		principal := strings.TrimSpace(getStringParam(req, "principal"))
+		visible := func(rec model.MemoryRecord) bool { return app.linkVisible(rec, session, principal) }
+		found, err := app.findRecords(ctx, app.currentID(int64(id)))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if rec, ok := found[app.currentID(int64(id))]; !ok || !visible(rec) {
+			return mcp.NewToolResultError(fmt.Sprintf("record %d not found", int64(id))), nil
+		}
+		direction := strings.ToLower(strings.TrimSpace(getStringParam(req, "direction")))
+		switch direction {
+		case "":
+			direction = linkBoth
+		case linkOut, linkIn, linkBoth:
+		default:
+			return mcp.NewToolResultError(fmt.Sprintf("unknown direction %q (want out, in or both)", direction)), nil
+		}
+		ns, err := app.neighbors(ctx, []int64{int64(id)}, int(getNumberParam(req, "hops")), splitTags(strings.ToLower(getStringParam(req, "types"))), direction, visible)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if ns == nil {
+			ns = []Neighbor{}
+		}
+		return mcp.NewToolResultJSON(map[string]any{"id": int64(id), "neighbors": ns})
+	})
+}
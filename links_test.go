@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// idOf returns the ID of the record of session holding content.
+func idOf(t *testing.T, app *App, session, content string) int64 {
+	t.Helper()
+	for id, rec := range recordIDs(t, app, session) {
+		if rec.Content == content {
+			return id
+		}
+	}
+	t.Fatalf("session %q has no record %q", session, content)
+	return 0
+}
+
+func mustLink(t *testing.T, app *App, from, to int64) {
+	t.Helper()
+	if _, _, err := app.linkRecords(context.Background(), from, to, "relates_to", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpandLinksKeepsToVisibleRecords(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+	app.upsertSpace("team", time.Hour, map[string]memory.SpaceRole{"dana": memory.SpaceRoleReader}, "", "")
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	mustStore(t, app, "s1", "the billing service uses Postgres", nil)
+	mustStore(t, app, "s1", "the old billing database was MySQL", map[string]any{metaExpiresAt: past})
+	mustStore(t, app, "s2", "the billing password rotates weekly", nil)
+	mustStore(t, app, "team", "billing is owned by the payments team", nil)
+	seed := idOf(t, app, "s1", "the billing service uses Postgres")
+	expired := idOf(t, app, "s1", "the old billing database was MySQL")
+	private := idOf(t, app, "s2", "the billing password rotates weekly")
+	shared := idOf(t, app, "team", "billing is owned by the payments team")
+	for _, to := range []int64{expired, private, shared} {
+		mustLink(t, app, seed, to)
+	}
+
+	expand := func(principal string) []int64 {
+		recs, err := app.expandLinks(ctx, []model.MemoryRecord{{ID: seed, SessionID: "s1"}}, 1, nil, "s1", principal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return recordIDsOf(recs[1:])
+	}
+	if got := expand(""); len(got) != 0 {
+		t.Fatalf("expanded to %v without a principal, want nothing", got)
+	}
+	if got := expand("dana"); !slices.Equal(got, []int64{shared}) {
+		t.Fatalf("expanded to %v for dana, want only the space record %d", got, shared)
+	}
+}
+
+func TestForkAndRestoreCarryLinks(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+	src, err := app.sessions.create("proj", SessionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, app, src.ID, "the billing service uses Postgres", nil)
+	mustStore(t, app, src.ID, "Postgres runs on version 16", nil)
+	a := idOf(t, app, src.ID, "the billing service uses Postgres")
+	b := idOf(t, app, src.ID, "Postgres runs on version 16")
+	mustLink(t, app, a, b)
+
+	fork, _, err := app.forkSession(ctx, src, "proj", SessionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa := idOf(t, app, fork.ID, "the billing service uses Postgres")
+	fb := idOf(t, app, fork.ID, "Postgres runs on version 16")
+	if ls, err := app.links.Links(ctx, []int64{fa}); err != nil || len(ls) != 1 || ls[0].To != fb {
+		t.Fatalf("fork links = %+v, %v; want %d -> %d", ls, err, fa, fb)
+	}
+
+	snap, err := app.snapshotSession(ctx, src.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := loadSnapshot(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.restoreSnapshot(ctx, snap, recs); err != nil {
+		t.Fatal(err)
+	}
+	ra := idOf(t, app, src.ID, "the billing service uses Postgres")
+	rb := idOf(t, app, src.ID, "Postgres runs on version 16")
+	if ls, err := app.links.Links(ctx, []int64{ra}); err != nil || len(ls) != 1 || ls[0].To != rb {
+		t.Fatalf("restored links = %+v, %v; want %d -> %d", ls, err, ra, rb)
+	}
+	if ls, _ := app.links.Links(ctx, []int64{a, b}); len(ls) != 0 {
+		t.Fatalf("links of the replaced records remain: %+v", ls)
+	}
+}
+
+// fakeQdrant serves the point payload endpoints qdrantLinks uses.
+type fakeQdrant struct {
+	mu     sync.Mutex
+	points map[int64]map[string]any
+}
+
+func (f *fakeQdrant) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var body struct {
+		IDs     []int64        `json:"ids"`
+		Points  []int64        `json:"points"`
+		Payload map[string]any `json:"payload"`
+		Filter  struct {
+			Must []struct {
+				Match struct {
+					Any []int64 `json:"any"`
+				} `json:"match"`
+			} `json:"must"`
+		} `json:"filter"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	type point struct {
+		ID      int64          `json:"id"`
+		Payload map[string]any `json:"payload"`
+	}
+	var result any
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/points/payload"):
+		for _, id := range body.Points {
+			p, ok := f.points[id]
+			if !ok {
+				http.Error(w, "no point", http.StatusNotFound)
+				return
+			}
+			for k, v := range body.Payload {
+				p[k] = v
+			}
+		}
+		result = true
+	case strings.HasSuffix(r.URL.Path, "/points/scroll"):
+		var pts []point
+		for id, p := range f.points {
+			targets, _ := p[qdrantTargetsKey].([]any)
+			for _, want := range body.Filter.Must[0].Match.Any {
+				if slices.Contains(targets, any(float64(want))) {
+					pts = append(pts, point{id, p})
+					break
+				}
+			}
+		}
+		result = map[string]any{"points": pts, "next_page_offset": nil}
+	default:
+		var pts []point
+		for _, id := range body.IDs {
+			if p, ok := f.points[id]; ok {
+				pts = append(pts, point{id, p})
+			}
+		}
+		result = pts
+	}
+	json.NewEncoder(w).Encode(map[string]any{"result": result, "status": "ok"})
+}
+
+func TestQdrantLinksLiveInPayload(t *testing.T) {
+	fake := &fakeQdrant{points: map[int64]map[string]any{1: {}, 2: {}, 3: {}}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	ql := newQdrantLinks(srv.URL, "memories", "")
+	ctx := context.Background()
+
+	for _, l := range []MemoryLink{{From: 1, To: 2, Type: "caused_by"}, {From: 3, To: 1, Type: "relates_to"}} {
+		if created, err := ql.Add(ctx, l); err != nil || !created {
+			t.Fatalf("add %+v = %v, %v", l, created, err)
+		}
+	}
+	if created, _ := ql.Add(ctx, MemoryLink{From: 1, To: 2, Type: "caused_by"}); created {
+		t.Fatal("a duplicate link was added")
+	}
+	if _, err := ql.Add(ctx, MemoryLink{From: 9, To: 1, Type: "caused_by"}); err == nil {
+		t.Fatal("a link was added to a missing point")
+	}
+	ls, err := ql.Links(ctx, []int64{1})
+	if err != nil || len(ls) != 2 {
+		t.Fatalf("links of 1 = %+v, %v; want the outgoing and the incoming link", ls, err)
+	}
+	if n, err := ql.Remove(ctx, 3, 1, ""); err != nil || n != 1 {
+		t.Fatalf("remove = %d, %v", n, err)
+	}
+	if ls, _ := ql.Links(ctx, []int64{1}); len(ls) != 1 || ls[0].To != 2 {
+		t.Fatalf("links of 1 after remove = %+v", ls)
+	}
+}
+
+func TestLinkToolsCheckAccess(t *testing.T) {
+	app := newTestApp(t, nil)
+	owned, err := app.sessions.create("proj", SessionInfo{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mustStore(t, app, owned.ID, "billing uses Postgres", nil).ID
+	b := mustStore(t, app, owned.ID, "Postgres runs on port 5432", nil).ID
+	other := mustStore(t, app, "s2", "the s2 deploy key rotates weekly", nil).ID
+
+	link := func(from, to int64, session, principal string) *mcp.CallToolResult {
+		return callTool(t, app, registerLinkTools, "memory.link", map[string]any{
+			"from": float64(from), "to": float64(to), "type": "relates_to", "session_id": session, "principal": principal,
+		})
+	}
+	if res := link(a, other, owned.ID, "alice"); !res.IsError {
+		t.Fatal("linked to a record of another session")
+	}
+	if res := link(other, a, "s2", "mallory"); !res.IsError {
+		t.Fatal("linked from another session to alice's record")
+	}
+	if res := link(a, b, owned.ID, "alice"); res.IsError {
+		t.Fatalf("link within the session failed: %v", res.Content)
+	}
+
+	unlink := func(session, principal string) *mcp.CallToolResult {
+		return callTool(t, app, registerLinkTools, "memory.unlink", map[string]any{
+			"from": float64(a), "to": float64(b), "session_id": session, "principal": principal,
+		})
+	}
+	if res := unlink("s2", "alice"); !res.IsError {
+		t.Fatal("unlinked a record not visible from the session")
+	}
+	if res := unlink(owned.ID, "mallory"); !res.IsError {
+		t.Fatal("mallory unlinked alice's record")
+	}
+	if links, _ := app.links.Links(context.Background(), []int64{a}); len(links) != 1 {
+		t.Fatalf("links = %v, want the link kept", links)
+	}
+	if res := unlink(owned.ID, "alice"); res.IsError {
+		t.Fatalf("the owner alice could not unlink: %v", res.Content)
+	}
+}
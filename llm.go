@@ -0,0 +1,165 @@
+// llm.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// llmClient is the model the server asks for fact extraction. It has the
+// shape of go-agent's models.Agent, so any of those can be plugged in.
+type llmClient interface {
+	Generate(ctx context.Context, prompt string) (any, error)
+}
+
+// LLMSettings selects the model behind llmClient.
+type LLMSettings struct {
+	Provider string // gemini, openai, ollama or stub
+	Model    string
+	BaseURL  string // OpenAI-compatible endpoint; defaults per provider
+}
+
+// llmProvider is the endpoint and credentials of a provider's
+// OpenAI-compatible chat completions API.
+type llmProvider struct {
+	baseURL string
+	keyEnv  []string
+	model   string
+}
+
+var llmProviders = map[string]llmProvider{
+	"gemini": {"https://generativelanguage.googleapis.com/v1beta/openai", []string{"GEMINI_API_KEY", "GOOGLE_API_KEY"}, "gemini-2.5-flash"},
+	"openai": {"https://api.openai.com/v1", []string{"OPENAI_API_KEY"}, "gpt-4o-mini"},
+	"ollama": {"http://localhost:11434/v1", nil, "llama3.1"},
+}
+
+// llmSettingsFrom reads the llm_* settings with their environment
+// overrides.
+func llmSettingsFrom(settings *GeminiSettings) LLMSettings {
+	return LLMSettings{
+		Provider: envOrDefault("LLM_PROVIDER", settings.LLMProvider),
+		Model:    envOrDefault("LLM_MODEL", settings.LLMModel),
+		BaseURL:  envOrDefault("LLM_BASE_URL", settings.LLMBaseURL),
+	}
+}
+
+// provider returns the normalized provider name.
+func (s LLMSettings) provider() string {
+	provider := strings.ToLower(strings.TrimSpace(s.Provider))
+	if provider == "google" {
+		return "gemini"
+	}
+	return provider
+}
+
+// model returns the configured model, or the provider's default when
+// none is set.
+func (s LLMSettings) model() string {
+	if s.Model != "" {
+		return s.Model
+	}
+	return llmProviders[s.provider()].model
+}
+
+// newLLMClient builds the client for settings. "stub" needs no network.
+func newLLMClient(settings LLMSettings) (llmClient, error) {
+	provider := settings.provider()
+	if provider == "stub" {
+		return stubLLM{}, nil
+	}
+	p, ok := llmProviders[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown llm_provider %q (want gemini, openai, ollama or stub)", settings.Provider)
+	}
+	c := &chatClient{baseURL: p.baseURL, model: settings.model(), http: &http.Client{Timeout: 60 * time.Second}}
+	if settings.BaseURL != "" {
+		c.baseURL = strings.TrimRight(settings.BaseURL, "/")
+	}
+	for _, env := range p.keyEnv {
+		if c.apiKey = os.Getenv(env); c.apiKey != "" {
+			break
+		}
+	}
+	if len(p.keyEnv) > 0 && c.apiKey == "" && settings.BaseURL == "" {
+		return nil, fmt.Errorf("%s needs %s", provider, strings.Join(p.keyEnv, " or "))
+	}
+	return c, nil
+}
+
+// lazyLLM creates its client on first use, so a misconfigured provider
+// only fails the calls that need a model.
+type lazyLLM struct {
+	settings LLMSettings
+	once     sync.Once
+	client   llmClient
+	err      error
+}
+
+func (l *lazyLLM) Generate(ctx context.Context, prompt string) (any, error) {
+	l.once.Do(func() { l.client, l.err = newLLMClient(l.settings) })
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.client.Generate(ctx, prompt)
+}
+
+// chatClient calls an OpenAI-compatible /chat/completions endpoint.
+type chatClient struct {
+	baseURL string
+	apiKey  string
+	model   string
+	http    *http.Client
+}
+
+func (c *chatClient) Generate(ctx context.Context, prompt string) (any, error) {
+	body, err := json.Marshal(map[string]any{
+		"model":       c.model,
+		"temperature": 0,
+		"messages":    []map[string]string{{"role": "user", "content": prompt}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s: %s", c.model, resp.Status, strings.TrimSpace(string(data)))
+	}
+	var out struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("%s: bad response: %w", c.model, err)
+	}
+	if len(out.Choices) == 0 {
+		return nil, fmt.Errorf("%s: empty response", c.model)
+	}
+	return out.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,146 @@
+// logging.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultRedactFields are attribute keys whose values carry user content.
+var defaultRedactFields = []string{"content", "query", "text", "prompt", "metadata"}
+
+// LoggingOptions configures the process-wide slog logger.
+type LoggingOptions struct {
+	Level  string // debug | info | warn | error
+	Format string // text | json
+	// Redact lists attribute keys whose string values are replaced by a
+	// length marker. "none" disables redaction; empty uses the defaults.
+	Redact string
+}
+
+// setupLogging installs the default slog logger. Output always goes to
+// stderr: in stdio mode stdout carries the MCP protocol stream. The
+// standard log package is routed through the same handler, so messages
+// from dependencies are formatted and filtered alike.
+func setupLogging(opts LoggingOptions) error {
+	h, err := newLogHandler(os.Stderr, opts)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+func newLogHandler(w io.Writer, opts LoggingOptions) (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(opts.Level))); err != nil && opts.Level != "" {
+		return nil, fmt.Errorf("invalid log_level %q: %w", opts.Level, err)
+	}
+
+	redact := map[string]bool{}
+	switch r := strings.TrimSpace(opts.Redact); strings.ToLower(r) {
+	case "none", "off", "false":
+	case "":
+		for _, k := range defaultRedactFields {
+			redact[k] = true
+		}
+	default:
+		for _, k := range strings.Split(r, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				redact[k] = true
+			}
+		}
+	}
+
+	hopts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if redact[a.Key] && a.Value.Kind() == slog.KindString {
+				return slog.String(a.Key, fmt.Sprintf("[redacted %d chars]", len(a.Value.String())))
+			}
+			return a
+		},
+	}
+	switch strings.ToLower(strings.TrimSpace(opts.Format)) {
+	case "", "text":
+		return slog.NewTextHandler(w, hopts), nil
+	case "json":
+		return slog.NewJSONHandler(w, hopts), nil
+	default:
+		return nil, fmt.Errorf("invalid log_format %q (want text or json)", opts.Format)
+	}
+}
+
+type (
+	loggerKey    struct{}
+	requestIDKey struct{}
+)
+
+// logger returns the request-scoped logger installed by logToolMiddleware,
+// or the default logger outside tool calls.
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// requestID returns the ID logToolMiddleware assigned to the current call.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// logToolMiddleware tags every log line of a tool call with a request ID
+// (and the trace ID when tracing is on) and logs the call's outcome.
+func logToolMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		id := newRequestID()
+		l := slog.Default().With("request_id", id, "tool", req.Params.Name)
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			l = l.With("trace_id", sc.TraceID().String())
+		}
+		ctx = context.WithValue(ctx, loggerKey{}, l)
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+
+		start := time.Now()
+		l.Debug("tool call started")
+		res, err := next(ctx, req)
+		elapsed := time.Since(start)
+		switch {
+		case err != nil:
+			l.Error("tool call failed", "duration", elapsed, "error", err)
+		case res != nil && res.IsError:
+			l.Warn("tool call returned error", "duration", elapsed, "error", toolResultText(res))
+		default:
+			l.Info("tool call completed", "duration", elapsed)
+		}
+		return res, err
+	}
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
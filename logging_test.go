@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func TestLogRedaction(t *testing.T) {
+	for _, tc := range []struct {
+		redact       string
+		hidden, kept []string
+	}{
+		{"", []string{"content", "query"}, []string{"session_id"}},
+		{"query, session_id", []string{"query", "session_id"}, []string{"content"}},
+		{"none", nil, []string{"content", "query", "session_id"}},
+	} {
+		var buf bytes.Buffer
+		h, err := newLogHandler(&buf, LoggingOptions{Format: "json", Redact: tc.redact})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slog.New(h).With("session_id", "s1").Info("stored", "content", "my password is hunter2", "query", "hunter2?", "limit", 5)
+
+		var line map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("redact %q: %v in %s", tc.redact, err, buf.String())
+		}
+		for _, k := range tc.hidden {
+			if v, _ := line[k].(string); !strings.HasPrefix(v, "[redacted ") {
+				t.Fatalf("redact %q: %s = %q", tc.redact, k, v)
+			}
+		}
+		for _, k := range tc.kept {
+			if v, _ := line[k].(string); strings.HasPrefix(v, "[redacted") || v == "" {
+				t.Fatalf("redact %q: %s = %q, want it kept", tc.redact, k, v)
+			}
+		}
+		if line["limit"] != float64(5) {
+			t.Fatalf("redact %q: limit = %v", tc.redact, line["limit"])
+		}
+	}
+}
+
+func TestLogRedactionMarksLength(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := newLogHandler(&buf, LoggingOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("query", "query", "hunter2")
+	if out := buf.String(); strings.Contains(out, "hunter2") || !strings.Contains(out, `query="[redacted 7 chars]"`) {
+		t.Fatalf("log line = %q", out)
+	}
+}
+
+func TestNewLogHandlerRejectsBadOptions(t *testing.T) {
+	for _, opts := range []LoggingOptions{{Level: "loud"}, {Format: "xml"}} {
+		if _, err := newLogHandler(&bytes.Buffer{}, opts); err == nil {
+			t.Fatalf("options %+v were accepted", opts)
+		}
+	}
+	var buf bytes.Buffer
+	h, err := newLogHandler(&buf, LoggingOptions{Level: "warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("dropped")
+	if buf.Len() != 0 {
+		t.Fatalf("info line logged at warn level: %q", buf.String())
+	}
+}
+
+func TestLogToolMiddlewareTagsRequest(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := newLogHandler(&buf, LoggingOptions{Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	var id string
+	handler := logToolMiddleware(func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		id = requestID(ctx)
+		logger(ctx).Info("retrieving", "query", "secret plans")
+		return mcp.NewToolResultText("ok"), nil
+	})
+	req := mcp.CallToolRequest{}
+	req.Params.Name = "retrieve_context"
+	if _, err := handler(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("no request ID in the handler context")
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("log lines = %q", lines)
+	}
+	for _, l := range lines {
+		var line map[string]any
+		if err := json.Unmarshal([]byte(l), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line["request_id"] != id || line["tool"] != "retrieve_context" {
+			t.Fatalf("log line = %v", line)
+		}
+	}
+	if strings.Contains(buf.String(), "secret plans") {
+		t.Fatal("query was logged")
+	}
+}
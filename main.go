@@ -4,14 +4,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Protocol-Lattice/go-agent/src/memory"
@@ -23,6 +27,9 @@ import (
 // GeminiSettings represents the configuration from .gemini/settings.json
 type GeminiSettings struct {
 	LLMModel         string `json:"llm_model"`
+	LLMProvider      string `json:"llm_provider"`
+	LLMBaseURL       string `json:"llm_base_url"`
+	FactExtraction   bool   `json:"fact_extraction"`
 	MemoryStore      string `json:"memory_store"`
 	QdrantURL        string `json:"qdrant_url"`
 	QdrantCollection string `json:"qdrant_collection"`
@@ -33,6 +40,61 @@ type GeminiSettings struct {
 	MongoCollection  string `json:"mongo_collection"`
 	ShortTermSize    int    `json:"short_term_size"`
 	DefaultSpaceTTL  int    `json:"default_space_ttl_sec"`
+	EmbedCacheSize   int    `json:"embed_cache_size"`
+	EmbedCacheDisk   bool   `json:"embed_cache_disk"`
+	EmbedProvider    string `json:"embed_provider"`
+	EmbedModel       string `json:"embed_model"`
+	EmbedDim         int    `json:"embed_dim"`
+	Offline          bool   `json:"offline"`
+
+	EmbedCacheDiskEntries int `json:"embed_cache_disk_entries"`
+
+	TraceExporter    string  `json:"trace_exporter"`
+	TraceFile        string  `json:"trace_file"`
+	OTLPEndpoint     string  `json:"otlp_endpoint"`
+	TraceSampleRatio float64 `json:"trace_sample_ratio"`
+
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+	LogRedact string `json:"log_redact"`
+
+	Quotas  QuotaSettings  `json:"quotas"`
+	Tenants TenantSettings `json:"tenants"`
+
+	RecordTTL           int            `json:"record_ttl_sec"`
+	SessionRecordTTL    map[string]int `json:"session_record_ttl_sec"`
+	RecordExpiryAction  string         `json:"record_expiry_action"`
+	RecordSweepInterval int            `json:"record_sweep_interval_sec"`
+
+	SpaceExpiryAction  string `json:"space_expiry_action"`
+	SpaceOwnerSession  string `json:"space_owner_session"`
+	SpaceExpiryGrace   int    `json:"space_expiry_grace_sec"`
+	SpaceSweepInterval int    `json:"space_sweep_interval_sec"`
+
+	SnapshotMaxPerSession int `json:"snapshot_max_per_session"`
+	SnapshotMaxAge        int `json:"snapshot_max_age_sec"`
+
+	ConflictCheck     bool    `json:"conflict_check"`
+	ConflictThreshold float64 `json:"conflict_threshold"`
+	ConflictAction    string  `json:"conflict_action"`
+	ConflictLLMJudge  bool    `json:"conflict_llm_judge"`
+
+	AuditDisabled bool `json:"audit_disabled"`
+	AuditMaxBytes int  `json:"audit_max_bytes"`
+	AuditMaxFiles int  `json:"audit_max_files"`
+
+	Admins []string `json:"admins"`
+
+	EmbedMaxRetries       int     `json:"embed_max_retries"`
+	EmbedRetryBaseMs      int     `json:"embed_retry_base_ms"`
+	EmbedRatePerSec       float64 `json:"embed_rate_per_sec"`
+	EmbedRateBurst        int     `json:"embed_rate_burst"`
+	EmbedBreakerThreshold int     `json:"embed_breaker_threshold"`
+	EmbedBreakerCooldown  int     `json:"embed_breaker_cooldown_sec"`
+	EmbedQueueWhenDown    bool    `json:"embed_queue_when_down"`
+	EmbedQueueSize        int     `json:"embed_queue_size"`
+	AsyncWrites           bool    `json:"async_writes"`
+	WriteWorkers          int     `json:"write_workers"`
 }
 
 // App wires MemoryBank + SessionMemory + Spaces and registers MCP tools.
@@ -43,6 +105,40 @@ type App struct {
 	spaces *memory.SpaceRegistry
 	shared map[string]*memory.SharedSession
 	mu     sync.RWMutex
+
+	embedder   memory.Embedder
+	embedCache *embedCache
+	modelStore *modelTagStore
+	reembed    *reembedJobs
+	provider   *resilientEmbedder
+	writeQueue *writeQueue
+	factQueue  *factQueue
+
+	asyncWrites   bool
+	queueWhenDown bool
+
+	metrics       *serverMetrics
+	shortTermSize int
+	quotas        *quotaManager
+	sweeper       *expirySweeper
+	catalog       *spaceCatalog
+	lifecycle     SpaceLifecycleOptions
+	spaceTallies  spaceTallyCache
+	audit         *auditLog
+	admins        []string
+	groups        *groupDirectory
+	sessions      *sessionRegistry
+	snapshots     SnapshotOptions
+	versions      *versionIndex
+	links         linkStore
+	llm           llmClient
+
+	factExtraction bool
+	conflicts      ConflictOptions
+
+	tenant     string
+	stateDir   string
+	embedStack *embedStack
 }
 
 // loadGeminiSettings reads configuration from .gemini/settings.json
@@ -59,15 +155,18 @@ func loadGeminiSettings() (*GeminiSettings, error) {
 		if err := json.Unmarshal(data, &settings); err != nil {
 			return nil, fmt.Errorf("failed to parse settings JSON: %w", err)
 		}
-		log.Printf("Loaded settings from %s", settingsPath)
+		slog.Info("loaded settings", "path", settingsPath)
 	} else if !os.IsNotExist(err) {
 		return nil, fmt.Errorf("failed to read settings file: %w", err)
 	} else {
-		log.Printf("No .gemini/settings.json found, using defaults")
+		slog.Info("no .gemini/settings.json found, using defaults")
 	}
 	if settings.MemoryStore == "" {
 		settings.MemoryStore = "qdrant"
 	}
+	if settings.LLMProvider == "" {
+		settings.LLMProvider = "gemini"
+	}
 	if settings.QdrantURL == "" {
 		settings.QdrantURL = "http://localhost:6333"
 	}
@@ -80,40 +179,130 @@ func loadGeminiSettings() (*GeminiSettings, error) {
 	if settings.DefaultSpaceTTL == 0 {
 		settings.DefaultSpaceTTL = 86400
 	}
+	if settings.EmbedCacheSize == 0 {
+		settings.EmbedCacheSize = 4096
+	}
+	if settings.EmbedMaxRetries == 0 {
+		settings.EmbedMaxRetries = 3
+	}
+	if settings.EmbedRetryBaseMs == 0 {
+		settings.EmbedRetryBaseMs = 200
+	}
+	if settings.EmbedBreakerThreshold == 0 {
+		settings.EmbedBreakerThreshold = 5
+	}
+	if settings.EmbedBreakerCooldown == 0 {
+		settings.EmbedBreakerCooldown = 30
+	}
+	if settings.EmbedQueueSize == 0 {
+		settings.EmbedQueueSize = 1000
+	}
+	if settings.WriteWorkers == 0 {
+		settings.WriteWorkers = 4
+	}
+	if settings.Quotas.RecountSec == 0 {
+		settings.Quotas.RecountSec = 300
+	}
+	if settings.RecordExpiryAction == "" {
+		settings.RecordExpiryAction = expireDelete
+	}
+	if settings.RecordSweepInterval == 0 {
+		settings.RecordSweepInterval = 60
+	}
+	if settings.SpaceExpiryAction == "" {
+		settings.SpaceExpiryAction = spaceArchive
+	}
+	if settings.SpaceExpiryGrace == 0 {
+		settings.SpaceExpiryGrace = 3600
+	}
+	if settings.SpaceSweepInterval == 0 {
+		settings.SpaceSweepInterval = 60
+	}
+	if settings.ConflictThreshold == 0 {
+		settings.ConflictThreshold = defaultConflictThreshold
+	}
+	if settings.ConflictAction == "" {
+		settings.ConflictAction = conflictFlag
+	}
+	if settings.SnapshotMaxPerSession == 0 {
+		settings.SnapshotMaxPerSession = 10
+	}
+	if settings.AuditMaxBytes == 0 {
+		settings.AuditMaxBytes = 10 << 20
+	}
+	if settings.AuditMaxFiles == 0 {
+		settings.AuditMaxFiles = 10
+	}
+	if settings.Tenants.MaxTenants == 0 {
+		settings.Tenants.MaxTenants = 100
+	}
+	if settings.Tenants.Default == "" {
+		settings.Tenants.Default = "default"
+	}
 	// Add similar checks for other fields like QdrantAPIKey, PostgresDSN, etc., if needed
 
 	return &settings, nil
 }
-func newApp(ctx context.Context, settings *GeminiSettings) (*App, error) {
+
+// newApp builds the state of one tenant; "" is the default tenant, which
+// keeps the un-suffixed collections and state directory. shared is the
+// embedder stack built for the first tenant, or nil to build it.
+func newApp(ctx context.Context, settings *GeminiSettings, tenant string, shared *embedStack) (*App, error) {
 	// Use settings with environment variable fallbacks
 	storeKind := strings.ToLower(envOrDefault("MEMORY_STORE", settings.MemoryStore))
 	shortBuf := envIntOrDefault("SHORT_TERM_SIZE", settings.ShortTermSize)
 	spaceTTL := envIntOrDefault("DEFAULT_SPACE_TTL_SEC", settings.DefaultSpaceTTL)
+	cacheSize := envIntOrDefault("EMBED_CACHE_SIZE", settings.EmbedCacheSize)
+	cacheDisk := envBoolOrDefault("EMBED_CACHE_DISK", settings.EmbedCacheDisk)
+	cacheDiskEntries := envIntOrDefault("EMBED_CACHE_DISK_ENTRIES", settings.EmbedCacheDiskEntries)
+	embedProvider := envOrDefault("EMBED_PROVIDER", settings.EmbedProvider)
+	embedModel := envOrDefault("EMBED_MODEL", settings.EmbedModel)
+	embedDim := envIntOrDefault("EMBED_DIM", settings.EmbedDim)
+	offline := envBoolOrDefault("MEMORY_BANK_OFFLINE", settings.Offline)
+	resilience := ResilienceOptions{
+		MaxRetries:       max(envIntOrDefault("EMBED_MAX_RETRIES", settings.EmbedMaxRetries), 0),
+		BaseBackoff:      time.Duration(envIntOrDefault("EMBED_RETRY_BASE_MS", settings.EmbedRetryBaseMs)) * time.Millisecond,
+		RatePerSec:       envFloatOrDefault("EMBED_RATE_PER_SEC", settings.EmbedRatePerSec),
+		RateBurst:        envIntOrDefault("EMBED_RATE_BURST", settings.EmbedRateBurst),
+		FailureThreshold: envIntOrDefault("EMBED_BREAKER_THRESHOLD", settings.EmbedBreakerThreshold),
+		OpenTimeout:      time.Duration(envIntOrDefault("EMBED_BREAKER_COOLDOWN_SEC", settings.EmbedBreakerCooldown)) * time.Second,
+	}
+	asyncWrites := envBoolOrDefault("ASYNC_WRITES", settings.AsyncWrites)
+	queueWhenDown := envBoolOrDefault("EMBED_QUEUE_WHEN_DOWN", settings.EmbedQueueWhenDown)
+	writeWorkers := envIntOrDefault("WRITE_WORKERS", settings.WriteWorkers)
+	queueSize := envIntOrDefault("EMBED_QUEUE_SIZE", settings.EmbedQueueSize)
 
 	var vs memory.VectorStore
+	var links linkStore
 	var err error
+	backend := storeKind
 
 	switch storeKind {
 	case "postgres", "pg":
+		backend = "postgres"
 		dsn := envOrDefault("POSTGRES_DSN", settings.PostgresDSN)
 		if dsn == "" {
 			return nil, fmt.Errorf("postgres_dsn not configured")
 		}
-		vs, err = memory.NewPostgresStore(ctx, dsn)
+		vs, err = newTenantPostgresStore(ctx, dsn, tenant)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create postgres store: %w", err)
 		}
+		if links, err = newPGLinks(ctx, vs.(*memory.PostgresStore).DB); err != nil {
+			return nil, err
+		}
 
 	case "qdrant":
 		base := envOrDefault("QDRANT_URL", settings.QdrantURL)
-		col := envOrDefault("QDRANT_COLLECTION", settings.QdrantCollection)
+		col := tenantCollection(envOrDefault("QDRANT_COLLECTION", settings.QdrantCollection), tenant)
 		api := envOrDefault("QDRANT_API_KEY", settings.QdrantAPIKey)
 		vs = memory.NewQdrantStore(base, col, api)
+		links = newQdrantLinks(base, col, api)
 
 	case "mongo":
 		uri := envOrDefault("MONGO_URI", settings.MongoURI)
 		database := envOrDefault("MONGO_DATABASE", settings.MongoDatabase)
-		collection := envOrDefault("MONGO_COLLECTION", settings.MongoCollection)
+		collection := tenantCollection(envOrDefault("MONGO_COLLECTION", settings.MongoCollection), tenant)
 		if uri == "" || database == "" {
 			return nil, fmt.Errorf("mongo_uri and mongo_database must be configured")
 		}
@@ -121,24 +310,237 @@ func newApp(ctx context.Context, settings *GeminiSettings) (*App, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to create mongo store: %w", err)
 		}
+		if links, err = newMongoLinks(ctx, uri, database, collection); err != nil {
+			return nil, err
+		}
 
 	default:
-		log.Printf("Using in-memory store (store kind: %s)", storeKind)
+		slog.Info("using in-memory store", "store_kind", storeKind)
+		backend = "inmemory"
 		vs = memory.NewInMemoryStore()
 	}
+	metrics := newServerMetrics()
+	vs = newTracedStore(newTimedStore(vs, backend, metrics), backend)
+
+	quotas := newQuotaManager(QuotaSettings{
+		Principal: quotaLimitsFromEnv(scopePrincipal, settings.Quotas.Principal),
+		Session:   quotaLimitsFromEnv(scopeSession, settings.Quotas.Session),
+		Space:     quotaLimitsFromEnv(scopeSpace, settings.Quotas.Space),
+	})
+	if quotas.enabled() {
+		vs = &quotaStore{VectorStore: vs, quotas: quotas}
+		go quotas.runRecount(ctx, vs, time.Duration(envIntOrDefault("QUOTA_RECOUNT_SEC", settings.Quotas.RecountSec))*time.Second)
+	}
+
+	// One provider stack shared by every tenant, so all hit the same rate
+	// limit and breaker, and one cache in which tenants' entries are keyed
+	// apart.
+	if shared == nil {
+		var cachePath string
+		if cacheDisk {
+			dir, err := ensureSessionDir()
+			if err != nil {
+				return nil, err
+			}
+			cachePath = filepath.Join(dir, "embed_cache.bin")
+		}
+		cache, err := newEmbedCache(cacheSize, cachePath, cacheDiskEntries)
+		if err != nil {
+			return nil, err
+		}
+		base, provider, model, err := newEmbedder(ctx, embedProvider, embedModel, embedDim, offline)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("embedder configured", "provider", provider, "model", model)
+		resilient := newResilientEmbedder(&timedEmbedder{base: base, metrics: metrics}, provider, resilience)
+		shared = &embedStack{
+			cache:     cache,
+			resilient: resilient,
+			provider:  provider,
+			model:     model,
+		}
+	}
+	cache, resilient, provider, model := shared.cache, shared.resilient, shared.provider, shared.model
+	// Engine and SessionMemory share the tenant's embedder.
+	embedder := &memoEmbedder{base: &tracedEmbedder{base: newCachedEmbedder(resilient, cache, tenant, provider, model)}}
+
+	stateDir, err := tenantStateDir(tenant)
+	if err != nil {
+		return nil, err
+	}
+	// Every record is tagged with the embedder that produced it.
+	tagged, err := newModelTagStore(vs, provider, model, stateDir)
+	if err != nil {
+		return nil, err
+	}
+	recordTTL := time.Duration(envIntOrDefault("RECORD_TTL_SEC", settings.RecordTTL)) * time.Second
+	vs = newTTLStore(tagged, recordTTL, settings.SessionRecordTTL)
+
+	expiryAction := strings.ToLower(envOrDefault("RECORD_EXPIRY_ACTION", settings.RecordExpiryAction))
+	if expiryAction != expireDelete && expiryAction != expireArchive {
+		return nil, fmt.Errorf("unknown record_expiry_action %q (want delete or archive)", expiryAction)
+	}
+	versions, err := newVersionIndex(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	vs = &versionStore{VectorStore: vs, index: versions}
+	if links == nil {
+		if links, err = newFileLinks(stateDir); err != nil {
+			return nil, err
+		}
+	}
+	sweeper := newExpirySweeper(vs, expiryAction, filepath.Join(stateDir, "archive"))
+	if every := envIntOrDefault("RECORD_SWEEP_INTERVAL_SEC", settings.RecordSweepInterval); every > 0 {
+		go sweeper.run(ctx, time.Duration(every)*time.Second)
+	}
 
 	bank := memory.NewMemoryBankWithStore(vs)
-	eng := memory.NewEngine(vs, memory.DefaultOptions()).WithEmbedder(memory.AutoEmbedder())
-	sm := memory.NewSessionMemory(bank, shortBuf).WithEmbedder(memory.AutoEmbedder()).WithEngine(eng)
+	eng := memory.NewEngine(&pruneScopeStore{VectorStore: vs}, memory.DefaultOptions()).WithEmbedder(embedder)
+	sm := memory.NewSessionMemory(bank, shortBuf).WithEmbedder(embedder).WithEngine(eng)
 	spaces := memory.NewSpaceRegistry(time.Duration(spaceTTL) * time.Second)
+	// SharedSession checks ACLs against the SessionMemory's registry.
+	sm.Spaces = spaces
+
+	lifecycle := SpaceLifecycleOptions{
+		Action:       strings.ToLower(envOrDefault("SPACE_EXPIRY_ACTION", settings.SpaceExpiryAction)),
+		OwnerSession: envOrDefault("SPACE_OWNER_SESSION", settings.SpaceOwnerSession),
+		Grace:        time.Duration(envIntOrDefault("SPACE_EXPIRY_GRACE_SEC", settings.SpaceExpiryGrace)) * time.Second,
+		ExportDir:    filepath.Join(stateDir, "spaces"),
+	}
+	if !validSpaceAction(lifecycle.Action) {
+		return nil, fmt.Errorf("unknown space_expiry_action %q (want purge, archive or transfer)", lifecycle.Action)
+	}
+	if lifecycle.Action == spaceTransfer && lifecycle.OwnerSession == "" {
+		return nil, fmt.Errorf("space_expiry_action transfer needs space_owner_session")
+	}
+	conflicts := ConflictOptions{
+		Enabled:   envBoolOrDefault("CONFLICT_CHECK", settings.ConflictCheck),
+		Threshold: envFloatOrDefault("CONFLICT_THRESHOLD", settings.ConflictThreshold),
+		Action:    strings.ToLower(envOrDefault("CONFLICT_ACTION", settings.ConflictAction)),
+		LLMJudge:  envBoolOrDefault("CONFLICT_LLM_JUDGE", settings.ConflictLLMJudge),
+	}
+	if !validConflictAction(conflicts.Action) {
+		return nil, fmt.Errorf("unknown conflict_action %q (want flag or supersede)", conflicts.Action)
+	}
 
-	return &App{
-		bank:   bank,
-		sm:     sm,
-		engine: eng,
-		spaces: spaces,
-		shared: make(map[string]*memory.SharedSession),
-	}, nil
+	sessions, err := newSessionRegistry(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := newSpaceCatalog(stateDir, time.Duration(spaceTTL)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := newGroupDirectory(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	writeQueue, err := newWriteQueue(queueSize, writeWorkers, stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var audit *auditLog
+	if !envBoolOrDefault("AUDIT_DISABLED", settings.AuditDisabled) {
+		audit, err = newAuditLog(filepath.Join(stateDir, "audit"),
+			int64(envIntOrDefault("AUDIT_MAX_BYTES", settings.AuditMaxBytes)),
+			envIntOrDefault("AUDIT_MAX_FILES", settings.AuditMaxFiles))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	app := &App{
+		bank:       bank,
+		sm:         sm,
+		engine:     eng,
+		spaces:     spaces,
+		shared:     make(map[string]*memory.SharedSession),
+		embedder:   embedder,
+		embedCache: cache,
+		modelStore: tagged,
+		reembed:    newReembedJobs(ctx),
+		provider:   resilient,
+		writeQueue: writeQueue,
+		factQueue:  newFactQueue(factQueueSize),
+
+		asyncWrites:   asyncWrites,
+		queueWhenDown: queueWhenDown,
+
+		metrics:        metrics,
+		shortTermSize:  shortBuf,
+		quotas:         quotas,
+		sweeper:        sweeper,
+		catalog:        catalog,
+		lifecycle:      lifecycle,
+		audit:          audit,
+		admins:         splitTags(envOrDefault("MEMORY_BANK_ADMINS", strings.Join(settings.Admins, ","))),
+		groups:         groups,
+		sessions:       sessions,
+		versions:       versions,
+		links:          links,
+		llm:            &lazyLLM{settings: llmSettingsFrom(settings)},
+		factExtraction: envBoolOrDefault("FACT_EXTRACTION", settings.FactExtraction),
+		conflicts:      conflicts,
+		snapshots: SnapshotOptions{
+			Dir:           filepath.Join(stateDir, "snapshots"),
+			MaxPerSession: envIntOrDefault("SNAPSHOT_MAX_PER_SESSION", settings.SnapshotMaxPerSession),
+			MaxAge:        time.Duration(envIntOrDefault("SNAPSHOT_MAX_AGE_SEC", settings.SnapshotMaxAge)) * time.Second,
+		},
+		tenant:     tenant,
+		stateDir:   stateDir,
+		embedStack: shared,
+	}
+	app.restoreSpaces()
+	if app.writeQueue.enabled() {
+		app.runWriteWorkers(ctx)
+	}
+	go app.runFactWorker(ctx)
+	if every := envIntOrDefault("SPACE_SWEEP_INTERVAL_SEC", settings.SpaceSweepInterval); every > 0 {
+		go app.runSpaceLifecycle(ctx, time.Duration(every)*time.Second)
+	}
+	return app, nil
+}
+
+// MetricsReport is the engine.metrics payload: the engine counters plus
+// server-side subsystems.
+type MetricsReport struct {
+	memory.MetricsSnapshot
+	EmbedCache    EmbedCacheStats     `json:"embed_cache"`
+	EmbedModel    EmbedModelStats     `json:"embed_model"`
+	EmbedProvider EmbedProviderStats  `json:"embed_provider"`
+	WriteQueue    WriteQueueStats     `json:"write_queue"`
+	FactQueue     FactQueueStats      `json:"fact_queue"`
+	Expiry        ExpiryStats         `json:"expiry"`
+	Spaces        SpaceLifecycleStats `json:"spaces"`
+}
+
+func (a *App) metricsReport() MetricsReport {
+	return MetricsReport{
+		MetricsSnapshot: a.engine.MetricsSnapshot(),
+		EmbedCache:      a.embedCache.Stats(),
+		EmbedModel:      a.modelStore.Stats(),
+		EmbedProvider:   a.provider.Stats(),
+		WriteQueue:      a.writeQueue.Stats(),
+		FactQueue:       a.factQueue.Stats(),
+		Expiry:          a.sweeper.Stats(),
+		Spaces:          a.catalog.Stats(),
+	}
+}
+
+// embed runs text through the full embedder stack (cache, retries, rate
+// limit, breaker) and surfaces provider errors that Engine and
+// SessionMemory would otherwise hide behind DummyEmbedding. The vector is
+// kept in the call's embedMemo, so the Engine's own embed of the same text
+// does not reach the provider again.
+func (a *App) embed(ctx context.Context, text string) ([]float32, error) {
+	if err := a.quotas.checkEmbed(ctx); err != nil {
+		return nil, err
+	}
+	return a.embedder.Embed(ctx, text)
 }
 
 func (a *App) sharedFor(principal string) *memory.SharedSession {
@@ -186,32 +588,74 @@ func main() {
 
 	flag.Parse()
 
-	ctx := context.Background()
+	// SIGINT and SIGTERM stop the transport so deferred cleanup, such as
+	// flushing buffered spans, still runs.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Load settings from .gemini/settings.json
 	settings, err := loadGeminiSettings()
 	if err != nil {
-		log.Fatalf("Failed to load settings: %v", err)
+		fatal("failed to load settings", "error", err)
+	}
+	if err := setupLogging(LoggingOptions{
+		Level:  envOrDefault("LOG_LEVEL", settings.LogLevel),
+		Format: envOrDefault("LOG_FORMAT", settings.LogFormat),
+		Redact: envOrDefault("LOG_REDACT", settings.LogRedact),
+	}); err != nil {
+		fatal("failed to set up logging", "error", err)
 	}
 
-	app, err := newApp(ctx, settings)
+	shutdownTracing, err := setupTracing(ctx, TracingOptions{
+		Exporter:    envOrDefault("TRACE_EXPORTER", settings.TraceExporter),
+		File:        envOrDefault("TRACE_FILE", settings.TraceFile),
+		Endpoint:    envOrDefault("OTEL_EXPORTER_OTLP_ENDPOINT", settings.OTLPEndpoint),
+		SampleRatio: envFloatOrDefault("TRACE_SAMPLE_RATIO", settings.TraceSampleRatio),
+		Transport:   *transport,
+	})
+	if err != nil {
+		fatal("failed to set up tracing", "error", err)
+	}
+	flushTraces := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("tracing shutdown failed", "error", err)
+		}
+	}
+	defer flushTraces()
+
+	tenants, err := newTenantSet(ctx, settings)
+	if err != nil {
+		fatal("failed to configure tenants", "error", err)
+	}
+	// The default tenant is built first and its App backs every handler
+	// outside a tool call; handlers switch to the caller's App via appFor.
+	app, err := tenants.get(tenants.opts.Default)
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to initialise", "error", err)
 	}
 
 	// Use settings with environment variable overrides
-	llmModel := envOrDefault("LLM_MODEL", "gemini-2.5-pro")
+	llmModel := llmSettingsFrom(settings).model()
 	qdrantURL := envOrDefault("QDRANT_URL", settings.QdrantURL)
 	qdrantCollection := envOrDefault("QDRANT_COLLECTION", settings.QdrantCollection)
 
-	log.Printf("Configuration: LLM=%s, Store=%s, Qdrant=%s/%s",
-		llmModel, settings.MemoryStore, qdrantURL, qdrantCollection)
+	slog.Info("configuration", "llm", llmModel, "store", settings.MemoryStore, "qdrant", qdrantURL+"/"+qdrantCollection)
 
 	s := server.NewMCPServer(
 		"memory-bank",
 		"0.1.0",
 		server.WithToolCapabilities(true),
 		server.WithRecovery(),
+		server.WithToolHandlerMiddleware(traceToolMiddleware),
+		server.WithToolHandlerMiddleware(logToolMiddleware),
+		server.WithToolHandlerMiddleware(tenants.middleware),
+		server.WithToolHandlerMiddleware(auditMiddleware),
+		server.WithToolHandlerMiddleware(quotaMiddleware),
+		server.WithToolHandlerMiddleware(metricsMiddleware),
+		server.WithToolHandlerMiddleware(sessionMiddleware),
+		server.WithToolHandlerMiddleware(embedMemoMiddleware),
 	)
 
 	// ---- Tool: health.ping ----
@@ -227,32 +671,53 @@ func main() {
 		mcp.WithString("text", mcp.Required(), mcp.Description("Text to embed")),
 	)
 	s.AddTool(embedTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		text, err := req.RequireString("text")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing required parameter 'text': %v", err)), nil
 		}
-		e, err := app.sm.Embed(ctx, text)
+		e, err := app.embed(ctx, text)
 		if err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
 		res, _ := mcp.NewToolResultJSON(map[string]any{
 			"embedding": e,
+			"provider":  app.modelStore.provider,
+			"model":     app.modelStore.model,
+			"dim":       len(e),
 		})
 		return res, nil
 	})
 
 	initTool := mcp.NewTool("initialize",
-		mcp.WithDescription("Generate a new session ID and save it to disk"))
+		mcp.WithDescription("Generate a new session ID and make it the current session of the project"),
+		mcp.WithString("project", mcp.Description("Workspace key or directory (default: the server's git root or working directory)")),
+		mcp.WithString("name", mcp.Description("Optional unique name for the session")),
+		mcp.WithString("title"),
+		mcp.WithString("description"),
+		mcp.WithString("tags", mcp.Description("Comma-separated tags")),
+		mcp.WithString("principal", mcp.Description("Owner of the session")),
+	)
 	s.AddTool(initTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		sid := fmt.Sprintf("sess-%d", time.Now().UnixNano())
-
-		// Save the session ID to disk
-		if err := saveSessionID(sid); err != nil {
+		app := appFor(ctx, app)
+		project := getStringParam(req, "project")
+
+		// Register the session and bind it to the project
+		info, err := app.sessions.create(project, SessionInfo{
+			Name:        getStringParam(req, "name"),
+			Title:       strings.TrimSpace(getStringParam(req, "title")),
+			Description: strings.TrimSpace(getStringParam(req, "description")),
+			Tags:        splitTags(getStringParam(req, "tags")),
+			Owner:       strings.TrimSpace(getStringParam(req, "principal")),
+		})
+		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("failed to save session: %v", err)), nil
 		}
 
 		res, _ := mcp.NewToolResultJSON(map[string]any{
-			"session_id": sid,
+			"session_id": info.ID,
+			"name":       info.Name,
+			"project":    projectKey(project),
 			"saved":      true,
 		})
 		return res, nil
@@ -261,23 +726,22 @@ func main() {
 	// Tool: prompt_with_memories - Enhanced version that uses stored session
 	promptWithMemories := mcp.NewTool("prompt_with_memories",
 		mcp.WithDescription("Build a prompt augmented with relevant memories from the session"),
-		mcp.WithString("session_id", mcp.Description("Session ID (optional, will use stored session if not provided)")),
+		mcp.WithString("session_id", mcp.Description("Session ID (optional, will use the project's current session if not provided)")),
+		mcp.WithString("project", mcp.Description("Workspace key or directory whose current session to use")),
 		mcp.WithString("query", mcp.Required(), mcp.Description("The user's query/prompt")),
 		mcp.WithNumber("limit", mcp.Description("Number of relevant memories to retrieve (default 5)")),
 		mcp.WithBoolean("include_short_term", mcp.Description("Include short-term memories (default true)")),
+		mcp.WithBoolean("include_pending", mcp.Description("Also keyword-match writes that are still waiting to be embedded (default true)")),
 	)
 	s.AddTool(promptWithMemories, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		// Get session ID - use provided or load from disk
+		app := appFor(ctx, app)
+		// Get session ID - use provided or the project's current one
 		sid := getStringParam(req, "session_id")
 		if sid == "" {
-			loadedSID, err := loadSessionID()
-			if err != nil {
-				return mcp.NewToolResultError(fmt.Sprintf("failed to load session: %v", err)), nil
-			}
-			if loadedSID == "" {
-				return mcp.NewToolResultError("no session_id provided and no saved session found. Use initialize or get_or_create_session first"), nil
+			sid = app.sessions.current(getStringParam(req, "project"))
+			if sid == "" {
+				return mcp.NewToolResultError("no session_id provided and no current session for this project. Use initialize or get_or_create_session first"), nil
 			}
-			sid = loadedSID
 		}
 
 		query, err := req.RequireString("query")
@@ -290,11 +754,20 @@ func main() {
 			limit = 5
 		}
 
+		if _, err := app.embed(ctx, query); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("failed to embed query: %v", err)), nil
+		}
+
 		// Retrieve relevant memories
 		memories, err := app.sm.RetrieveContext(ctx, sid, query, limit)
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("failed to retrieve memories: %v", err)), nil
 		}
+		memories = dropExpired(memories)
+		if req.GetBool("include_pending", true) {
+			memories = append(memories, app.pendingMatches(sid, query, limit-len(memories))...)
+		}
+		traceResults(ctx, len(memories))
 
 		// Build augmented prompt
 		var promptBuilder strings.Builder
@@ -338,6 +811,7 @@ func main() {
 	)
 
 	s.AddTool(agentModeSet, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 
 		sid, _ := req.RequireString("session_id")
 		storeFlag := req.GetBool("store", false)
@@ -372,6 +846,15 @@ The memory block is always part of your input. Treat it as authoritative context
 				"scope": "system",
 			}
 
+			app.stampPrincipal(ctx, sid, meta)
+			release, err := app.quotas.checkWrite(sid, meta, len(promptText))
+			if err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+			defer release()
+			if _, err := app.embed(ctx, promptText); err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
 			rec, err := app.engine.Store(ctx, sid, promptText, meta)
 			if err != nil {
 				return mcp.NewToolResultError(err.Error()), nil
@@ -397,8 +880,13 @@ The memory block is always part of your input. Treat it as authoritative context
 		mcp.WithString("session_id", mcp.Required()),
 		mcp.WithString("content", mcp.Required()),
 		mcp.WithString("metadata_json", mcp.Description("JSON object (string->string)")),
+		mcp.WithNumber("ttl_seconds", mcp.Description("Expire the memory after this many seconds")),
+		mcp.WithString("expires_at", mcp.Description("Expire the memory at this RFC 3339 time")),
+		mcp.WithString("principal", mcp.Description("Principal the write is charged to for quotas")),
+		mcp.WithBoolean("async", mcp.Description("Return a pending_id immediately and embed in the background (default: async_writes setting)")),
 	)
 	s.AddTool(addShort, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		sid, err := req.RequireString("session_id")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing session_id: %v", err)), nil
@@ -415,11 +903,45 @@ The memory block is always part of your input. Treat it as authoritative context
 				return mcp.NewToolResultError(fmt.Sprintf("invalid metadata_json: %v", err)), nil
 			}
 		}
-		e, err := app.sm.Embed(ctx, content)
+		if p := strings.TrimSpace(getStringParam(req, "principal")); p != "" {
+			m["principal"] = p
+		}
+		expiresAt, err := expiryFromRequest(req)
 		if err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
-		app.sm.AddShortTerm(sid, content, stringMapToJSON(m), e)
+		if !expiresAt.IsZero() {
+			m[metaExpiresAt] = expiresAt.Format(time.RFC3339)
+		}
+		meta := stringMapToAny(m)
+		app.stampPrincipal(ctx, sid, meta)
+		if p, _ := meta["principal"].(string); p != "" {
+			m["principal"] = p
+		}
+		release, err := app.quotas.checkWrite(sid, meta, len(content))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		// A queued write keeps the reservation until a worker is done.
+		defer func() { release() }()
+		if req.GetBool("async", app.asyncWrites) {
+			w, err := app.enqueueWrite(writeShort, sid, content, meta, writeStages{}, release)
+			if err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+			release = func() {}
+			return mcp.NewToolResultJSON(map[string]any{"status": "pending", "pending_id": w.ID})
+		}
+		e, err := app.embed(ctx, content)
+		if err != nil {
+			w, qerr := app.deferWrite(writeShort, sid, content, meta, writeStages{}, err, release)
+			if qerr != nil {
+				return mcp.NewToolResultError(qerr.Error()), nil
+			}
+			release = func() {}
+			return mcp.NewToolResultJSON(map[string]any{"status": "queued", "queue_id": w.ID, "reason": w.LastError})
+		}
+		app.addShortTerm(sid, content, stringMapToJSON(m), e)
 		return mcp.NewToolResultText("ok"), nil
 	})
 
@@ -427,15 +949,21 @@ The memory block is always part of your input. Treat it as authoritative context
 	flush := mcp.NewTool("flush",
 		mcp.WithDescription("Promote short-term buffer to long-term vector store for the given session"),
 		mcp.WithString("session_id", mcp.Required()),
+		mcp.WithBoolean("extract_facts", mcp.Description("Extract entities and facts from the flushed records in the background (default: fact_extraction setting)")),
 	)
 	s.AddTool(flush, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		sid, err := req.RequireString("session_id")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing session_id: %v", err)), nil
 		}
-		if err := app.sm.FlushToLongTerm(ctx, sid); err != nil {
+		start := time.Now()
+		if err := app.flushShortTerm(ctx, sid); err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
+		if req.GetBool("extract_facts", app.factExtraction) {
+			app.extractInBackground(ctx, sid, start, nil)
+		}
 		return mcp.NewToolResultText("flushed"), nil
 	})
 
@@ -445,8 +973,16 @@ The memory block is always part of your input. Treat it as authoritative context
 		mcp.WithString("session_id", mcp.Required()),
 		mcp.WithString("content", mcp.Required()),
 		mcp.WithString("metadata_json", mcp.Description("JSON object (any) e.g. {\"source\":\"chat\"}")),
+		mcp.WithNumber("ttl_seconds", mcp.Description("Expire the memory after this many seconds")),
+		mcp.WithString("expires_at", mcp.Description("Expire the memory at this RFC 3339 time")),
+		mcp.WithString("principal", mcp.Description("Principal the write is charged to for quotas")),
+		mcp.WithBoolean("async", mcp.Description("Return a pending_id immediately and embed in the background (default: async_writes setting)")),
+		mcp.WithBoolean("extract_facts", mcp.Description("Extract entities and facts from the content in the background (default: fact_extraction setting)")),
+		mcp.WithBoolean("check_conflicts", mcp.Description("Compare with similar records of the session first and report duplicates, refinements and contradictions (default: conflict_check setting)")),
+		mcp.WithString("conflict_action", mcp.Description("What to do with a refined or contradicted record: flag (default) or supersede it with this write")),
 	)
 	s.AddTool(storeLong, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		sid, err := req.RequireString("session_id")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing session_id: %v", err)), nil
@@ -464,7 +1000,51 @@ The memory block is always part of your input. Treat it as authoritative context
 			}
 		}
 
-		rec, err := app.engine.Store(ctx, sid, content, meta)
+		if p := strings.TrimSpace(getStringParam(req, "principal")); p != "" {
+			meta["principal"] = p
+		}
+		expiresAt, err := expiryFromRequest(req)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if !expiresAt.IsZero() {
+			meta[metaExpiresAt] = expiresAt.Format(time.RFC3339)
+		}
+		app.stampPrincipal(ctx, sid, meta)
+		release, err := app.quotas.checkWrite(sid, meta, len(content))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		// A queued write keeps the reservation until a worker is done.
+		defer func() { release() }()
+		stages := writeStages{ExtractFacts: req.GetBool("extract_facts", app.factExtraction)}
+		if req.GetBool("check_conflicts", app.conflicts.Enabled) {
+			opts := app.conflicts
+			if action := getStringParam(req, "conflict_action"); action != "" {
+				opts.Action = action
+			}
+			if !validConflictAction(opts.Action) {
+				return mcp.NewToolResultError(fmt.Sprintf("conflict_action must be %s or %s", conflictFlag, conflictSupersede)), nil
+			}
+			stages.Conflicts = &opts
+		}
+		if req.GetBool("async", app.asyncWrites) {
+			w, err := app.enqueueWrite(writeLong, sid, content, meta, stages, release)
+			if err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+			release = func() {}
+			return mcp.NewToolResultJSON(map[string]any{"status": "pending", "pending_id": w.ID})
+		}
+		if _, err := app.embed(ctx, content); err != nil {
+			w, qerr := app.deferWrite(writeLong, sid, content, meta, stages, err, release)
+			if qerr != nil {
+				return mcp.NewToolResultError(qerr.Error()), nil
+			}
+			release = func() {}
+			return mcp.NewToolResultJSON(map[string]any{"status": "queued", "queue_id": w.ID, "reason": w.LastError})
+		}
+		rec, err := app.storeLong(ctx, sid, content, meta, stages)
 		if err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
@@ -480,17 +1060,40 @@ The memory block is always part of your input. Treat it as authoritative context
 		mcp.WithString("query", mcp.Required()),
 		mcp.WithNumber("limit", mcp.Description("Number of records to return (default 3)")),
 		mcp.WithBoolean("all", mcp.Description("If true, returns all stored items regardless of similarity")),
+		mcp.WithBoolean("include_pending", mcp.Description("Also keyword-match writes that are still waiting to be embedded (default true)")),
+		mcp.WithBoolean("include_history", mcp.Description("Also return superseded versions of updated records")),
+		mcp.WithNumber("expand_hops", mcp.Description("Also return records linked to the hits, up to this many links away (max 3)")),
+		mcp.WithString("link_types", mcp.Description("Comma-separated link types expand_hops follows (default: all)")),
+		mcp.WithString("principal", mcp.Description("Caller; expand_hops also follows links into spaces it can read")),
 	)
 	s.AddTool(retrieveCtx, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		if req.GetBool("include_history", false) {
+			ctx = withHistory(ctx)
+		}
 		sessionID, _ := req.RequireString("session_id")
 		query, _ := req.RequireString("query")
 		limit := int(req.GetInt("limit", 3))
-		log.Printf("[memory-bank] retrieve_context: session=%s query=%s limit=%d\n", sessionID, query, limit)
+		logger(ctx).Info("retrieve_context", "session_id", sessionID, "query", query, "limit", limit)
 
+		if _, err := app.embed(ctx, query); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
 		recs, err := app.sm.RetrieveContext(ctx, sessionID, query, limit)
 		if err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
+		recs = dropExpired(recs)
+		hits := len(recs)
+		if hops := int(getNumberParam(req, "expand_hops")); hops > 0 {
+			if recs, err = app.expandLinks(ctx, recs, hops, splitTags(strings.ToLower(getStringParam(req, "link_types"))), sessionID, strings.TrimSpace(getStringParam(req, "principal"))); err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("link expansion failed: %v", err)), nil
+			}
+		}
+		if req.GetBool("include_pending", true) {
+			recs = append(recs, app.pendingMatches(sessionID, query, limit-hits)...)
+		}
+		traceResults(ctx, len(recs))
 
 		return mcp.NewToolResultJSON(map[string]any{
 			"session_id": sessionID,
@@ -507,17 +1110,40 @@ The memory block is always part of your input. Treat it as authoritative context
 		mcp.WithString("session_id", mcp.Required()),
 		mcp.WithString("query", mcp.Required()),
 		mcp.WithNumber("limit", mcp.Description("Number of records to return (default 10)")),
+		mcp.WithBoolean("include_pending", mcp.Description("Also keyword-match writes that are still waiting to be embedded (default true)")),
+		mcp.WithBoolean("include_history", mcp.Description("Also return superseded versions of updated records")),
+		mcp.WithNumber("expand_hops", mcp.Description("Also return records linked to the hits, up to this many links away (max 3)")),
+		mcp.WithString("link_types", mcp.Description("Comma-separated link types expand_hops follows (default: all)")),
+		mcp.WithString("principal", mcp.Description("Caller; expand_hops also follows links into spaces it can read")),
 	)
 	s.AddTool(memoryQuery, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		if req.GetBool("include_history", false) {
+			ctx = withHistory(ctx)
+		}
 		sessionID, _ := req.RequireString("session_id")
 		query, _ := req.RequireString("query")
 		limit := int(req.GetInt("limit", 10))
-		log.Printf("[memory-bank] memory_query: session=%s query=%s limit=%d\n", sessionID, query, limit)
+		logger(ctx).Info("memory_query", "session_id", sessionID, "query", query, "limit", limit)
 
+		if _, err := app.embed(ctx, query); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
 		recs, err := app.sm.RetrieveContext(ctx, sessionID, query, limit)
 		if err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
+		recs = dropExpired(recs)
+		hits := len(recs)
+		if hops := int(getNumberParam(req, "expand_hops")); hops > 0 {
+			if recs, err = app.expandLinks(ctx, recs, hops, splitTags(strings.ToLower(getStringParam(req, "link_types"))), sessionID, strings.TrimSpace(getStringParam(req, "principal"))); err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("link expansion failed: %v", err)), nil
+			}
+		}
+		if req.GetBool("include_pending", true) {
+			recs = append(recs, app.pendingMatches(sessionID, query, limit-hits)...)
+		}
+		traceResults(ctx, len(recs))
 
 		return mcp.NewToolResultJSON(map[string]any{
 			"session_id": sessionID,
@@ -537,6 +1163,7 @@ The memory block is always part of your input. Treat it as authoritative context
 	)
 
 	s.AddTool(chainPrompt, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		sid, _ := req.RequireString("session_id")
 		content, _ := req.RequireString("content")
 		query, _ := req.RequireString("query")
@@ -546,14 +1173,22 @@ The memory block is always part of your input. Treat it as authoritative context
 			limit = 5
 		}
 
-		e, err := app.sm.Embed(ctx, content)
+		meta := map[string]any{}
+		app.stampPrincipal(ctx, sid, meta)
+		release, err := app.quotas.checkWrite(sid, meta, len(content))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		defer release()
+		e, err := app.embed(ctx, content)
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("embed failed: %v", err)), nil
 		}
 
-		app.sm.AddShortTerm(sid, content, "{}", e)
+		metaJSON, _ := json.Marshal(meta)
+		app.addShortTerm(sid, content, string(metaJSON), e)
 
-		if err := app.sm.FlushToLongTerm(ctx, sid); err != nil {
+		if err := app.flushShortTerm(ctx, sid); err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("flush failed: %v", err)), nil
 		}
 
@@ -575,15 +1210,29 @@ The memory block is always part of your input. Treat it as authoritative context
 	// ---- Tools: spaces.* ----
 	spacesUpsert := mcp.NewTool("spaces.upsert",
 		mcp.WithDescription("Create or update a space definition with TTL and ACL"),
-		mcp.WithString("name", mcp.Required()),
+		mcp.WithString("name", mcp.Required(), mcp.Description("Path-like name, e.g. eng/payments/refunds; the ACL is inherited from parent spaces")),
+		mcp.WithString("caller", mcp.Required(), mcp.Description("Must be an admin of an existing space; becomes admin of a new one")),
 		mcp.WithNumber("ttl_seconds"),
-		mcp.WithString("acl_json", mcp.Description("JSON map principal->role (reader|writer|admin)")),
+		mcp.WithString("acl_json", mcp.Description("JSON map principal->role (reader|writer|admin); entries override inherited roles")),
+		mcp.WithString("expiry_action", mcp.Description("purge, archive or transfer once expired (default from settings)")),
+		mcp.WithString("owner_session", mcp.Description("Session receiving the memories when expiry_action=transfer")),
 	)
 	s.AddTool(spacesUpsert, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		name, err := req.RequireString("name")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing name: %v", err)), nil
 		}
+		if err := validSpaceName(name); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		caller, err := req.RequireString("caller")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing caller: %v", err)), nil
+		}
+		if err := app.requireRole(name, caller, memory.SpaceRoleAdmin); err != nil {
+			return toolError(err), nil
+		}
 
 		ttl := getNumberParam(req, "ttl_seconds")
 
@@ -597,20 +1246,42 @@ The memory block is always part of your input. Treat it as authoritative context
 
 		m := map[string]memory.SpaceRole{}
 		for p, role := range acl {
-			m[p] = parseRole(role)
+			r, err := parseRole(role)
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("invalid acl_json entry for %q: %v", p, err)), nil
+			}
+			if err := app.checkACLPrincipal(p); err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+			m[p] = r
+		}
+		if _, exists := app.catalog.get(name); !exists {
+			m[strings.TrimSpace(caller)] = memory.SpaceRoleAdmin
+		}
+		action := strings.ToLower(strings.TrimSpace(getStringParam(req, "expiry_action")))
+		if action != "" && !validSpaceAction(action) {
+			return mcp.NewToolResultError(fmt.Sprintf("unknown expiry_action %q (want purge, archive or transfer)", action)), nil
+		}
+		owner := strings.TrimSpace(getStringParam(req, "owner_session"))
+		if action == spaceTransfer && owner == "" && app.lifecycle.OwnerSession == "" {
+			return mcp.NewToolResultError("expiry_action transfer needs owner_session"), nil
 		}
-		app.spaces.Upsert(name, time.Duration(int(ttl))*time.Second, m)
+		app.upsertSpace(name, time.Duration(int(ttl))*time.Second, m, action, owner)
+		app.metrics.spaceSeen(name)
 		return mcp.NewToolResultText("ok"), nil
 	})
 
 	spacesGrant := mcp.NewTool("spaces.grant",
 		mcp.WithDescription("Grant a role to a principal for a space"),
 		mcp.WithString("name", mcp.Required()),
+		mcp.WithString("caller", mcp.Required(), mcp.Description("Must be an admin of the space; becomes admin of a new one")),
 		mcp.WithString("principal", mcp.Required()),
-		mcp.WithString("role", mcp.Required()),
-		mcp.WithNumber("ttl_seconds"),
+		mcp.WithString("role", mcp.Required(), mcp.Description("reader, writer or admin")),
+		mcp.WithNumber("ttl_seconds", mcp.Description("Renew the space for this long (default 3600)")),
+		mcp.WithNumber("grant_ttl_seconds", mcp.Description("Revoke this grant after this long, independent of the space's TTL (default: never)")),
 	)
 	s.AddTool(spacesGrant, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		name, err := req.RequireString("name")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing name: %v", err)), nil
@@ -623,24 +1294,48 @@ The memory block is always part of your input. Treat it as authoritative context
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing role: %v", err)), nil
 		}
+		role, err := parseRole(roleStr)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if err := app.checkACLPrincipal(principal); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if err := validSpaceName(name); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		caller, err := req.RequireString("caller")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing caller: %v", err)), nil
+		}
+		if err := app.requireRole(name, caller, memory.SpaceRoleAdmin); err != nil {
+			return toolError(err), nil
+		}
 
 		ttl := int(getNumberParam(req, "ttl_seconds"))
 		if ttl <= 0 {
 			ttl = 3600
 		}
 
-		if err := app.spaces.Grant(name, principal, parseRole(roleStr), time.Duration(ttl)*time.Second); err != nil {
+		if _, exists := app.catalog.get(name); !exists {
+			app.upsertSpace(name, time.Duration(ttl)*time.Second, map[string]memory.SpaceRole{caller: memory.SpaceRoleAdmin}, "", "")
+		}
+		grantTTL := time.Duration(getNumberParam(req, "grant_ttl_seconds")) * time.Second
+		if err := app.grantSpace(name, principal, role, time.Duration(ttl)*time.Second, grantTTL); err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
+		app.metrics.spaceSeen(name)
 		return mcp.NewToolResultText("ok"), nil
 	})
 
 	spacesRevoke := mcp.NewTool("spaces.revoke",
 		mcp.WithDescription("Revoke a principal from a space"),
 		mcp.WithString("name", mcp.Required()),
+		mcp.WithString("caller", mcp.Required(), mcp.Description("Must be an admin of the space")),
 		mcp.WithString("principal", mcp.Required()),
 	)
 	s.AddTool(spacesRevoke, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		name, err := req.RequireString("name")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing name: %v", err)), nil
@@ -649,7 +1344,14 @@ The memory block is always part of your input. Treat it as authoritative context
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err)), nil
 		}
-		app.spaces.Revoke(name, principal)
+		caller, err := req.RequireString("caller")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing caller: %v", err)), nil
+		}
+		if err := app.requireRole(name, caller, memory.SpaceRoleAdmin); err != nil {
+			return toolError(err), nil
+		}
+		app.revokeSpace(name, principal)
 		return mcp.NewToolResultText("ok"), nil
 	})
 
@@ -658,6 +1360,7 @@ The memory block is always part of your input. Treat it as authoritative context
 		mcp.WithString("principal", mcp.Required()),
 	)
 	s.AddTool(spacesList, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		principal, err := req.RequireString("principal")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err)), nil
@@ -672,8 +1375,10 @@ The memory block is always part of your input. Treat it as authoritative context
 		mcp.WithDescription("Ensure a principal view exists and join a space"),
 		mcp.WithString("principal", mcp.Required()),
 		mcp.WithString("space", mcp.Required()),
+		mcp.WithBoolean("include_descendants", mcp.Description("Also join readable sub-spaces, including ones created later")),
 	)
 	s.AddTool(sharedJoin, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		p, err := req.RequireString("principal")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err)), nil
@@ -682,8 +1387,10 @@ The memory block is always part of your input. Treat it as authoritative context
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing space: %v", err)), nil
 		}
-		ss := app.sharedFor(p)
-		if err := ss.Join(space); err != nil {
+		if err := app.requireRole(space, p, memory.SpaceRoleReader); err != nil {
+			return toolError(err), nil
+		}
+		if err := app.joinSpace(p, space, req.GetBool("include_descendants", false)); err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
 		return mcp.NewToolResultText("ok"), nil
@@ -695,6 +1402,7 @@ The memory block is always part of your input. Treat it as authoritative context
 		mcp.WithString("space", mcp.Required()),
 	)
 	s.AddTool(sharedLeave, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		p, err := req.RequireString("principal")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err)), nil
@@ -703,7 +1411,7 @@ The memory block is always part of your input. Treat it as authoritative context
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing space: %v", err)), nil
 		}
-		app.sharedFor(p).Leave(space)
+		app.leaveSpace(p, space)
 		return mcp.NewToolResultText("ok"), nil
 	})
 
@@ -713,8 +1421,11 @@ The memory block is always part of your input. Treat it as authoritative context
 		mcp.WithString("space", mcp.Required()),
 		mcp.WithString("content", mcp.Required()),
 		mcp.WithString("metadata_json"),
+		mcp.WithNumber("ttl_seconds", mcp.Description("Expire the memory after this many seconds")),
+		mcp.WithString("expires_at", mcp.Description("Expire the memory at this RFC 3339 time")),
 	)
 	s.AddTool(sharedAdd, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		p, err := req.RequireString("principal")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err)), nil
@@ -736,9 +1447,33 @@ The memory block is always part of your input. Treat it as authoritative context
 			}
 		}
 
+		if err := app.requireRole(space, p, memory.SpaceRoleWriter); err != nil {
+			return toolError(err), nil
+		}
+		if _, ok := meta["principal"]; !ok {
+			meta["principal"] = p
+		}
+		meta[metaSharedSpace] = space
+		expiresAt, err := expiryFromRequest(req)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if !expiresAt.IsZero() {
+			meta[metaExpiresAt] = expiresAt.Format(time.RFC3339)
+		}
+		release, err := app.quotas.checkWrite(space, stringMapToAny(meta), len(content))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		defer release()
+		if _, err := app.embed(ctx, content); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
 		if err := app.sharedFor(p).AddShortTo(space, content, meta); err != nil {
 			return mcp.NewToolResultError(err.Error()), nil
 		}
+		app.metrics.shortTermAdded(space, app.shortTermSize)
+		app.quotas.buffer(space, ownerOf(space, stringMapToAny(meta)), len(content), app.shortTermSize)
 		return mcp.NewToolResultText("ok"), nil
 	})
 
@@ -750,6 +1485,7 @@ The memory block is always part of your input. Treat it as authoritative context
 		mcp.WithString("only_shared"),
 	)
 	s.AddTool(sharedRetrieve, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
 		p, err := req.RequireString("principal")
 		if err != nil {
 			return mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err)), nil
@@ -766,6 +1502,13 @@ The memory block is always part of your input. Treat it as authoritative context
 
 		only := strings.ToLower(getStringParam(req, "only_shared")) == "true"
 
+		app.dropUnreadableSpaces(ctx, p)
+		app.walkJoinedTrees(p)
+
+		if _, err := app.embed(ctx, q); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
 		var (
 			recs []memory.MemoryRecord
 			rerr error
@@ -778,33 +1521,32 @@ The memory block is always part of your input. Treat it as authoritative context
 		if rerr != nil {
 			return mcp.NewToolResultError(rerr.Error()), nil
 		}
+		recs = dropExpired(recs)
+		traceResults(ctx, len(recs))
 		res, _ := mcp.NewToolResultJSON(recs)
 		return res, nil
 	})
 
 	// Tool: get_or_create_session
 	getOrCreateSession := mcp.NewTool("get_or_create_session",
-		mcp.WithDescription("Get existing session ID from disk, or create a new one if none exists"),
+		mcp.WithDescription("Get the project's current session ID, or create a new one if it has none"),
+		mcp.WithString("project", mcp.Description("Workspace key or directory (default: the server's git root or working directory)")),
+		mcp.WithString("principal", mcp.Description("Owner of the session if one is created")),
 	)
 	s.AddTool(getOrCreateSession, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		// Try to load existing session
-		sessionID, err := loadSessionID()
+		app := appFor(ctx, app)
+		project := getStringParam(req, "project")
+		// Use the project's current session, or create one if it has none
+		info, created, err := app.sessions.currentOrCreate(project, SessionInfo{
+			Owner: strings.TrimSpace(getStringParam(req, "principal")),
+		})
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("failed to load session: %v", err)), nil
-		}
-
-		created := false
-		if sessionID == "" {
-			// Create new session if none exists
-			sessionID = fmt.Sprintf("sess-%d", time.Now().UnixNano())
-			if err := saveSessionID(sessionID); err != nil {
-				return mcp.NewToolResultError(fmt.Sprintf("failed to save session: %v", err)), nil
-			}
-			created = true
+			return mcp.NewToolResultError(fmt.Sprintf("failed to save session: %v", err)), nil
 		}
 
 		res, _ := mcp.NewToolResultJSON(map[string]any{
-			"session_id": sessionID,
+			"session_id": info.ID,
+			"project":    projectKey(project),
 			"created":    created,
 			"loaded":     !created,
 		})
@@ -816,28 +1558,62 @@ The memory block is always part of your input. Treat it as authoritative context
 
 	metrics := mcp.NewTool("engine.metrics", mcp.WithDescription("Return engine metrics snapshot")) // This was already correct, but including for completeness
 	s.AddTool(metrics, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		res, _ := mcp.NewToolResultJSON(app.engine.MetricsSnapshot())
+		app := appFor(ctx, app)
+		res, _ := mcp.NewToolResultJSON(app.metricsReport())
 		return res, nil
 	})
 
+	registerReembedTools(s, app)
+	registerWriteQueueTools(s, app)
+	registerQuotaTools(s, app)
+	registerSpaceLifecycleTools(s, app)
+	registerSpaceInspectTools(s, app)
+	registerAuditTools(s, app)
+	registerGroupTools(s, app)
+	registerSessionTools(s, app)
+	registerSessionLifecycleTools(s, app)
+	registerSessionForkTools(s, app)
+	registerSnapshotTools(s, app)
+	registerVersionTools(s, app)
+	registerLinkTools(s, app)
+	registerFactTools(s, app)
+
 	// ---- start transport ----
 	switch strings.ToLower(*transport) {
 	case "stdio":
-		if err := server.ServeStdio(s); err != nil {
-			log.Fatal(err)
+		if err := server.NewStdioServer(s).Listen(ctx, os.Stdin, os.Stdout); err != nil && ctx.Err() == nil {
+			flushTraces()
+			fatal("stdio server failed", "error", err)
 		}
 	case "http":
-		log.SetOutput(os.Stderr)
-		log.Printf("[MCP] Starting HTTP server on %s", *addr)
-
-		h := server.NewStreamableHTTPServer(s)
-
-		if err := h.Start(*addr); err != nil {
-			log.Fatalf("failed to start MCP HTTP server: %v", err)
+		slog.Info("starting HTTP server", "addr", *addr)
+
+		mux := http.NewServeMux()
+		h := server.NewStreamableHTTPServer(s,
+			server.WithStreamableHTTPServer(&http.Server{Addr: *addr, Handler: mux}),
+			server.WithHTTPContextFunc(tenants.httpContext))
+		mux.Handle("/mcp", h)
+		mux.Handle("/metrics", tenants.metricsHandler())
+
+		errc := make(chan error, 1)
+		go func() { errc <- h.Start(*addr) }()
+		select {
+		case err := <-errc:
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				flushTraces()
+				fatal("failed to start MCP HTTP server", "error", err)
+			}
+		case <-ctx.Done():
+			slog.Info("shutting down")
+			sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := h.Shutdown(sctx); err != nil {
+				slog.Warn("HTTP server shutdown failed", "error", err)
+			}
+			cancel()
 		}
 
 	default:
-		log.Fatal("unknown transport: ", *transport)
+		fatal("unknown transport", "transport", *transport)
 	}
 }
 
@@ -857,6 +1633,24 @@ func envIntOrDefault(key string, def int) int {
 	return def
 }
 
+func envBoolOrDefault(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func envFloatOrDefault(key string, def float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
 func mustEnv(k string) string {
 	v := os.Getenv(k)
 	if v == "" {
@@ -873,16 +1667,12 @@ func atoi(s string, def int) int {
 	return i
 }
 
-func parseRole(s string) memory.SpaceRole {
-	s = strings.ToLower(strings.TrimSpace(s))
-	switch s {
-	case "admin":
-		return memory.SpaceRoleAdmin
-	case "writer", "write":
-		return memory.SpaceRoleWriter
-	default:
-		return memory.SpaceRoleReader
+func stringMapToAny(m map[string]string) map[string]any {
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		out[k] = v
 	}
+	return out
 }
 
 func stringMapToJSON(m map[string]string) string {
@@ -929,40 +1719,3 @@ func ensureSessionDir() (string, error) {
 
 	return dir, nil
 }
-
-// saveSessionID persists the session ID to disk
-func saveSessionID(sessionID string) error {
-	dir, err := ensureSessionDir()
-	if err != nil {
-		return err
-	}
-
-	filePath := filepath.Join(dir, "session_id")
-	if err := os.WriteFile(filePath, []byte(sessionID), 0644); err != nil {
-		return fmt.Errorf("failed to write session ID: %w", err)
-	}
-
-	log.Printf("Saved session ID to %s", filePath)
-	return nil
-}
-
-// loadSessionID retrieves the session ID from disk, returns empty string if not found
-func loadSessionID() (string, error) {
-	dir, err := getSessionDir()
-	if err != nil {
-		return "", err
-	}
-
-	filePath := filepath.Join(dir, "session_id")
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return "", nil // Not an error, just no saved session
-		}
-		return "", fmt.Errorf("failed to read session ID: %w", err)
-	}
-
-	sessionID := strings.TrimSpace(string(data))
-	log.Printf("Loaded session ID from %s", filePath)
-	return sessionID, nil
-}
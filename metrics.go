@@ -0,0 +1,418 @@
+// metrics.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// latencyBuckets are histogram upper bounds in seconds.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, non-cumulative; last slot is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(seconds float64) {
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+type opStat struct {
+	latency *histogram
+	errors  uint64
+}
+
+func (s *opStat) record(d time.Duration, err error) {
+	s.latency.observe(d.Seconds())
+	if err != nil {
+		s.errors++
+	}
+}
+
+// clone copies s, so it can be written out after the lock is released.
+func (s *opStat) clone() *opStat {
+	h := *s.latency
+	h.counts = append([]uint64(nil), s.latency.counts...)
+	return &opStat{latency: &h, errors: s.errors}
+}
+
+type storeOp struct{ backend, op string }
+
+// serverMetrics collects the counters served on /metrics in HTTP mode.
+// Everything is guarded by one mutex; updates are a few increments, far
+// cheaper than the calls they measure.
+type serverMetrics struct {
+	mu        sync.Mutex
+	tools     map[string]*opStat
+	embed     *opStat
+	stores    map[storeOp]*opStat
+	shortTerm map[string]int
+	spaces    map[string]struct{}
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		tools:     make(map[string]*opStat),
+		embed:     &opStat{latency: newHistogram()},
+		stores:    make(map[storeOp]*opStat),
+		shortTerm: make(map[string]int),
+		spaces:    make(map[string]struct{}),
+	}
+}
+
+func (m *serverMetrics) observeTool(name string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.tools[name]
+	if st == nil {
+		st = &opStat{latency: newHistogram()}
+		m.tools[name] = st
+	}
+	st.record(d, err)
+}
+
+func (m *serverMetrics) observeEmbed(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.embed.record(d, err)
+}
+
+func (m *serverMetrics) observeStore(backend, op string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := storeOp{backend, op}
+	st := m.stores[key]
+	if st == nil {
+		st = &opStat{latency: newHistogram()}
+		m.stores[key] = st
+	}
+	st.record(d, err)
+}
+
+// shortTermAdded mirrors SessionMemory's buffer length, which it does not
+// expose; the buffer keeps at most limit records per session.
+func (m *serverMetrics) shortTermAdded(sessionID string, limit int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n := m.shortTerm[sessionID] + 1; limit <= 0 || n <= limit {
+		m.shortTerm[sessionID] = n
+	}
+}
+
+func (m *serverMetrics) shortTermFlushed(sessionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.shortTerm, sessionID)
+}
+
+func (m *serverMetrics) spaceSeen(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spaces[name] = struct{}{}
+}
+
+func (m *serverMetrics) spaceGone(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.spaces, name)
+}
+
+// toolMiddleware times every tool handler. A result with IsError counts as
+// an error as well as a returned error.
+func (m *serverMetrics) toolMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		start := time.Now()
+		res, err := next(ctx, req)
+		failed := err
+		if failed == nil && res != nil && res.IsError {
+			failed = fmt.Errorf("tool error")
+		}
+		m.observeTool(req.Params.Name, time.Since(start), failed)
+		return res, err
+	}
+}
+
+// timedEmbedder measures calls that reach the embedding provider.
+type timedEmbedder struct {
+	base    memory.Embedder
+	metrics *serverMetrics
+}
+
+func (e *timedEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	start := time.Now()
+	vec, err := e.base.Embed(ctx, text)
+	e.metrics.observeEmbed(time.Since(start), err)
+	return vec, err
+}
+
+// timedStore measures vector store latency per backend and operation.
+type timedStore struct {
+	memory.VectorStore
+	backend string
+	metrics *serverMetrics
+}
+
+func newTimedStore(vs memory.VectorStore, backend string, metrics *serverMetrics) *timedStore {
+	return &timedStore{VectorStore: vs, backend: backend, metrics: metrics}
+}
+
+func (s *timedStore) observe(op string, start time.Time, err error) {
+	s.metrics.observeStore(s.backend, op, time.Since(start), err)
+}
+
+func (s *timedStore) StoreMemory(ctx context.Context, sessionID, content string, metadata map[string]any, embedding []float32) error {
+	start := time.Now()
+	err := s.VectorStore.StoreMemory(ctx, sessionID, content, metadata, embedding)
+	s.observe("store", start, err)
+	return err
+}
+
+func (s *timedStore) SearchMemory(ctx context.Context, queryEmbedding []float32, limit int) ([]model.MemoryRecord, error) {
+	start := time.Now()
+	recs, err := s.VectorStore.SearchMemory(ctx, queryEmbedding, limit)
+	s.observe("search", start, err)
+	return recs, err
+}
+
+func (s *timedStore) UpdateEmbedding(ctx context.Context, id int64, embedding []float32, lastEmbedded time.Time) error {
+	start := time.Now()
+	err := s.VectorStore.UpdateEmbedding(ctx, id, embedding, lastEmbedded)
+	s.observe("update_embedding", start, err)
+	return err
+}
+
+func (s *timedStore) DeleteMemory(ctx context.Context, ids []int64) error {
+	start := time.Now()
+	err := s.VectorStore.DeleteMemory(ctx, ids)
+	s.observe("delete", start, err)
+	return err
+}
+
+func (s *timedStore) Iterate(ctx context.Context, fn func(model.MemoryRecord) bool) error {
+	start := time.Now()
+	err := s.VectorStore.Iterate(ctx, fn)
+	s.observe("iterate", start, err)
+	return err
+}
+
+func (s *timedStore) Count(ctx context.Context) (int, error) {
+	start := time.Now()
+	n, err := s.VectorStore.Count(ctx)
+	s.observe("count", start, err)
+	return n, err
+}
+
+// addShortTerm appends to the session buffer and keeps the buffer gauge
+// and the quota charge for buffered records in step.
+func (a *App) addShortTerm(sessionID, content, metadata string, embedding []float32) {
+	a.sm.AddShortTerm(sessionID, content, metadata, embedding)
+	a.metrics.shortTermAdded(sessionID, a.shortTermSize)
+	a.quotas.buffer(sessionID, ownerOf(sessionID, model.DecodeMetadata(metadata)), len(content), a.shortTermSize)
+}
+
+func (a *App) flushShortTerm(ctx context.Context, sessionID string) error {
+	ctx, span := tracer.Start(ctx, "flush", trace.WithAttributes(attrSession.String(sessionID)))
+	err := a.sm.FlushToLongTerm(ctx, sessionID)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	a.metrics.shortTermFlushed(sessionID)
+	a.quotas.flushed(sessionID)
+	return nil
+}
+
+// metricsHandler serves all metrics in the Prometheus text exposition
+// format.
+func (a *App) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		a.writeMetrics(w)
+	})
+}
+
+func (a *App) writeMetrics(w io.Writer) {
+	// Copy everything under the lock and write after releasing it, so a
+	// slow scraper does not stall the calls being measured.
+	m := a.metrics
+	m.mu.Lock()
+	toolOps := sortedOps(m.tools, func(k string) []string { return []string{k} })
+	embedOps := []labeledOp{{nil, m.embed.clone()}}
+	storeOps := make([]labeledOp, 0, len(m.stores))
+	for k, st := range m.stores {
+		storeOps = append(storeOps, labeledOp{[]string{k.backend, k.op}, st.clone()})
+	}
+	buffered, sessions := 0, 0
+	for _, n := range m.shortTerm {
+		buffered += n
+		sessions++
+	}
+	names := make([]string, 0, len(m.spaces))
+	for name := range m.spaces {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(storeOps, func(i, j int) bool {
+		return strings.Join(storeOps[i].labels, "\x00") < strings.Join(storeOps[j].labels, "\x00")
+	})
+	writeOpStats(w, "memory_bank_tool", "MCP tool", []string{"tool"}, toolOps)
+	writeOpStats(w, "memory_bank_embed", "embedding provider", nil, embedOps)
+	writeOpStats(w, "memory_bank_store", "vector store", []string{"backend", "op"}, storeOps)
+
+	// A scrape must not change state, so expired spaces are skipped here
+	// and left to the lifecycle sweeper to remove.
+	spaces := 0
+	now := time.Now()
+	for _, name := range names {
+		if sp, ok := a.catalog.get(name); !ok || sp.ExpiresAt.IsZero() || now.Before(sp.ExpiresAt) {
+			spaces++
+		}
+	}
+
+	a.mu.RLock()
+	shared := len(a.shared)
+	a.mu.RUnlock()
+	writeGauge(w, "memory_bank_short_term_buffered_records", "Records in all short-term buffers.", float64(buffered))
+	writeGauge(w, "memory_bank_short_term_sessions", "Sessions with a non-empty short-term buffer.", float64(sessions))
+	writeGauge(w, "memory_bank_spaces", "Spaces created through spaces.upsert or spaces.grant that have not expired.", float64(spaces))
+	writeGauge(w, "memory_bank_shared_sessions", "Principals with a shared session view.", float64(shared))
+
+	// Engine counters and server-side subsystem stats, one metric per field.
+	rep := a.metricsReport()
+	writeStructMetrics(w, "memory_bank_engine", rep.MetricsSnapshot)
+	writeStructMetrics(w, "memory_bank_embed_cache", rep.EmbedCache)
+	writeStructMetrics(w, "memory_bank_embed_provider", rep.EmbedProvider)
+	writeStructMetrics(w, "memory_bank_write_queue", rep.WriteQueue)
+	writeStructMetrics(w, "memory_bank_fact_queue", rep.FactQueue)
+	writeStructMetrics(w, "memory_bank_space_lifecycle", rep.Spaces)
+	writeGauge(w, "memory_bank_embed_incompatible_skipped", "Search hits dropped because another embedder produced them.", float64(rep.EmbedModel.IncompatibleSkipped))
+	writeGauge(w, "memory_bank_embed_breaker_open", "1 if the embedding provider's circuit breaker is open.", boolFloat(rep.EmbedProvider.BreakerState == breakerOpen))
+}
+
+type labeledOp struct {
+	labels []string
+	stat   *opStat
+}
+
+// sortedOps copies ops ordered by key; m.mu must be held.
+func sortedOps(ops map[string]*opStat, labels func(string) []string) []labeledOp {
+	keys := make([]string, 0, len(ops))
+	for k := range ops {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]labeledOp, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, labeledOp{labels(k), ops[k].clone()})
+	}
+	return out
+}
+
+// writeOpStats emits <prefix>_calls_total, <prefix>_errors_total and a
+// <prefix>_duration_seconds histogram.
+func writeOpStats(w io.Writer, prefix, what string, labelNames []string, ops []labeledOp) {
+	fmt.Fprintf(w, "# HELP %s_calls_total Calls to the %s.\n# TYPE %s_calls_total counter\n", prefix, what, prefix)
+	for _, op := range ops {
+		fmt.Fprintf(w, "%s_calls_total%s %d\n", prefix, labelSet(labelNames, op.labels, ""), op.stat.latency.count)
+	}
+	fmt.Fprintf(w, "# HELP %s_errors_total Failed calls to the %s.\n# TYPE %s_errors_total counter\n", prefix, what, prefix)
+	for _, op := range ops {
+		fmt.Fprintf(w, "%s_errors_total%s %d\n", prefix, labelSet(labelNames, op.labels, ""), op.stat.errors)
+	}
+	fmt.Fprintf(w, "# HELP %s_duration_seconds Latency of %s calls.\n# TYPE %s_duration_seconds histogram\n", prefix, what, prefix)
+	for _, op := range ops {
+		h := op.stat.latency
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "%s_duration_seconds_bucket%s %d\n", prefix, labelSet(labelNames, op.labels, fmt.Sprint(le)), cum)
+		}
+		fmt.Fprintf(w, "%s_duration_seconds_bucket%s %d\n", prefix, labelSet(labelNames, op.labels, "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_duration_seconds_sum%s %g\n", prefix, labelSet(labelNames, op.labels, ""), h.sum)
+		fmt.Fprintf(w, "%s_duration_seconds_count%s %d\n", prefix, labelSet(labelNames, op.labels, ""), h.count)
+	}
+}
+
+func labelSet(names, values []string, le string) string {
+	parts := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		parts = append(parts, n+"="+quoteLabel(values[i]))
+	}
+	if le != "" {
+		parts = append(parts, "le="+quoteLabel(le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func quoteLabel(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return `"` + v + `"`
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+}
+
+// writeStructMetrics emits one untyped metric per numeric or bool field of
+// v, named after its json tag, so new snapshot fields show up without
+// touching this file.
+func writeStructMetrics(w io.Writer, prefix string, v any) {
+	rv := reflect.ValueOf(v)
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		tag := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		var val float64
+		switch f := rv.Field(i); f.Kind() {
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			val = float64(f.Int())
+		case reflect.Uint, reflect.Uint32, reflect.Uint64:
+			val = float64(f.Uint())
+		case reflect.Float32, reflect.Float64:
+			val = f.Float()
+		case reflect.Bool:
+			val = boolFloat(f.Bool())
+		default:
+			continue
+		}
+		name := prefix + "_" + tag
+		fmt.Fprintf(w, "# TYPE %s untyped\n%s %g\n", name, name, val)
+	}
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
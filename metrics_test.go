@@ -0,0 +1,57 @@
+// metrics_test.go
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetricsExposition(t *testing.T) {
+	app := newTestApp(t, nil)
+	m := app.metrics
+	m.observeTool("probe_tool", 2*time.Millisecond, nil)
+	m.observeTool("probe_tool", 20*time.Second, errors.New("boom"))
+	m.observeStore("probe", `op"x`, time.Millisecond, nil)
+
+	var b strings.Builder
+	app.writeMetrics(&b)
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE memory_bank_tool_calls_total counter\n",
+		`memory_bank_tool_calls_total{tool="probe_tool"} 2` + "\n",
+		`memory_bank_tool_errors_total{tool="probe_tool"} 1` + "\n",
+		"# TYPE memory_bank_tool_duration_seconds histogram\n",
+		`memory_bank_tool_duration_seconds_bucket{tool="probe_tool",le="0.005"} 1` + "\n",
+		`memory_bank_tool_duration_seconds_bucket{tool="probe_tool",le="+Inf"} 2` + "\n",
+		`memory_bank_tool_duration_seconds_count{tool="probe_tool"} 2` + "\n",
+		`memory_bank_store_calls_total{backend="probe",op="op\"x"} 1` + "\n",
+		"memory_bank_embed_calls_total ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("exposition lacks %q", want)
+		}
+	}
+}
+
+// lockCheckWriter fails the test if the metrics lock is held during a write.
+type lockCheckWriter struct {
+	t *testing.T
+	m *serverMetrics
+}
+
+func (w lockCheckWriter) Write(p []byte) (int, error) {
+	if !w.m.mu.TryLock() {
+		w.t.Fatalf("metrics lock held while writing %q", p)
+	}
+	w.m.mu.Unlock()
+	return len(p), nil
+}
+
+func TestWriteMetricsReleasesLockBeforeWriting(t *testing.T) {
+	app := newTestApp(t, nil)
+	app.metrics.observeTool("probe_tool", time.Millisecond, nil)
+	app.metrics.observeStore("probe", "store", time.Millisecond, nil)
+	app.writeMetrics(lockCheckWriter{t, app.metrics})
+}
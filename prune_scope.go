@@ -0,0 +1,52 @@
+// prune_scope.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+)
+
+// pruneScopeStore is the store the engine sees. Engine.Prune drops every
+// record whose content repeats an earlier one anywhere in the store, which
+// would delete the copies forks and merges make in other sessions. Iterate
+// therefore prefixes each record's content with its dedup scope, so Prune
+// only treats records of the same scope as duplicates.
+type pruneScopeStore struct {
+	memory.VectorStore
+}
+
+// dedupScope is the scope within which Prune dedups rec: its session, or
+// for records restored from a snapshot, the restore run, so the staged
+// copies are not taken for duplicates of the records they replace.
+// Versions of an edited record are never deduped: a revert stores the
+// content of an earlier version again on purpose. Extracted facts and
+// entities are only deduped against their own kind, as their text often
+// repeats the record they came from.
+func dedupScope(rec model.MemoryRecord) string {
+	if !strings.Contains(rec.Metadata, metaRestoreRun) && !strings.Contains(rec.Metadata, metaLineage) && !strings.Contains(rec.Metadata, metaKind) {
+		return rec.SessionID
+	}
+	meta := model.DecodeMetadata(rec.Metadata)
+	if isExtracted(meta) {
+		return rec.SessionID + "\x00" + fmt.Sprint(meta[metaKind])
+	}
+	if _, ok := meta[metaLineage]; ok {
+		return rec.SessionID + "\x00" + strconv.FormatInt(rec.ID, 10)
+	}
+	if run, _ := meta[metaRestoreRun].(string); run != "" {
+		return rec.SessionID + "\x00" + run
+	}
+	return rec.SessionID
+}
+
+func (s *pruneScopeStore) Iterate(ctx context.Context, fn func(model.MemoryRecord) bool) error {
+	return s.VectorStore.Iterate(ctx, func(rec model.MemoryRecord) bool {
+		rec.Content = dedupScope(rec) + "\x00" + rec.Content
+		return fn(rec)
+	})
+}
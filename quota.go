@@ -0,0 +1,562 @@
+// quota.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+	"golang.org/x/time/rate"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// QuotaLimits caps one principal, session or space. Zero means unlimited.
+type QuotaLimits struct {
+	MaxRecords   int64 `json:"max_records"`
+	MaxBytes     int64 `json:"max_bytes"`
+	WritesPerMin int   `json:"writes_per_min"`
+	EmbedsPerMin int   `json:"embeds_per_min"`
+}
+
+func (l QuotaLimits) zero() bool {
+	return l == QuotaLimits{}
+}
+
+// QuotaSettings is the "quotas" block of settings.json.
+type QuotaSettings struct {
+	Principal  QuotaLimits `json:"principal"`
+	Session    QuotaLimits `json:"session"`
+	Space      QuotaLimits `json:"space"`
+	RecountSec int         `json:"recount_sec"`
+}
+
+// quotaLimitsFromEnv overrides l with QUOTA_<SCOPE>_* variables.
+func quotaLimitsFromEnv(scope string, l QuotaLimits) QuotaLimits {
+	prefix := "QUOTA_" + strings.ToUpper(scope) + "_"
+	l.MaxRecords = int64(envIntOrDefault(prefix+"MAX_RECORDS", int(l.MaxRecords)))
+	l.MaxBytes = int64(envIntOrDefault(prefix+"MAX_BYTES", int(l.MaxBytes)))
+	l.WritesPerMin = envIntOrDefault(prefix+"WRITES_PER_MIN", l.WritesPerMin)
+	l.EmbedsPerMin = envIntOrDefault(prefix+"EMBEDS_PER_MIN", l.EmbedsPerMin)
+	return l
+}
+
+// Quota scope kinds.
+const (
+	scopePrincipal = "principal"
+	scopeSession   = "session"
+	scopeSpace     = "space"
+)
+
+// ErrQuotaExceeded is returned when a call would go over a limit.
+type ErrQuotaExceeded struct {
+	Scope   string
+	Name    string
+	Limit   string
+	Max     int64
+	Current int64
+}
+
+func (e *ErrQuotaExceeded) Error() string {
+	if strings.HasSuffix(e.Limit, "_per_min") {
+		return fmt.Sprintf("quota exceeded: %s %q is limited to %d %s", e.Scope, e.Name, e.Max, e.Limit)
+	}
+	return fmt.Sprintf("quota exceeded: %s %q is at %d of %d %s", e.Scope, e.Name, e.Current, e.Max, e.Limit)
+}
+
+type scopeKey struct{ kind, name string }
+
+type quotaUsage struct {
+	records int64
+	bytes   int64
+	// buffered records and bytes sit in a short-term buffer and count
+	// against max_records and max_bytes until they are flushed.
+	buffered      int64
+	bufferedBytes int64
+	// reserved records and bytes were admitted by checkWrite but have not
+	// reached the store or a buffer yet, so concurrent writes cannot all
+	// pass the same capacity check.
+	reserved      int64
+	reservedBytes int64
+	writes        *rate.Limiter
+	embeds        *rate.Limiter
+}
+
+// bufferedWrite is one short-term record's charge, released on flush.
+type bufferedWrite struct {
+	scopes []scopeKey
+	size   int64
+}
+
+// quotaManager tracks stored records and bytes per scope, and rate limits
+// writes and embeds with one token bucket per scope. Record and byte
+// counts are bumped on every store write and rebuilt from the store
+// periodically, which also accounts for deletions.
+type quotaManager struct {
+	mu        sync.Mutex
+	limits    map[string]QuotaLimits
+	usage     map[scopeKey]*quotaUsage
+	shortTerm map[string][]bufferedWrite
+	synced    time.Time
+}
+
+func newQuotaManager(qs QuotaSettings) *quotaManager {
+	return &quotaManager{
+		limits: map[string]QuotaLimits{
+			scopePrincipal: qs.Principal,
+			scopeSession:   qs.Session,
+			scopeSpace:     qs.Space,
+		},
+		usage:     make(map[scopeKey]*quotaUsage),
+		shortTerm: make(map[string][]bufferedWrite),
+	}
+}
+
+func (q *quotaManager) enabled() bool {
+	for _, l := range q.limits {
+		if !l.zero() {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the usage entry for a scope; callers hold q.mu.
+func (q *quotaManager) get(kind, name string) *quotaUsage {
+	key := scopeKey{kind, name}
+	u := q.usage[key]
+	if u == nil {
+		u = &quotaUsage{}
+		l := q.limits[kind]
+		if l.WritesPerMin > 0 {
+			u.writes = rate.NewLimiter(rate.Limit(float64(l.WritesPerMin)/60), l.WritesPerMin)
+		}
+		if l.EmbedsPerMin > 0 {
+			u.embeds = rate.NewLimiter(rate.Limit(float64(l.EmbedsPerMin)/60), l.EmbedsPerMin)
+		}
+		q.usage[key] = u
+	}
+	return u
+}
+
+// quotaSubject is who a tool call acts for, taken from its arguments.
+type quotaSubject struct {
+	Principal string
+	Session   string
+	Space     string
+}
+
+func (s quotaSubject) scopes() []scopeKey {
+	var out []scopeKey
+	if s.Principal != "" {
+		out = append(out, scopeKey{scopePrincipal, s.Principal})
+	}
+	if s.Session != "" {
+		out = append(out, scopeKey{scopeSession, s.Session})
+	}
+	if s.Space != "" {
+		out = append(out, scopeKey{scopeSpace, s.Space})
+	}
+	return out
+}
+
+type quotaSubjectKey struct{}
+
+// quotaMiddleware records the call's principal/session/space so checks
+// deeper in the handler (including App.embed) know whom to charge. A
+// call on an owned session is charged to the owner, whatever principal
+// it names.
+func quotaMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		subject := subjectOf(req)
+		if app := appFor(ctx, nil); app != nil {
+			subject.Principal = app.chargedPrincipal(subject.Session, subject.Principal)
+		}
+		return next(context.WithValue(ctx, quotaSubjectKey{}, subject), req)
+	}
+}
+
+func subjectOf(req mcp.CallToolRequest) quotaSubject {
+	return quotaSubject{
+		Principal: strings.TrimSpace(getStringParam(req, "principal")),
+		Session:   strings.TrimSpace(getStringParam(req, "session_id")),
+		Space:     strings.TrimSpace(getStringParam(req, "space")),
+	}
+}
+
+func quotaSubjectFrom(ctx context.Context) quotaSubject {
+	s, _ := ctx.Value(quotaSubjectKey{}).(quotaSubject)
+	return s
+}
+
+// chargedPrincipal is who a write to session sid is charged to. Principals
+// in tool arguments are not verified, so an owned session always charges
+// its owner; asserted is used only for sessions without one.
+func (a *App) chargedPrincipal(sid, asserted string) string {
+	if sid != "" {
+		if info, err := a.sessions.get(sid); err == nil && info.Owner != "" {
+			return info.Owner
+		}
+	}
+	return asserted
+}
+
+// stampPrincipal sets meta's principal to whom a write to sid is charged,
+// so the store counts the record against the principal checkWrite checked.
+func (a *App) stampPrincipal(ctx context.Context, sid string, meta map[string]any) {
+	asserted, _ := meta["principal"].(string)
+	if asserted == "" {
+		asserted = quotaSubjectFrom(ctx).Principal
+	}
+	if p := a.chargedPrincipal(sid, strings.TrimSpace(asserted)); p != "" {
+		meta["principal"] = p
+	}
+}
+
+// checkWrite admits a write of size bytes with metadata meta to session.
+// Every scope the record will count against is checked for records and
+// bytes, then write tokens are taken from all of them or from none. The
+// record and bytes stay reserved until the returned release is called,
+// which the caller does once the record is stored or buffered, or the
+// write failed. release may be called more than once.
+func (q *quotaManager) checkWrite(session string, meta map[string]any, size int) (func(), error) {
+	if !q.enabled() {
+		return func() {}, nil
+	}
+	owner := ownerOf(session, meta)
+	if owner.Principal == "" && !q.limits[scopePrincipal].zero() {
+		return nil, fmt.Errorf("quota: a principal is required when principal quotas are set")
+	}
+	scopes := owner.scopes()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.capacityLocked(scopes, 1, int64(size)); err != nil {
+		return nil, err
+	}
+	limiters := make([]*rate.Limiter, len(scopes))
+	for i, k := range scopes {
+		limiters[i] = q.get(k.kind, k.name).writes
+	}
+	if i := takeAll(limiters); i >= 0 {
+		k := scopes[i]
+		return nil, &ErrQuotaExceeded{Scope: k.kind, Name: k.name, Limit: "writes_per_min", Max: int64(q.limits[k.kind].WritesPerMin)}
+	}
+	q.reserveLocked(scopes, int64(size), 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.reserveLocked(scopes, int64(size), -1)
+		})
+	}, nil
+}
+
+func (q *quotaManager) reserveLocked(scopes []scopeKey, size, sign int64) {
+	for _, k := range scopes {
+		u := q.get(k.kind, k.name)
+		u.reserved += sign
+		u.reservedBytes += sign * size
+	}
+}
+
+// checkCapacity admits n records of size bytes in total for owner without
+// spending write tokens. Server-side copies (forks, merges, extracted
+// facts) use it: they add records, but are not writes of the caller's.
+func (q *quotaManager) checkCapacity(owner recordOwner, n int, size int) error {
+	if !q.enabled() {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.capacityLocked(owner.scopes(), int64(n), int64(size))
+}
+
+// capacityLocked checks record and byte limits, counting buffered
+// short-term records and reserved writes; callers hold q.mu.
+func (q *quotaManager) capacityLocked(scopes []scopeKey, n, size int64) error {
+	for _, k := range scopes {
+		l, u := q.limits[k.kind], q.get(k.kind, k.name)
+		if cur := u.records + u.buffered + u.reserved; l.MaxRecords > 0 && cur+n > l.MaxRecords {
+			return &ErrQuotaExceeded{Scope: k.kind, Name: k.name, Limit: "max_records", Max: l.MaxRecords, Current: cur}
+		}
+		if cur := u.bytes + u.bufferedBytes + u.reservedBytes; l.MaxBytes > 0 && cur+size > l.MaxBytes {
+			return &ErrQuotaExceeded{Scope: k.kind, Name: k.name, Limit: "max_bytes", Max: l.MaxBytes, Current: cur}
+		}
+	}
+	return nil
+}
+
+// takeAll takes one token from every non-nil limiter, or none of them. It
+// returns the index of the first limiter without a token, or -1.
+func takeAll(limiters []*rate.Limiter) int {
+	now := time.Now()
+	held := make([]*rate.Reservation, 0, len(limiters))
+	for i, l := range limiters {
+		if l == nil {
+			continue
+		}
+		r := l.ReserveN(now, 1)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			r.CancelAt(now)
+			for _, h := range held {
+				h.CancelAt(now)
+			}
+			return i
+		}
+		held = append(held, r)
+	}
+	return -1
+}
+
+// checkEmbed admits one embedding call for the call's subject.
+func (q *quotaManager) checkEmbed(ctx context.Context) error {
+	scopes := quotaSubjectFrom(ctx).scopes()
+	if len(scopes) == 0 || !q.enabled() {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limiters := make([]*rate.Limiter, len(scopes))
+	for i, k := range scopes {
+		limiters[i] = q.get(k.kind, k.name).embeds
+	}
+	if i := takeAll(limiters); i >= 0 {
+		k := scopes[i]
+		return &ErrQuotaExceeded{Scope: k.kind, Name: k.name, Limit: "embeds_per_min", Max: int64(q.limits[k.kind].EmbedsPerMin)}
+	}
+	return nil
+}
+
+// buffer charges a record added to session's short-term buffer, which
+// keeps at most limit records; the oldest charge goes when it overflows.
+func (q *quotaManager) buffer(session string, owner recordOwner, size, limit int) {
+	if !q.enabled() {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w := bufferedWrite{scopes: owner.scopes(), size: int64(size)}
+	q.chargeLocked(w, 1)
+	q.shortTerm[session] = append(q.shortTerm[session], w)
+	if buf := q.shortTerm[session]; limit > 0 && len(buf) > limit {
+		q.chargeLocked(buf[0], -1)
+		q.shortTerm[session] = buf[1:]
+	}
+}
+
+// flushed releases session's buffered charges once the buffer reached the
+// store, where recordStored counts the records instead.
+func (q *quotaManager) flushed(session string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, w := range q.shortTerm[session] {
+		q.chargeLocked(w, -1)
+	}
+	delete(q.shortTerm, session)
+}
+
+func (q *quotaManager) chargeLocked(w bufferedWrite, sign int64) {
+	for _, k := range w.scopes {
+		u := q.get(k.kind, k.name)
+		u.buffered += sign
+		u.bufferedBytes += sign * w.size
+	}
+}
+
+// recordStored counts a record that reached the vector store.
+func (q *quotaManager) recordStored(rec recordOwner, size int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, k := range rec.scopes() {
+		u := q.get(k.kind, k.name)
+		u.records++
+		u.bytes += int64(size)
+	}
+}
+
+// recordOwner names the scopes a stored record counts against.
+type recordOwner struct {
+	Session   string
+	Space     string
+	Principal string
+}
+
+func (o recordOwner) scopes() []scopeKey {
+	out := []scopeKey{{scopeSession, o.Session}}
+	if o.Space != "" {
+		out = append(out, scopeKey{scopeSpace, o.Space})
+	}
+	if o.Principal != "" {
+		out = append(out, scopeKey{scopePrincipal, o.Principal})
+	}
+	return out
+}
+
+func ownerOf(sessionID string, meta map[string]any) recordOwner {
+	o := recordOwner{Session: sessionID, Space: sessionID}
+	if space, _ := meta["space"].(string); space != "" {
+		o.Space = space
+	}
+	o.Principal, _ = meta["principal"].(string)
+	return o
+}
+
+// recount rebuilds record and byte usage from the store.
+func (q *quotaManager) recount(ctx context.Context, vs memory.VectorStore) error {
+	type tally struct{ records, bytes int64 }
+	counts := map[scopeKey]*tally{}
+	err := vs.Iterate(ctx, func(rec model.MemoryRecord) bool {
+		owner := ownerOf(rec.SessionID, model.DecodeMetadata(rec.Metadata))
+		if rec.Space != "" {
+			owner.Space = rec.Space
+		}
+		for _, k := range owner.scopes() {
+			t := counts[k]
+			if t == nil {
+				t = &tally{}
+				counts[k] = t
+			}
+			t.records++
+			t.bytes += int64(len(rec.Content))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for k, u := range q.usage {
+		if t := counts[k]; t != nil {
+			u.records, u.bytes = t.records, t.bytes
+		} else {
+			u.records, u.bytes = 0, 0
+		}
+	}
+	for k, t := range counts {
+		u := q.get(k.kind, k.name)
+		u.records, u.bytes = t.records, t.bytes
+	}
+	q.synced = time.Now().UTC()
+	return nil
+}
+
+func (q *quotaManager) runRecount(ctx context.Context, vs memory.VectorStore, every time.Duration) {
+	if err := q.recount(ctx, vs); err != nil {
+		slog.Warn("quota recount failed", "error", err)
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := q.recount(ctx, vs); err != nil {
+				slog.Warn("quota recount failed", "error", err)
+			}
+		}
+	}
+}
+
+// QuotaStatus is one scope's limits and usage as reported by quota.status.
+type QuotaStatus struct {
+	Scope            string      `json:"scope"`
+	Name             string      `json:"name"`
+	Limits           QuotaLimits `json:"limits"`
+	Records          int64       `json:"records"`
+	Bytes            int64       `json:"bytes"`
+	Buffered         int64       `json:"buffered,omitempty"`
+	Reserved         int64       `json:"reserved,omitempty"`
+	WritesAvailable  *int        `json:"writes_available,omitempty"`
+	EmbedsAvailable  *int        `json:"embeds_available,omitempty"`
+	UsageRecountedAt time.Time   `json:"usage_recounted_at,omitempty"`
+}
+
+func (q *quotaManager) status(kind, name string) QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.statusLocked(scopeKey{kind, name}, q.get(kind, name))
+}
+
+func (q *quotaManager) statusLocked(k scopeKey, u *quotaUsage) QuotaStatus {
+	st := QuotaStatus{
+		Scope:            k.kind,
+		Name:             k.name,
+		Limits:           q.limits[k.kind],
+		Records:          u.records,
+		Bytes:            u.bytes,
+		Buffered:         u.buffered,
+		Reserved:         u.reserved,
+		UsageRecountedAt: q.synced,
+	}
+	if u.writes != nil {
+		n := int(u.writes.Tokens())
+		st.WritesAvailable = &n
+	}
+	if u.embeds != nil {
+		n := int(u.embeds.Tokens())
+		st.EmbedsAvailable = &n
+	}
+	return st
+}
+
+func (q *quotaManager) all() []QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]QuotaStatus, 0, len(q.usage))
+	for k, u := range q.usage {
+		out = append(out, q.statusLocked(k, u))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Scope != out[j].Scope {
+			return out[i].Scope < out[j].Scope
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// quotaStore counts every record written to the store against its
+// session, space and principal.
+type quotaStore struct {
+	memory.VectorStore
+	quotas *quotaManager
+}
+
+func (s *quotaStore) StoreMemory(ctx context.Context, sessionID, content string, metadata map[string]any, embedding []float32) error {
+	if err := s.VectorStore.StoreMemory(ctx, sessionID, content, metadata, embedding); err != nil {
+		return err
+	}
+	s.quotas.recordStored(ownerOf(sessionID, metadata), len(content))
+	return nil
+}
+
+func registerQuotaTools(s *server.MCPServer, app *App) {
+	statusTool := mcp.NewTool("quota.status",
+		mcp.WithDescription("Report quota limits and current usage for a principal, session or space (all tracked scopes if none is given)"),
+		mcp.WithString("principal"),
+		mcp.WithString("session_id"),
+		mcp.WithString("space"),
+	)
+	s.AddTool(statusTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		scopes := subjectOf(req).scopes()
+		if len(scopes) == 0 {
+			return mcp.NewToolResultJSON(map[string]any{"enabled": app.quotas.enabled(), "scopes": app.quotas.all()})
+		}
+		out := make([]QuotaStatus, 0, len(scopes))
+		for _, k := range scopes {
+			out = append(out, app.quotas.status(k.kind, k.name))
+		}
+		return mcp.NewToolResultJSON(map[string]any{"enabled": app.quotas.enabled(), "scopes": out})
+	})
+}
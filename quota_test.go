@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQuotaDenialSpendsNoTokens(t *testing.T) {
+	q := newQuotaManager(QuotaSettings{
+		Principal: QuotaLimits{WritesPerMin: 1},
+		Session:   QuotaLimits{WritesPerMin: 2},
+	})
+	if _, err := q.checkWrite("s1", map[string]any{"principal": "alice"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	var qe *ErrQuotaExceeded
+	if _, err := q.checkWrite("s1", map[string]any{"principal": "alice"}, 1); !errors.As(err, &qe) || qe.Scope != scopePrincipal {
+		t.Fatalf("second write by alice = %v, want a principal quota error", err)
+	}
+	// The denied write must not have used s1's second token.
+	if _, err := q.checkWrite("s1", map[string]any{"principal": "bob"}, 1); err != nil {
+		t.Fatalf("write by bob = %v, want it admitted", err)
+	}
+}
+
+func TestQuotaRequiresPrincipal(t *testing.T) {
+	q := newQuotaManager(QuotaSettings{Principal: QuotaLimits{MaxRecords: 10}})
+	if _, err := q.checkWrite("s1", map[string]any{}, 1); err == nil {
+		t.Fatal("write without a principal was admitted")
+	}
+	if _, err := q.checkWrite("s1", map[string]any{"principal": "alice"}, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuotaCountsBufferedRecords(t *testing.T) {
+	app := newTestApp(t, func(s *GeminiSettings) {
+		s.Quotas.Session = QuotaLimits{MaxRecords: 2}
+	})
+	ctx := context.Background()
+	for _, content := range []string{"the deploy runs on fridays", "billing uses postgres"} {
+		release, err := app.quotas.checkWrite("s1", map[string]any{}, len(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := app.embed(ctx, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.addShortTerm("s1", content, "{}", e)
+		release()
+	}
+	if _, err := app.quotas.checkWrite("s1", map[string]any{}, 1); err == nil {
+		t.Fatal("third buffered write was admitted")
+	}
+	if err := app.flushShortTerm(ctx, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.quotas.checkWrite("s1", map[string]any{}, 1); err == nil {
+		t.Fatal("write after flush was admitted")
+	}
+}
+
+func TestQuotaAppliesSpaceFromMetadata(t *testing.T) {
+	app := newTestApp(t, func(s *GeminiSettings) {
+		s.Quotas.Space = QuotaLimits{MaxRecords: 1}
+	})
+	mustStore(t, app, "s1", "the team standup is at nine", map[string]any{"space": "team"})
+	if _, err := app.quotas.checkWrite("s2", map[string]any{"space": "team"}, 1); err == nil {
+		t.Fatal("write to a full space named in metadata was admitted")
+	}
+}
+
+func TestQuotaReservesAdmittedWrites(t *testing.T) {
+	q := newQuotaManager(QuotaSettings{Session: QuotaLimits{MaxRecords: 5}})
+	var (
+		mu       sync.Mutex
+		admitted int
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := q.checkWrite("s1", map[string]any{}, 1); err == nil {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if admitted != 5 {
+		t.Fatalf("%d concurrent writes admitted, want 5", admitted)
+	}
+
+	q = newQuotaManager(QuotaSettings{Session: QuotaLimits{MaxRecords: 1}})
+	release, err := q.checkWrite("s1", map[string]any{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.checkWrite("s1", map[string]any{}, 1); err == nil {
+		t.Fatal("second write admitted while the first is reserved")
+	}
+	// A failed store releases its reservation.
+	release()
+	release()
+	if _, err := q.checkWrite("s1", map[string]any{}, 1); err != nil {
+		t.Fatalf("write after release = %v, want it admitted", err)
+	}
+}
+
+func TestQueuedWriteReleasesReservation(t *testing.T) {
+	q, err := newWriteQueue(10, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := 0
+	for _, outcome := range []error{nil, errors.New("status 400")} {
+		if _, err := q.push(&queuedWrite{Kind: writeLong, SessionID: "s1", Content: "x", release: func() { released++ }}); err != nil {
+			t.Fatal(err)
+		}
+		w := q.next(time.Now())
+		w.Attempts = writeMaxAttempts - 1
+		q.finish(w, 0, outcome)
+	}
+	if released != 2 {
+		t.Fatalf("%d reservations released, want one per finished or failed write", released)
+	}
+}
@@ -0,0 +1,378 @@
+// resilient_embedder.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"golang.org/x/time/rate"
+)
+
+// ResilienceOptions configures retries, rate limiting and circuit breaking
+// around an embedding provider.
+type ResilienceOptions struct {
+	MaxRetries       int
+	BaseBackoff      time.Duration
+	MaxBackoff       time.Duration
+	RatePerSec       float64
+	RateBurst        int
+	FailureThreshold int
+	OpenTimeout      time.Duration
+}
+
+// ErrCircuitOpen is returned without calling the provider while the
+// breaker is open.
+type ErrCircuitOpen struct {
+	Provider   string
+	RetryAfter time.Duration
+}
+
+func (e *ErrCircuitOpen) Error() string {
+	return fmt.Sprintf("embedding provider %s unavailable (circuit open, retry in %ds)", e.Provider, int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// ErrEmbedRejected is a provider error that retrying cannot fix, such as
+// a 4xx response or invalid input. It is not retried, does not count
+// towards the breaker and is not queued for later.
+type ErrEmbedRejected struct {
+	Provider string
+	Err      error
+}
+
+func (e *ErrEmbedRejected) Error() string {
+	return fmt.Sprintf("embedding provider %s rejected the request: %v", e.Provider, e.Err)
+}
+
+func (e *ErrEmbedRejected) Unwrap() error { return e.Err }
+
+// httpStatusRe finds an HTTP status in a lowercased error message, e.g.
+// "status 503", "http 429" or "400 bad request", but not a bare number
+// such as a vector dimension.
+var httpStatusRe = regexp.MustCompile(`(?:status|code|http\S*)\D{0,3}([45]\d\d)\b|\b([45]\d\d) (?:bad|unauthori|forbidden|not found|method|payload|unprocessable|too many|internal|service|gateway|request)`)
+
+// isTransientEmbedError reports whether err may go away on retry: network
+// failures, timeouts, 408/429 and 5xx responses. Providers wrap their
+// errors as text, so status codes and well-known phrases are matched in
+// the message; anything unrecognised is treated as permanent.
+func isTransientEmbedError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	if m := httpStatusRe.FindStringSubmatch(msg); m != nil {
+		code, _ := strconv.Atoi(m[1] + m[2])
+		return code == 408 || code == 429 || code >= 500
+	}
+	for _, s := range []string{"timeout", "timed out", "connection refused", "connection reset", "eof",
+		"temporarily", "unavailable", "rate limit", "too many requests", "overloaded", "no such host"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// EmbedProviderStats is reported under engine.metrics.
+type EmbedProviderStats struct {
+	Provider            string    `json:"provider"`
+	BreakerState        string    `json:"breaker_state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenedAt            time.Time `json:"opened_at,omitempty"`
+	Calls               int64     `json:"calls"`
+	Failures            int64     `json:"failures"`
+	Rejected            int64     `json:"rejected"`
+	Retries             int64     `json:"retries"`
+	ShortCircuited      int64     `json:"short_circuited"`
+	BreakerOpens        int64     `json:"breaker_opens"`
+	RateLimitWaits      int64     `json:"rate_limit_waits"`
+}
+
+// resilientEmbedder retries transient provider errors with exponential
+// backoff, rate limits calls with a token bucket and trips a circuit
+// breaker after repeated transient failures so callers fail fast. Errors
+// retrying cannot fix are returned at once as ErrEmbedRejected.
+type resilientEmbedder struct {
+	base     memory.Embedder
+	provider string
+	opts     ResilienceOptions
+	limiter  *rate.Limiter
+
+	mu            sync.Mutex
+	state         string
+	failures      int
+	openedAt      time.Time
+	probeInFlight bool
+
+	calls          atomic.Int64
+	failed         atomic.Int64
+	rejected       atomic.Int64
+	retries        atomic.Int64
+	shortCircuited atomic.Int64
+	opens          atomic.Int64
+	rateWaits      atomic.Int64
+}
+
+func newResilientEmbedder(base memory.Embedder, provider string, opts ResilienceOptions) *resilientEmbedder {
+	if opts.BaseBackoff <= 0 {
+		opts.BaseBackoff = 200 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Second
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = 30 * time.Second
+	}
+	r := &resilientEmbedder{base: base, provider: provider, opts: opts, state: breakerClosed}
+	if opts.RatePerSec > 0 {
+		burst := opts.RateBurst
+		if burst <= 0 {
+			burst = 1
+		}
+		r.limiter = rate.NewLimiter(rate.Limit(opts.RatePerSec), burst)
+	}
+	return r
+}
+
+func (r *resilientEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	if err := r.allow(); err != nil {
+		r.shortCircuited.Add(1)
+		return nil, err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= r.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			r.retries.Add(1)
+			if err := sleepCtx(ctx, r.backoff(attempt)); err != nil {
+				break
+			}
+		}
+		if r.limiter != nil {
+			if r.limiter.Tokens() < 1 {
+				r.rateWaits.Add(1)
+			}
+			if err := r.limiter.Wait(ctx); err != nil {
+				lastErr = err
+				break
+			}
+		}
+		r.calls.Add(1)
+		vec, err := r.base.Embed(ctx, text)
+		if err == nil && len(vec) == 0 {
+			err = errors.New("provider returned an empty embedding")
+		}
+		if err == nil {
+			r.onSuccess()
+			return vec, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+		if !isTransientEmbedError(err) {
+			// The provider answered; it is up, the request is bad.
+			r.rejected.Add(1)
+			r.onSuccess()
+			return nil, &ErrEmbedRejected{Provider: r.provider, Err: err}
+		}
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	if ctx.Err() != nil {
+		// The caller gave up; that says nothing about the provider.
+		r.onCanceled()
+		return nil, fmt.Errorf("embedding provider %s: %w", r.provider, lastErr)
+	}
+	r.failed.Add(1)
+	r.onFailure()
+	return nil, fmt.Errorf("embedding provider %s: %w", r.provider, lastErr)
+}
+
+// allow admits a call unless the breaker is open. After OpenTimeout a
+// single probe is let through (half-open); its outcome closes or re-opens
+// the breaker.
+func (r *resilientEmbedder) allow() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.state {
+	case breakerOpen:
+		if wait := r.opts.OpenTimeout - time.Since(r.openedAt); wait > 0 {
+			return &ErrCircuitOpen{Provider: r.provider, RetryAfter: wait}
+		}
+		r.state = breakerHalfOpen
+		r.probeInFlight = true
+		return nil
+	case breakerHalfOpen:
+		if r.probeInFlight {
+			return &ErrCircuitOpen{Provider: r.provider, RetryAfter: r.opts.OpenTimeout}
+		}
+		r.probeInFlight = true
+	}
+	return nil
+}
+
+func (r *resilientEmbedder) onSuccess() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != breakerClosed {
+		slog.Info("embedder circuit closed", "provider", r.provider)
+	}
+	r.state = breakerClosed
+	r.failures = 0
+	r.probeInFlight = false
+}
+
+func (r *resilientEmbedder) onFailure() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+	r.probeInFlight = false
+	if r.opts.FailureThreshold <= 0 {
+		return
+	}
+	if r.state == breakerHalfOpen || r.failures >= r.opts.FailureThreshold {
+		if r.state != breakerOpen {
+			r.opens.Add(1)
+			slog.Warn("embedder circuit opened", "provider", r.provider, "failures", r.failures)
+		}
+		r.state = breakerOpen
+		r.openedAt = time.Now()
+	}
+}
+
+// onCanceled frees the half-open probe of a canceled call, so the next
+// call probes instead, and leaves the breaker and failure count as they are.
+func (r *resilientEmbedder) onCanceled() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.probeInFlight = false
+}
+
+// Available reports whether a call would currently reach the provider.
+func (r *resilientEmbedder) Available() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state != breakerOpen || time.Since(r.openedAt) >= r.opts.OpenTimeout
+}
+
+func (r *resilientEmbedder) backoff(attempt int) time.Duration {
+	d := r.opts.BaseBackoff << (attempt - 1)
+	if d <= 0 || d > r.opts.MaxBackoff {
+		d = r.opts.MaxBackoff
+	}
+	// Equal jitter keeps concurrent retries from synchronising.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (r *resilientEmbedder) Stats() EmbedProviderStats {
+	r.mu.Lock()
+	st := EmbedProviderStats{
+		Provider:            r.provider,
+		BreakerState:        r.state,
+		ConsecutiveFailures: r.failures,
+	}
+	if r.state != breakerClosed {
+		st.OpenedAt = r.openedAt
+	}
+	r.mu.Unlock()
+	st.Calls = r.calls.Load()
+	st.Failures = r.failed.Load()
+	st.Rejected = r.rejected.Load()
+	st.Retries = r.retries.Load()
+	st.ShortCircuited = r.shortCircuited.Load()
+	st.BreakerOpens = r.opens.Load()
+	st.RateLimitWaits = r.rateWaits.Load()
+	return st
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// embedMemo holds the vectors embedded during one tool call. Handlers
+// embed content up front to surface provider errors, and Engine.Store or
+// Retrieve then embed the same text again; the memo serves the second
+// call even when the cache is disabled.
+type embedMemo struct {
+	mu   sync.Mutex
+	vecs map[string][]float32
+}
+
+type embedMemoKey struct{}
+
+// maxEmbedMemo bounds the memo of calls that embed many texts (forks,
+// merges); only the last few matter for the repeat.
+const maxEmbedMemo = 64
+
+// embedMemoMiddleware gives every tool call its own embedMemo.
+func embedMemoMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return next(context.WithValue(ctx, embedMemoKey{}, &embedMemo{vecs: make(map[string][]float32)}), req)
+	}
+}
+
+// memoEmbedder is the top of the embedder stack; it answers from the
+// call's embedMemo when the text was already embedded.
+type memoEmbedder struct {
+	base memory.Embedder
+}
+
+func (m *memoEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	memo, _ := ctx.Value(embedMemoKey{}).(*embedMemo)
+	if memo == nil {
+		return m.base.Embed(ctx, text)
+	}
+	key := normalizeEmbedText(text)
+	memo.mu.Lock()
+	vec, ok := memo.vecs[key]
+	memo.mu.Unlock()
+	if ok {
+		return append([]float32(nil), vec...), nil
+	}
+	vec, err := m.base.Embed(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	memo.mu.Lock()
+	if len(memo.vecs) >= maxEmbedMemo {
+		clear(memo.vecs)
+	}
+	memo.vecs[key] = append([]float32(nil), vec...)
+	memo.mu.Unlock()
+	return vec, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type fakeEmbedder struct {
+	calls int
+	errs  []error // returned in turn; nil once exhausted
+}
+
+func (f *fakeEmbedder) Embed(_ context.Context, text string) ([]float32, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []float32{float32(len(text)), 1}, nil
+}
+
+func TestIsTransientEmbedError(t *testing.T) {
+	for _, tc := range []struct {
+		err  string
+		want bool
+	}{
+		{"status 503: upstream unavailable", true},
+		{"HTTP 429 Too Many Requests", true},
+		{"dial tcp 127.0.0.1:11434: connect: connection refused", true},
+		{"400 Bad Request: input too long", false},
+		{"status code 401", false},
+		{"invalid input: expected 512 dimensions", false},
+		{"something odd happened", false},
+	} {
+		if got := isTransientEmbedError(errors.New(tc.err)); got != tc.want {
+			t.Errorf("isTransientEmbedError(%q) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+	if !isTransientEmbedError(fmt.Errorf("wrapped: %w", context.DeadlineExceeded)) {
+		t.Error("deadline exceeded should be transient")
+	}
+}
+
+func TestResilientEmbedderRetriesTransientErrors(t *testing.T) {
+	base := &fakeEmbedder{errs: []error{errors.New("status 503"), errors.New("status 502")}}
+	r := newResilientEmbedder(base, "fake", ResilienceOptions{MaxRetries: 3, BaseBackoff: time.Millisecond, FailureThreshold: 2})
+	if _, err := r.Embed(context.Background(), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if base.calls != 3 {
+		t.Fatalf("calls = %d, want 3", base.calls)
+	}
+	if st := r.Stats(); st.Retries != 2 || st.BreakerState != breakerClosed {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+func TestResilientEmbedderDoesNotRetryRejections(t *testing.T) {
+	base := &fakeEmbedder{errs: []error{errors.New("400 Bad Request"), errors.New("400 Bad Request"), errors.New("400 Bad Request")}}
+	r := newResilientEmbedder(base, "fake", ResilienceOptions{MaxRetries: 3, BaseBackoff: time.Millisecond, FailureThreshold: 1})
+	for i := 0; i < 3; i++ {
+		_, err := r.Embed(context.Background(), "hello")
+		var rejected *ErrEmbedRejected
+		if !errors.As(err, &rejected) {
+			t.Fatalf("err = %v, want ErrEmbedRejected", err)
+		}
+	}
+	if base.calls != 3 {
+		t.Fatalf("calls = %d, want one per Embed", base.calls)
+	}
+	if st := r.Stats(); st.BreakerState != breakerClosed || st.Rejected != 3 || st.Failures != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+func TestResilientEmbedderBreaker(t *testing.T) {
+	down := errors.New("connection refused")
+	base := &fakeEmbedder{errs: []error{down, down, down, down}}
+	r := newResilientEmbedder(base, "fake", ResilienceOptions{BaseBackoff: time.Millisecond, FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond})
+	ctx := context.Background()
+	r.Embed(ctx, "a")
+	r.Embed(ctx, "a")
+	var open *ErrCircuitOpen
+	if _, err := r.Embed(ctx, "a"); !errors.As(err, &open) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+	if base.calls != 2 {
+		t.Fatalf("open breaker reached the provider: %d calls", base.calls)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// The half-open probe fails and re-opens the breaker.
+	if _, err := r.Embed(ctx, "a"); err == nil || errors.As(err, &open) {
+		t.Fatalf("probe err = %v", err)
+	}
+	if st := r.Stats(); st.BreakerState != breakerOpen || st.BreakerOpens != 2 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+func TestMemoEmbedderReusesVectorWithinCall(t *testing.T) {
+	base := &fakeEmbedder{}
+	m := &memoEmbedder{base: base}
+	ctx := context.WithValue(context.Background(), embedMemoKey{}, &embedMemo{vecs: make(map[string][]float32)})
+	m.Embed(ctx, "some text")
+	m.Embed(ctx, " some   text ")
+	if base.calls != 1 {
+		t.Fatalf("calls = %d, want 1", base.calls)
+	}
+	m.Embed(context.Background(), "some text")
+	if base.calls != 2 {
+		t.Fatalf("calls without a memo = %d, want 2", base.calls)
+	}
+}
+
+func TestResilientEmbedderIgnoresCanceledCalls(t *testing.T) {
+	base := &fakeEmbedder{errs: []error{context.Canceled, context.Canceled, context.Canceled}}
+	r := newResilientEmbedder(base, "fake", ResilienceOptions{BaseBackoff: time.Millisecond, FailureThreshold: 1, OpenTimeout: time.Hour})
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := r.Embed(ctx, "a"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("err = %v, want context.Canceled", err)
+		}
+	}
+	if st := r.Stats(); st.BreakerState != breakerClosed || st.Failures != 0 || st.ConsecutiveFailures != 0 {
+		t.Fatalf("stats = %+v, want canceled calls not counted", st)
+	}
+	if _, err := r.Embed(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,507 @@
+// sessions.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// SessionInfo is one catalogued session. Projects lists the workspaces
+// whose current session it is.
+type SessionInfo struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	ForkedFrom  string    `json:"forked_from,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsed    time.Time `json:"last_used,omitzero"`
+	ArchivedAt  time.Time `json:"archived_at,omitzero"`
+	ExportFile  string    `json:"export_file,omitempty"`
+	Projects    []string  `json:"projects,omitempty"`
+	Current     bool      `json:"current,omitempty"`
+
+	savedUse time.Time // LastUsed as last written by touch
+}
+
+// sessionRegistry is the session catalog. It maps workspace keys to their
+// current session and names to sessions, and keeps each session's
+// metadata. It replaces the single session_id file, which every project
+// on the machine shared. Each stdio client runs its own server process on
+// the same sessions.json, so every call re-reads the file under a file
+// lock and writes its change back before releasing it.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	path     string
+	sessions map[string]*SessionInfo
+	bindings map[string]string
+}
+
+type sessionRegistryFile struct {
+	Sessions map[string]*SessionInfo `json:"sessions"`
+	Bindings map[string]string       `json:"bindings"`
+}
+
+// newSessionRegistry loads dir/sessions.json. On first start a legacy
+// session_id file is imported and bound to the server's workspace.
+func newSessionRegistry(dir string) (*sessionRegistry, error) {
+	r := &sessionRegistry{
+		path:     filepath.Join(dir, "sessions.json"),
+		sessions: make(map[string]*SessionInfo),
+		bindings: make(map[string]string),
+	}
+	release, err := r.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if _, err := os.Stat(r.path); os.IsNotExist(err) {
+		legacy, err := os.ReadFile(filepath.Join(dir, "session_id"))
+		if id := strings.TrimSpace(string(legacy)); err == nil && id != "" {
+			key := projectKey("")
+			r.sessions[id] = &SessionInfo{ID: id, CreatedAt: time.Now().UTC()}
+			r.bindings[key] = id
+			if err := r.save(); err != nil {
+				return nil, err
+			}
+			slog.Info("imported legacy session", "session_id", id, "project", key)
+		}
+	}
+	return r, nil
+}
+
+// begin locks the registry against this process and, through a lock
+// file, against others, then reloads sessions.json. The returned function
+// releases both locks.
+func (r *sessionRegistry) begin() (func(), error) {
+	r.mu.Lock()
+	unlock, err := lockFile(r.path + ".lock")
+	if err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	release := func() {
+		unlock()
+		r.mu.Unlock()
+	}
+	if err := r.reload(); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// view is begin for calls that cannot fail: if the file cannot be
+// reloaded, the catalog as last loaded is used.
+func (r *sessionRegistry) view() func() {
+	release, err := r.begin()
+	if err != nil {
+		slog.Warn("session registry reload failed", "path", r.path, "error", err)
+		r.mu.Lock()
+		return r.mu.Unlock
+	}
+	return release
+}
+
+// reload replaces the catalog with the file's, keeping the later use of
+// sessions this process touched without saving; r.mu must be held.
+func (r *sessionRegistry) reload() error {
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read session registry: %w", err)
+	}
+	var f sessionRegistryFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", r.path, err)
+	}
+	sessions := make(map[string]*SessionInfo, len(f.Sessions))
+	for id, s := range f.Sessions {
+		if old := r.sessions[id]; old != nil && old.LastUsed.After(s.LastUsed) {
+			s.LastUsed, s.savedUse = old.LastUsed, old.savedUse
+		}
+		sessions[id] = s
+	}
+	r.sessions = sessions
+	r.bindings = make(map[string]string, len(f.Bindings))
+	for k, id := range f.Bindings {
+		r.bindings[k] = id
+	}
+	return nil
+}
+
+// save writes the registry atomically; it must run between begin and the
+// release.
+func (r *sessionRegistry) save() error {
+	data, err := json.MarshalIndent(sessionRegistryFile{Sessions: r.sessions, Bindings: r.bindings}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write session registry: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("failed to write session registry: %w", err)
+	}
+	return nil
+}
+
+// projectKey names the workspace a session is bound to. An explicit
+// project that is not a directory is used as is; a directory, or the
+// server's working directory when project is empty, maps to the root of
+// its git repository if it is inside one.
+func projectKey(project string) string {
+	project = strings.TrimSpace(project)
+	dir := project
+	if dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "default"
+		}
+		dir = wd
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return project
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d
+		}
+		if filepath.Dir(d) == d {
+			return dir
+		}
+	}
+}
+
+// lookup finds a session by ID or name; r.mu must be held.
+func (r *sessionRegistry) lookup(ref string) (*SessionInfo, error) {
+	ref = strings.TrimSpace(ref)
+	if s := r.sessions[ref]; s != nil {
+		return s, nil
+	}
+	for _, s := range r.sessions {
+		if s.Name != "" && s.Name == ref {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown session %q", ref)
+}
+
+// checkName rejects names already used as another session's ID or name;
+// r.mu must be held.
+func (r *sessionRegistry) checkName(name, self string) error {
+	if name == "" {
+		return nil
+	}
+	if s, err := r.lookup(name); err == nil && s.ID != self {
+		return fmt.Errorf("session name %q is already taken by %s", name, s.ID)
+	}
+	return nil
+}
+
+// exists reports whether id is a registered session ID.
+func (r *sessionRegistry) exists(id string) bool {
+	defer r.view()()
+	return r.sessions[strings.TrimSpace(id)] != nil
+}
+
+// create registers a new session with the metadata of info and makes it
+// current for project.
+func (r *sessionRegistry) create(project string, info SessionInfo) (SessionInfo, error) {
+	release, err := r.begin()
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	defer release()
+	return r.createLocked(project, info)
+}
+
+// currentOrCreate returns project's current session, creating one with
+// the metadata of info if it has none. The lookup and the creation happen
+// under one lock, so concurrent callers agree on a single session.
+func (r *sessionRegistry) currentOrCreate(project string, info SessionInfo) (SessionInfo, bool, error) {
+	release, err := r.begin()
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+	defer release()
+	if s := r.sessions[r.bindings[projectKey(project)]]; s != nil {
+		return *s, false, nil
+	}
+	s, err := r.createLocked(project, info)
+	return s, err == nil, err
+}
+
+// createLocked is create; r.mu must be held.
+func (r *sessionRegistry) createLocked(project string, info SessionInfo) (SessionInfo, error) {
+	info.Name = strings.TrimSpace(info.Name)
+	if err := r.checkName(info.Name, ""); err != nil {
+		return SessionInfo{}, err
+	}
+	now := time.Now().UTC()
+	s := &info
+	s.ID, s.CreatedAt, s.LastUsed = fmt.Sprintf("sess-%d", now.UnixNano()), now, now
+	r.sessions[s.ID] = s
+	r.bindings[projectKey(project)] = s.ID
+	return *s, r.save()
+}
+
+// get returns a copy of the session ref with its bound projects.
+func (r *sessionRegistry) get(ref string) (SessionInfo, error) {
+	release, err := r.begin()
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	defer release()
+	s, err := r.lookup(ref)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	cp := *s
+	for k, id := range r.bindings {
+		if id == s.ID {
+			cp.Projects = append(cp.Projects, k)
+		}
+	}
+	sort.Strings(cp.Projects)
+	return cp, nil
+}
+
+// update applies fn to the session ref and saves the catalog.
+func (r *sessionRegistry) update(ref string, fn func(*SessionInfo)) (SessionInfo, error) {
+	release, err := r.begin()
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	defer release()
+	s, err := r.lookup(ref)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	fn(s)
+	return *s, r.save()
+}
+
+// unbind removes every project binding of the session id; r.mu must be
+// held.
+func (r *sessionRegistry) unbind(id string) {
+	for k, bound := range r.bindings {
+		if bound == id {
+			delete(r.bindings, k)
+		}
+	}
+}
+
+// touch records a use of session id, cataloguing sessions that were
+// created by passing a new session_id rather than through initialize.
+// Such sessions have no owner: only initialize, get_or_create_session and
+// forks set one, so a caller cannot claim a session by naming it first.
+// Only new sessions and uses more than a minute apart are saved, so
+// busy sessions do not rewrite the file on every call.
+func (r *sessionRegistry) touch(id string) error {
+	release, err := r.begin()
+	if err != nil {
+		return err
+	}
+	defer release()
+	now := time.Now().UTC()
+	s := r.sessions[id]
+	if s == nil {
+		r.sessions[id] = &SessionInfo{ID: id, CreatedAt: now, LastUsed: now}
+		return r.save()
+	}
+	s.LastUsed = now
+	if now.Sub(s.savedUse) > time.Minute {
+		s.savedUse = now
+		return r.save()
+	}
+	return nil
+}
+
+// current returns project's session ID, or "" if it has none.
+func (r *sessionRegistry) current(project string) string {
+	defer r.view()()
+	return r.bindings[projectKey(project)]
+}
+
+// switchTo makes the session ref current for project.
+func (r *sessionRegistry) switchTo(project, ref string) (SessionInfo, error) {
+	release, err := r.begin()
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	defer release()
+	s, err := r.lookup(ref)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	r.bindings[projectKey(project)] = s.ID
+	return *s, r.save()
+}
+
+// rename sets or, with an empty name, clears a session's name.
+func (r *sessionRegistry) rename(ref, name string) (SessionInfo, error) {
+	release, err := r.begin()
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	defer release()
+	s, err := r.lookup(ref)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	name = strings.TrimSpace(name)
+	if err := r.checkName(name, s.ID); err != nil {
+		return SessionInfo{}, err
+	}
+	s.Name = name
+	return *s, r.save()
+}
+
+// remove forgets a session and unbinds it from every project.
+func (r *sessionRegistry) remove(ref string) (SessionInfo, error) {
+	release, err := r.begin()
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	defer release()
+	s, err := r.lookup(ref)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	delete(r.sessions, s.ID)
+	r.unbind(s.ID)
+	return *s, r.save()
+}
+
+// list returns every session, or those tagged tag, newest first, marking
+// project's current one.
+func (r *sessionRegistry) list(project, tag string) []SessionInfo {
+	defer r.view()()
+	cur := r.bindings[projectKey(project)]
+	projects := map[string][]string{}
+	for k, id := range r.bindings {
+		projects[id] = append(projects[id], k)
+	}
+	out := make([]SessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		if tag != "" && !slices.Contains(s.Tags, tag) {
+			continue
+		}
+		cp := *s
+		cp.Projects = projects[s.ID]
+		sort.Strings(cp.Projects)
+		cp.Current = s.ID == cur
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// checkSessionRef looks up the session ref and checks that principal may
+// manage it (see checkSessionOwner).
+func (a *App) checkSessionRef(ref, principal string) error {
+	info, err := a.sessions.get(ref)
+	if err != nil {
+		return err
+	}
+	return checkSessionOwner(info, principal)
+}
+
+func registerSessionTools(s *server.MCPServer, app *App) {
+	listTool := mcp.NewTool("sessions.list",
+		mcp.WithDescription("List catalogued sessions with their metadata and bound projects, marking the project's current session"),
+		mcp.WithString("project", mcp.Description("Workspace key or directory (default: the server's git root or working directory)")),
+		mcp.WithString("tag", mcp.Description("Only sessions with this tag")),
+	)
+	s.AddTool(listTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		return mcp.NewToolResultJSON(app.sessions.list(getStringParam(req, "project"), strings.TrimSpace(getStringParam(req, "tag"))))
+	})
+
+	switchTool := mcp.NewTool("sessions.switch",
+		mcp.WithDescription("Make a session, by ID or name, the current session of a project"),
+		mcp.WithString("session", mcp.Required(), mcp.Description("Session ID or name")),
+		mcp.WithString("project", mcp.Description("Workspace key or directory (default: the server's git root or working directory)")),
+		mcp.WithString("principal", mcp.Description("Must be the owner if the session has one")),
+	)
+	s.AddTool(switchTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		ref, err := req.RequireString("session")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session: %v", err)), nil
+		}
+		if err := app.checkSessionRef(ref, getStringParam(req, "principal")); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		project := getStringParam(req, "project")
+		info, err := app.sessions.switchTo(project, ref)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(map[string]any{"session_id": info.ID, "name": info.Name, "project": projectKey(project)})
+	})
+
+	renameTool := mcp.NewTool("sessions.rename",
+		mcp.WithDescription("Name a session so it can be switched to by name; an empty name clears it"),
+		mcp.WithString("session", mcp.Required(), mcp.Description("Session ID or current name")),
+		mcp.WithString("name", mcp.Description("New name")),
+		mcp.WithString("principal", mcp.Description("Must be the owner if the session has one")),
+	)
+	s.AddTool(renameTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		ref, err := req.RequireString("session")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session: %v", err)), nil
+		}
+		if err := app.checkSessionRef(ref, getStringParam(req, "principal")); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		info, err := app.sessions.rename(ref, getStringParam(req, "name"))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(info)
+	})
+
+	deleteTool := mcp.NewTool("sessions.delete",
+		mcp.WithDescription("Remove a session from the registry and unbind it from every project; its stored records are kept"),
+		mcp.WithString("session", mcp.Required(), mcp.Description("Session ID or name")),
+		mcp.WithString("principal", mcp.Description("Must be the owner if the session has one")),
+	)
+	s.AddTool(deleteTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		ref, err := req.RequireString("session")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session: %v", err)), nil
+		}
+		if err := app.checkSessionRef(ref, getStringParam(req, "principal")); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		info, err := app.sessions.remove(ref)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(map[string]any{"deleted": info.ID})
+	})
+}
@@ -0,0 +1,354 @@
+// sessions_fork.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// defaultMergeThreshold is the cosine similarity above which a merged
+// record that differs from a target record is reported as a conflict.
+const defaultMergeThreshold = 0.92
+
+// MergeConflict is a source record that was not merged because the target
+// already holds a close but different record.
+type MergeConflict struct {
+	Record     int64   `json:"record_id"`
+	Existing   int64   `json:"existing_id"`
+	Similarity float64 `json:"similarity"`
+}
+
+// MergeReport is the sessions.merge payload. Duplicates are source records
+// whose content the target already has.
+type MergeReport struct {
+	From       string          `json:"from"`
+	Into       string          `json:"into"`
+	Copied     int             `json:"copied"`
+	Moved      int             `json:"moved"`
+	Duplicates []int64         `json:"duplicates"`
+	Conflicts  []MergeConflict `json:"conflicts"`
+}
+
+// copyRecord re-stores rec under session to through the store path every
+// write takes, so it is quota-checked and tagged with the embedder.
+// origin keys (e.g. forked_from) are added to its metadata.
+func (a *App) copyRecord(ctx context.Context, rec model.MemoryRecord, to string, origin map[string]any) error {
+	meta := copyMeta(rec, to, origin)
+	if err := a.quotas.checkCapacity(ownerOf(to, meta), 1, len(rec.Content)); err != nil {
+		return err
+	}
+	return a.storeCopy(ctx, rec, to, meta)
+}
+
+// copyMeta is rec's metadata for a copy under session to, with origin
+// added.
+func copyMeta(rec model.MemoryRecord, to string, origin map[string]any) map[string]any {
+	meta := model.DecodeMetadata(rec.Metadata)
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	if space, _ := meta["space"].(string); space == rec.SessionID {
+		meta["space"] = to
+	}
+	for k, v := range origin {
+		meta[k] = v
+	}
+	meta["source_record"] = rec.ID
+	return meta
+}
+
+// storeCopy stores rec's content and vector under session to with meta,
+// leaving quota checks to the caller.
+func (a *App) storeCopy(ctx context.Context, rec model.MemoryRecord, to string, meta map[string]any) error {
+	emb, err := a.recordEmbedding(ctx, rec)
+	if err != nil {
+		return err
+	}
+	return a.bank.Store.StoreMemory(ctx, to, rec.Content, meta, emb)
+}
+
+// recordEmbedding returns rec's vector, embedding its content when the
+// store did not return one.
+func (a *App) recordEmbedding(ctx context.Context, rec model.MemoryRecord) ([]float32, error) {
+	if len(rec.Embedding) > 0 {
+		return rec.Embedding, nil
+	}
+	return a.embedder.Embed(ctx, rec.Content)
+}
+
+// forkSession creates a session holding a snapshot of every long-term
+// record of from, and makes it project's current session. Later writes to
+// either session do not show up in the other.
+func (a *App) forkSession(ctx context.Context, from SessionInfo, project string, info SessionInfo) (SessionInfo, int, error) {
+	if err := a.flushShortTerm(ctx, from.ID); err != nil {
+		return SessionInfo{}, 0, fmt.Errorf("flush session %q: %w", from.ID, err)
+	}
+	recs, err := a.sessionRecords(ctx, from.ID)
+	if err != nil {
+		return SessionInfo{}, 0, err
+	}
+	recs = a.latestOnly(recs)
+	info.ForkedFrom = from.ID
+	fork, err := a.sessions.create(project, info)
+	if err != nil {
+		return SessionInfo{}, 0, err
+	}
+	for _, rec := range recs {
+		if err := a.copyRecord(ctx, rec, fork.ID, map[string]any{"forked_from": from.ID}); err != nil {
+			return fork, 0, fmt.Errorf("copy record %d: %w", rec.ID, err)
+		}
+	}
+	if err := a.carryLinks(ctx, recordIDsOf(recs), fork.ID, "forked_from", from.ID, nil); err != nil {
+		logger(ctx).Warn("failed to carry links over to fork", "session_id", fork.ID, "error", err)
+	}
+	return fork, len(recs), nil
+}
+
+// carryLinks makes the links of the records ids again on their copies in
+// session, found by their metadata key, and removes those of the records
+// in gone.
+func (a *App) carryLinks(ctx context.Context, ids []int64, session, key, value string, gone map[int64]bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ls, err := a.links.Links(ctx, ids)
+	if err != nil || len(ls) == 0 {
+		return err
+	}
+	moved, err := a.copiesOf(ctx, session, key, value)
+	if err != nil {
+		return err
+	}
+	return a.remapLinks(ctx, ls, moved, gone)
+}
+
+// mergeSessions copies the records ids of from (all of them if ids is
+// empty) into into. Records whose content into already has are skipped as
+// duplicates; records at least threshold similar to a different record
+// of into are skipped as conflicts unless force is set. With move, merged
+// and duplicate records are deleted from from.
+func (a *App) mergeSessions(ctx context.Context, from, into string, ids []int64, move, force bool, threshold float64) (MergeReport, error) {
+	rep := MergeReport{From: from, Into: into, Duplicates: []int64{}, Conflicts: []MergeConflict{}}
+	if err := a.flushShortTerm(ctx, from); err != nil {
+		return rep, fmt.Errorf("flush session %q: %w", from, err)
+	}
+	src, err := a.sessionRecords(ctx, from)
+	if err != nil {
+		return rep, err
+	}
+	src = a.latestOnly(src)
+	if len(ids) > 0 {
+		byID := make(map[int64]model.MemoryRecord, len(src))
+		for _, rec := range src {
+			byID[rec.ID] = rec
+		}
+		src = src[:0]
+		for _, id := range ids {
+			rec, ok := byID[id]
+			if !ok {
+				return rep, fmt.Errorf("record %d is not in session %q", id, from)
+			}
+			src = append(src, rec)
+		}
+	}
+	dst, err := a.sessionRecords(ctx, into)
+	if err != nil {
+		return rep, err
+	}
+	dst = a.latestOnly(dst)
+	type known struct {
+		id      int64
+		content string
+		emb     []float32
+	}
+	existing := make([]known, 0, len(dst))
+	for _, rec := range dst {
+		emb, err := a.recordEmbedding(ctx, rec)
+		if err != nil {
+			return rep, err
+		}
+		existing = append(existing, known{rec.ID, normalizeContent(rec.Content), emb})
+	}
+
+	var remove []int64
+	for _, rec := range src {
+		emb, err := a.recordEmbedding(ctx, rec)
+		if err != nil {
+			return rep, err
+		}
+		content := normalizeContent(rec.Content)
+		dup, conflict := false, MergeConflict{Record: rec.ID}
+		for _, k := range existing {
+			if k.content == content {
+				dup = true
+				break
+			}
+			if sim := model.CosineSimilarity(emb, k.emb); sim >= threshold && sim > conflict.Similarity {
+				conflict.Existing, conflict.Similarity = k.id, sim
+			}
+		}
+		switch {
+		case dup:
+			rep.Duplicates = append(rep.Duplicates, rec.ID)
+		case conflict.Existing != 0 && !force:
+			rep.Conflicts = append(rep.Conflicts, conflict)
+			continue
+		default:
+			rec.Embedding = emb
+			if err := a.copyRecord(ctx, rec, into, map[string]any{"merged_from": from}); err != nil {
+				return rep, fmt.Errorf("copy record %d: %w", rec.ID, err)
+			}
+			rep.Copied++
+			existing = append(existing, known{0, content, emb})
+		}
+		remove = append(remove, rec.ID)
+	}
+	var gone map[int64]bool
+	if move && len(remove) > 0 {
+		gone = make(map[int64]bool, len(remove))
+		for _, id := range remove {
+			gone[id] = true
+		}
+	}
+	// Links are read before the move deletes the records they hang on.
+	var ls []MemoryLink
+	if len(remove) > 0 {
+		if ls, err = a.links.Links(ctx, remove); err != nil {
+			return rep, err
+		}
+	}
+	if move && len(remove) > 0 {
+		if err := a.bank.Store.DeleteMemory(ctx, remove); err != nil {
+			return rep, err
+		}
+		rep.Moved = len(remove)
+	}
+	if len(ls) > 0 {
+		moved, err := a.copiesOf(ctx, into, "merged_from", from)
+		if err == nil {
+			err = a.remapLinks(ctx, ls, moved, gone)
+		}
+		if err != nil {
+			logger(ctx).Warn("failed to carry links over to merged records", "session_id", into, "error", err)
+		}
+	}
+	return rep, nil
+}
+
+// normalizeContent folds case and whitespace for duplicate detection.
+func normalizeContent(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// parseRecordIDs parses a comma-separated list of record IDs.
+func parseRecordIDs(s string) ([]int64, error) {
+	var ids []int64
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record id %q", f)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func registerSessionForkTools(s *server.MCPServer, app *App) {
+	forkTool := mcp.NewTool("sessions.fork",
+		mcp.WithDescription("Create a session holding a snapshot of another session's long-term records and make it the project's current session"),
+		mcp.WithString("session", mcp.Required(), mcp.Description("Session ID or name to fork")),
+		mcp.WithString("name", mcp.Description("Optional unique name for the fork")),
+		mcp.WithString("title"),
+		mcp.WithString("project", mcp.Description("Workspace key or directory (default: the server's git root or working directory)")),
+		mcp.WithString("principal", mcp.Description("Owner of the fork; must own the source if it has an owner")),
+	)
+	s.AddTool(forkTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		ref, err := req.RequireString("session")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session: %v", err)), nil
+		}
+		from, err := app.sessions.get(ref)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if err := checkSessionOwner(from, getStringParam(req, "principal")); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		fork, n, err := app.forkSession(ctx, from, getStringParam(req, "project"), SessionInfo{
+			Name:  getStringParam(req, "name"),
+			Title: strings.TrimSpace(getStringParam(req, "title")),
+			Tags:  from.Tags,
+			Owner: strings.TrimSpace(getStringParam(req, "principal")),
+		})
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("fork failed: %v", err)), nil
+		}
+		return mcp.NewToolResultJSON(map[string]any{"session_id": fork.ID, "forked_from": from.ID, "records": n})
+	})
+
+	mergeTool := mcp.NewTool("sessions.merge",
+		mcp.WithDescription("Copy or move records from one session into another, skipping duplicates and reporting conflicts"),
+		mcp.WithString("from", mcp.Required(), mcp.Description("Source session ID or name")),
+		mcp.WithString("into", mcp.Required(), mcp.Description("Target session ID or name")),
+		mcp.WithString("ids", mcp.Description("Comma-separated source record IDs (default: all)")),
+		mcp.WithBoolean("move", mcp.Description("Delete merged and duplicate records from the source")),
+		mcp.WithBoolean("force", mcp.Description("Merge conflicting records anyway")),
+		mcp.WithNumber("threshold", mcp.Description("Similarity at which a differing record conflicts (default 0.92)")),
+		mcp.WithString("principal", mcp.Description("Must own the source and the target if they have owners")),
+	)
+	s.AddTool(mergeTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		fromRef, err := req.RequireString("from")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing from: %v", err)), nil
+		}
+		intoRef, err := req.RequireString("into")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing into: %v", err)), nil
+		}
+		from, err := app.sessions.get(fromRef)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		into, err := app.sessions.get(intoRef)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if from.ID == into.ID {
+			return mcp.NewToolResultError("cannot merge a session into itself"), nil
+		}
+		principal := getStringParam(req, "principal")
+		move := req.GetBool("move", false)
+		// Copies of the source are readable in the target, so a plain
+		// copy needs the source owner as much as a move does.
+		for _, info := range []SessionInfo{from, into} {
+			if err := checkSessionOwner(info, principal); err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+		}
+		ids, err := parseRecordIDs(getStringParam(req, "ids"))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		threshold := getNumberParam(req, "threshold")
+		if threshold <= 0 {
+			threshold = defaultMergeThreshold
+		}
+		rep, err := app.mergeSessions(ctx, from.ID, into.ID, ids, move, req.GetBool("force", false), threshold)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("merge failed: %v", err)), nil
+		}
+		return mcp.NewToolResultJSON(rep)
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestForkCopiesSurvivePrune(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+	src, err := app.sessions.create("proj", SessionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, app, src.ID, "the billing service uses Postgres", nil)
+	mustStore(t, app, src.ID, "deploys go out on Tuesdays", nil)
+
+	fork, n, err := app.forkSession(ctx, src, "proj", SessionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("forked %d records, want 2", n)
+	}
+	// Every engine store prunes the whole store.
+	mustStore(t, app, src.ID, "the search service uses OpenSearch", nil)
+
+	if got := len(recordIDs(t, app, fork.ID)); got != 2 {
+		t.Fatalf("fork holds %d records after a prune, want 2", got)
+	}
+	if got := len(recordIDs(t, app, src.ID)); got != 3 {
+		t.Fatalf("source holds %d records after a prune, want 3", got)
+	}
+}
+
+func TestMergeNeedsSourceOwner(t *testing.T) {
+	app := newTestApp(t, nil)
+	from, err := app.sessions.create("alice-proj", SessionInfo{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	into, err := app.sessions.create("mallory-proj", SessionInfo{Owner: "mallory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, app, from.ID, "the vault password rotates monthly", nil)
+	args := map[string]any{"from": from.ID, "into": into.ID, "principal": "mallory"}
+	if res := callTool(t, app, registerSessionForkTools, "sessions.merge", args); !res.IsError {
+		t.Fatal("mallory copied alice's records without moving them")
+	}
+	if n := len(recordIDs(t, app, into.ID)); n != 0 {
+		t.Fatalf("target holds %d copies", n)
+	}
+}
@@ -0,0 +1,258 @@
+// sessions_lifecycle.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// SessionDescription is the sessions.describe payload: the catalog entry
+// plus counts taken from the store.
+type SessionDescription struct {
+	SessionInfo
+	Records   int       `json:"records"`
+	Bytes     int64     `json:"bytes"`
+	ShortTerm int       `json:"short_term"`
+	LastWrite time.Time `json:"last_write,omitzero"`
+}
+
+// SessionTeardown reports what sessions.archive or sessions.purge did.
+type SessionTeardown struct {
+	Session    string `json:"session_id"`
+	Action     string `json:"action"`
+	Records    int    `json:"records"`
+	ExportFile string `json:"export_file,omitempty"`
+}
+
+// sessionRecords returns every stored record of session id.
+func (a *App) sessionRecords(ctx context.Context, id string) ([]model.MemoryRecord, error) {
+	var recs []model.MemoryRecord
+	err := a.bank.Store.Iterate(ctx, func(rec model.MemoryRecord) bool {
+		if rec.SessionID == id {
+			recs = append(recs, rec)
+		}
+		return true
+	})
+	return recs, err
+}
+
+func (a *App) describeSession(ctx context.Context, ref string) (SessionDescription, error) {
+	info, err := a.sessions.get(ref)
+	if err != nil {
+		return SessionDescription{}, err
+	}
+	desc := SessionDescription{SessionInfo: info}
+	recs, err := a.sessionRecords(ctx, info.ID)
+	if err != nil {
+		return desc, err
+	}
+	for _, rec := range recs {
+		desc.Records++
+		desc.Bytes += int64(len(rec.Content))
+		if rec.CreatedAt.After(desc.LastWrite) {
+			desc.LastWrite = rec.CreatedAt
+		}
+	}
+	a.metrics.mu.Lock()
+	desc.ShortTerm = a.metrics.shortTerm[info.ID]
+	a.metrics.mu.Unlock()
+	return desc, nil
+}
+
+// teardownSession flushes the session's short-term buffer and deletes all
+// of its records. With archive they are exported first and the catalog
+// keeps the session, marked archived and unbound from its projects;
+// otherwise the session is dropped from the catalog.
+func (a *App) teardownSession(ctx context.Context, id string, archive bool) (SessionTeardown, error) {
+	out := SessionTeardown{Session: id, Action: "purge"}
+	if archive {
+		out.Action = "archive"
+	}
+	if err := a.flushShortTerm(ctx, id); err != nil {
+		return out, fmt.Errorf("flush session %q: %w", id, err)
+	}
+	recs, err := a.sessionRecords(ctx, id)
+	if err != nil {
+		return out, err
+	}
+	out.Records = len(recs)
+	if archive {
+		if out.ExportFile, err = exportRecords(filepath.Join(a.stateDir, "sessions"), id, recs); err != nil {
+			return out, err
+		}
+	}
+	if len(recs) > 0 {
+		ids := make([]int64, len(recs))
+		for i, rec := range recs {
+			ids[i] = rec.ID
+		}
+		if err := a.bank.Store.DeleteMemory(ctx, ids); err != nil {
+			return out, err
+		}
+	}
+	if !archive {
+		_, err = a.sessions.remove(id)
+		return out, err
+	}
+	a.sessions.mu.Lock()
+	a.sessions.unbind(id)
+	a.sessions.mu.Unlock()
+	_, err = a.sessions.update(id, func(s *SessionInfo) {
+		s.ArchivedAt = time.Now().UTC()
+		s.ExportFile = out.ExportFile
+	})
+	return out, err
+}
+
+// splitTags parses a comma-separated tag list, dropping blanks and
+// duplicates.
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" && !slices.Contains(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// hasParam reports whether the call passed key at all, so an empty string
+// can clear a field.
+func hasParam(req mcp.CallToolRequest, key string) bool {
+	_, ok := req.GetArguments()[key]
+	return ok
+}
+
+// checkSessionOwner lets anyone manage an unowned session and only the
+// owner manage an owned one.
+func checkSessionOwner(info SessionInfo, principal string) error {
+	if info.Owner != "" && strings.TrimSpace(principal) != info.Owner {
+		return fmt.Errorf("permission denied: session %q is owned by %q", info.ID, info.Owner)
+	}
+	return nil
+}
+
+// sessionMiddleware rejects calls on an owned session from anyone but its
+// owner and records the use of every session_id a tool call carries in
+// the calling tenant's catalog.
+func sessionMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		sid := strings.TrimSpace(getStringParam(req, "session_id"))
+		app := appFor(ctx, nil)
+		if app != nil && sid != "" {
+			if info, err := app.sessions.get(sid); err == nil && info.ID == sid {
+				if err := checkSessionOwner(info, getStringParam(req, "principal")); err != nil {
+					return mcp.NewToolResultError(err.Error()), nil
+				}
+			}
+		}
+		res, err := next(ctx, req)
+		if app != nil && sid != "" && err == nil && (res == nil || !res.IsError) {
+			if terr := app.sessions.touch(sid); terr != nil {
+				logger(ctx).Warn("session catalog update failed", "session_id", sid, "error", terr)
+			}
+		}
+		return res, err
+	}
+}
+
+func registerSessionLifecycleTools(s *server.MCPServer, app *App) {
+	describeTool := mcp.NewTool("sessions.describe",
+		mcp.WithDescription("Show a session's title, tags, owner, timestamps, bound projects and record counts"),
+		mcp.WithString("session", mcp.Required(), mcp.Description("Session ID or name")),
+	)
+	s.AddTool(describeTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		ref, err := req.RequireString("session")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session: %v", err)), nil
+		}
+		desc, err := app.describeSession(ctx, ref)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(desc)
+	})
+
+	updateTool := mcp.NewTool("sessions.update",
+		mcp.WithDescription("Set a session's title, description, tags or owner; omitted fields are kept"),
+		mcp.WithString("session", mcp.Required(), mcp.Description("Session ID or name")),
+		mcp.WithString("principal", mcp.Description("Must be the owner if the session has one")),
+		mcp.WithString("title"),
+		mcp.WithString("description"),
+		mcp.WithString("tags", mcp.Description("Comma-separated tags, replacing the current ones")),
+		mcp.WithString("owner", mcp.Description("New owner principal")),
+	)
+	s.AddTool(updateTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		ref, err := req.RequireString("session")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session: %v", err)), nil
+		}
+		info, err := app.sessions.get(ref)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if err := checkSessionOwner(info, getStringParam(req, "principal")); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		info, err = app.sessions.update(info.ID, func(s *SessionInfo) {
+			if hasParam(req, "title") {
+				s.Title = strings.TrimSpace(getStringParam(req, "title"))
+			}
+			if hasParam(req, "description") {
+				s.Description = strings.TrimSpace(getStringParam(req, "description"))
+			}
+			if hasParam(req, "tags") {
+				s.Tags = splitTags(getStringParam(req, "tags"))
+			}
+			if hasParam(req, "owner") {
+				s.Owner = strings.TrimSpace(getStringParam(req, "owner"))
+			}
+		})
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(info)
+	})
+
+	for _, archive := range []bool{true, false} {
+		name, desc := "sessions.purge", "Delete every record of a session, including its short-term buffer, and drop it from the catalog"
+		if archive {
+			name, desc = "sessions.archive", "Export every record of a session to JSONL, delete them from the store and mark the session archived"
+		}
+		tool := mcp.NewTool(name,
+			mcp.WithDescription(desc),
+			mcp.WithString("session", mcp.Required(), mcp.Description("Session ID or name")),
+			mcp.WithString("principal", mcp.Description("Must be the owner if the session has one")),
+		)
+		s.AddTool(tool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+			app := appFor(ctx, app)
+			ref, err := req.RequireString("session")
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("missing session: %v", err)), nil
+			}
+			info, err := app.sessions.get(ref)
+			if err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+			if err := checkSessionOwner(info, getStringParam(req, "principal")); err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+			res, err := app.teardownSession(ctx, info.ID, archive)
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("%s failed: %v", name, err)), nil
+			}
+			return mcp.NewToolResultJSON(res)
+		})
+	}
+}
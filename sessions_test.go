@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func TestSessionMiddlewareChecksOwnership(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.WithValue(context.Background(), tenantAppKey{}, app)
+	handler := sessionMiddleware(func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return mcp.NewToolResultText("ok"), nil
+	})
+	call := func(sid, principal string) *mcp.CallToolResult {
+		var req mcp.CallToolRequest
+		req.Params.Arguments = map[string]any{"session_id": sid, "principal": principal}
+		res, err := handler(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Naming a new session first does not make mallory its owner.
+	call("sess-new", "mallory")
+	if info, err := app.sessions.get("sess-new"); err != nil || info.Owner != "" {
+		t.Fatalf("touched session = %+v, %v; want it catalogued without an owner", info, err)
+	}
+
+	owned, err := app.sessions.create("proj", SessionInfo{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := call(owned.ID, "mallory"); !res.IsError {
+		t.Fatal("mallory used alice's session")
+	}
+	if res := call(owned.ID, "alice"); res.IsError {
+		t.Fatal("the owner alice was rejected")
+	}
+}
+
+func TestCurrentOrCreateIsAtomic(t *testing.T) {
+	app := newTestApp(t, nil)
+	ids := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, _, err := app.sessions.currentOrCreate("proj", SessionInfo{})
+			if err != nil {
+				t.Error(err)
+			}
+			ids[i] = info.ID
+		}()
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Fatalf("concurrent callers got different sessions: %v", ids)
+		}
+	}
+}
+
+func TestSessionToolsCheckOwner(t *testing.T) {
+	app := newTestApp(t, nil)
+	owned, err := app.sessions.create("proj", SessionInfo{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		tool string
+		args map[string]any
+	}{
+		{"sessions.switch", map[string]any{"session": owned.ID, "project": "other"}},
+		{"sessions.rename", map[string]any{"session": owned.ID, "name": "mine"}},
+		{"sessions.delete", map[string]any{"session": owned.ID}},
+	} {
+		tc.args["principal"] = "mallory"
+		if res := callTool(t, app, registerSessionTools, tc.tool, tc.args); !res.IsError {
+			t.Errorf("mallory ran %s on alice's session", tc.tool)
+		}
+		tc.args["principal"] = "alice"
+		if res := callTool(t, app, registerSessionTools, tc.tool, tc.args); res.IsError {
+			t.Errorf("the owner alice could not run %s", tc.tool)
+		}
+	}
+}
+
+func TestSessionRegistrySharedBetweenProcesses(t *testing.T) {
+	dir := t.TempDir()
+	a, err := newSessionRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newSessionRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, err := a.create("proj-a", SessionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := b.create("proj-b", SessionInfo{Owner: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a's next write must not drop the session b created meanwhile.
+	if _, err := a.rename(sa.ID, "alpha"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newSessionRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.current("proj-a") != sa.ID || c.current("proj-b") != sb.ID {
+		t.Fatalf("bindings after both wrote: a=%q b=%q", c.current("proj-a"), c.current("proj-b"))
+	}
+	if info, err := a.get(sb.ID); err != nil || info.Owner != "bob" {
+		t.Fatalf("a sees b's session as %+v, %v", info, err)
+	}
+}
+
+// gitWorkspace makes a repository root with a subdirectory and returns
+// both, with symlinks resolved so they compare equal to os.Getwd.
+func gitWorkspace(t *testing.T) (root, sub string) {
+	t.Helper()
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub = filepath.Join(root, "cmd", "server")
+	for _, d := range []string{filepath.Join(root, ".git"), sub} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, sub
+}
+
+func TestProjectKey(t *testing.T) {
+	root, sub := gitWorkspace(t)
+	plain, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(sub)
+	for _, tc := range []struct{ project, want string }{
+		{"", root},
+		{sub, root},
+		{".", root},
+		{plain, plain},
+		{" billing-api ", "billing-api"},
+	} {
+		if got := projectKey(tc.project); got != tc.want {
+			t.Errorf("projectKey(%q) = %q, want %q", tc.project, got, tc.want)
+		}
+	}
+}
+
+func TestSessionsAreBoundPerProject(t *testing.T) {
+	r, err := newSessionRegistry(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := r.create("proj-a", SessionInfo{Name: "alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.create("proj-b", SessionInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.current("proj-a") != a.ID || r.current("proj-b") != b.ID {
+		t.Fatal("creating a session for proj-b replaced proj-a's")
+	}
+	if _, err := r.create("proj-c", SessionInfo{Name: "alpha"}); err == nil {
+		t.Fatal("a second session took the name alpha")
+	}
+
+	// Switching by name binds proj-b to alpha as well; proj-a keeps it.
+	if _, err := r.switchTo("proj-b", "alpha"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := r.get(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(info.Projects, []string{"proj-a", "proj-b"}) {
+		t.Fatalf("alpha is bound to %v", info.Projects)
+	}
+	for _, s := range r.list("proj-a", "") {
+		if s.Current != (s.ID == a.ID) {
+			t.Fatalf("list marks %s current=%v", s.ID, s.Current)
+		}
+	}
+
+	if _, err := r.remove("alpha"); err != nil {
+		t.Fatal(err)
+	}
+	if r.current("proj-a") != "" || r.current("proj-b") != "" {
+		t.Fatal("deleting a session left its project bindings")
+	}
+	if !r.exists(b.ID) {
+		t.Fatal("deleting alpha removed another session")
+	}
+}
+
+func TestLegacySessionFileIsImportedOnce(t *testing.T) {
+	root, sub := gitWorkspace(t)
+	t.Chdir(sub)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "session_id"), []byte("sess-legacy\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newSessionRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.current("") != "sess-legacy" || r.current(root) != "sess-legacy" {
+		t.Fatalf("current = %q, want the legacy session bound to %s", r.current(""), root)
+	}
+	if r.current("elsewhere") != "" {
+		t.Fatal("the legacy session was bound to another project")
+	}
+
+	// Once sessions.json exists the legacy file is ignored, so a deleted
+	// session does not come back on the next start.
+	if _, err := r.remove("sess-legacy"); err != nil {
+		t.Fatal(err)
+	}
+	r, err = newSessionRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.exists("sess-legacy") || r.current("") != "" {
+		t.Fatal("the legacy session was imported again")
+	}
+}
@@ -0,0 +1,383 @@
+// snapshots.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// metaRestoreRun tags the records of one sessions.restore run.
+const metaRestoreRun = "restore_run"
+
+// SnapshotOptions configures session snapshots. Zero limits keep
+// everything.
+type SnapshotOptions struct {
+	Dir           string
+	MaxPerSession int
+	MaxAge        time.Duration
+}
+
+// SnapshotInfo describes one snapshot; it is stored next to the records
+// as <id>.json.
+type SnapshotInfo struct {
+	ID        string    `json:"id"`
+	Session   string    `json:"session_id"`
+	Label     string    `json:"label,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Records   int       `json:"records"`
+	File      string    `json:"file"`
+}
+
+// snapshotDir is <Dir>/<session>. Session IDs first seen in a tool call
+// are chosen by the caller, so any that could leave Dir are rejected.
+func (a *App) snapshotDir(session string) (string, error) {
+	if session == "" || session == "." || session == ".." || strings.ContainsAny(session, `/\:`) || strings.ContainsRune(session, os.PathSeparator) {
+		return "", fmt.Errorf("session %q cannot be snapshotted: its ID is not a valid directory name", session)
+	}
+	return filepath.Join(a.snapshots.Dir, session), nil
+}
+
+// snapshotSession writes every long-term record of session, with its
+// vector, to <id>.jsonl, so a restore does not have to re-embed.
+func (a *App) snapshotSession(ctx context.Context, session, label string) (SnapshotInfo, error) {
+	if err := a.flushShortTerm(ctx, session); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("flush session %q: %w", session, err)
+	}
+	recs, err := a.sessionRecords(ctx, session)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	recs = a.latestOnly(recs)
+	dir, err := a.snapshotDir(session)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	now := time.Now().UTC()
+	info := SnapshotInfo{
+		ID:        fmt.Sprintf("snap-%d", now.UnixNano()),
+		Session:   session,
+		Label:     strings.TrimSpace(label),
+		CreatedAt: now,
+		Records:   len(recs),
+	}
+	info.File = filepath.Join(dir, info.ID+".jsonl")
+	if err := writeSnapshotRecords(info.File, recs); err != nil {
+		return SnapshotInfo{}, err
+	}
+	meta, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, info.ID+".json"), meta, 0644); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	a.pruneSnapshots(ctx, session)
+	return info, nil
+}
+
+func writeSnapshotRecords(path string, recs []model.MemoryRecord) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return fmt.Errorf("failed to write snapshot: %w", err)
+		}
+	}
+	return f.Sync()
+}
+
+// listSnapshots returns the snapshots of session, newest first.
+func (a *App) listSnapshots(session string) ([]SnapshotInfo, error) {
+	dir, err := a.snapshotDir(session)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "snap-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	out := []SnapshotInfo{}
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		var info SnapshotInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// pruneSnapshots applies the retention limits to session's snapshots.
+func (a *App) pruneSnapshots(ctx context.Context, session string) {
+	snaps, err := a.listSnapshots(session)
+	if err != nil {
+		logger(ctx).Warn("snapshot retention failed", "session_id", session, "error", err)
+		return
+	}
+	cutoff := time.Now().Add(-a.snapshots.MaxAge)
+	for i, info := range snaps {
+		tooMany := a.snapshots.MaxPerSession > 0 && i >= a.snapshots.MaxPerSession
+		tooOld := a.snapshots.MaxAge > 0 && info.CreatedAt.Before(cutoff)
+		if tooMany || tooOld {
+			a.deleteSnapshot(info)
+			logger(ctx).Info("snapshot pruned", "session_id", session, "snapshot", info.ID)
+		}
+	}
+}
+
+func (a *App) deleteSnapshot(info SnapshotInfo) {
+	os.Remove(info.File)
+	os.Remove(strings.TrimSuffix(info.File, ".jsonl") + ".json")
+}
+
+func (a *App) findSnapshot(session, id string) (SnapshotInfo, error) {
+	snaps, err := a.listSnapshots(session)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	for _, info := range snaps {
+		if info.ID == id {
+			return info, nil
+		}
+	}
+	return SnapshotInfo{}, fmt.Errorf("session %q has no snapshot %q", session, id)
+}
+
+// loadSnapshot reads the records of a snapshot.
+func loadSnapshot(info SnapshotInfo) ([]model.MemoryRecord, error) {
+	var recs []model.MemoryRecord
+	f, err := os.Open(info.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	for sc.Scan() {
+		var rec model.MemoryRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("corrupt snapshot %s: %w", info.ID, err)
+		}
+		recs = append(recs, rec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	return recs, nil
+}
+
+// restoreSnapshot replaces the records of the snapshot's session with
+// recs, loaded from it. The restored records are stored first and the
+// current ones deleted only once all of them are in, so a failed restore
+// leaves the session as it was. Restored records get new IDs and carry
+// restored_from and source_record in their metadata; links are moved to
+// the new IDs.
+func (a *App) restoreSnapshot(ctx context.Context, info SnapshotInfo, recs []model.MemoryRecord) (int, error) {
+	if err := a.flushShortTerm(ctx, info.Session); err != nil {
+		return 0, fmt.Errorf("flush session %q: %w", info.Session, err)
+	}
+	current, err := a.sessionRecords(ctx, info.Session)
+	if err != nil {
+		return 0, err
+	}
+	// The session ends up holding recs instead of current, so only the
+	// growth is held to its quota, not the staged copies.
+	n, size := len(recs)-len(current), 0
+	for _, rec := range recs {
+		size += len(rec.Content)
+	}
+	for _, rec := range current {
+		size -= len(rec.Content)
+	}
+	if n > 0 || size > 0 {
+		if err := a.quotas.checkCapacity(ownerOf(info.Session, nil), max(n, 0), max(size, 0)); err != nil {
+			return 0, err
+		}
+	}
+	// Tag the staged copies with this run, so Prune does not dedup them
+	// against the records they replace and a failure can find them.
+	run := fmt.Sprintf("%s-%d", info.ID, time.Now().UnixNano())
+	for i, rec := range recs {
+		meta := copyMeta(rec, info.Session, map[string]any{"restored_from": info.ID, metaRestoreRun: run})
+		if err := a.storeCopy(ctx, rec, info.Session, meta); err != nil {
+			if rerr := a.dropRestoreRun(ctx, info.Session, run); rerr != nil {
+				logger(ctx).Warn("failed to remove partially restored records", "session_id", info.Session, "error", rerr)
+			}
+			return i, fmt.Errorf("restore record %d: %w", rec.ID, err)
+		}
+	}
+	// Links hang on the snapshot's records and on the current ones; read
+	// them before the current ones, and their links, are deleted.
+	gone := map[int64]bool{}
+	for _, rec := range current {
+		gone[rec.ID] = true
+	}
+	for _, rec := range recs {
+		gone[rec.ID] = true
+	}
+	ls, err := a.links.Links(ctx, slices.Collect(maps.Keys(gone)))
+	if err != nil {
+		return len(recs), err
+	}
+	if len(current) > 0 {
+		if err := a.bank.Store.DeleteMemory(ctx, recordIDsOf(current)); err != nil {
+			return len(recs), err
+		}
+	}
+	if len(ls) > 0 {
+		moved, err := a.copiesOf(ctx, info.Session, metaRestoreRun, run)
+		if err == nil {
+			err = a.remapLinks(ctx, ls, moved, gone)
+		}
+		if err != nil {
+			logger(ctx).Warn("failed to carry links over to restored records", "session_id", info.Session, "error", err)
+		}
+	}
+	return len(recs), nil
+}
+
+// dropRestoreRun deletes the records a failed restore run staged.
+func (a *App) dropRestoreRun(ctx context.Context, session, run string) error {
+	recs, err := a.sessionRecords(ctx, session)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for _, rec := range recs {
+		if model.DecodeMetadata(rec.Metadata)[metaRestoreRun] == run {
+			ids = append(ids, rec.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return a.bank.Store.DeleteMemory(ctx, ids)
+}
+
+func registerSnapshotTools(s *server.MCPServer, app *App) {
+	snapshotTool := mcp.NewTool("sessions.snapshot",
+		mcp.WithDescription("Save a point-in-time snapshot of a session's records that sessions.restore can roll back to"),
+		mcp.WithString("session", mcp.Required(), mcp.Description("Session ID or name")),
+		mcp.WithString("label", mcp.Description("Free-form note, e.g. \"before cleanup\"")),
+		mcp.WithString("principal", mcp.Description("Must be the owner if the session has one")),
+	)
+	s.AddTool(snapshotTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		ref, err := req.RequireString("session")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session: %v", err)), nil
+		}
+		sess, err := app.sessions.get(ref)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if err := checkSessionOwner(sess, getStringParam(req, "principal")); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		info, err := app.snapshotSession(ctx, sess.ID, getStringParam(req, "label"))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("snapshot failed: %v", err)), nil
+		}
+		return mcp.NewToolResultJSON(info)
+	})
+
+	listTool := mcp.NewTool("sessions.snapshots",
+		mcp.WithDescription("List a session's snapshots, newest first"),
+		mcp.WithString("session", mcp.Required(), mcp.Description("Session ID or name")),
+		mcp.WithString("principal", mcp.Description("Must be the owner if the session has one")),
+	)
+	s.AddTool(listTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		ref, err := req.RequireString("session")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session: %v", err)), nil
+		}
+		sess, err := app.sessions.get(ref)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if err := checkSessionOwner(sess, getStringParam(req, "principal")); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		snaps, err := app.listSnapshots(sess.ID)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(snaps)
+	})
+
+	restoreTool := mcp.NewTool("sessions.restore",
+		mcp.WithDescription("Replace a session's records with those of one of its snapshots"),
+		mcp.WithString("session", mcp.Required(), mcp.Description("Session ID or name")),
+		mcp.WithString("snapshot", mcp.Required(), mcp.Description("Snapshot ID from sessions.snapshots")),
+		mcp.WithString("principal", mcp.Description("Must be the owner if the session has one")),
+		mcp.WithBoolean("backup", mcp.Description("Snapshot the current records first (default true)")),
+	)
+	s.AddTool(restoreTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		ref, err := req.RequireString("session")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing session: %v", err)), nil
+		}
+		id, err := req.RequireString("snapshot")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing snapshot: %v", err)), nil
+		}
+		sess, err := app.sessions.get(ref)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if err := checkSessionOwner(sess, getStringParam(req, "principal")); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		info, err := app.findSnapshot(sess.ID, strings.TrimSpace(id))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		// Load first: the backup snapshot may prune the one being restored.
+		recs, err := loadSnapshot(info)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		out := map[string]any{"session_id": sess.ID, "snapshot": info.ID}
+		if req.GetBool("backup", true) {
+			backup, err := app.snapshotSession(ctx, sess.ID, "before restore of "+info.ID)
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("backup snapshot failed: %v", err)), nil
+			}
+			out["backup"] = backup.ID
+		}
+		n, err := app.restoreSnapshot(ctx, info, recs)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("restore failed after %d records: %v", n, err)), nil
+		}
+		out["records"] = n
+		return mcp.NewToolResultJSON(out)
+	})
+}
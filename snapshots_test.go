@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRestoreReplacesRecords(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+	mustStore(t, app, "s1", "the billing service uses Postgres", nil)
+	snap, err := app.snapshotSession(ctx, "s1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, app, "s1", "the search service uses OpenSearch", nil)
+
+	recs, err := loadSnapshot(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := app.restoreSnapshot(ctx, snap, recs)
+	if err != nil || n != 1 {
+		t.Fatalf("restored %d records, %v; want 1", n, err)
+	}
+	// Another write prunes the store; the restored record stays.
+	mustStore(t, app, "s2", "deploys go out on Tuesdays", nil)
+	got := recordIDs(t, app, "s1")
+	if len(got) != 1 {
+		t.Fatalf("session holds %d records after restore, want 1", len(got))
+	}
+	for _, rec := range got {
+		if rec.Content != "the billing service uses Postgres" {
+			t.Fatalf("session holds %q after restore", rec.Content)
+		}
+	}
+}
+
+func TestSnapshotDirRejectsEscapingSessions(t *testing.T) {
+	app := newTestApp(t, nil)
+	for _, session := range []string{"", ".", "..", "../etc", `a\b`, "c:d"} {
+		if _, err := app.snapshotDir(session); err == nil {
+			t.Errorf("snapshotDir(%q) was accepted", session)
+		}
+	}
+	if _, err := app.snapshotDir("sess-1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotToolsCheckOwner(t *testing.T) {
+	app := newTestApp(t, nil)
+	owned, err := app.sessions.create("proj", SessionInfo{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tool := range []string{"sessions.snapshot", "sessions.snapshots"} {
+		args := map[string]any{"session": owned.ID, "principal": "mallory"}
+		if res := callTool(t, app, registerSnapshotTools, tool, args); !res.IsError {
+			t.Errorf("mallory ran %s on alice's session", tool)
+		}
+		args["principal"] = "alice"
+		if res := callTool(t, app, registerSnapshotTools, tool, args); res.IsError {
+			t.Errorf("the owner alice could not run %s", tool)
+		}
+	}
+}
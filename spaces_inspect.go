@@ -0,0 +1,223 @@
+// spaces_inspect.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// SpaceDescription is the spaces.describe payload.
+type SpaceDescription struct {
+	spaceInfo
+	TTLSeconds   int64                     `json:"ttl_seconds"`
+	Expired      bool                      `json:"expired"`
+	Parent       string                    `json:"parent,omitempty"`
+	EffectiveACL map[string]effectiveGrant `json:"effective_acl"`
+	Members      []string                  `json:"members"`
+}
+
+// SpaceContributor counts one principal's records in a space.
+type SpaceContributor struct {
+	Principal string `json:"principal"`
+	Records   int    `json:"records"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// SpaceStats is the spaces.stats payload. Short-term records are counted
+// separately since they only reach the store on flush.
+type SpaceStats struct {
+	Space           string             `json:"space"`
+	Records         int                `json:"records"`
+	Bytes           int64              `json:"bytes"`
+	ShortTerm       int                `json:"short_term"`
+	LastWrite       time.Time          `json:"last_write,omitzero"`
+	Unattributed    int                `json:"unattributed"`
+	TopContributors []SpaceContributor `json:"top_contributors"`
+}
+
+func (a *App) describeSpace(name string) (SpaceDescription, bool) {
+	sp, ok := a.catalog.get(name)
+	if !ok {
+		return SpaceDescription{}, false
+	}
+	members := make([]string, 0, len(sp.joined))
+	for p := range sp.joined {
+		members = append(members, p)
+	}
+	sort.Strings(members)
+	parent, _ := a.catalog.nearestAncestor(name)
+	return SpaceDescription{
+		spaceInfo:    sp,
+		TTLSeconds:   int64(sp.TTL / time.Second),
+		Expired:      !sp.ExpiresAt.IsZero() && time.Now().After(sp.ExpiresAt),
+		Parent:       parent,
+		EffectiveACL: a.catalog.effective(name),
+		Members:      members,
+	}, true
+}
+
+// spaceTalliesTTL is how long one store scan serves spaces.stats for
+// every space.
+const spaceTalliesTTL = 30 * time.Second
+
+// spaceTally is one space's long-term usage from the last scan.
+type spaceTally struct {
+	records      int
+	bytes        int64
+	lastWrite    time.Time
+	unattributed int
+	byPrincipal  map[string]*SpaceContributor
+}
+
+func (t *spaceTally) add(rec model.MemoryRecord, principal string, size int64) {
+	t.records++
+	t.bytes += size
+	if rec.CreatedAt.After(t.lastWrite) {
+		t.lastWrite = rec.CreatedAt
+	}
+	if principal == "" {
+		t.unattributed++
+		return
+	}
+	c := t.byPrincipal[principal]
+	if c == nil {
+		c = &SpaceContributor{Principal: principal}
+		t.byPrincipal[principal] = c
+	}
+	c.Records++
+	c.Bytes += size
+}
+
+// spaceTallyCache holds the usage of all spaces, gathered in a single
+// pass over the store, so spaces.stats does not scan the store per call.
+type spaceTallyCache struct {
+	mu      sync.Mutex
+	at      time.Time
+	tallies map[string]*spaceTally
+}
+
+// tally returns name's usage, rescanning the store when the last scan is
+// older than spaceTalliesTTL.
+func (c *spaceTallyCache) tally(ctx context.Context, vs memory.VectorStore, name string) (spaceTally, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tallies == nil || time.Since(c.at) > spaceTalliesTTL {
+		tallies := map[string]*spaceTally{}
+		err := vs.Iterate(ctx, func(rec model.MemoryRecord) bool {
+			size := int64(len(rec.Content))
+			p, _ := model.DecodeMetadata(rec.Metadata)["principal"].(string)
+			names := []string{rec.SessionID}
+			if sp := recordSpace(rec); sp != "" && sp != rec.SessionID {
+				names = append(names, sp)
+			}
+			for _, n := range names {
+				t := tallies[n]
+				if t == nil {
+					t = &spaceTally{byPrincipal: map[string]*SpaceContributor{}}
+					tallies[n] = t
+				}
+				t.add(rec, p, size)
+			}
+			return true
+		})
+		if err != nil {
+			return spaceTally{}, err
+		}
+		c.tallies, c.at = tallies, time.Now()
+	}
+	if t := c.tallies[name]; t != nil {
+		return *t, nil
+	}
+	return spaceTally{}, nil
+}
+
+// spaceStats reports name's usage from the tally cache; top is the number
+// of contributors to return.
+func (a *App) spaceStats(ctx context.Context, name string, top int) (SpaceStats, error) {
+	st := SpaceStats{Space: name, TopContributors: []SpaceContributor{}}
+	t, err := a.spaceTallies.tally(ctx, a.bank.Store, name)
+	if err != nil {
+		return st, err
+	}
+	st.Records, st.Bytes, st.LastWrite, st.Unattributed = t.records, t.bytes, t.lastWrite, t.unattributed
+	for _, c := range t.byPrincipal {
+		st.TopContributors = append(st.TopContributors, *c)
+	}
+	sort.Slice(st.TopContributors, func(i, j int) bool {
+		ci, cj := st.TopContributors[i], st.TopContributors[j]
+		if ci.Records != cj.Records {
+			return ci.Records > cj.Records
+		}
+		return ci.Principal < cj.Principal
+	})
+	if len(st.TopContributors) > top {
+		st.TopContributors = st.TopContributors[:top]
+	}
+	a.metrics.mu.Lock()
+	st.ShortTerm = a.metrics.shortTerm[name]
+	a.metrics.mu.Unlock()
+	return st, nil
+}
+
+func registerSpaceInspectTools(s *server.MCPServer, app *App) {
+	describeTool := mcp.NewTool("spaces.describe",
+		mcp.WithDescription("Show a space's TTL, expiry, ACL with grant expiries, inherited ACL and joined members"),
+		mcp.WithString("name", mcp.Required()),
+		mcp.WithString("principal", mcp.Required(), mcp.Description("Must be a reader of the space")),
+	)
+	s.AddTool(describeTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		name, err := req.RequireString("name")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing name: %v", err)), nil
+		}
+		principal, err := req.RequireString("principal")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err)), nil
+		}
+		if err := app.requireRole(name, principal, memory.SpaceRoleReader); err != nil {
+			return toolError(err), nil
+		}
+		desc, _ := app.describeSpace(name)
+		return mcp.NewToolResultJSON(desc)
+	})
+
+	statsTool := mcp.NewTool("spaces.stats",
+		mcp.WithDescription("Record count, bytes, last write time and top contributors of a space"),
+		mcp.WithString("name", mcp.Required()),
+		mcp.WithString("principal", mcp.Required(), mcp.Description("Must be a reader of the space")),
+		mcp.WithNumber("top", mcp.Description("Number of top contributors to return (default 5)")),
+	)
+	s.AddTool(statsTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		name, err := req.RequireString("name")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing name: %v", err)), nil
+		}
+		principal, err := req.RequireString("principal")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err)), nil
+		}
+		if err := app.requireRole(name, principal, memory.SpaceRoleReader); err != nil {
+			return toolError(err), nil
+		}
+		top := int(getNumberParam(req, "top"))
+		if top <= 0 {
+			top = 5
+		}
+		st, err := app.spaceStats(ctx, name, top)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("space stats failed: %v", err)), nil
+		}
+		return mcp.NewToolResultJSON(st)
+	})
+}
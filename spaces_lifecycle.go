@@ -0,0 +1,642 @@
+// spaces_lifecycle.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// What happens to a space's memories once it has expired.
+const (
+	spacePurge    = "purge"
+	spaceArchive  = "archive"
+	spaceTransfer = "transfer"
+)
+
+// metaSharedSpace marks records written to a space with
+// shared.add_short_to. Spaces and sessions share one namespace, so a
+// space's teardown only touches records carrying the marker, never ones
+// that merely have its name as their session.
+const metaSharedSpace = "shared_space"
+
+// sharedSpaceOf returns the space rec was written to, or "".
+func sharedSpaceOf(rec model.MemoryRecord) string {
+	if !strings.Contains(rec.Metadata, metaSharedSpace) {
+		return ""
+	}
+	space, _ := model.DecodeMetadata(rec.Metadata)[metaSharedSpace].(string)
+	return space
+}
+
+func validSpaceAction(action string) bool {
+	switch action {
+	case spacePurge, spaceArchive, spaceTransfer:
+		return true
+	}
+	return false
+}
+
+// spaceInfo mirrors what the registry knows about a space; SpaceRegistry
+// has no getter, and drops expired spaces without telling anyone.
+type spaceInfo struct {
+	Name         string                `json:"name"`
+	ACL          map[string]spaceGrant `json:"acl,omitempty"`
+	TTL          time.Duration         `json:"-"`
+	CreatedAt    time.Time             `json:"created_at"`
+	UpdatedAt    time.Time             `json:"updated_at"`
+	ExpiresAt    time.Time             `json:"expires_at,omitzero"`
+	ExpiryAction string                `json:"expiry_action,omitempty"`
+	OwnerSession string                `json:"owner_session,omitempty"`
+	// joined holds principals whose shared session has joined the space,
+	// including ones whose access has since lapsed. The value is true when
+	// the join also covers descendant spaces.
+	joined map[string]bool
+	// synced is the effective ACL last pushed to the registry.
+	synced map[string]memory.SpaceRole
+}
+
+// spaceGrant is one ACL entry. It lives as long as the space unless
+// spaces.grant gave it a grant_ttl_seconds of its own; renewing the space
+// does not extend that.
+type spaceGrant struct {
+	Role      memory.SpaceRole `json:"role"`
+	GrantedAt time.Time        `json:"granted_at"`
+	ExpiresAt time.Time        `json:"expires_at,omitzero"`
+}
+
+func (s *spaceInfo) clone() spaceInfo {
+	cp := *s
+	cp.ACL = make(map[string]spaceGrant, len(s.ACL))
+	for k, v := range s.ACL {
+		cp.ACL[k] = v
+	}
+	cp.joined = make(map[string]bool, len(s.joined))
+	for k, v := range s.joined {
+		cp.joined[k] = v
+	}
+	return cp
+}
+
+// spaceCatalog tracks every space created through the tools, including
+// expired ones until the lifecycle sweeper has handled their memories. It
+// is kept in spaces.json, so spaces survive a restart and still expire.
+type spaceCatalog struct {
+	mu         sync.Mutex
+	path       string
+	spaces     map[string]*spaceInfo
+	defaultTTL time.Duration
+	stats      SpaceLifecycleStats
+}
+
+// savedSpace is a catalog entry as written to spaces.json.
+type savedSpace struct {
+	spaceInfo
+	TTL    time.Duration   `json:"ttl,omitempty"`
+	Joined map[string]bool `json:"joined,omitempty"`
+}
+
+// SpaceLifecycleStats is reported under engine.metrics.
+type SpaceLifecycleStats struct {
+	Spaces      int       `json:"spaces"`
+	TornDown    int64     `json:"torn_down"`
+	Purged      int64     `json:"purged"`
+	Archived    int64     `json:"archived"`
+	Transferred int64     `json:"transferred"`
+	Errors      int64     `json:"errors"`
+	LastRun     time.Time `json:"last_run,omitempty"`
+}
+
+// newSpaceCatalog loads dir/spaces.json, if there is one.
+func newSpaceCatalog(dir string, defaultTTL time.Duration) (*spaceCatalog, error) {
+	c := &spaceCatalog{path: filepath.Join(dir, "spaces.json"), spaces: make(map[string]*spaceInfo), defaultTTL: defaultTTL}
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read space catalog: %w", err)
+	}
+	var saved map[string]*savedSpace
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", c.path, err)
+	}
+	for name, sv := range saved {
+		sp := sv.spaceInfo
+		sp.Name, sp.TTL, sp.joined = name, sv.TTL, sv.Joined
+		if sp.ACL == nil {
+			sp.ACL = map[string]spaceGrant{}
+		}
+		c.spaces[name] = &sp
+	}
+	return c, nil
+}
+
+// saveLocked writes the catalog; c.mu must be held. Callers cannot undo
+// the change they made, so a failed write is logged.
+func (c *spaceCatalog) saveLocked() {
+	if c.path == "" {
+		return
+	}
+	saved := make(map[string]*savedSpace, len(c.spaces))
+	for name, sp := range c.spaces {
+		saved[name] = &savedSpace{spaceInfo: *sp, TTL: sp.TTL, Joined: sp.joined}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		tmp := c.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, c.path)
+		}
+	}
+	if err != nil {
+		slog.Error("failed to write space catalog", "path", c.path, "error", err)
+	}
+}
+
+// touch applies the same TTL rule as SpaceRegistry.Upsert.
+func (c *spaceCatalog) touch(name string, ttl time.Duration) *spaceInfo {
+	now := time.Now().UTC()
+	sp := c.spaces[name]
+	if sp == nil {
+		sp = &spaceInfo{Name: name, CreatedAt: now, ACL: map[string]spaceGrant{}}
+		c.spaces[name] = sp
+	}
+	sp.UpdatedAt = now
+	if ttl <= 0 {
+		ttl = c.defaultTTL
+	}
+	sp.TTL = ttl
+	if ttl > 0 {
+		sp.ExpiresAt = now.Add(ttl)
+	} else {
+		sp.ExpiresAt = time.Time{}
+	}
+	return sp
+}
+
+func (c *spaceCatalog) get(name string) (spaceInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sp := c.spaces[name]
+	if sp == nil {
+		return spaceInfo{}, false
+	}
+	return sp.clone(), true
+}
+
+// join records that principal's shared session joined name, optionally
+// with its descendants; leave undoes it.
+func (c *spaceCatalog) join(name, principal string, descendants bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sp := c.spaces[name]; sp != nil {
+		if sp.joined == nil {
+			sp.joined = map[string]bool{}
+		}
+		sp.joined[principal] = sp.joined[principal] || descendants
+		c.saveLocked()
+	}
+}
+
+func (c *spaceCatalog) leave(name, principal string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sp := c.spaces[name]; sp != nil {
+		delete(sp.joined, principal)
+		c.saveLocked()
+	}
+}
+
+// joinedBy returns the spaces principal has joined, sorted, and the
+// subset joined with their descendants.
+func (c *spaceCatalog) joinedBy(principal string) (spaces, trees []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, sp := range c.spaces {
+		if tree, ok := sp.joined[principal]; ok {
+			spaces = append(spaces, name)
+			if tree {
+				trees = append(trees, name)
+			}
+		}
+	}
+	sort.Strings(spaces)
+	sort.Strings(trees)
+	return spaces, trees
+}
+
+func (c *spaceCatalog) record(res SpaceTeardown, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.stats.Errors++
+		return
+	}
+	c.stats.TornDown++
+	switch res.Action {
+	case spacePurge:
+		c.stats.Purged += int64(res.Records)
+	case spaceArchive:
+		c.stats.Archived += int64(res.Records)
+	case spaceTransfer:
+		c.stats.Transferred += int64(res.Transferred)
+	}
+}
+
+func (c *spaceCatalog) Stats() SpaceLifecycleStats {
+	if c == nil {
+		return SpaceLifecycleStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Spaces = len(c.spaces)
+	return st
+}
+
+// due returns spaces whose expiry plus grace has passed.
+func (c *spaceCatalog) due(now time.Time, grace time.Duration) []spaceInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []spaceInfo
+	for _, sp := range c.spaces {
+		if !sp.ExpiresAt.IsZero() && now.After(sp.ExpiresAt.Add(grace)) {
+			out = append(out, sp.clone())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// expiredGrants returns space -> principals whose grant has run out while
+// the space itself is still live.
+func (c *spaceCatalog) expiredGrants(now time.Time) map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := map[string][]string{}
+	for name, sp := range c.spaces {
+		if !sp.ExpiresAt.IsZero() && now.After(sp.ExpiresAt) {
+			continue
+		}
+		for p, g := range sp.ACL {
+			if !g.ExpiresAt.IsZero() && now.After(g.ExpiresAt) {
+				out[name] = append(out[name], p)
+			}
+		}
+	}
+	return out
+}
+
+// SpaceLifecycleOptions configures expired-space handling.
+type SpaceLifecycleOptions struct {
+	Action       string
+	OwnerSession string
+	Grace        time.Duration
+	ExportDir    string
+}
+
+// upsertSpace creates or updates a space in the registry and the catalog.
+// acl goes to the catalog only; syncSpaceACLs pushes the resolved ACL,
+// with groups expanded to their members, into the registry.
+func (a *App) upsertSpace(name string, ttl time.Duration, acl map[string]memory.SpaceRole, action, owner string) {
+	a.spaces.Upsert(name, ttl, nil)
+	defer a.syncSpaceACLs(name)
+	a.catalog.mu.Lock()
+	defer a.catalog.mu.Unlock()
+	sp := a.catalog.touch(name, ttl)
+	for p, role := range acl {
+		if p = strings.TrimSpace(p); p != "" {
+			sp.ACL[p] = spaceGrant{Role: role, GrantedAt: sp.UpdatedAt}
+		}
+	}
+	if action != "" {
+		sp.ExpiryAction = action
+	}
+	if owner != "" {
+		sp.OwnerSession = owner
+	}
+	a.catalog.saveLocked()
+}
+
+// restoreSpaces pushes the ACLs of the spaces loaded from spaces.json into
+// the registry and rejoins the shared sessions that had joined them.
+func (a *App) restoreSpaces() {
+	a.syncAllSpaceACLs()
+	a.catalog.mu.Lock()
+	joins := map[string][]string{}
+	for name, sp := range a.catalog.spaces {
+		for p := range sp.joined {
+			joins[p] = append(joins[p], name)
+		}
+	}
+	a.catalog.mu.Unlock()
+	for p, spaces := range joins {
+		for _, space := range spaces {
+			// A lapsed grant keeps the join for shared.retrieve to report.
+			_ = a.sharedFor(p).Join(space)
+		}
+	}
+}
+
+// grantSpace records a grant in the catalog and renews the space TTL, as
+// SpaceRegistry.Grant does; the registry only gets the resolved ACL.
+// A grantTTL above zero makes the grant lapse on its own after that long.
+func (a *App) grantSpace(name, principal string, role memory.SpaceRole, ttl, grantTTL time.Duration) error {
+	if a.spaces.Upsert(name, ttl, nil) == nil {
+		return fmt.Errorf("space name is empty")
+	}
+	defer a.syncSpaceACLs(name)
+	a.catalog.mu.Lock()
+	defer a.catalog.mu.Unlock()
+	sp := a.catalog.touch(name, ttl)
+	g := spaceGrant{Role: role, GrantedAt: sp.UpdatedAt}
+	if grantTTL > 0 {
+		g.ExpiresAt = sp.UpdatedAt.Add(grantTTL)
+	}
+	sp.ACL[strings.TrimSpace(principal)] = g
+	a.catalog.saveLocked()
+	return nil
+}
+
+func (a *App) revokeSpace(name, principal string) {
+	a.spaces.Revoke(name, principal)
+	defer a.syncSpaceACLs(name)
+	a.catalog.mu.Lock()
+	defer a.catalog.mu.Unlock()
+	if sp := a.catalog.spaces[name]; sp != nil {
+		delete(sp.ACL, strings.TrimSpace(principal))
+		a.catalog.saveLocked()
+	}
+}
+
+// SpaceTeardown reports what happened to a deleted or expired space.
+type SpaceTeardown struct {
+	Space       string `json:"space"`
+	Action      string `json:"action"`
+	Records     int    `json:"records"`
+	ExportFile  string `json:"export_file,omitempty"`
+	TransferTo  string `json:"transfer_to,omitempty"`
+	Transferred int    `json:"transferred,omitempty"`
+}
+
+// teardownSpace flushes the space's short-term buffer, applies action to
+// its long-term memories (those marked with metaSharedSpace) and removes
+// the space everywhere.
+func (a *App) teardownSpace(ctx context.Context, name, action, owner string) (res SpaceTeardown, err error) {
+	defer func() { a.catalog.record(res, err) }()
+	out := SpaceTeardown{Space: name, Action: action}
+	if action == spaceTransfer {
+		if owner == "" {
+			return out, fmt.Errorf("space %q: transfer needs an owner session", name)
+		}
+		out.TransferTo = owner
+	}
+	if err := a.flushShortTerm(ctx, name); err != nil {
+		return out, fmt.Errorf("flush space %q: %w", name, err)
+	}
+
+	var recs []model.MemoryRecord
+	err = a.bank.Store.Iterate(ctx, func(rec model.MemoryRecord) bool {
+		if sharedSpaceOf(rec) == name {
+			recs = append(recs, rec)
+		}
+		return true
+	})
+	if err != nil {
+		return out, err
+	}
+	out.Records = len(recs)
+
+	switch action {
+	case spaceArchive:
+		path, err := exportRecords(a.lifecycle.ExportDir, name, recs)
+		if err != nil {
+			return out, err
+		}
+		out.ExportFile = path
+	case spaceTransfer:
+		// Links are read first: the deletes below take them along.
+		ids := recordIDsOf(recs)
+		ls, err := a.links.Links(ctx, ids)
+		if err != nil {
+			return out, err
+		}
+		// Each record is deleted once its copy is stored, so a failure
+		// part-way leaves every record in one place and a retry moves only
+		// the rest.
+		for _, rec := range recs {
+			if err := a.transferRecord(ctx, rec, name, owner); err != nil {
+				return out, fmt.Errorf("transfer record %d: %w", rec.ID, err)
+			}
+			if err := a.bank.Store.DeleteMemory(ctx, []int64{rec.ID}); err != nil {
+				return out, fmt.Errorf("delete transferred record %d: %w", rec.ID, err)
+			}
+			out.Transferred++
+		}
+		if len(ls) > 0 {
+			gone := make(map[int64]bool, len(ids))
+			for _, id := range ids {
+				gone[id] = true
+			}
+			moved, err := a.copiesOf(ctx, owner, "transferred_from", name)
+			if err == nil {
+				err = a.remapLinks(ctx, ls, moved, gone)
+			}
+			if err != nil {
+				logger(ctx).Warn("failed to carry links over to transferred records", "space", name, "error", err)
+			}
+		}
+		recs = nil
+	}
+	if len(recs) > 0 {
+		ids := make([]int64, len(recs))
+		for i, rec := range recs {
+			ids[i] = rec.ID
+		}
+		if err := a.bank.Store.DeleteMemory(ctx, ids); err != nil {
+			return out, err
+		}
+	}
+
+	a.dropSpace(name)
+	return out, nil
+}
+
+// dropSpace removes name from the catalog, the registry and every shared
+// session. SpaceRegistry has no delete, so every principal the catalog
+// pushed into the registry is revoked; an entry that admits nobody is
+// dropped by the registry once it expires, or reset if the space is
+// created again. The catalog entry goes first and under the same lock,
+// so a concurrent sync cannot push grants back.
+func (a *App) dropSpace(name string) {
+	a.catalog.mu.Lock()
+	if sp := a.catalog.spaces[name]; sp != nil {
+		for p := range sp.ACL {
+			a.spaces.Revoke(name, p)
+		}
+		for p := range sp.synced {
+			a.spaces.Revoke(name, p)
+		}
+	}
+	delete(a.catalog.spaces, name)
+	a.catalog.saveLocked()
+	a.catalog.mu.Unlock()
+	a.metrics.spaceGone(name)
+	a.mu.RLock()
+	for _, ss := range a.shared {
+		ss.Leave(name)
+	}
+	a.mu.RUnlock()
+	// Descendants lose what they inherited from name.
+	for _, d := range a.catalog.descendants(name) {
+		a.syncSpaceACLs(d)
+	}
+}
+
+// exportRecords writes recs without their vectors to
+// dir/<name>-<timestamp>.jsonl and returns the path.
+func exportRecords(dir, name string, recs []model.MemoryRecord) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create export directory: %w", err)
+	}
+	safe := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, name)
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.jsonl", safe, time.Now().UTC().Format("20060102T150405Z")))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, rec := range recs {
+		rec.Embedding = nil
+		if err := enc.Encode(rec); err != nil {
+			return "", fmt.Errorf("failed to write export file: %w", err)
+		}
+	}
+	return path, f.Sync()
+}
+
+// transferRecord re-homes rec under the owner session, keeping its vector
+// when the store returned one.
+func (a *App) transferRecord(ctx context.Context, rec model.MemoryRecord, from, owner string) error {
+	meta := model.DecodeMetadata(rec.Metadata)
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	meta["space"] = owner
+	meta["transferred_from"] = from
+	meta["source_record"] = rec.ID
+	emb := rec.Embedding
+	if len(emb) == 0 {
+		var err error
+		if emb, err = a.embedder.Embed(ctx, rec.Content); err != nil {
+			return err
+		}
+	}
+	return a.bank.Store.StoreMemory(ctx, owner, rec.Content, meta, emb)
+}
+
+// runSpaceLifecycle periodically tears down spaces whose grace period has
+// run out.
+func (a *App) runSpaceLifecycle(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			now := time.Now()
+			a.catalog.mu.Lock()
+			a.catalog.stats.LastRun = now.UTC()
+			a.catalog.mu.Unlock()
+			if a.groups.pruneExpired(now) {
+				a.syncAllSpaceACLs()
+			}
+			for name, principals := range a.catalog.expiredGrants(now) {
+				for _, p := range principals {
+					a.revokeSpace(name, p)
+					slog.Info("space grant expired", "space", name, "principal", p)
+				}
+			}
+			for _, sp := range a.catalog.due(now, a.lifecycle.Grace) {
+				action, owner := sp.ExpiryAction, sp.OwnerSession
+				if action == "" {
+					action = a.lifecycle.Action
+				}
+				if owner == "" {
+					owner = a.lifecycle.OwnerSession
+				}
+				res, err := a.teardownSpace(ctx, sp.Name, action, owner)
+				if err != nil {
+					slog.Error("expired space teardown failed", "space", sp.Name, "action", action, "error", err)
+					continue
+				}
+				slog.Info("expired space torn down", "space", sp.Name, "action", action, "records", res.Records, "export_file", res.ExportFile)
+			}
+		}
+	}
+}
+
+func registerSpaceLifecycleTools(s *server.MCPServer, app *App) {
+	deleteTool := mcp.NewTool("spaces.delete",
+		mcp.WithDescription("Tear down a space: purge, archive or transfer its memories and remove it"),
+		mcp.WithString("name", mcp.Required()),
+		mcp.WithString("principal", mcp.Required(), mcp.Description("Must be an admin of the space")),
+		mcp.WithString("action", mcp.Description("purge (default), archive or transfer")),
+		mcp.WithString("owner_session", mcp.Description("Session receiving the memories when action=transfer")),
+	)
+	s.AddTool(deleteTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		name, err := req.RequireString("name")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing name: %v", err)), nil
+		}
+		principal, err := req.RequireString("principal")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing principal: %v", err)), nil
+		}
+		sp, ok := app.catalog.get(name)
+		if !ok {
+			return mcp.NewToolResultError(fmt.Sprintf("unknown space %q", name)), nil
+		}
+		if err := app.requireRole(name, principal, memory.SpaceRoleAdmin); err != nil {
+			return toolError(err), nil
+		}
+		action := strings.ToLower(strings.TrimSpace(getStringParam(req, "action")))
+		if action == "" {
+			action = spacePurge
+		}
+		if !validSpaceAction(action) {
+			return mcp.NewToolResultError(fmt.Sprintf("unknown action %q (want purge, archive or transfer)", action)), nil
+		}
+		owner := strings.TrimSpace(getStringParam(req, "owner_session"))
+		if owner == "" {
+			owner = sp.OwnerSession
+		}
+		res, err := app.teardownSpace(ctx, name, action, owner)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(res)
+	})
+}
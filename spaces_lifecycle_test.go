@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+)
+
+func TestTeardownTransfersAndDropsSpace(t *testing.T) {
+	app := newTestApp(t, nil)
+	app.upsertSpace("team", time.Hour, map[string]memory.SpaceRole{"alice": memory.SpaceRoleAdmin}, "", "")
+	mustStore(t, app, "team", "the standup is at nine", map[string]any{metaSharedSpace: "team"})
+	mustStore(t, app, "team", "releases go out on thursdays", map[string]any{metaSharedSpace: "team"})
+
+	res, err := app.teardownSpace(context.Background(), "team", spaceTransfer, "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Transferred != 2 {
+		t.Fatalf("transferred %d records, want 2", res.Transferred)
+	}
+	if n := len(recordIDs(t, app, "team")); n != 0 {
+		t.Fatalf("%d records left in the space", n)
+	}
+	if n := len(recordIDs(t, app, "archive")); n != 2 {
+		t.Fatalf("owner session has %d records, want 2", n)
+	}
+	if _, ok := app.catalog.get("team"); ok {
+		t.Fatal("space is still in the catalog")
+	}
+	if app.spaces.CanRead("team", "alice") {
+		t.Fatal("alice can still read the dropped space")
+	}
+}
+
+func TestGrantExpiryIsIndependentOfSpaceTTL(t *testing.T) {
+	app := newTestApp(t, nil)
+	app.upsertSpace("team", time.Hour, map[string]memory.SpaceRole{"alice": memory.SpaceRoleAdmin}, "", "")
+	if err := app.grantSpace("team", "bob", memory.SpaceRoleReader, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.grantSpace("team", "carol", memory.SpaceRoleReader, time.Hour, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// Renewing the space must not extend carol's grant, and bob's grant
+	// must not lapse with the space's old expiry.
+	app.upsertSpace("team", 2*time.Hour, nil, "", "")
+	got := app.catalog.expiredGrants(time.Now().Add(90 * time.Minute))
+	if len(got["team"]) != 1 || got["team"][0] != "carol" {
+		t.Fatalf("expired grants = %v, want only carol", got)
+	}
+}
+
+func TestSpaceCannotClaimSessionRecords(t *testing.T) {
+	app := newTestApp(t, nil)
+	if err := app.sessions.touch("sess-victim"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.requireRole("sess-victim", "mallory", memory.SpaceRoleAdmin); err == nil {
+		t.Fatal("mallory may create a space named after a session")
+	}
+
+	// A space whose name matches a session that registered later keeps
+	// away from that session's records.
+	app.upsertSpace("team", time.Hour, map[string]memory.SpaceRole{"alice": memory.SpaceRoleAdmin}, "", "")
+	mustStore(t, app, "team", "the standup is at nine", map[string]any{metaSharedSpace: "team"})
+	mustStore(t, app, "team", "my own notes about the release", nil)
+	res, err := app.teardownSpace(context.Background(), "team", spacePurge, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Records != 1 {
+		t.Fatalf("purged %d records, want only the one written to the space", res.Records)
+	}
+	recs := recordIDs(t, app, "team")
+	if len(recs) != 1 {
+		t.Fatalf("%d session records left, want 1", len(recs))
+	}
+}
+
+func TestSpaceCatalogSurvivesRestart(t *testing.T) {
+	app := newTestApp(t, nil)
+	app.upsertSpace("team", time.Hour, map[string]memory.SpaceRole{"alice": memory.SpaceRoleAdmin}, spacePurge, "")
+	if err := app.grantSpace("team", "bob", memory.SpaceRoleReader, time.Hour, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.joinSpace("bob", "team", false); err != nil {
+		t.Fatal(err)
+	}
+
+	app = reopenTestApp(t, nil)
+	sp, ok := app.catalog.get("team")
+	if !ok {
+		t.Fatal("space was lost on restart")
+	}
+	if sp.ExpiresAt.IsZero() || sp.ExpiryAction != spacePurge || sp.ACL["bob"].ExpiresAt.IsZero() {
+		t.Fatalf("space after restart = %+v", sp)
+	}
+	if len(app.catalog.due(time.Now().Add(3*time.Hour), 0)) != 1 {
+		t.Fatal("restored space never comes due")
+	}
+	if !app.spaces.CanRead("team", "bob") {
+		t.Fatal("registry lost bob's grant on restart")
+	}
+	if joined, _ := app.catalog.joinedBy("bob"); len(joined) != 1 || len(app.sharedFor("bob").Spaces()) != 1 {
+		t.Fatalf("bob's join was lost: %v", joined)
+	}
+}
+
+func TestUnreadableJoinedSpaceIsDropped(t *testing.T) {
+	app := newTestApp(t, nil)
+	for _, name := range []string{"team", "docs"} {
+		app.upsertSpace(name, time.Hour, map[string]memory.SpaceRole{"bob": memory.SpaceRoleReader}, "", "")
+		if err := app.joinSpace("bob", name, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app.revokeSpace("docs", "bob")
+	app.dropUnreadableSpaces(context.Background(), "bob")
+	if joined, _ := app.catalog.joinedBy("bob"); len(joined) != 1 || joined[0] != "team" {
+		t.Fatalf("joined = %v, want only team", joined)
+	}
+	if spaces := app.sharedFor("bob").Spaces(); !slices.Contains(spaces, "team") || slices.Contains(spaces, "docs") {
+		t.Fatalf("shared view = %v, want team without docs", spaces)
+	}
+}
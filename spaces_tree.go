@@ -0,0 +1,215 @@
+// spaces_tree.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+)
+
+// Space names are paths such as "eng/payments/refunds". A space inherits
+// the ACL of its ancestors; an entry in its own ACL overrides the
+// inherited role for that principal, in either direction.
+
+// validSpaceName rejects empty path segments and surrounding whitespace.
+func validSpaceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("space name is empty")
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == "" || seg != strings.TrimSpace(seg) {
+			return fmt.Errorf("invalid space name %q: path segments must be non-empty and untrimmed", name)
+		}
+	}
+	return nil
+}
+
+// spaceAncestors returns the ancestors of name, nearest first.
+func spaceAncestors(name string) []string {
+	var out []string
+	for i := strings.LastIndex(name, "/"); i > 0; i = strings.LastIndex(name, "/") {
+		name = name[:i]
+		out = append(out, name)
+	}
+	return out
+}
+
+func isSpaceDescendant(name, ancestor string) bool {
+	return strings.HasPrefix(name, ancestor+"/")
+}
+
+// effectiveGrant is a principal's resolved role and the space it came from.
+type effectiveGrant struct {
+	Role memory.SpaceRole `json:"role"`
+	From string           `json:"from"`
+}
+
+// effectiveLocked overlays the ACLs from the root down to name. Ancestors
+// that were never created are skipped. c.mu must be held.
+func (c *spaceCatalog) effectiveLocked(name string) map[string]effectiveGrant {
+	chain := spaceAncestors(name)
+	out := map[string]effectiveGrant{}
+	for i := len(chain) - 1; i >= -1; i-- {
+		n := name
+		if i >= 0 {
+			n = chain[i]
+		}
+		if sp := c.spaces[n]; sp != nil {
+			for p, g := range sp.ACL {
+				out[p] = effectiveGrant{Role: g.Role, From: n}
+			}
+		}
+	}
+	return out
+}
+
+func (c *spaceCatalog) effective(name string) map[string]effectiveGrant {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.effectiveLocked(name)
+}
+
+// nearestAncestor returns the closest existing ancestor of name.
+func (c *spaceCatalog) nearestAncestor(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range spaceAncestors(name) {
+		if c.spaces[n] != nil {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+// descendants returns the existing descendants of name, sorted.
+func (c *spaceCatalog) descendants(name string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []string
+	for n := range c.spaces {
+		if isSpaceDescendant(n, name) {
+			out = append(out, n)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// syncSpaceACLs pushes the effective ACL of name and its descendants into
+// the SpaceRegistry, which SharedSession consults and which knows nothing
+// about inheritance or groups.
+func (a *App) syncSpaceACLs(name string) {
+	for _, n := range append([]string{name}, a.catalog.descendants(name)...) {
+		a.syncSpaceACL(n)
+	}
+}
+
+// syncSpaceACL resolves one space's ACL to individual principals. The
+// registry's Upsert resets expiry, so the space is re-upserted with its
+// remaining lifetime; expired spaces are skipped.
+func (a *App) syncSpaceACL(name string) {
+	now := time.Now()
+	a.catalog.mu.Lock()
+	sp := a.catalog.spaces[name]
+	if sp == nil || (!sp.ExpiresAt.IsZero() && !now.Before(sp.ExpiresAt)) {
+		a.catalog.mu.Unlock()
+		return
+	}
+	eff := a.catalog.effectiveLocked(name)
+	var ttl time.Duration
+	if !sp.ExpiresAt.IsZero() {
+		ttl = sp.ExpiresAt.Sub(now)
+	}
+	a.catalog.mu.Unlock()
+
+	acl := a.resolveACL(eff)
+
+	a.catalog.mu.Lock()
+	stale := sp.synced
+	sp.synced = acl
+	a.catalog.mu.Unlock()
+
+	for p := range stale {
+		if _, ok := acl[p]; !ok {
+			a.spaces.Revoke(name, p)
+		}
+	}
+	a.spaces.Upsert(name, ttl, acl)
+}
+
+// syncAllSpaceACLs re-resolves every space, e.g. after a group changed.
+func (a *App) syncAllSpaceACLs() {
+	a.catalog.mu.Lock()
+	names := make([]string, 0, len(a.catalog.spaces))
+	for n := range a.catalog.spaces {
+		names = append(names, n)
+	}
+	a.catalog.mu.Unlock()
+	for _, n := range names {
+		a.syncSpaceACL(n)
+	}
+}
+
+// joinSpace adds space to principal's shared view. With descendants, the
+// readable sub-spaces are joined too, and walkJoinedTrees picks up ones
+// created later.
+func (a *App) joinSpace(principal, space string, descendants bool) error {
+	if err := a.sharedFor(principal).Join(space); err != nil {
+		return err
+	}
+	a.catalog.join(space, principal, descendants)
+	if descendants {
+		a.walkJoinedTrees(principal)
+	}
+	return nil
+}
+
+// leaveSpace removes space from principal's view, along with descendants
+// that were only joined through it.
+func (a *App) leaveSpace(principal, space string) {
+	_, trees := a.catalog.joinedBy(principal)
+	a.sharedFor(principal).Leave(space)
+	a.catalog.leave(space, principal)
+	if !slices.Contains(trees, space) {
+		return
+	}
+	explicit, _ := a.catalog.joinedBy(principal)
+	for _, d := range a.catalog.descendants(space) {
+		if !slices.Contains(explicit, d) {
+			a.sharedFor(principal).Leave(d)
+		}
+	}
+}
+
+// dropUnreadableSpaces leaves the joined spaces principal can no longer
+// read, because the grant lapsed or the space expired, so one of them does
+// not fail every shared.retrieve. Joining again needs a new grant.
+func (a *App) dropUnreadableSpaces(ctx context.Context, principal string) {
+	joined, _ := a.catalog.joinedBy(principal)
+	for _, space := range joined {
+		if err := a.requireRole(space, principal, memory.SpaceRoleReader); err != nil {
+			logger(ctx).Warn("leaving unreadable space", "principal", principal, "space", space, "error", err)
+			a.leaveSpace(principal, space)
+		}
+	}
+}
+
+// walkJoinedTrees joins every readable descendant of the spaces principal
+// joined with descendants. Unreadable ones are skipped silently; the
+// SharedSession hides them from retrieval anyway.
+func (a *App) walkJoinedTrees(principal string) {
+	_, trees := a.catalog.joinedBy(principal)
+	ss := a.sharedFor(principal)
+	for _, root := range trees {
+		for _, d := range a.catalog.descendants(root) {
+			if a.requireRole(d, principal, memory.SpaceRoleReader) == nil {
+				ss.Join(d)
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// tenants.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// TenantSettings is the "tenants" block of settings.json. Each tenant gets
+// its own store collection (or Postgres schema), state directory, sessions,
+// spaces, groups, quotas, audit log and metrics. When Tokens is set the
+// tenant comes only from the bearer token and Header is ignored, so a
+// client cannot pick another tenant by sending a different header. Header
+// alone needs Allowed, so a client cannot create tenants at will.
+type TenantSettings struct {
+	Header     string            `json:"header"`
+	Default    string            `json:"default"`
+	Allowed    []string          `json:"allowed"`
+	Tokens     map[string]string `json:"tokens"`
+	MaxTenants int               `json:"max_tenants"`
+}
+
+// tenantNameRe allows at most 56 characters, so tenantSchema stays within
+// Postgres's 63-byte identifier limit instead of being truncated onto
+// another tenant's schema.
+var tenantNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,55}$`)
+
+func validTenantName(name string) error {
+	if !tenantNameRe.MatchString(name) {
+		return fmt.Errorf("invalid tenant %q: want lowercase letters, digits, '-' or '_'", name)
+	}
+	return nil
+}
+
+// tenantCollection suffixes a Qdrant or Mongo collection name with the
+// tenant; the default tenant keeps the configured name.
+func tenantCollection(col, tenant string) string {
+	if tenant == "" {
+		return col
+	}
+	return col + "_" + tenant
+}
+
+// tenantStateDir is ~/.memory-bank-mcp for the default tenant and
+// ~/.memory-bank-mcp/tenants/<tenant> otherwise.
+func tenantStateDir(tenant string) (string, error) {
+	dir, err := ensureSessionDir()
+	if err != nil || tenant == "" {
+		return dir, err
+	}
+	dir = filepath.Join(dir, "tenants", tenant)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create tenant directory: %w", err)
+	}
+	return dir, nil
+}
+
+// tenantSchema is the tenant's Postgres schema as a quoted identifier.
+// The name is kept as is, so team-a and team_a get different schemas.
+func tenantSchema(tenant string) string {
+	return `"tenant_` + tenant + `"`
+}
+
+// newTenantPostgresStore connects with search_path set to the tenant's
+// schema, creating the schema and its tables on first use.
+func newTenantPostgresStore(ctx context.Context, dsn, tenant string) (memory.VectorStore, error) {
+	if tenant == "" {
+		return memory.NewPostgresStore(ctx, dsn)
+	}
+	schema := tenantSchema(tenant)
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema+",public")
+		u.RawQuery = q.Encode()
+		dsn = u.String()
+	} else {
+		dsn += fmt.Sprintf(" search_path='%s,public'", schema)
+	}
+	ps, err := memory.NewPostgresStore(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ps.DB.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+schema); err != nil {
+		return nil, fmt.Errorf("failed to create schema %s: %w", schema, err)
+	}
+	if err := ps.CreateSchema(ctx, ""); err != nil {
+		return nil, fmt.Errorf("failed to create tables in %s: %w", schema, err)
+	}
+	return ps, nil
+}
+
+// embedStack is the embedding provider wrapper and the cache. It is built
+// once and shared by all tenants, so they share one provider rate limit
+// and breaker; each tenant's embedder keys its cache entries by tenant.
+type embedStack struct {
+	cache     *embedCache
+	resilient *resilientEmbedder
+	provider  string
+	model     string
+}
+
+// tenantSet creates each tenant's App on first use.
+type tenantSet struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	settings *GeminiSettings
+	opts     TenantSettings
+	apps     map[string]*App
+	shared   *embedStack
+}
+
+func newTenantSet(ctx context.Context, settings *GeminiSettings) (*tenantSet, error) {
+	opts := settings.Tenants
+	opts.Header = envOrDefault("TENANT_HEADER", opts.Header)
+	opts.Default = envOrDefault("MEMORY_BANK_TENANT", opts.Default)
+	opts.MaxTenants = envIntOrDefault("MAX_TENANTS", opts.MaxTenants)
+	if err := validTenantName(opts.Default); err != nil {
+		return nil, err
+	}
+	if opts.Header != "" && len(opts.Tokens) == 0 && len(opts.Allowed) == 0 {
+		return nil, fmt.Errorf("tenants.header needs tenants.allowed or tenants.tokens, or any client could create a tenant")
+	}
+	for _, name := range append(slices.Clone(opts.Allowed), mapValues(opts.Tokens)...) {
+		if err := validTenantName(name); err != nil {
+			return nil, err
+		}
+	}
+	return &tenantSet{ctx: ctx, settings: settings, opts: opts, apps: make(map[string]*App)}, nil
+}
+
+func mapValues(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for _, v := range m {
+		out = append(out, v)
+	}
+	return out
+}
+
+// get returns the App of tenant name, creating it if needed.
+func (t *tenantSet) get(name string) (*App, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if app := t.apps[name]; app != nil {
+		return app, nil
+	}
+	if t.opts.MaxTenants > 0 && len(t.apps) >= t.opts.MaxTenants {
+		return nil, fmt.Errorf("tenant %q: limit of %d tenants reached", name, t.opts.MaxTenants)
+	}
+	storeTenant := name
+	if name == t.opts.Default {
+		storeTenant = ""
+	}
+	app, err := newApp(t.ctx, t.settings, storeTenant, t.shared)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %q: %w", name, err)
+	}
+	t.shared = app.embedStack
+	t.apps[name] = app
+	slog.Info("tenant initialised", "tenant", name)
+	return app, nil
+}
+
+// tenantRequest is what the HTTP transport saw of the caller.
+type tenantRequest struct {
+	header string
+	token  string
+}
+
+type tenantRequestKey struct{}
+type tenantAppKey struct{}
+
+// httpContext records the tenant header and bearer token of an HTTP
+// request for resolve.
+func (t *tenantSet) httpContext(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, tenantRequestKey{}, t.fromHTTP(r))
+}
+
+func (t *tenantSet) fromHTTP(r *http.Request) tenantRequest {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return tenantRequest{header: strings.TrimSpace(r.Header.Get(t.opts.Header)), token: strings.TrimSpace(token)}
+}
+
+// resolve picks the tenant of a request. Stdio calls, which carry no
+// request, get the default tenant.
+func (t *tenantSet) resolve(tr *tenantRequest) (string, error) {
+	name := t.opts.Default
+	switch {
+	case tr == nil:
+	case len(t.opts.Tokens) > 0:
+		var ok bool
+		if name, ok = t.opts.Tokens[tr.token]; !ok || tr.token == "" {
+			return "", fmt.Errorf("unknown or missing bearer token")
+		}
+	case t.opts.Header != "" && tr.header != "":
+		name = strings.ToLower(tr.header)
+	}
+	if err := validTenantName(name); err != nil {
+		return "", err
+	}
+	if len(t.opts.Allowed) > 0 && name != t.opts.Default && !slices.Contains(t.opts.Allowed, name) {
+		return "", fmt.Errorf("tenant %q is not allowed", name)
+	}
+	return name, nil
+}
+
+// middleware resolves the caller's tenant and hands its App to the rest of
+// the chain and to the tool handlers through appFor.
+func (t *tenantSet) middleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var tr *tenantRequest
+		if v, ok := ctx.Value(tenantRequestKey{}).(tenantRequest); ok {
+			tr = &v
+		}
+		name, err := t.resolve(tr)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("tenant rejected: %v", err)), nil
+		}
+		app, err := t.get(name)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		ctx = context.WithValue(ctx, tenantAppKey{}, app)
+		ctx = context.WithValue(ctx, loggerKey{}, logger(ctx).With("tenant", name))
+		return next(ctx, req)
+	}
+}
+
+// appFor returns the App of the calling tenant, or fallback outside a
+// tool call.
+func appFor(ctx context.Context, fallback *App) *App {
+	if app, ok := ctx.Value(tenantAppKey{}).(*App); ok {
+		return app
+	}
+	return fallback
+}
+
+// auditMiddleware and metricsMiddleware record into the calling tenant's
+// audit log and metrics; they run inside tenantSet.middleware.
+func auditMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return appFor(ctx, nil).audit.middleware(next)(ctx, req)
+	}
+}
+
+func metricsMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return appFor(ctx, nil).metrics.toolMiddleware(next)(ctx, req)
+	}
+}
+
+// metricsHandler serves the metrics of the tenant the request selects,
+// the same way tool calls select it.
+func (t *tenantSet) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr := t.fromHTTP(r)
+		name, err := t.resolve(&tr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		app, err := t.get(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		app.metricsHandler().ServeHTTP(w, r)
+	})
+}
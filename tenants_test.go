@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func testTenantSettings(t *testing.T) *GeminiSettings {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("LLM_PROVIDER", "stub")
+	settings, err := loadGeminiSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.MemoryStore = "inmemory"
+	settings.EmbedProvider = "hash"
+	return settings
+}
+
+func TestTenantHeaderNeedsAllowedOrTokens(t *testing.T) {
+	settings := testTenantSettings(t)
+	settings.Tenants.Header = "X-Tenant-ID"
+	if _, err := newTenantSet(context.Background(), settings); err == nil {
+		t.Fatal("header mode without allowed or tokens was accepted")
+	}
+	settings.Tenants.Allowed = []string{"payments"}
+	if _, err := newTenantSet(context.Background(), settings); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTenantLimit(t *testing.T) {
+	settings := testTenantSettings(t)
+	settings.Tenants.Header = "X-Tenant-ID"
+	settings.Tenants.Allowed = []string{"payments", "search"}
+	settings.Tenants.MaxTenants = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts, err := newTenantSet(ctx, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"default", "payments"} {
+		if _, err := ts.get(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ts.get("search"); err == nil {
+		t.Fatal("a third tenant was created with max_tenants=2")
+	}
+}
+
+func TestEmbedCacheKeyedByTenant(t *testing.T) {
+	if newEmbedCacheKey("payments", "hash", "m", "text") == newEmbedCacheKey("search", "hash", "m", "text") {
+		t.Fatal("two tenants share a cache key")
+	}
+}
+
+func TestTenantSchemasDoNotCollide(t *testing.T) {
+	if a, b := tenantSchema("team-a"), tenantSchema("team_a"); a == b {
+		t.Fatalf("team-a and team_a share schema %s", a)
+	}
+	long := strings.Repeat("a", 56)
+	if err := validTenantName(long); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tenantSchema(long)) - 2; n > 63 {
+		t.Fatalf("schema of a %d-character tenant is %d bytes, over the Postgres limit", len(long), n)
+	}
+	if err := validTenantName(long + "a"); err == nil {
+		t.Fatal("accepted a tenant whose schema would be truncated")
+	}
+}
@@ -0,0 +1,290 @@
+// tracing.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer resolves through the global provider, so spans started before
+// setupTracing (or with tracing off) are no-ops.
+var tracer = otel.Tracer("github.com/Protocol-Lattice/memory-bank-mcp")
+
+// Span attribute keys.
+const (
+	attrTool      = attribute.Key("mcp.tool")
+	attrSession   = attribute.Key("memory.session_id")
+	attrSpace     = attribute.Key("memory.space")
+	attrPrincipal = attribute.Key("memory.principal")
+	attrResults   = attribute.Key("memory.result_count")
+	attrBackend   = attribute.Key("memory.store.backend")
+	attrLimit     = attribute.Key("memory.limit")
+	attrTextLen   = attribute.Key("memory.text_length")
+	attrCacheHit  = attribute.Key("memory.embed.cache_hit")
+)
+
+// TracingOptions selects the span exporter.
+type TracingOptions struct {
+	Exporter    string // none | stdout | file | otlp
+	File        string
+	Endpoint    string // OTLP/HTTP collector base URL; OTEL_EXPORTER_OTLP_TRACES_ENDPOINT wins
+	SampleRatio float64
+	Transport   string
+}
+
+// otlpTracesURL turns a collector base URL, as in
+// OTEL_EXPORTER_OTLP_ENDPOINT, into the traces URL by appending the
+// default /v1/traces path when none is given.
+func otlpTracesURL(endpoint string) string {
+	u, err := url.Parse(strings.TrimSpace(endpoint))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/v1/traces"
+	}
+	return u.String()
+}
+
+// setupTracing installs the global tracer provider. The returned shutdown
+// flushes buffered spans and must be called before exit.
+func setupTracing(ctx context.Context, opts TracingOptions) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	var exp sdktrace.SpanExporter
+	var closer io.Closer
+	switch strings.ToLower(strings.TrimSpace(opts.Exporter)) {
+	case "", "none", "off":
+		return noop, nil
+
+	case "stdout":
+		// In stdio mode stdout carries the MCP protocol stream.
+		var w io.Writer = os.Stdout
+		if strings.EqualFold(opts.Transport, "stdio") {
+			w = os.Stderr
+		}
+		e, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout trace exporter: %w", err)
+		}
+		exp = e
+
+	case "file":
+		path := opts.File
+		if path == "" {
+			dir, err := ensureSessionDir()
+			if err != nil {
+				return nil, err
+			}
+			path = filepath.Join(dir, "traces.jsonl")
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		e, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to create file trace exporter: %w", err)
+		}
+		exp, closer = e, f
+
+	case "otlp":
+		var httpOpts []otlptracehttp.Option
+		if u := otlpTracesURL(opts.Endpoint); u != "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+			httpOpts = append(httpOpts, otlptracehttp.WithEndpointURL(u))
+		}
+		e, err := otlptracehttp.New(ctx, httpOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlp trace exporter: %w", err)
+		}
+		exp = e
+
+	default:
+		return nil, fmt.Errorf("unknown trace_exporter %q (want none, stdout, file or otlp)", opts.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("memory-bank-mcp"),
+		semconv.ServiceVersion("0.1.0"),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if opts.SampleRatio > 0 && opts.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(opts.SampleRatio)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	slog.Info("tracing enabled", "exporter", opts.Exporter)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// traceToolMiddleware opens a span per tool call, tagged with the common
+// session/space/principal arguments.
+func traceToolMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		ctx, span := tracer.Start(ctx, "tool "+req.Params.Name, trace.WithAttributes(attrTool.String(req.Params.Name)))
+		defer span.End()
+		if v := getStringParam(req, "session_id"); v != "" {
+			span.SetAttributes(attrSession.String(v))
+		}
+		if v := getStringParam(req, "space"); v != "" {
+			span.SetAttributes(attrSpace.String(v))
+		}
+		if v := getStringParam(req, "principal"); v != "" {
+			span.SetAttributes(attrPrincipal.String(v))
+		}
+
+		res, err := next(ctx, req)
+		switch {
+		case err != nil:
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		case res != nil && res.IsError:
+			span.SetStatus(codes.Error, toolResultText(res))
+		}
+		return res, err
+	}
+}
+
+// traceResults records how many records a handler returned on its span.
+func traceResults(ctx context.Context, n int) {
+	trace.SpanFromContext(ctx).SetAttributes(attrResults.Int(n))
+}
+
+func toolResultText(res *mcp.CallToolResult) string {
+	for _, c := range res.Content {
+		if t, ok := c.(mcp.TextContent); ok {
+			return t.Text
+		}
+	}
+	return "tool error"
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedEmbedder emits an "embed" span for every embedding request,
+// including the ones Engine and SessionMemory make internally.
+type tracedEmbedder struct {
+	base memory.Embedder
+}
+
+func (e *tracedEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	ctx, span := tracer.Start(ctx, "embed", trace.WithAttributes(attrTextLen.Int(len(text))))
+	vec, err := e.base.Embed(ctx, text)
+	endSpan(span, err)
+	return vec, err
+}
+
+// tracedStore emits a span per vector store operation.
+type tracedStore struct {
+	memory.VectorStore
+	backend string
+}
+
+func newTracedStore(vs memory.VectorStore, backend string) *tracedStore {
+	return &tracedStore{VectorStore: vs, backend: backend}
+}
+
+func (s *tracedStore) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attrBackend.String(s.backend))
+	return tracer.Start(ctx, "store."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (s *tracedStore) StoreMemory(ctx context.Context, sessionID, content string, metadata map[string]any, embedding []float32) error {
+	ctx, span := s.start(ctx, "upsert", attrSession.String(sessionID))
+	if space, _ := metadata["space"].(string); space != "" {
+		span.SetAttributes(attrSpace.String(space))
+	}
+	err := s.VectorStore.StoreMemory(ctx, sessionID, content, metadata, embedding)
+	endSpan(span, err)
+	return err
+}
+
+func (s *tracedStore) SearchMemory(ctx context.Context, queryEmbedding []float32, limit int) ([]model.MemoryRecord, error) {
+	ctx, span := s.start(ctx, "query", attrLimit.Int(limit))
+	recs, err := s.VectorStore.SearchMemory(ctx, queryEmbedding, limit)
+	span.SetAttributes(attrResults.Int(len(recs)))
+	endSpan(span, err)
+	return recs, err
+}
+
+func (s *tracedStore) UpdateEmbedding(ctx context.Context, id int64, embedding []float32, lastEmbedded time.Time) error {
+	ctx, span := s.start(ctx, "update_embedding")
+	err := s.VectorStore.UpdateEmbedding(ctx, id, embedding, lastEmbedded)
+	endSpan(span, err)
+	return err
+}
+
+func (s *tracedStore) DeleteMemory(ctx context.Context, ids []int64) error {
+	ctx, span := s.start(ctx, "delete", attrResults.Int(len(ids)))
+	err := s.VectorStore.DeleteMemory(ctx, ids)
+	endSpan(span, err)
+	return err
+}
+
+func (s *tracedStore) Iterate(ctx context.Context, fn func(model.MemoryRecord) bool) error {
+	ctx, span := s.start(ctx, "iterate")
+	n := 0
+	err := s.VectorStore.Iterate(ctx, func(rec model.MemoryRecord) bool {
+		n++
+		return fn(rec)
+	})
+	span.SetAttributes(attrResults.Int(n))
+	endSpan(span, err)
+	return err
+}
+
+func (s *tracedStore) Count(ctx context.Context) (int, error) {
+	ctx, span := s.start(ctx, "count")
+	n, err := s.VectorStore.Count(ctx)
+	span.SetAttributes(attrResults.Int(n))
+	endSpan(span, err)
+	return n, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/mark3labs/mcp-go/mcp"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestToolSpansCarryIdsButNotContent checks the span tree of one tool call:
+// the tool span names the session, space and principal, its embed and
+// store children hang off it, and no attribute holds the stored text.
+func TestToolSpansCarryIdsButNotContent(t *testing.T) {
+	// tracer binds to the first provider installed, so this is the only
+	// test that sets one; shutting it down leaves later spans unrecorded.
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	const secret = "the launch code is 0000"
+	embedder := &tracedEmbedder{base: newHashEmbedder(32)}
+	store := newTracedStore(memory.NewInMemoryStore(), "inmemory")
+	handler := traceToolMiddleware(func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		vec, err := embedder.Embed(ctx, secret)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.StoreMemory(ctx, "s1", secret, map[string]any{"space": "team"}, vec); err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultError("quota exceeded"), nil
+	})
+	req := mcp.CallToolRequest{}
+	req.Params.Name = "store_long"
+	req.Params.Arguments = map[string]any{"session_id": "s1", "space": "team", "principal": "alice", "content": secret}
+	if _, err := handler(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
+		for _, kv := range s.Attributes() {
+			if strings.Contains(kv.Value.Emit(), "launch code") {
+				t.Fatalf("span %q attribute %s holds the content", s.Name(), kv.Key)
+			}
+		}
+	}
+	tool, embed, upsert := spans["tool store_long"], spans["embed"], spans["store.upsert"]
+	if tool == nil || embed == nil || upsert == nil {
+		t.Fatalf("spans = %v", rec.Ended())
+	}
+	want := map[attribute.Key]string{attrTool: "store_long", attrSession: "s1", attrSpace: "team", attrPrincipal: "alice"}
+	got := map[attribute.Key]string{}
+	for _, kv := range tool.Attributes() {
+		got[kv.Key] = kv.Value.Emit()
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("tool span %s = %q, want %q", k, got[k], v)
+		}
+	}
+	if tool.Status().Code != codes.Error || tool.Status().Description != "quota exceeded" {
+		t.Fatalf("tool span status = %+v", tool.Status())
+	}
+	for _, child := range []sdktrace.ReadOnlySpan{embed, upsert} {
+		if child.Parent().SpanID() != tool.SpanContext().SpanID() {
+			t.Fatalf("span %q is not a child of the tool span", child.Name())
+		}
+	}
+	if !hasAttr(embed, attrTextLen.Int(len(secret))) {
+		t.Fatalf("embed span attributes = %v", embed.Attributes())
+	}
+	if !hasAttr(upsert, attrSpace.String("team")) || !hasAttr(upsert, attrBackend.String("inmemory")) {
+		t.Fatalf("upsert span attributes = %v", upsert.Attributes())
+	}
+}
+
+func hasAttr(s sdktrace.ReadOnlySpan, want attribute.KeyValue) bool {
+	for _, kv := range s.Attributes() {
+		if kv == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+// ttl.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// metaExpiresAt holds a record's expiry as an RFC 3339 timestamp.
+const metaExpiresAt = "expires_at"
+
+// Sweeper actions for expired records.
+const (
+	expireDelete  = "delete"
+	expireArchive = "archive"
+)
+
+// expiryFromRequest reads the optional ttl_seconds / expires_at arguments.
+// The zero time means no explicit expiry.
+func expiryFromRequest(req mcp.CallToolRequest) (time.Time, error) {
+	ttl := getNumberParam(req, "ttl_seconds")
+	at := getStringParam(req, "expires_at")
+	switch {
+	case ttl != 0 && at != "":
+		return time.Time{}, fmt.Errorf("pass either ttl_seconds or expires_at, not both")
+	case ttl < 0:
+		return time.Time{}, fmt.Errorf("ttl_seconds must be positive")
+	case ttl > 0:
+		return time.Now().UTC().Add(time.Duration(ttl * float64(time.Second))), nil
+	case at != "":
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expires_at (want RFC 3339): %w", err)
+		}
+		if !t.After(time.Now()) {
+			return time.Time{}, fmt.Errorf("expires_at is in the past")
+		}
+		return t.UTC(), nil
+	}
+	return time.Time{}, nil
+}
+
+// recordExpiry returns the expiry stored in metadata, if any.
+func recordExpiry(meta map[string]any) (time.Time, bool) {
+	s, _ := meta[metaExpiresAt].(string)
+	if s == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
+
+func recordExpired(rec model.MemoryRecord, now time.Time) bool {
+	t, ok := recordExpiry(model.DecodeMetadata(rec.Metadata))
+	return ok && !t.After(now)
+}
+
+// dropExpired filters records that expired but have not been swept yet,
+// including short-term buffer entries, which the sweeper cannot reach.
+func dropExpired(recs []model.MemoryRecord) []model.MemoryRecord {
+	now := time.Now()
+	out := recs[:0:0]
+	for _, rec := range recs {
+		if !recordExpired(rec, now) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// ttlStore applies the default record TTL to writes that carry no
+// expires_at and hides expired records from search.
+type ttlStore struct {
+	memory.VectorStore
+	defaultTTL time.Duration
+	sessionTTL map[string]time.Duration
+}
+
+func newTTLStore(vs memory.VectorStore, def time.Duration, perSession map[string]int) *ttlStore {
+	s := &ttlStore{VectorStore: vs, defaultTTL: def, sessionTTL: make(map[string]time.Duration)}
+	for sid, sec := range perSession {
+		s.sessionTTL[sid] = time.Duration(sec) * time.Second
+	}
+	return s
+}
+
+func (s *ttlStore) ttlFor(sessionID string) time.Duration {
+	if d, ok := s.sessionTTL[sessionID]; ok {
+		return d
+	}
+	return s.defaultTTL
+}
+
+func (s *ttlStore) StoreMemory(ctx context.Context, sessionID, content string, metadata map[string]any, embedding []float32) error {
+	if _, ok := metadata[metaExpiresAt]; !ok {
+		if ttl := s.ttlFor(sessionID); ttl > 0 {
+			if metadata == nil {
+				metadata = map[string]any{}
+			}
+			metadata[metaExpiresAt] = time.Now().UTC().Add(ttl).Format(time.RFC3339)
+		}
+	}
+	return s.VectorStore.StoreMemory(ctx, sessionID, content, metadata, embedding)
+}
+
+func (s *ttlStore) SearchMemory(ctx context.Context, queryEmbedding []float32, limit int) ([]model.MemoryRecord, error) {
+	now := time.Now()
+	return searchKeeping(ctx, s.VectorStore, queryEmbedding, limit, func(rec model.MemoryRecord) bool {
+		return !recordExpired(rec, now)
+	})
+}
+
+// searchKeeping searches vs and drops the hits keep rejects. If a full
+// page lost hits it searches once more for limit*4, so expired or hidden
+// records do not crowd live ones out of the results.
+func searchKeeping(ctx context.Context, vs memory.VectorStore, queryEmbedding []float32, limit int, keep func(model.MemoryRecord) bool) ([]model.MemoryRecord, error) {
+	filter := func(recs []model.MemoryRecord) []model.MemoryRecord {
+		out := recs[:0:0]
+		for _, rec := range recs {
+			if keep(rec) {
+				out = append(out, rec)
+			}
+		}
+		return out
+	}
+	recs, err := vs.SearchMemory(ctx, queryEmbedding, limit)
+	if err != nil {
+		return nil, err
+	}
+	out := filter(recs)
+	if limit > 0 && len(out) < len(recs) && len(recs) >= limit {
+		more, err := vs.SearchMemory(ctx, queryEmbedding, limit*4)
+		if err != nil {
+			return nil, err
+		}
+		out = filter(more)
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// ExpiryStats is reported under engine.metrics.
+type ExpiryStats struct {
+	Action   string    `json:"action"`
+	Swept    int64     `json:"swept"`
+	Archived int64     `json:"archived"`
+	Errors   int64     `json:"errors"`
+	LastRun  time.Time `json:"last_run,omitempty"`
+}
+
+// expirySweeper periodically deletes (or archives, then deletes) expired
+// records. It only uses Iterate and DeleteMemory, so it works with every
+// backend.
+type expirySweeper struct {
+	store      memory.VectorStore
+	action     string
+	archiveDir string
+
+	mu    sync.Mutex
+	stats ExpiryStats
+}
+
+func newExpirySweeper(vs memory.VectorStore, action, archiveDir string) *expirySweeper {
+	return &expirySweeper{store: vs, action: action, archiveDir: archiveDir, stats: ExpiryStats{Action: action}}
+}
+
+func (s *expirySweeper) run(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if n, err := s.sweep(ctx); err != nil {
+				slog.Warn("expiry sweep failed", "error", err)
+			} else if n > 0 {
+				slog.Info("expired records swept", "count", n, "action", s.action)
+			}
+		}
+	}
+}
+
+func (s *expirySweeper) sweep(ctx context.Context) (int, error) {
+	now := time.Now()
+	var expired []model.MemoryRecord
+	err := s.store.Iterate(ctx, func(rec model.MemoryRecord) bool {
+		if recordExpired(rec, now) {
+			expired = append(expired, rec)
+		}
+		return true
+	})
+	if err == nil && len(expired) > 0 && s.action == expireArchive {
+		err = s.archive(expired)
+	}
+	if err == nil && len(expired) > 0 {
+		ids := make([]int64, len(expired))
+		for i, rec := range expired {
+			ids[i] = rec.ID
+		}
+		err = s.store.DeleteMemory(ctx, ids)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.LastRun = now.UTC()
+	if err != nil {
+		s.stats.Errors++
+		return 0, err
+	}
+	s.stats.Swept += int64(len(expired))
+	if s.action == expireArchive {
+		s.stats.Archived += int64(len(expired))
+	}
+	return len(expired), nil
+}
+
+// archive appends records to a dated JSON Lines file.
+func (s *expirySweeper) archive(recs []model.MemoryRecord) error {
+	if err := os.MkdirAll(s.archiveDir, 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	path := filepath.Join(s.archiveDir, "expired-"+time.Now().UTC().Format("20060102")+".jsonl")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, rec := range recs {
+		rec.Embedding = nil
+		if err := enc.Encode(rec); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+	return f.Sync()
+}
+
+func (s *expirySweeper) Stats() ExpiryStats {
+	if s == nil {
+		return ExpiryStats{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
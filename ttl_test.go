@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+)
+
+func TestTTLSearchFillsPageAfterDroppingExpired(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.NewInMemoryStore()
+	vec := []float32{1, 0, 0}
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	for i := 0; i < 3; i++ {
+		if err := inner.StoreMemory(ctx, "s", "expired", map[string]any{metaExpiresAt: past}, vec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := inner.StoreMemory(ctx, "s", "live", nil, []float32{0.9, 0.1, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := &ttlStore{VectorStore: inner}
+	recs, err := ts.SearchMemory(ctx, vec, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d hits, want 2", len(recs))
+	}
+	for _, rec := range recs {
+		if rec.Content != "live" {
+			t.Fatalf("got expired record %d", rec.ID)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+// versions.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Metadata keys of versioned records. A record's lineage is the ID of its
+// first version.
+const (
+	metaLineage    = "lineage"
+	metaVersion    = "version"
+	metaEditor     = "editor"
+	metaSupersedes = "supersedes"
+	metaRevertedTo = "reverted_to"
+)
+
+// versionRef is one version of a lineage in the index.
+type versionRef struct {
+	ID         int64     `json:"id"`
+	Version    int       `json:"version"`
+	Editor     string    `json:"editor,omitempty"`
+	EditedAt   time.Time `json:"edited_at"`
+	RevertedTo int       `json:"reverted_to,omitempty"`
+}
+
+// versionIndex records which records are versions of which, oldest first.
+// Prior versions stay in the store unchanged; the index is what hides
+// them from search, and it is saved to versions.json in the state
+// directory.
+type versionIndex struct {
+	mu       sync.Mutex
+	edit     sync.Mutex // serialises updates so two edits cannot fork a lineage
+	path     string
+	lineages map[int64][]versionRef
+	rootOf   map[int64]int64
+}
+
+func newVersionIndex(dir string) (*versionIndex, error) {
+	idx := &versionIndex{
+		path:     filepath.Join(dir, "versions.json"),
+		lineages: make(map[int64][]versionRef),
+		rootOf:   make(map[int64]int64),
+	}
+	data, err := os.ReadFile(idx.path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version index: %w", err)
+	}
+	var saved map[string][]versionRef
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", idx.path, err)
+	}
+	for k, refs := range saved {
+		root, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: bad lineage %q", idx.path, k)
+		}
+		idx.lineages[root] = refs
+		for _, r := range refs {
+			idx.rootOf[r.ID] = root
+		}
+	}
+	return idx, nil
+}
+
+// save writes the index; idx.mu must be held.
+func (idx *versionIndex) save() error {
+	data, err := json.MarshalIndent(idx.lineages, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write version index: %w", err)
+	}
+	return os.Rename(tmp, idx.path)
+}
+
+// lineage returns the root and versions of the lineage id belongs to; a
+// record that was never updated is its own single-version lineage.
+func (idx *versionIndex) lineage(id int64) (int64, []versionRef) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	root, ok := idx.rootOf[id]
+	if !ok {
+		return id, nil
+	}
+	return root, append([]versionRef(nil), idx.lineages[root]...)
+}
+
+// superseded reports whether id has a newer version.
+func (idx *versionIndex) superseded(id int64) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	root, ok := idx.rootOf[id]
+	if !ok {
+		return false
+	}
+	refs := idx.lineages[root]
+	return refs[len(refs)-1].ID != id
+}
+
+// add appends a version to root's lineage, seeding it with first when the
+// lineage is new.
+func (idx *versionIndex) add(root int64, first, next versionRef) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if len(idx.lineages[root]) == 0 {
+		idx.lineages[root] = []versionRef{first}
+		idx.rootOf[first.ID] = root
+	}
+	idx.lineages[root] = append(idx.lineages[root], next)
+	idx.rootOf[next.ID] = root
+	return idx.save()
+}
+
+// versionLookupLimit is how many nearest records updateRecord searches for
+// the version it stored; copies of the same content in forks share its
+// vector.
+const versionLookupLimit = 8
+
+type historyKey struct{}
+
+// withHistory makes searches under ctx return superseded versions too.
+func withHistory(ctx context.Context) context.Context {
+	return context.WithValue(ctx, historyKey{}, true)
+}
+
+// versionStore hides superseded versions from search unless the context
+// asks for history.
+type versionStore struct {
+	memory.VectorStore
+	index *versionIndex
+}
+
+func (s *versionStore) SearchMemory(ctx context.Context, queryEmbedding []float32, limit int) ([]model.MemoryRecord, error) {
+	if ctx.Value(historyKey{}) != nil {
+		return s.VectorStore.SearchMemory(ctx, queryEmbedding, limit)
+	}
+	return searchKeeping(ctx, s.VectorStore, queryEmbedding, limit, func(rec model.MemoryRecord) bool {
+		return !s.index.superseded(rec.ID)
+	})
+}
+
+// latestOnly drops superseded versions from recs, for operations that
+// copy records and would otherwise turn old versions into current ones.
+func (a *App) latestOnly(recs []model.MemoryRecord) []model.MemoryRecord {
+	out := recs[:0:0]
+	for _, rec := range recs {
+		if !a.versions.superseded(rec.ID) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// RecordVersion is one entry of memory.history.
+type RecordVersion struct {
+	Version    int            `json:"version"`
+	ID         int64          `json:"id"`
+	Content    string         `json:"content"`
+	Metadata   map[string]any `json:"metadata,omitempty"`
+	EmbedModel string         `json:"embed_model,omitempty"`
+	Editor     string         `json:"editor,omitempty"`
+	EditedAt   time.Time      `json:"edited_at"`
+	RevertedTo int            `json:"reverted_to,omitempty"`
+	Current    bool           `json:"current"`
+	Missing    bool           `json:"missing,omitempty"`
+}
+
+// findRecords returns the stored records among ids.
+func (a *App) findRecords(ctx context.Context, ids ...int64) (map[int64]model.MemoryRecord, error) {
+	want := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	found := make(map[int64]model.MemoryRecord, len(ids))
+	err := a.bank.Store.Iterate(ctx, func(rec model.MemoryRecord) bool {
+		if want[rec.ID] {
+			found[rec.ID] = rec
+		}
+		return len(found) < len(want)
+	})
+	return found, err
+}
+
+// checkRecordEditor checks that principal may edit rec: a writer of its
+// space for records of a shared space, and the owner, if it has one, for
+// records of a session.
+func (a *App) checkRecordEditor(rec model.MemoryRecord, principal string) error {
+	if space := recordSpace(rec); space != "" {
+		if _, ok := a.catalog.get(space); ok {
+			return a.requireRole(space, principal, memory.SpaceRoleWriter)
+		}
+	}
+	info, err := a.sessions.get(rec.SessionID)
+	if err != nil || info.ID != rec.SessionID {
+		return nil
+	}
+	return checkSessionOwner(info, principal)
+}
+
+// updateRecord stores content as the next version of record id, which
+// must be the latest version. patch is merged into the previous metadata.
+// The new version keeps the session and gets a new ID; the old one stays
+// in the store for memory.history. editor must be allowed to edit the
+// record. The edit counts as a write of editor's against the quotas.
+func (a *App) updateRecord(ctx context.Context, id int64, content string, patch map[string]any, editor string, revertedTo int) (model.MemoryRecord, error) {
+	return a.storeVersion(ctx, id, content, patch, editor, revertedTo, a.quotas.checkWrite)
+}
+
+// storeVersion is updateRecord with the quota check as admit, or none if
+// admit is nil, for callers that already admitted the write.
+func (a *App) storeVersion(ctx context.Context, id int64, content string, patch map[string]any, editor string, revertedTo int, admit func(session string, meta map[string]any, size int) (func(), error)) (model.MemoryRecord, error) {
+	a.versions.edit.Lock()
+	defer a.versions.edit.Unlock()
+
+	found, err := a.findRecords(ctx, id)
+	if err != nil {
+		return model.MemoryRecord{}, err
+	}
+	old, ok := found[id]
+	if !ok {
+		return model.MemoryRecord{}, fmt.Errorf("record %d not found", id)
+	}
+	if err := a.checkRecordEditor(old, editor); err != nil {
+		return model.MemoryRecord{}, err
+	}
+	root, refs := a.versions.lineage(id)
+	if len(refs) > 0 && refs[len(refs)-1].ID != id {
+		return model.MemoryRecord{}, fmt.Errorf("record %d is version %d of %d; update the latest version, record %d",
+			id, versionOf(refs, id), len(refs), refs[len(refs)-1].ID)
+	}
+	oldMeta := model.DecodeMetadata(old.Metadata)
+	first := versionRef{ID: id, Version: 1, EditedAt: old.CreatedAt}
+	if p, _ := oldMeta["principal"].(string); p != "" {
+		first.Editor = p
+	}
+	next := versionRef{Version: 2, Editor: editor, EditedAt: time.Now().UTC(), RevertedTo: revertedTo}
+	if len(refs) > 0 {
+		next.Version = refs[len(refs)-1].Version + 1
+	}
+
+	meta := map[string]any{}
+	for k, v := range oldMeta {
+		switch k {
+		case metaRevertedTo, metaEmbedProvider, metaEmbedModel, metaEmbedDim, "last_embedded", "importance", "summary":
+		default:
+			meta[k] = v
+		}
+	}
+	for k, v := range patch {
+		meta[k] = v
+	}
+	meta[metaLineage] = root
+	meta[metaVersion] = next.Version
+	meta[metaSupersedes] = id
+	if editor != "" {
+		meta[metaEditor] = editor
+	}
+	if revertedTo > 0 {
+		meta[metaRevertedTo] = revertedTo
+	}
+
+	if admit != nil {
+		release, err := admit(old.SessionID, meta, len(content))
+		if err != nil {
+			return model.MemoryRecord{}, err
+		}
+		defer release()
+	}
+	emb, err := a.embed(ctx, content)
+	if err != nil {
+		return model.MemoryRecord{}, err
+	}
+	if err := a.bank.Store.StoreMemory(ctx, old.SessionID, content, meta, emb); err != nil {
+		return model.MemoryRecord{}, err
+	}
+	// StoreMemory does not return the ID; search for the version just
+	// written by its vector, skipping other records with the same content.
+	hits, err := searchKeeping(ctx, a.bank.Store, emb, versionLookupLimit, func(rec model.MemoryRecord) bool {
+		m := model.DecodeMetadata(rec.Metadata)
+		return rec.SessionID == old.SessionID && metaInt(m[metaLineage]) == root && metaInt(m[metaVersion]) == int64(next.Version)
+	})
+	if err != nil {
+		return model.MemoryRecord{}, err
+	}
+	if len(hits) == 0 {
+		return model.MemoryRecord{}, fmt.Errorf("stored version %d of record %d could not be found", next.Version, root)
+	}
+	stored := hits[0]
+	next.ID = stored.ID
+	if err := a.versions.add(root, first, next); err != nil {
+		return stored, err
+	}
+	return stored, nil
+}
+
+func versionOf(refs []versionRef, id int64) int {
+	for _, r := range refs {
+		if r.ID == id {
+			return r.Version
+		}
+	}
+	return 0
+}
+
+// metaInt reads a number from decoded metadata, where JSON numbers are
+// float64.
+func metaInt(v any) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case json.Number:
+		i, _ := n.Int64()
+		return i
+	}
+	return 0
+}
+
+// recordHistory returns every version of the lineage id belongs to, oldest
+// first. Versions that were deleted from the store are marked missing.
+func (a *App) recordHistory(ctx context.Context, id int64) ([]RecordVersion, error) {
+	_, refs := a.versions.lineage(id)
+	if len(refs) == 0 {
+		refs = []versionRef{{ID: id, Version: 1}}
+	}
+	ids := make([]int64, len(refs))
+	for i, r := range refs {
+		ids[i] = r.ID
+	}
+	found, err := a.findRecords(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := found[id]; !ok && len(refs) == 1 {
+		return nil, fmt.Errorf("record %d not found", id)
+	}
+	out := make([]RecordVersion, 0, len(refs))
+	for i, r := range refs {
+		v := RecordVersion{Version: r.Version, ID: r.ID, Editor: r.Editor, EditedAt: r.EditedAt, RevertedTo: r.RevertedTo, Current: i == len(refs)-1}
+		rec, ok := found[r.ID]
+		if !ok {
+			v.Missing = true
+			out = append(out, v)
+			continue
+		}
+		v.Content = rec.Content
+		v.Metadata = model.DecodeMetadata(rec.Metadata)
+		if p, _ := v.Metadata[metaEmbedProvider].(string); p != "" {
+			v.EmbedModel = p + "/" + fmt.Sprint(v.Metadata[metaEmbedModel])
+		}
+		if v.EditedAt.IsZero() {
+			v.EditedAt = rec.CreatedAt
+		}
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// revertRecord stores the content and metadata of an earlier version as
+// the new latest version.
+func (a *App) revertRecord(ctx context.Context, id int64, version int, editor string) (model.MemoryRecord, error) {
+	hist, err := a.recordHistory(ctx, id)
+	if err != nil {
+		return model.MemoryRecord{}, err
+	}
+	var target *RecordVersion
+	for i := range hist {
+		if hist[i].Version == version {
+			target = &hist[i]
+		}
+	}
+	switch {
+	case target == nil:
+		return model.MemoryRecord{}, fmt.Errorf("record %d has no version %d", id, version)
+	case target.Missing:
+		return model.MemoryRecord{}, fmt.Errorf("version %d of record %d was deleted from the store", version, id)
+	case target.Current:
+		return model.MemoryRecord{}, fmt.Errorf("version %d is already the current version", version)
+	}
+	patch := map[string]any{}
+	for k, v := range target.Metadata {
+		switch k {
+		case metaLineage, metaVersion, metaSupersedes, metaEditor, metaRevertedTo:
+		default:
+			patch[k] = v
+		}
+	}
+	return a.updateRecord(ctx, hist[len(hist)-1].ID, target.Content, patch, editor, version)
+}
+
+func registerVersionTools(s *server.MCPServer, app *App) {
+	updateTool := mcp.NewTool("memory.update",
+		mcp.WithDescription("Store new content for a record as its next version; the prior version is kept for memory.history"),
+		mcp.WithNumber("id", mcp.Required(), mcp.Description("ID of the record's latest version")),
+		mcp.WithString("content", mcp.Required()),
+		mcp.WithString("metadata_json", mcp.Description("JSON object merged into the previous metadata")),
+		mcp.WithString("principal", mcp.Description("Editor, recorded with the version and charged for quotas; must be a writer of the record's space or the owner of its session")),
+	)
+	s.AddTool(updateTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		id, err := req.RequireFloat("id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing id: %v", err)), nil
+		}
+		content, err := req.RequireString("content")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing content: %v", err)), nil
+		}
+		patch := map[string]any{}
+		if metaStr := getStringParam(req, "metadata_json"); metaStr != "" {
+			if err := json.Unmarshal([]byte(metaStr), &patch); err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("invalid metadata_json: %v", err)), nil
+			}
+		}
+		rec, err := app.updateRecord(ctx, int64(id), content, patch, strings.TrimSpace(getStringParam(req, "principal")), 0)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("update failed: %v", err)), nil
+		}
+		return mcp.NewToolResultJSON(rec)
+	})
+
+	historyTool := mcp.NewTool("memory.history",
+		mcp.WithDescription("List every version of a record, oldest first, with content, metadata, embedding model, editor and time"),
+		mcp.WithNumber("id", mcp.Required(), mcp.Description("ID of any version of the record")),
+	)
+	s.AddTool(historyTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		id, err := req.RequireFloat("id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing id: %v", err)), nil
+		}
+		hist, err := app.recordHistory(ctx, int64(id))
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultJSON(hist)
+	})
+
+	revertTool := mcp.NewTool("memory.revert",
+		mcp.WithDescription("Make an earlier version of a record current again by storing it as a new version"),
+		mcp.WithNumber("id", mcp.Required(), mcp.Description("ID of any version of the record")),
+		mcp.WithNumber("version", mcp.Required(), mcp.Description("Version number from memory.history")),
+		mcp.WithString("principal", mcp.Description("Editor, recorded with the new version; must be a writer of the record's space or the owner of its session")),
+	)
+	s.AddTool(revertTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		id, err := req.RequireFloat("id")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing id: %v", err)), nil
+		}
+		version, err := req.RequireFloat("version")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("missing version: %v", err)), nil
+		}
+		rec, err := app.revertRecord(ctx, int64(id), int(version), strings.TrimSpace(getStringParam(req, "principal")))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("revert failed: %v", err)), nil
+		}
+		return mcp.NewToolResultJSON(rec)
+	})
+}
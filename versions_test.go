@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+	"github.com/Protocol-Lattice/go-agent/src/memory/model"
+)
+
+func TestRevertSurvivesPrune(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+	v1 := mustStore(t, app, "s1", "the billing service uses Postgres", nil)
+	v2, err := app.updateRecord(ctx, v1.ID, "the billing service uses MySQL", nil, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3, err := app.revertRecord(ctx, v2.ID, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another write prunes the store; v3 repeats v1's content.
+	mustStore(t, app, "s1", "deploys go out on Tuesdays", nil)
+
+	got := recordIDs(t, app, "s1")
+	for _, id := range []int64{v1.ID, v2.ID, v3.ID} {
+		if _, ok := got[id]; !ok {
+			t.Fatalf("version record %d was pruned", id)
+		}
+	}
+	if v3.Content != v1.Content {
+		t.Fatalf("reverted content = %q, want %q", v3.Content, v1.Content)
+	}
+}
+
+func TestUpdateChecksEditor(t *testing.T) {
+	app := newTestApp(t, nil)
+	ctx := context.Background()
+	owned, err := app.sessions.create("proj", SessionInfo{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := mustStore(t, app, owned.ID, "the billing service uses Postgres", nil)
+	if _, err := app.updateRecord(ctx, rec.ID, "the billing service uses MySQL", nil, "mallory", 0); err == nil {
+		t.Fatal("mallory updated a record of alice's session")
+	}
+	if _, err := app.updateRecord(ctx, rec.ID, "the billing service uses MySQL", nil, "alice", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	app.upsertSpace("team", time.Hour, map[string]memory.SpaceRole{"dana": memory.SpaceRoleWriter, "rita": memory.SpaceRoleReader}, "", "")
+	shared := mustStore(t, app, "team", "standup is at ten", nil)
+	if _, err := app.updateRecord(ctx, shared.ID, "standup is at eleven", nil, "rita", 0); err == nil {
+		t.Fatal("reader rita updated a space record")
+	}
+	if _, err := app.updateRecord(ctx, shared.ID, "standup is at eleven", nil, "dana", 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVersionSearchFillsPageAfterHidingSuperseded(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.NewInMemoryStore()
+	idx, err := newVersionIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vec := []float32{1, 0, 0}
+	for i := 0; i < 4; i++ {
+		if err := inner.StoreMemory(ctx, "s", "old", nil, vec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := inner.StoreMemory(ctx, "s", "live", nil, []float32{0.9, 0.1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	var old []int64
+	inner.Iterate(ctx, func(rec model.MemoryRecord) bool {
+		if rec.Content == "old" {
+			old = append(old, rec.ID)
+		}
+		return true
+	})
+	// Each old record is superseded by a later version.
+	for i, id := range old {
+		if err := idx.add(id, versionRef{ID: id, Version: 1}, versionRef{ID: int64(1000 + i), Version: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vs := &versionStore{VectorStore: inner, index: idx}
+	recs, err := vs.SearchMemory(ctx, vec, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Content != "live" {
+		t.Fatalf("got %d hits, want the live record", len(recs))
+	}
+}
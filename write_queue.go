@@ -0,0 +1,597 @@
+// write_queue.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/Protocol-Lattice/go-agent/src/memory"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Kinds of deferred writes.
+const (
+	writeLong  = "long"
+	writeShort = "short"
+)
+
+// States of a deferred write.
+const (
+	writePending = "pending"
+	writeRunning = "running"
+	writeFailed  = "failed"
+	writeDone    = "done"
+)
+
+// queuedWrite is a store_long / add_short call that is embedded and
+// persisted in the background, either because the caller asked for an
+// async write or because the embedding provider was down.
+type queuedWrite struct {
+	ID          string         `json:"id"`
+	Kind        string         `json:"kind"`
+	SessionID   string         `json:"session_id"`
+	Content     string         `json:"-"`
+	Metadata    map[string]any `json:"-"`
+	State       string         `json:"state"`
+	QueuedAt    time.Time      `json:"queued_at"`
+	NextAttempt time.Time      `json:"next_attempt,omitempty"`
+	Attempts    int            `json:"attempts"`
+	LastError   string         `json:"last_error,omitempty"`
+	// RecordID is the stored record of a finished long write.
+	RecordID   int64     `json:"record_id,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	writeStages
+	// release frees the write's quota reservation once it is stored or
+	// has failed. Writes reloaded after a restart have none.
+	release func()
+}
+
+// savedWrite is a queuedWrite as kept in write_queue.json, with the
+// content the API responses leave out.
+type savedWrite struct {
+	queuedWrite
+	Content  string         `json:"content,omitempty"`
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+type savedWriteQueue struct {
+	Items  []savedWrite `json:"items"`
+	Failed []savedWrite `json:"failed"`
+	Done   []savedWrite `json:"done"`
+}
+
+// writeStages are the optional steps of a long write around the store.
+type writeStages struct {
+	// ExtractFacts runs fact extraction once the record is stored.
+	ExtractFacts bool `json:"extract_facts,omitempty"`
+	// Conflicts, when set, checks the write against similar records
+	// first (see storeChecked).
+	Conflicts *ConflictOptions `json:"conflicts,omitempty"`
+}
+
+// WriteQueueStats is reported under engine.metrics.
+type WriteQueueStats struct {
+	Enabled   bool  `json:"enabled"`
+	Workers   int   `json:"workers"`
+	Pending   int   `json:"pending"`
+	Running   int   `json:"running"`
+	Failed    int   `json:"failed"`
+	Capacity  int   `json:"capacity"`
+	Queued    int64 `json:"queued"`
+	Completed int64 `json:"completed"`
+	Dropped   int64 `json:"dropped"`
+}
+
+var errWriteQueueFull = errors.New("deferred write queue is full")
+
+const (
+	writeMaxAttempts  = 20
+	writeFailedKeep   = 100
+	writeDoneKeep     = 100
+	writeRetryBackoff = 5 * time.Second
+)
+
+// writeQueue is a bounded queue of deferred writes served by a pool of
+// workers. Items that keep failing are moved to a failed list, and the
+// last writeDoneKeep finished ones to a done list with their record ID,
+// so memory.status can answer for a pending_id after the write is done.
+// The queue is saved to write_queue.json on every change, so writes not
+// yet stored when the server stops are picked up again on restart.
+type writeQueue struct {
+	mu       sync.Mutex
+	path     string
+	items    []*queuedWrite // pending and running, in arrival order
+	failed   []*queuedWrite
+	done     []*queuedWrite
+	capacity int
+	workers  int
+	wake     chan struct{}
+
+	queued    atomic.Int64
+	completed atomic.Int64
+	dropped   atomic.Int64
+}
+
+// newWriteQueue loads the queue saved in dir, if any; an empty dir keeps
+// the queue in memory only.
+func newWriteQueue(capacity, workers int, dir string) (*writeQueue, error) {
+	if workers <= 0 {
+		workers = 1
+	}
+	q := &writeQueue{capacity: capacity, workers: workers, wake: make(chan struct{}, 1)}
+	if dir == "" {
+		return q, nil
+	}
+	q.path = filepath.Join(dir, "write_queue.json")
+	data, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write queue: %w", err)
+	}
+	var saved savedWriteQueue
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", q.path, err)
+	}
+	restore := func(ws []savedWrite) []*queuedWrite {
+		out := make([]*queuedWrite, len(ws))
+		for i, sw := range ws {
+			w := sw.queuedWrite
+			w.Content, w.Metadata = sw.Content, sw.Metadata
+			out[i] = &w
+		}
+		return out
+	}
+	q.items, q.failed, q.done = restore(saved.Items), restore(saved.Failed), restore(saved.Done)
+	for _, w := range q.items {
+		// The server stopped before the write finished.
+		w.State = writePending
+	}
+	return q, nil
+}
+
+// saveLocked writes the queue; q.mu must be held. Callers cannot undo the
+// change they made, so a failed write is logged.
+func (q *writeQueue) saveLocked() {
+	if q.path == "" {
+		return
+	}
+	save := func(ws []*queuedWrite) []savedWrite {
+		out := make([]savedWrite, len(ws))
+		for i, w := range ws {
+			out[i] = savedWrite{queuedWrite: *w, Content: w.Content, Metadata: w.Metadata}
+		}
+		return out
+	}
+	data, err := json.Marshal(savedWriteQueue{Items: save(q.items), Failed: save(q.failed), Done: save(q.done)})
+	if err == nil {
+		tmp := q.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, q.path)
+		}
+	}
+	if err != nil {
+		slog.Error("failed to write write queue", "path", q.path, "error", err)
+	}
+}
+
+func (q *writeQueue) enabled() bool {
+	return q != nil && q.capacity > 0
+}
+
+// push enqueues w and returns a snapshot safe to read after a worker has
+// picked it up.
+func (q *writeQueue) push(w *queuedWrite) (queuedWrite, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) >= q.capacity {
+		return queuedWrite{}, errWriteQueueFull
+	}
+	w.ID = fmt.Sprintf("q-%d", time.Now().UnixNano())
+	w.QueuedAt = time.Now().UTC()
+	w.State = writePending
+	q.items = append(q.items, w)
+	q.queued.Add(1)
+	q.saveLocked()
+	q.signal()
+	return *w, nil
+}
+
+func (q *writeQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next claims the oldest pending item that is due.
+func (q *writeQueue) next(now time.Time) *queuedWrite {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, w := range q.items {
+		if w.State == writePending && !w.NextAttempt.After(now) {
+			w.State = writeRunning
+			return w
+		}
+	}
+	return nil
+}
+
+// finish records the outcome of a claimed item: recordID is the stored
+// record of a long write, 0 for a short one.
+func (q *writeQueue) finish(w *queuedWrite, recordID int64, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.saveLocked()
+	if err == nil {
+		q.remove(w)
+		w.releaseQuota()
+		q.completed.Add(1)
+		w.State, w.RecordID, w.LastError, w.FinishedAt = writeDone, recordID, "", time.Now().UTC()
+		w.Content, w.Metadata = "", nil
+		q.done = append(q.done, w)
+		if len(q.done) > writeDoneKeep {
+			q.done = q.done[len(q.done)-writeDoneKeep:]
+		}
+		return
+	}
+	w.Attempts++
+	w.LastError = err.Error()
+	if w.Attempts < writeMaxAttempts {
+		w.State = writePending
+		w.NextAttempt = time.Now().Add(writeRetryBackoff)
+		return
+	}
+	slog.Error("deferred write failed", "queue_id", w.ID, "session_id", w.SessionID, "attempts", w.Attempts, "error", err)
+	q.remove(w)
+	w.releaseQuota()
+	w.State, w.FinishedAt = writeFailed, time.Now().UTC()
+	q.failed = append(q.failed, w)
+	if len(q.failed) > writeFailedKeep {
+		q.failed = q.failed[len(q.failed)-writeFailedKeep:]
+		q.dropped.Add(1)
+	}
+}
+
+func (w *queuedWrite) releaseQuota() {
+	if w.release != nil {
+		w.release()
+		w.release = nil
+	}
+}
+
+// release hands a claimed item back untouched, e.g. while the breaker is open.
+func (q *writeQueue) release(w *queuedWrite) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w.State = writePending
+	w.NextAttempt = time.Now().Add(writeRetryBackoff)
+}
+
+func (q *writeQueue) remove(w *queuedWrite) {
+	for i, it := range q.items {
+		if it == w {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return
+		}
+	}
+}
+
+// List returns snapshots of queued and failed writes, optionally limited to
+// one session.
+func (q *writeQueue) List(sessionID string) (queued, failed []queuedWrite) {
+	if q == nil {
+		return nil, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return filterWrites(q.items, sessionID), filterWrites(q.failed, sessionID)
+}
+
+// Done returns snapshots of the recently finished writes, optionally
+// limited to one session.
+func (q *writeQueue) Done(sessionID string) []queuedWrite {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return filterWrites(q.done, sessionID)
+}
+
+// Lookup finds a write by its pending_id in any list.
+func (q *writeQueue) Lookup(id string) (queuedWrite, bool) {
+	if q == nil {
+		return queuedWrite{}, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, list := range [][]*queuedWrite{q.items, q.failed, q.done} {
+		for _, w := range list {
+			if w.ID == id {
+				return *w, true
+			}
+		}
+	}
+	return queuedWrite{}, false
+}
+
+func filterWrites(ws []*queuedWrite, sessionID string) []queuedWrite {
+	var out []queuedWrite
+	for _, w := range ws {
+		if sessionID == "" || w.SessionID == sessionID {
+			out = append(out, *w)
+		}
+	}
+	return out
+}
+
+// RetryFailed moves failed writes back to the queue.
+func (q *writeQueue) RetryFailed(sessionID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept := q.failed[:0]
+	n := 0
+	for _, w := range q.failed {
+		if sessionID != "" && w.SessionID != sessionID {
+			kept = append(kept, w)
+			continue
+		}
+		w.State, w.Attempts, w.NextAttempt = writePending, 0, time.Time{}
+		q.items = append(q.items, w)
+		n++
+	}
+	q.failed = kept
+	if n > 0 {
+		q.saveLocked()
+		q.signal()
+	}
+	return n
+}
+
+func (q *writeQueue) Stats() WriteQueueStats {
+	if q == nil {
+		return WriteQueueStats{}
+	}
+	q.mu.Lock()
+	st := WriteQueueStats{
+		Enabled:  q.enabled(),
+		Workers:  q.workers,
+		Failed:   len(q.failed),
+		Capacity: q.capacity,
+	}
+	for _, w := range q.items {
+		if w.State == writeRunning {
+			st.Running++
+		} else {
+			st.Pending++
+		}
+	}
+	q.mu.Unlock()
+	st.Queued = q.queued.Load()
+	st.Completed = q.completed.Load()
+	st.Dropped = q.dropped.Load()
+	return st
+}
+
+// runWriteWorkers starts the worker pool. Workers leave items queued while
+// the embedding provider's breaker is open.
+func (a *App) runWriteWorkers(ctx context.Context) {
+	for i := 0; i < a.writeQueue.workers; i++ {
+		go a.writeWorker(ctx)
+	}
+}
+
+func (a *App) writeWorker(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		for {
+			w := a.writeQueue.next(time.Now())
+			if w == nil {
+				break
+			}
+			if !a.provider.Available() {
+				a.writeQueue.release(w)
+				break
+			}
+			id, err := a.applyWrite(ctx, w)
+			a.writeQueue.finish(w, id, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.writeQueue.wake:
+		case <-t.C:
+		}
+	}
+}
+
+// applyWrite embeds and stores w, returning the record ID of a long write.
+func (a *App) applyWrite(ctx context.Context, w *queuedWrite) (int64, error) {
+	vec, err := a.embed(ctx, w.Content)
+	if err != nil {
+		return 0, err
+	}
+	switch w.Kind {
+	case writeShort:
+		meta, _ := json.Marshal(w.Metadata)
+		a.addShortTerm(w.SessionID, w.Content, string(meta), vec)
+		return 0, nil
+	default:
+		out, err := a.storeLong(ctx, w.SessionID, w.Content, w.Metadata, w.writeStages)
+		return out.ID, err
+	}
+}
+
+// storeLong persists a long-term memory through the engine, or through
+// storeChecked when stages.Conflicts is set, then starts fact extraction.
+func (a *App) storeLong(ctx context.Context, sessionID, content string, meta map[string]any, stages writeStages) (CheckedWrite, error) {
+	start := time.Now()
+	var out CheckedWrite
+	var err error
+	if stages.Conflicts != nil {
+		out, err = a.storeChecked(ctx, sessionID, content, meta, *stages.Conflicts)
+	} else {
+		out.MemoryRecord, err = a.engine.Store(ctx, sessionID, content, meta)
+	}
+	if err != nil {
+		return out, err
+	}
+	// A near-duplicate returns the existing record, whose facts were
+	// extracted when it was stored.
+	if stages.ExtractFacts && !out.CreatedAt.Before(start) {
+		rec := out.MemoryRecord
+		a.extractInBackground(ctx, sessionID, time.Time{}, &rec)
+	}
+	return out, nil
+}
+
+// enqueueWrite queues an async write for the worker pool. Once queued,
+// the write owns release, its quota reservation from checkWrite.
+func (a *App) enqueueWrite(kind, sessionID, content string, meta map[string]any, stages writeStages, release func()) (queuedWrite, error) {
+	if !a.writeQueue.enabled() {
+		return queuedWrite{}, errors.New("write queue is disabled (embed_queue_size < 0)")
+	}
+	return a.writeQueue.push(&queuedWrite{Kind: kind, SessionID: sessionID, Content: content, Metadata: meta, writeStages: stages, release: release})
+}
+
+// deferWrite parks a write whose embedding failed when queueing on
+// provider failure is enabled. It returns the queued entry, or the
+// original error otherwise. Like enqueueWrite, a queued write owns release.
+func (a *App) deferWrite(kind, sessionID, content string, meta map[string]any, stages writeStages, cause error, release func()) (queuedWrite, error) {
+	var quotaErr *ErrQuotaExceeded
+	var rejected *ErrEmbedRejected
+	if !a.queueWhenDown || !a.writeQueue.enabled() || errors.As(cause, &quotaErr) || errors.As(cause, &rejected) {
+		return queuedWrite{}, cause
+	}
+	w, err := a.writeQueue.push(&queuedWrite{Kind: kind, SessionID: sessionID, Content: content, Metadata: meta, LastError: cause.Error(), writeStages: stages, release: release})
+	if err != nil {
+		return queuedWrite{}, fmt.Errorf("%v (%w)", cause, err)
+	}
+	slog.Warn("write queued until embedder recovers", "kind", kind, "queue_id", w.ID, "session_id", sessionID, "error", cause)
+	return w, nil
+}
+
+// pendingMatches scores a session's not-yet-embedded writes against query
+// by keyword overlap, so async writes are retrievable before the workers
+// get to them. Callers pass the room left under their limit after the
+// semantic hits, so the merged results never exceed it.
+func (a *App) pendingMatches(sessionID, query string, limit int) []memory.MemoryRecord {
+	queued, _ := a.writeQueue.List(sessionID)
+	terms := lexicalTerms(query)
+	if len(queued) == 0 || len(terms) == 0 || limit <= 0 {
+		return nil
+	}
+	var out []memory.MemoryRecord
+	for _, w := range queued {
+		have := map[string]struct{}{}
+		for _, t := range lexicalTerms(w.Content) {
+			have[t] = struct{}{}
+		}
+		hits := 0
+		for _, t := range terms {
+			if _, ok := have[t]; ok {
+				hits++
+			}
+		}
+		if hits == 0 {
+			continue
+		}
+		score := float64(hits) / float64(len(terms))
+		meta, _ := json.Marshal(map[string]any{"pending": true, "pending_id": w.ID})
+		out = append(out, memory.MemoryRecord{
+			SessionID:    w.SessionID,
+			Space:        w.SessionID,
+			Content:      w.Content,
+			Metadata:     string(meta),
+			Score:        score,
+			KeywordScore: score,
+			CreatedAt:    w.QueuedAt,
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Score > out[j].Score })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// lexicalTerms lowercases text and splits it into unique word tokens.
+func lexicalTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	seen := make(map[string]struct{}, len(words))
+	out := words[:0]
+	for _, w := range words {
+		if len(w) < 2 {
+			continue
+		}
+		if _, ok := seen[w]; ok {
+			continue
+		}
+		seen[w] = struct{}{}
+		out = append(out, w)
+	}
+	return out
+}
+
+func registerWriteQueueTools(s *server.MCPServer, app *App) {
+	statusTool := mcp.NewTool("memory.status",
+		mcp.WithDescription("Report writes that are pending embedding, have failed or have recently finished"),
+		mcp.WithString("session_id", mcp.Description("Only report writes of this session")),
+		mcp.WithString("pending_id", mcp.Description("Only report the write with this pending_id, e.g. to get its record_id once done")),
+		mcp.WithBoolean("retry_failed", mcp.Description("Move failed writes back to the queue before reporting")),
+	)
+	s.AddTool(statusTool, func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		app := appFor(ctx, app)
+		sid := strings.TrimSpace(getStringParam(req, "session_id"))
+		retried := 0
+		if req.GetBool("retry_failed", false) {
+			if !app.writeQueue.enabled() {
+				return mcp.NewToolResultError("write queue is disabled"), nil
+			}
+			retried = app.writeQueue.RetryFailed(sid)
+		}
+		if id := strings.TrimSpace(getStringParam(req, "pending_id")); id != "" {
+			w, ok := app.writeQueue.Lookup(id)
+			if !ok || (sid != "" && w.SessionID != sid) {
+				return mcp.NewToolResultError(fmt.Sprintf("write %s not found", id)), nil
+			}
+			return mcp.NewToolResultJSON(map[string]any{"write": w, "retried": retried})
+		}
+		queued, failed := app.writeQueue.List(sid)
+		if queued == nil {
+			queued = []queuedWrite{}
+		}
+		if failed == nil {
+			failed = []queuedWrite{}
+		}
+		done := app.writeQueue.Done(sid)
+		if done == nil {
+			done = []queuedWrite{}
+		}
+		return mcp.NewToolResultJSON(map[string]any{
+			"stats":   app.writeQueue.Stats(),
+			"pending": queued,
+			"failed":  failed,
+			"done":    done,
+			"retried": retried,
+		})
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+func TestPendingMatchesRespectsLimit(t *testing.T) {
+	app := newTestApp(t, nil)
+	for _, c := range []string{"deploy the billing service", "billing runs nightly", "billing owner is Ana"} {
+		if _, err := app.writeQueue.push(&queuedWrite{Kind: writeLong, SessionID: "s", Content: c}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := app.pendingMatches("s", "billing", 2); len(got) != 2 {
+		t.Fatalf("got %d matches, want 2", len(got))
+	}
+	if got := app.pendingMatches("s", "billing", 0); len(got) != 0 {
+		t.Fatalf("got %d matches with no room left, want 0", len(got))
+	}
+}
+
+func TestWriteWorkerReportsStoredRecord(t *testing.T) {
+	app := newTestApp(t, nil)
+	w, err := app.enqueueWrite(writeLong, "s1", "the deploy runs on fridays", map[string]any{}, writeStages{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got queuedWrite
+	deadline := time.Now().Add(5 * time.Second)
+	for got.State != writeDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("write did not finish: %+v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+		res := callTool(t, app, registerWriteQueueTools, "memory.status", map[string]any{"pending_id": w.ID})
+		if res.IsError {
+			t.Fatalf("memory.status failed: %v", res.Content)
+		}
+		var out struct {
+			Write queuedWrite `json:"write"`
+		}
+		if err := json.Unmarshal([]byte(res.Content[0].(mcp.TextContent).Text), &out); err != nil {
+			t.Fatal(err)
+		}
+		got = out.Write
+	}
+	if got.RecordID == 0 || got.RecordID != idOf(t, app, "s1", "the deploy runs on fridays") {
+		t.Fatalf("finished write reports record %d", got.RecordID)
+	}
+	if queued, _ := app.writeQueue.List("s1"); len(queued) != 0 {
+		t.Fatalf("finished write still queued: %+v", queued)
+	}
+}
+
+func TestWriteQueueMovesExhaustedWritesToFailed(t *testing.T) {
+	q, err := newWriteQueue(10, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.push(&queuedWrite{Kind: writeLong, SessionID: "s1", Content: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now()
+	for i := 0; i < writeMaxAttempts; i++ {
+		later = later.Add(2 * writeRetryBackoff)
+		claimed := q.next(later)
+		if claimed == nil {
+			t.Fatalf("attempt %d: nothing to claim", i+1)
+		}
+		q.finish(claimed, 0, errors.New("status 503"))
+	}
+	got, ok := q.Lookup(w.ID)
+	if !ok || got.State != writeFailed || got.LastError != "status 503" || got.Attempts != writeMaxAttempts {
+		t.Fatalf("write = %+v, want it failed after %d attempts", got, writeMaxAttempts)
+	}
+	if st := q.Stats(); st.Pending != 0 || st.Failed != 1 {
+		t.Fatalf("stats = %+v", st)
+	}
+	if n := q.RetryFailed("s1"); n != 1 || q.next(later) == nil {
+		t.Fatal("retried write is not pending again")
+	}
+}
+
+func TestWriteQueueSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newWriteQueue(10, 1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := q.push(&queuedWrite{Kind: writeLong, SessionID: "s1", Content: "one", Metadata: map[string]any{"k": "v"}})
+	second, _ := q.push(&queuedWrite{Kind: writeShort, SessionID: "s1", Content: "two"})
+	q.next(time.Now()) // running when the server stops
+
+	q, err = newWriteQueue(10, 1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, _ := q.List("")
+	if len(queued) != 2 || queued[0].State != writePending || queued[0].Content != "one" || queued[0].Metadata["k"] != "v" {
+		t.Fatalf("reloaded queue = %+v", queued)
+	}
+	q.finish(q.next(time.Now()), 42, nil)
+
+	q, err = newWriteQueue(10, 1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := q.Lookup(first.ID); !ok || got.State != writeDone || got.RecordID != 42 {
+		t.Fatalf("finished write after restart = %+v, %v", got, ok)
+	}
+	if got, ok := q.Lookup(second.ID); !ok || got.State != writePending {
+		t.Fatalf("pending write after restart = %+v, %v", got, ok)
+	}
+}